@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/agent"
+)
+
+type certRenewer interface {
+	RenewCert(ctx context.Context) error
+}
+
+// renewCertOnSIGHUP signs a new certificate every time the process receives
+// SIGHUP, until ctx is done.
+func renewCertOnSIGHUP(ctx context.Context, logger log.Logger, r certRenewer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-sigs:
+			level.Info(logger).Log("msg", "received SIGHUP")
+			if err := r.RenewCert(ctx); err != nil {
+				level.Error(logger).Log("msg", "could not renew certificate", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type stateReporter interface {
+	State() agent.State
+}
+
+// logStateOnSignal logs the state of the agent every time the process
+// receives one of dumpStateSignals, until ctx is done.
+func logStateOnSignal(ctx context.Context, logger log.Logger, r stateReporter) {
+	// Notify relays all signals when none are given.
+	if len(dumpStateSignals) == 0 {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, dumpStateSignals...)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-sigs:
+			logState(logger, r.State())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logState logs a snapshot of the state of the agent.
+func logState(logger log.Logger, st agent.State) {
+	keyvals := []interface{}{
+		"msg", "agent state",
+		"tunnel_state", st.TunnelState,
+		"connected_connections", st.ConnectedConnections,
+		"reconnects", st.Reconnects,
+	}
+	if st.CertErr != nil {
+		keyvals = append(keyvals, "cert_err", st.CertErr)
+	} else {
+		keyvals = append(keyvals,
+			"cert_valid_after", st.CertValidAfter.Format(time.RFC3339),
+			"cert_valid_before", st.CertValidBefore.Format(time.RFC3339),
+			"cert_principals", strings.Join(st.CertPrincipals, ","),
+		)
+	}
+	keyvals = append(keyvals,
+		"api_url", st.APIURL,
+		"gateway", st.Gateway,
+		"uptime", st.Uptime.Round(time.Second),
+	)
+	level.Info(logger).Log(keyvals...)
+}
+
+// logHeartbeat logs a summary of the state of the agent every interval, until
+// ctx is done, so that logs show that a long-running agent is still up.
+func logHeartbeat(ctx context.Context, logger log.Logger, r stateReporter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			st := r.State()
+			keyvals := []interface{}{
+				"msg", "heartbeat",
+				"tunnel_state", st.TunnelState,
+				"connected_connections", st.ConnectedConnections,
+				"reconnects", st.Reconnects,
+			}
+			if st.CertErr == nil {
+				keyvals = append(keyvals, "cert_valid_before", st.CertValidBefore.Format(time.RFC3339))
+			}
+			keyvals = append(keyvals, "uptime", st.Uptime.Round(time.Second))
+			level.Info(logger).Log(keyvals...)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/pdc-agent/pkg/agent"
+)
+
+func TestLogState(t *testing.T) {
+	st := agent.State{
+		TunnelState:          "Connected",
+		ConnectedConnections: 2,
+		Reconnects:           3,
+		CertValidAfter:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		CertValidBefore:      time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC),
+		CertPrincipals:       []string{"1", "team-a"},
+		APIURL:               "https://private-datasource-connect-api-prod-us-east-0.grafana.net",
+		Gateway:              "private-datasource-connect-prod-us-east-0.grafana.net:22",
+		Uptime:               90*time.Minute + 400*time.Millisecond,
+	}
+
+	t.Run("all fields are logged", func(t *testing.T) {
+		var buf bytes.Buffer
+		logState(log.NewLogfmtLogger(&buf), st)
+
+		for _, field := range []string{
+			`level=info msg="agent state"`,
+			"tunnel_state=Connected",
+			"connected_connections=2",
+			"reconnects=3",
+			"cert_valid_after=2024-01-01T00:00:00Z",
+			"cert_valid_before=2024-01-01T01:00:00Z",
+			"cert_principals=1,team-a",
+			"api_url=https://private-datasource-connect-api-prod-us-east-0.grafana.net",
+			"gateway=private-datasource-connect-prod-us-east-0.grafana.net:22",
+			"uptime=1h30m0s",
+		} {
+			assert.Contains(t, buf.String(), field)
+		}
+	})
+
+	t.Run("certificate cannot be read", func(t *testing.T) {
+		st := st
+		st.CertErr = errors.New("no such file")
+
+		var buf bytes.Buffer
+		logState(log.NewLogfmtLogger(&buf), st)
+
+		assert.Contains(t, buf.String(), `cert_err="no such file"`)
+		assert.NotContains(t, buf.String(), "cert_valid_after")
+	})
+}
+
+// countingReporter returns st, and counts how many times it was asked.
+type countingReporter struct {
+	st    agent.State
+	calls atomic.Int32
+}
+
+func (r *countingReporter) State() agent.State {
+	r.calls.Add(1)
+	return r.st
+}
+
+func TestLogHeartbeat(t *testing.T) {
+	r := &countingReporter{st: agent.State{
+		TunnelState:          "Connected",
+		ConnectedConnections: 1,
+		Reconnects:           2,
+		CertValidBefore:      time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC),
+		Uptime:               time.Hour,
+	}}
+
+	var buf bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		logHeartbeat(ctx, log.NewLogfmtLogger(&buf), r, 10*time.Millisecond)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return r.calls.Load() >= 2 }, 5*time.Second, 5*time.Millisecond, "heartbeat was not logged")
+	cancel()
+	<-done
+
+	assert.Contains(t, buf.String(), `level=info msg=heartbeat tunnel_state=Connected connected_connections=1 reconnects=2 cert_valid_before=2024-01-01T01:00:00Z uptime=1h0m0s`)
+}
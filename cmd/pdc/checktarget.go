@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const checkTargetCommand = "check-target"
+
+// tunnelPollInterval is how often the state of the tunnel is checked while
+// waiting for it to connect.
+const tunnelPollInterval = 100 * time.Millisecond
+
+type checkTargetFlags struct {
+	Target  string
+	Timeout time.Duration
+}
+
+func (tf *checkTargetFlags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&tf.Target, "target", "", "The host:port of the datasource to connect to")
+	fs.DurationVar(&tf.Timeout, "timeout", 30*time.Second, "How long to wait for the tunnel to connect and the datasource to accept the connection")
+}
+
+// runCheckTarget brings up the tunnel with the agent configuration, waits for
+// it to connect, then connects to the target over TCP from the agent host, as
+// the ssh client does for datasource traffic sent through the tunnel. The
+// connection does not go through the gateway: that can only be tested from
+// Grafana. It tears everything down and returns the exit code.
+func runCheckTarget(args []string) int {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+	tf := &checkTargetFlags{}
+
+	usageFn, env, err := parseFlags(args, mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags, tf.RegisterFlags)
+	if err != nil {
+		fmt.Printf("cannot parse flags: %s\n", err)
+		return exitConfig
+	}
+	registerLogSecrets(sshConfig, pdcClientCfg)
+	if mf.PrintHelp {
+		usageFn()
+		return exitOK
+	}
+	if tf.Target == "" {
+		usageFn()
+		fmt.Println("-target is required")
+		return exitConfig
+	}
+
+	sshConfig.LogLevel, err = sshLogLevel(mf.logLevel(), sshConfig.SSHVerbosity)
+	if err != nil {
+		fmt.Printf("setting log level: %s\n", err)
+		return exitConfig
+	}
+	logger := setupLogger(os.Stdout, mf.logLevel(), mf.LogDedupeWindow, mf.instanceID())
+	env.log(logger)
+
+	if err := ssh.CheckSSHBinary(sshConfig.SSHBinary); err != nil {
+		level.Error(logger).Log("err", err, "binary", sshConfig.SSHBinary)
+		return exitCode(err)
+	}
+
+	applyDiscovery(context.Background(), logger, mf, pdcClientCfg.HostedGrafanaID)
+
+	warnExplicitURLs(logger, mf)
+	if err := configureURLs(mf, sshConfig, pdcClientCfg); err != nil {
+		level.Error(logger).Log("err", err)
+		return exitCode(err)
+	}
+
+	resolver, err := newResolver(mf.DNSServer)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		return exitConfig
+	}
+	if err := checkGatewayDNS(context.Background(), resolver, sshConfig.GatewayHost()); err != nil {
+		level.Error(logger).Log("err", err)
+		return exitCode(err)
+	}
+
+	// The PDC API is not used to sign certificates when a pre-signed
+	// certificate is provided.
+	var pdcClient pdc.Client
+	if sshConfig.PreSignedCertFile == "" {
+		pdcClient, err = pdc.NewClient(pdcClientCfg, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "cannot initialise PDC client", "err", err)
+			return exitConfig
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tf.Timeout)
+	defer cancel()
+
+	latency, err := checkTarget(ctx, logger, sshConfig, pdcClient, tf.Target)
+	if err != nil {
+		level.Error(logger).Log("msg", "target check failed", "target", tf.Target, "err", err)
+		return exitCode(err)
+	}
+
+	level.Info(logger).Log("msg", "target check succeeded", "target", tf.Target, "latency", latency)
+	return exitOK
+}
+
+// checkTarget starts the tunnel, waits until it is connected, and returns how
+// long a TCP connection to target takes from the agent host.
+func checkTarget(ctx context.Context, logger log.Logger, sshConfig *ssh.Config, pdcClient pdc.Client, target string) (time.Duration, error) {
+	// The service context is canceled when the check is done, which stops
+	// the ssh command.
+	svcCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	km := ssh.NewKeyManager(sshConfig, logger, pdcClient)
+	sshClient := ssh.NewClient(sshConfig, logger, km)
+	if err := sshClient.StartAsync(svcCtx); err != nil {
+		return 0, fmt.Errorf("cannot start ssh client: %w", err)
+	}
+	defer func() {
+		_ = services.StopAndAwaitTerminated(context.Background(), sshClient)
+	}()
+	if err := sshClient.AwaitRunning(ctx); err != nil {
+		// The cause, e.g. a rejected token, decides the exit code.
+		if ferr := sshClient.FailureCase(); ferr != nil {
+			err = ferr
+		}
+		return 0, fmt.Errorf("cannot start ssh client: %w", err)
+	}
+	if err := awaitConnected(ctx, sshClient); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	_ = conn.Close()
+
+	return latency, nil
+}
+
+// awaitConnected waits until the tunnel of sshClient is connected, or ctx is
+// done.
+func awaitConnected(ctx context.Context, sshClient *ssh.Client) error {
+	ticker := time.NewTicker(tunnelPollInterval)
+	defer ticker.Stop()
+
+	for sshClient.TunnelState() != ssh.StateConnected {
+		if err := sshClient.FailureCase(); err != nil {
+			return fmt.Errorf("tunnel stopped: %w", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err := errors.New("tunnel did not connect")
+			if _, lastErr := sshClient.LastError(); lastErr != nil {
+				err = fmt.Errorf("%w: %w", err, lastErr)
+			}
+			return fmt.Errorf("%w: %w", err, ctx.Err())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestRunCheckTarget(t *testing.T) {
+	t.Run("target is required", func(t *testing.T) {
+		assert.Equal(t, exitConfig, runCheckTarget([]string{}))
+	})
+
+	t.Run("invalid flag", func(t *testing.T) {
+		assert.Equal(t, exitConfig, runCheckTarget([]string{"-not-a-flag"}))
+	})
+}
+
+// rejectingSigner is a PDC client that rejects the token.
+type rejectingSigner struct{}
+
+func (rejectingSigner) SignSSHKey(context.Context, []byte) (*pdc.SigningResponse, error) {
+	return nil, pdc.ErrInvalidCredentials
+}
+
+func TestCheckTarget(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh binary is a shell script")
+	}
+	t.Parallel()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := gossh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	// newConfig returns a config for a fake ssh binary that runs script.
+	newConfig := func(t *testing.T, script string) *ssh.Config {
+		dir := t.TempDir()
+		fakeSSH := filepath.Join(dir, "ssh")
+		require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\n"+script+"\n"), 0o755))
+
+		cfg := ssh.DefaultConfig()
+		cfg.KeyFile = filepath.Join(dir, "grafana_pdc")
+		cfg.SSHBinary = fakeSSH
+		cfg.SkipSSHValidation = true
+		cfg.URL = &url.URL{Path: "gateway.example.com"}
+		cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+		return cfg
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	t.Run("target is reached once the tunnel is connected", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		cfg := newConfig(t, "exec sleep 60")
+		start := time.Now()
+		_, err := checkTarget(ctx, log.NewNopLogger(), cfg, caSigner{ca: ca}, ln.Addr().String())
+		require.NoError(t, err)
+		// The tunnel is connected once the ssh command has been running for
+		// a while.
+		assert.GreaterOrEqual(t, time.Since(start), 4*time.Second)
+	})
+
+	t.Run("unreachable target", func(t *testing.T) {
+		t.Parallel()
+
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, closed.Close())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		cfg := newConfig(t, "exec sleep 60")
+		_, err = checkTarget(ctx, log.NewNopLogger(), cfg, caSigner{ca: ca}, closed.Addr().String())
+		assert.ErrorContains(t, err, "connection refused")
+	})
+
+	t.Run("tunnel that does not connect", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		cfg := newConfig(t, "exit 255")
+		_, err := checkTarget(ctx, log.NewNopLogger(), cfg, caSigner{ca: ca}, ln.Addr().String())
+		assert.ErrorContains(t, err, "tunnel did not connect")
+		assert.Equal(t, exitGeneric, exitCode(err))
+	})
+
+	t.Run("rejected token", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cfg := newConfig(t, "exec sleep 60")
+		_, err := checkTarget(ctx, log.NewNopLogger(), cfg, rejectingSigner{}, ln.Addr().String())
+		require.Error(t, err)
+		assert.Equal(t, exitAuth, exitCode(err))
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/httpclient"
+)
+
+// discoveryTimeout is how long the discovery endpoint has to respond.
+const discoveryTimeout = 10 * time.Second
+
+// discoveryResponse is the response of the discovery endpoint.
+type discoveryResponse struct {
+	Cluster string `json:"cluster"`
+	Domain  string `json:"domain"`
+}
+
+// discoverCluster queries the discovery endpoint for the cluster and domain of
+// the hosted Grafana instance.
+func discoverCluster(ctx context.Context, client *http.Client, discoveryURL string, hostedGrafanaID string) (discoveryResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	u, err := url.Parse(discoveryURL)
+	if err != nil {
+		return discoveryResponse{}, err
+	}
+	q := u.Query()
+	q.Set("hosted_grafana_id", hostedGrafanaID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return discoveryResponse{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return discoveryResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return discoveryResponse{}, fmt.Errorf("unexpected response from discovery endpoint: %d", resp.StatusCode)
+	}
+
+	dr := discoveryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&dr); err != nil {
+		return discoveryResponse{}, fmt.Errorf("decoding discovery response: %w", err)
+	}
+	if dr.Cluster == "" {
+		return discoveryResponse{}, fmt.Errorf("discovery response has no cluster")
+	}
+
+	return dr, nil
+}
+
+// applyDiscovery sets the cluster and domain flags from the discovery
+// endpoint, if one is configured. If discovery fails, the flags are unchanged.
+func applyDiscovery(ctx context.Context, logger log.Logger, mf *mainFlags, hostedGrafanaID string) {
+	if mf.DiscoveryURL == "" {
+		return
+	}
+
+	client := &http.Client{Transport: httpclient.UserAgentTransport(nil, httpclient.UserAgent(version))}
+	dr, err := discoverCluster(ctx, client, mf.DiscoveryURL, hostedGrafanaID)
+	if err != nil {
+		level.Warn(logger).Log("msg", "cluster discovery failed, using the -cluster and -domain flags", "err", err)
+		return
+	}
+
+	level.Info(logger).Log("msg", "discovered cluster", "cluster", dr.Cluster, "domain", dr.Domain)
+	mf.Cluster = dr.Cluster
+	if dr.Domain != "" {
+		mf.Domain = dr.Domain
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyDiscovery(t *testing.T) {
+	t.Parallel()
+
+	t.Run("cluster and domain are discovered", func(t *testing.T) {
+		t.Parallel()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "123", r.URL.Query().Get("hosted_grafana_id"))
+			_, _ = w.Write([]byte(`{"cluster": "prod-eu-west-0", "domain": "grafana.example"}`))
+		}))
+		defer ts.Close()
+
+		mf := &mainFlags{Cluster: "flag-cluster", Domain: "grafana.net", DiscoveryURL: ts.URL}
+		applyDiscovery(context.Background(), log.NewNopLogger(), mf, "123")
+
+		assert.Equal(t, "prod-eu-west-0", mf.Cluster)
+		assert.Equal(t, "grafana.example", mf.Domain)
+	})
+
+	t.Run("discovery fails: fall back to flags", func(t *testing.T) {
+		t.Parallel()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		mf := &mainFlags{Cluster: "flag-cluster", Domain: "grafana.net", DiscoveryURL: ts.URL}
+		applyDiscovery(context.Background(), log.NewNopLogger(), mf, "123")
+
+		assert.Equal(t, "flag-cluster", mf.Cluster)
+		assert.Equal(t, "grafana.net", mf.Domain)
+	})
+
+	t.Run("invalid response: fall back to flags", func(t *testing.T) {
+		t.Parallel()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"domain": "grafana.example"}`))
+		}))
+		defer ts.Close()
+
+		mf := &mainFlags{Cluster: "flag-cluster", Domain: "grafana.net", DiscoveryURL: ts.URL}
+		applyDiscovery(context.Background(), log.NewNopLogger(), mf, "123")
+
+		assert.Equal(t, "flag-cluster", mf.Cluster)
+		assert.Equal(t, "grafana.net", mf.Domain)
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const doctorCommand = "doctor"
+
+// doctorTimeout is how long each check of the doctor command can take.
+const doctorTimeout = 10 * time.Second
+
+// doctorClockSkewTolerance is how far the local clock can be from the clock
+// of the PDC API before it is reported.
+const doctorClockSkewTolerance = time.Minute
+
+// Statuses of doctor checks.
+const (
+	statusPass = "PASS"
+	statusWarn = "WARN"
+	statusFail = "FAIL"
+)
+
+// checkResult is the outcome of a doctor check. Hint tells the user how to
+// fix a warning or failure.
+type checkResult struct {
+	Status string
+	Detail string
+	Hint   string
+}
+
+func pass(detail string) checkResult {
+	return checkResult{Status: statusPass, Detail: detail}
+}
+
+func warn(detail, hint string) checkResult {
+	return checkResult{Status: statusWarn, Detail: detail, Hint: hint}
+}
+
+func fail(detail, hint string) checkResult {
+	return checkResult{Status: statusFail, Detail: detail, Hint: hint}
+}
+
+// doctorCheck is a named check of the doctor command.
+type doctorCheck struct {
+	Name string
+	Run  func(ctx context.Context) checkResult
+}
+
+// runDoctor runs the preflight checks of the agent and prints their results,
+// without starting the tunnel. It accepts the flags of the agent, so that it
+// can be run with the same command line. It returns the exit code.
+func runDoctor(args []string) int {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+
+	usageFn, env, err := parseFlags(args, mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
+	if err != nil {
+		fmt.Printf("cannot parse flags: %s\n", err)
+		return exitConfig
+	}
+	registerLogSecrets(sshConfig, pdcClientCfg)
+	if mf.PrintHelp {
+		usageFn()
+		return exitOK
+	}
+
+	// Logs go to stderr, so that they do not mix with the check results.
+	logger := setupLogger(os.Stderr, mf.logLevel(), 0, mf.instanceID())
+	env.log(logger)
+
+	applyDiscovery(context.Background(), logger, mf, pdcClientCfg.HostedGrafanaID)
+	if err := configureURLs(mf, sshConfig, pdcClientCfg); err != nil {
+		fmt.Printf("%s  configuration: %s\n", statusFail, err)
+		return exitConfig
+	}
+	resolver, err := newResolver(mf.DNSServer)
+	if err != nil {
+		fmt.Printf("%s  configuration: %s\n", statusFail, err)
+		return exitConfig
+	}
+
+	d := &doctor{
+		logger:     logger,
+		sshConfig:  sshConfig,
+		pdcConfig:  pdcClientCfg,
+		resolver:   resolver,
+		httpClient: &http.Client{Timeout: doctorTimeout},
+		now:        time.Now,
+	}
+	if sshConfig.PreSignedCertFile == "" {
+		d.pdcClient, err = pdc.NewClient(pdcClientCfg, logger)
+		if err != nil {
+			fmt.Printf("%s  configuration: cannot initialise PDC client: %s\n", statusFail, err)
+			return exitConfig
+		}
+	}
+
+	if !runChecks(context.Background(), os.Stdout, d.checks()) {
+		return exitGeneric
+	}
+	return exitOK
+}
+
+// runChecks runs checks in order, and writes a line with the status of each
+// one to w, followed by a hint for warnings and failures. It returns false if
+// any check failed.
+func runChecks(ctx context.Context, w io.Writer, checks []doctorCheck) bool {
+	ok := true
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+		r := c.Run(ctx)
+		cancel()
+
+		fmt.Fprintf(w, "%s  %s: %s\n", r.Status, c.Name, r.Detail)
+		if r.Hint != "" {
+			fmt.Fprintf(w, "      hint: %s\n", r.Hint)
+		}
+		if r.Status == statusFail {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// doctor holds the configuration and the state shared by the doctor checks.
+type doctor struct {
+	logger     log.Logger
+	sshConfig  *ssh.Config
+	pdcConfig  *pdc.Config
+	pdcClient  pdc.Client
+	resolver   *net.Resolver
+	httpClient *http.Client
+	now        func() time.Time
+
+	// apiDate is the time of the PDC API, from the response to the
+	// reachability check.
+	apiDate time.Time
+}
+
+// checks returns the checks in the order they run. Later checks can depend
+// on the results of earlier ones.
+func (d *doctor) checks() []doctorCheck {
+	return []doctorCheck{
+		{Name: "ssh binary", Run: d.checkSSHBinary},
+		{Name: "ssh version", Run: d.checkSSHVersion},
+		{Name: "gateway DNS", Run: d.checkGatewayDNS},
+		{Name: "PDC API", Run: d.checkAPI},
+		{Name: "clock skew", Run: d.checkClockSkew},
+		{Name: "private key permissions", Run: d.checkKeyPermissions},
+		{Name: "token", Run: d.checkToken},
+	}
+}
+
+func (d *doctor) checkSSHBinary(_ context.Context) checkResult {
+	if err := ssh.CheckSSHBinary(d.sshConfig.SSHBinary); err != nil {
+		return fail(fmt.Sprintf("%q: %s", d.sshConfig.SSHBinary, err), "install the OpenSSH client, or set -ssh-binary to the path of the ssh binary")
+	}
+	return pass(d.sshConfig.SSHBinary)
+}
+
+func (d *doctor) checkSSHVersion(_ context.Context) checkResult {
+	v := tryGetOpenSSHVersion(d.sshConfig.SSHBinary)
+	if !strings.HasPrefix(v, "OpenSSH_") {
+		return warn(fmt.Sprintf("cannot tell the OpenSSH version of %q: %s", d.sshConfig.SSHBinary, v), "the agent is only supported with the OpenSSH client, check that -ssh-binary runs it")
+	}
+	return pass(v)
+}
+
+func (d *doctor) checkGatewayDNS(ctx context.Context) checkResult {
+	host := d.sshConfig.GatewayHost()
+	if err := checkGatewayDNS(ctx, d.resolver, host); err != nil {
+		return fail(err.Error(), "check -cluster and -domain, or -ssh.gateway-url, and that the DNS server, or -dns.server, can resolve the gateway host")
+	}
+	return pass(host)
+}
+
+// checkAPI checks that the PDC API answers HTTP requests. Any response will
+// do, as only signing requests are authenticated.
+func (d *doctor) checkAPI(ctx context.Context) checkResult {
+	u := d.pdcConfig.URL.String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fail(err.Error(), "check -pdc.api-url")
+	}
+	for header, value := range d.pdcConfig.ExtraHeaders {
+		req.Header.Set(header, value)
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fail(err.Error(), "check that the agent host can make HTTPS requests to the PDC API, through a proxy if HTTPS_PROXY is set")
+	}
+	_ = resp.Body.Close()
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		d.apiDate = date
+	}
+	return pass(u)
+}
+
+// checkClockSkew compares the local clock to the Date header of the PDC API.
+// Certificates are signed with the clock of the PDC API, so a skewed local
+// clock makes them look not yet valid or expired.
+func (d *doctor) checkClockSkew(_ context.Context) checkResult {
+	if d.apiDate.IsZero() {
+		return warn("skipped, the time of the PDC API is unknown", "fix the PDC API check first")
+	}
+
+	skew := d.now().Sub(d.apiDate).Round(time.Second)
+	if skew.Abs() > doctorClockSkewTolerance {
+		return warn(fmt.Sprintf("the local clock is %s off the PDC API", skew.Abs()), "sync the clock of the agent host with NTP")
+	}
+	return pass(skew.String())
+}
+
+// checkToken signs the public key of the agent, to check that the PDC API
+// accepts the token. The certificate is not saved. The check is skipped if
+// the agent has no key pair yet, rather than creating one.
+func (d *doctor) checkToken(ctx context.Context) checkResult {
+	if d.pdcClient == nil {
+		return pass("not used, the certificate is pre-signed")
+	}
+
+	if err := checkSigningTokens(d.logger, d.pdcConfig.SigningTokens(), d.now()); err != nil {
+		return fail(err.Error(), "create a new token in Grafana Cloud under Private data source connections, and set it with -token")
+	}
+
+	var pub []byte
+	var err error
+	if d.sshConfig.PKCS11Module != "" {
+		// The key pair is in the token, and is only read.
+		pub, err = ssh.NewKeyManager(d.sshConfig, d.logger, nil).PublicKey()
+	} else {
+		if _, statErr := os.Stat(d.sshConfig.KeyFile); statErr != nil {
+			return warn(fmt.Sprintf("skipped, there is no key pair to sign: %s", statErr), "the key pair is created when the agent first runs, or with the show-pubkey command")
+		}
+		pub, err = os.ReadFile(d.sshConfig.KeyFile + ".pub")
+	}
+	if err != nil {
+		return fail(fmt.Sprintf("cannot read the public key: %s", err), "run the show-pubkey command to recreate the public key")
+	}
+	if _, err := d.pdcClient.SignSSHKey(ctx, pub); err != nil {
+		if errors.Is(err, pdc.ErrInvalidCredentials) || errors.Is(err, pdc.ErrForbidden) {
+			return fail(err.Error(), "check -token, or GCLOUD_PDC_SIGNING_TOKEN, and -gcloud-hosted-grafana-id. Tokens can be created in Grafana Cloud under Private data source connections")
+		}
+		return fail(err.Error(), "check the PDC API check, and retry later if the PDC API has an outage")
+	}
+	return pass("accepted by the PDC API")
+}
+
+func (d *doctor) checkKeyPermissions(_ context.Context) checkResult {
+	if _, err := os.Stat(d.sshConfig.KeyFile); err != nil && d.sshConfig.PKCS11Module == "" {
+		return warn(err.Error(), "the key pair is created when the agent first runs, or with the show-pubkey command")
+	}
+	km := ssh.NewKeyManager(d.sshConfig, d.logger, nil)
+	if err := km.CheckKeyFilePermissions(); err != nil {
+		return fail(err.Error(), fmt.Sprintf("run chmod 600 %s", d.sshConfig.KeyFile))
+	}
+	return pass(d.sshConfig.KeyFile)
+}
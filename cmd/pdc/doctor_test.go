@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestRunChecks(t *testing.T) {
+	check := func(name string, r checkResult) doctorCheck {
+		return doctorCheck{Name: name, Run: func(context.Context) checkResult { return r }}
+	}
+
+	t.Run("passes and warnings", func(t *testing.T) {
+		var out bytes.Buffer
+		ok := runChecks(context.Background(), &out, []doctorCheck{
+			check("first", pass("fine")),
+			check("second", warn("not great", "do something")),
+		})
+
+		assert.True(t, ok)
+		assert.Equal(t, "PASS  first: fine\nWARN  second: not great\n      hint: do something\n", out.String())
+	})
+
+	t.Run("a failure fails the run, and the next checks still run", func(t *testing.T) {
+		var out bytes.Buffer
+		ok := runChecks(context.Background(), &out, []doctorCheck{
+			check("first", fail("broken", "fix it")),
+			check("second", pass("fine")),
+		})
+
+		assert.False(t, ok)
+		assert.Equal(t, "FAIL  first: broken\n      hint: fix it\nPASS  second: fine\n", out.String())
+	})
+}
+
+// fakeSigner is a PDC client that returns err for every sign request.
+type fakeSigner struct {
+	err error
+}
+
+func (f fakeSigner) SignSSHKey(context.Context, []byte) (*pdc.SigningResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &pdc.SigningResponse{}, nil
+}
+
+// countingSigner is a PDC client that counts the sign requests.
+type countingSigner struct {
+	calls int
+}
+
+func (c *countingSigner) SignSSHKey(context.Context, []byte) (*pdc.SigningResponse, error) {
+	c.calls++
+	return &pdc.SigningResponse{}, nil
+}
+
+// writeTestKeyPair writes a key pair to keyFile and keyFile.pub, as the agent
+// does.
+func writeTestKeyPair(t *testing.T, keyFile string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(keyFile, []byte("private key"), 0o600))
+	require.NoError(t, os.WriteFile(keyFile+".pub", []byte("ssh-ed25519 AAAA"), 0o644))
+}
+
+func newTestDoctor(t *testing.T) *doctor {
+	t.Helper()
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+	return &doctor{
+		logger:     log.NewNopLogger(),
+		sshConfig:  sshConfig,
+		pdcConfig:  &pdc.Config{},
+		httpClient: http.DefaultClient,
+		now:        time.Now,
+	}
+}
+
+func TestDoctor_Checks(t *testing.T) {
+	t.Run("ssh binary missing", func(t *testing.T) {
+		d := newTestDoctor(t)
+		d.sshConfig.SSHBinary = filepath.Join(t.TempDir(), "missing-ssh")
+		r := d.checkSSHBinary(context.Background())
+		assert.Equal(t, statusFail, r.Status)
+		assert.Contains(t, r.Hint, "-ssh-binary")
+	})
+
+	t.Run("PDC API reachable, clock in sync", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+
+		d := newTestDoctor(t)
+		d.pdcConfig.URL, _ = url.Parse(srv.URL)
+
+		assert.Equal(t, statusPass, d.checkAPI(context.Background()).Status)
+		assert.Equal(t, statusPass, d.checkClockSkew(context.Background()).Status)
+	})
+
+	t.Run("local clock skewed", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer srv.Close()
+
+		d := newTestDoctor(t)
+		d.pdcConfig.URL, _ = url.Parse(srv.URL)
+		d.now = func() time.Time { return time.Now().Add(-10 * time.Minute) }
+
+		require.Equal(t, statusPass, d.checkAPI(context.Background()).Status)
+		r := d.checkClockSkew(context.Background())
+		assert.Equal(t, statusWarn, r.Status)
+		assert.Contains(t, r.Detail, "off the PDC API")
+	})
+
+	t.Run("PDC API unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.Close()
+
+		d := newTestDoctor(t)
+		d.pdcConfig.URL, _ = url.Parse(srv.URL)
+
+		assert.Equal(t, statusFail, d.checkAPI(context.Background()).Status)
+		assert.Equal(t, statusWarn, d.checkClockSkew(context.Background()).Status, "clock skew cannot be checked")
+	})
+
+	t.Run("token accepted", func(t *testing.T) {
+		d := newTestDoctor(t)
+		writeTestKeyPair(t, d.sshConfig.KeyFile)
+		d.pdcClient = fakeSigner{}
+		assert.Equal(t, statusPass, d.checkToken(context.Background()).Status)
+		assert.NoFileExists(t, d.sshConfig.CertFile(), "certificate must not be saved")
+	})
+
+	t.Run("token not checked without a key pair", func(t *testing.T) {
+		d := newTestDoctor(t)
+		signer := &countingSigner{}
+		d.pdcClient = signer
+		r := d.checkToken(context.Background())
+		assert.Equal(t, statusWarn, r.Status)
+		assert.Contains(t, r.Detail, "no key pair")
+		assert.Zero(t, signer.calls, "the PDC API must not be called")
+		assert.NoFileExists(t, d.sshConfig.KeyFile, "a key pair must not be created")
+	})
+
+	t.Run("token rejected", func(t *testing.T) {
+		d := newTestDoctor(t)
+		writeTestKeyPair(t, d.sshConfig.KeyFile)
+		d.pdcClient = fakeSigner{err: fmt.Errorf("signing: %w", pdc.ErrInvalidCredentials)}
+		r := d.checkToken(context.Background())
+		assert.Equal(t, statusFail, r.Status)
+		assert.Contains(t, r.Hint, "-token")
+	})
+
+	t.Run("token expired", func(t *testing.T) {
+		d := newTestDoctor(t)
+		d.pdcClient = fakeSigner{}
+		// An unsigned JWT that expired on 2024-06-01.
+		d.pdcConfig.Token = "eyJhbGciOiJIUzI1NiJ9.eyJleHAiOjE3MTcyMzk2MDB9.c2ln"
+		r := d.checkToken(context.Background())
+		assert.Equal(t, statusFail, r.Status)
+		assert.Contains(t, r.Detail, "signing token expired at 2024-06-01T11:00:00Z")
+	})
+
+	t.Run("private key readable by others", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("file permissions are not checked on windows")
+		}
+		d := newTestDoctor(t)
+		require.NoError(t, os.WriteFile(d.sshConfig.KeyFile, []byte("key"), 0644))
+
+		r := d.checkKeyPermissions(context.Background())
+		assert.Equal(t, statusFail, r.Status)
+		assert.Equal(t, "run chmod 600 "+d.sshConfig.KeyFile, r.Hint)
+	})
+
+	t.Run("key permissions are checked before the token", func(t *testing.T) {
+		var names []string
+		for _, c := range newTestDoctor(t).checks() {
+			names = append(names, c.Name)
+		}
+		assert.Less(t, slices.Index(names, "private key permissions"), slices.Index(names, "token"))
+	})
+
+	t.Run("private key not created yet", func(t *testing.T) {
+		d := newTestDoctor(t)
+		assert.Equal(t, statusWarn, d.checkKeyPermissions(context.Background()).Status)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// envVar is an environment variable that can be used to set a flag. The value
+// is parsed by the flag, so that it accepts the same values, and is checked
+// the same way, as on the command line.
+type envVar struct {
+	flag string
+	env  string
+	// fatal makes a malformed value stop the agent, as it would on the
+	// command line, instead of being skipped.
+	fatal bool
+}
+
+// envVars are the environment variables that can be used to set flags, in the
+// order they are applied. Flags set on the command line take precedence.
+var envVars = []envVar{
+	{flag: "cert-expiry-window", env: "GCLOUD_SSH_CERT_EXPIRY_WINDOW"},
+	{flag: "gcloud-hosted-grafana-id", env: "GCLOUD_HOSTED_GRAFANA_ID"},
+	{flag: "metrics.auth.basic", env: "GCLOUD_PDC_METRICS_AUTH_BASIC", fatal: true},
+	{flag: "metrics.auth.token", env: "GCLOUD_PDC_METRICS_AUTH_TOKEN"},
+	{flag: "no-legacy", env: "GCLOUD_PDC_NO_LEGACY"},
+	{flag: "ssh.flags-file", env: "GCLOUD_SSH_FLAGS_FILE", fatal: true},
+	{flag: "ssh.pkcs11-pin", env: "GCLOUD_PDC_PKCS11_PIN"},
+	{flag: "ssh.port", env: "GCLOUD_SSH_PORT"},
+	{flag: "token", env: "GCLOUD_PDC_SIGNING_TOKEN"},
+}
+
+// envOverrides are the results of applying environment variables to flags.
+type envOverrides struct {
+	// applied are the environment variables that set a flag.
+	applied []string
+	// errs are the environment variables that have a malformed value. They
+	// are not applied.
+	errs []error
+	// fatalErrs are the malformed values of fatal environment variables.
+	fatalErrs []error
+}
+
+// applyEnvOverrides sets the flags in fs that were not set on the command
+// line from their environment variables. Malformed values are skipped, and
+// reported in the returned errs, or fatalErrs for fatal variables.
+func applyEnvOverrides(fs *flag.FlagSet) envOverrides {
+	return applyEnvVars(fs, envVars, os.LookupEnv)
+}
+
+// applyEnvVars sets the flags in fs that were not set on the command line from
+// vars, looking up their values with lookupEnv.
+func applyEnvVars(fs *flag.FlagSet, vars []envVar, lookupEnv func(string) (string, bool)) envOverrides {
+	var o envOverrides
+	var set map[string]bool
+	for _, ev := range vars {
+		v, ok := lookupEnv(ev.env)
+		if !ok {
+			continue
+		}
+		f := fs.Lookup(ev.flag)
+		if f == nil {
+			continue
+		}
+		// The flags set on the command line are only collected once an
+		// environment variable is found, as usually none are.
+		if set == nil {
+			set = map[string]bool{}
+			fs.Visit(func(f *flag.Flag) {
+				set[f.Name] = true
+			})
+		}
+		if set[ev.flag] {
+			continue
+		}
+		// A failed Set can leave the flag at its zero value, so restore it.
+		prev := f.Value.String()
+		if err := fs.Set(ev.flag, v); err != nil {
+			_ = fs.Set(ev.flag, prev)
+			err = fmt.Errorf("invalid value %q for %s: %w", v, ev.env, err)
+			if ev.fatal {
+				o.fatalErrs = append(o.fatalErrs, err)
+			} else {
+				o.errs = append(o.errs, err)
+			}
+			continue
+		}
+		o.applied = append(o.applied, ev.env)
+	}
+	return o
+}
+
+// err returns the malformed values of fatal environment variables, which stop
+// the agent.
+func (o envOverrides) err() error {
+	return errors.Join(o.fatalErrs...)
+}
+
+// log logs a summary of the applied overrides, and a warning for each
+// malformed value.
+func (o envOverrides) log(logger log.Logger) {
+	for _, err := range o.errs {
+		level.Warn(logger).Log("msg", "ignoring environment variable", "err", err)
+	}
+	if len(o.applied) > 0 {
+		level.Info(logger).Log("msg", fmt.Sprintf("applied %d env overrides", len(o.applied)), "vars", fmt.Sprint(o.applied))
+	}
+}
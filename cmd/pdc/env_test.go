@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	cases := []struct {
+		description string
+		args        []string
+		env         map[string]string
+		wantApplied []string
+		wantErr     string
+		wantFatal   string
+		check       func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config)
+	}{
+		{
+			description: "no env vars",
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, 22, sshCfg.Port)
+			},
+		},
+		{
+			description: "port set from env var",
+			env:         map[string]string{"GCLOUD_SSH_PORT": "2222"},
+			wantApplied: []string{"GCLOUD_SSH_PORT"},
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, 2222, sshCfg.Port)
+			},
+		},
+		{
+			description: "flag takes precedence over env var",
+			args:        []string{"-ssh.port", "2244"},
+			env:         map[string]string{"GCLOUD_SSH_PORT": "2222"},
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, 2244, sshCfg.Port)
+			},
+		},
+		{
+			description: "malformed port is ignored",
+			env:         map[string]string{"GCLOUD_SSH_PORT": "not a port"},
+			wantErr:     `invalid value "not a port" for GCLOUD_SSH_PORT`,
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, 22, sshCfg.Port)
+			},
+		},
+		{
+			description: "cert expiry window set from env var",
+			env:         map[string]string{"GCLOUD_SSH_CERT_EXPIRY_WINDOW": "10m"},
+			wantApplied: []string{"GCLOUD_SSH_CERT_EXPIRY_WINDOW"},
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, 10*time.Minute, sshCfg.CertExpiryWindow)
+			},
+		},
+		{
+			description: "malformed cert expiry window is ignored",
+			env:         map[string]string{"GCLOUD_SSH_CERT_EXPIRY_WINDOW": "10"},
+			wantErr:     `invalid value "10" for GCLOUD_SSH_CERT_EXPIRY_WINDOW`,
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, 5*time.Minute, sshCfg.CertExpiryWindow)
+			},
+		},
+		{
+			description: "missing ssh flags file is fatal",
+			env:         map[string]string{"GCLOUD_SSH_FLAGS_FILE": "/nonexistent/ssh-flags"},
+			wantFatal:   `invalid value "/nonexistent/ssh-flags" for GCLOUD_SSH_FLAGS_FILE`,
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Empty(t, sshCfg.SSHFlags)
+			},
+		},
+		{
+			description: "no legacy set from env var",
+			env:         map[string]string{"GCLOUD_PDC_NO_LEGACY": "true"},
+			wantApplied: []string{"GCLOUD_PDC_NO_LEGACY"},
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.True(t, mf.NoLegacy)
+			},
+		},
+		{
+			description: "malformed no legacy is ignored",
+			env:         map[string]string{"GCLOUD_PDC_NO_LEGACY": "maybe"},
+			wantErr:     `invalid value "maybe" for GCLOUD_PDC_NO_LEGACY`,
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.False(t, mf.NoLegacy)
+			},
+		},
+		{
+			description: "token set from env var",
+			env:         map[string]string{"GCLOUD_PDC_SIGNING_TOKEN": "a,b"},
+			wantApplied: []string{"GCLOUD_PDC_SIGNING_TOKEN"},
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, "a", pdcCfg.Token)
+				assert.Equal(t, []string{"b"}, pdcCfg.FallbackTokens)
+			},
+		},
+		{
+			description: "hosted grafana id set from env var",
+			env:         map[string]string{"GCLOUD_HOSTED_GRAFANA_ID": "123"},
+			wantApplied: []string{"GCLOUD_HOSTED_GRAFANA_ID"},
+			check: func(t *testing.T, mf *mainFlags, sshCfg *ssh.Config, pdcCfg *pdc.Config) {
+				assert.Equal(t, "123", pdcCfg.HostedGrafanaID)
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			mf := &mainFlags{}
+			sshCfg := ssh.DefaultConfig()
+			pdcCfg := &pdc.Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			mf.RegisterFlags(fs)
+			sshCfg.RegisterFlags(fs)
+			pdcCfg.RegisterFlags(fs)
+			require.NoError(t, fs.Parse(tt.args))
+
+			o := applyEnvOverrides(fs)
+			assert.Equal(t, tt.wantApplied, o.applied)
+			if tt.wantErr != "" {
+				require.Len(t, o.errs, 1)
+				assert.ErrorContains(t, o.errs[0], tt.wantErr)
+			} else {
+				assert.Empty(t, o.errs)
+			}
+			if tt.wantFatal != "" {
+				assert.ErrorContains(t, o.err(), tt.wantFatal)
+			} else {
+				assert.NoError(t, o.err())
+			}
+			tt.check(t, mf, sshCfg, pdcCfg)
+		})
+	}
+}
+
+func TestParseFlags_FatalEnv(t *testing.T) {
+	t.Setenv("GCLOUD_SSH_FLAGS_FILE", "/nonexistent/ssh-flags")
+
+	mf := &mainFlags{}
+	sshCfg := ssh.DefaultConfig()
+	pdcCfg := &pdc.Config{}
+	_, _, err := parseFlags(nil, mf.RegisterFlags, sshCfg.RegisterFlags, pdcCfg.RegisterFlags)
+	assert.ErrorContains(t, err, `invalid value "/nonexistent/ssh-flags" for GCLOUD_SSH_FLAGS_FILE`)
+}
+
+func TestEnvOverrides_Log(t *testing.T) {
+	t.Setenv("GCLOUD_SSH_PORT", "2222")
+	t.Setenv("GCLOUD_SSH_CERT_EXPIRY_WINDOW", "bad")
+
+	cfg := ssh.DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse(nil))
+
+	buf := &bytes.Buffer{}
+	applyEnvOverrides(fs).log(log.NewLogfmtLogger(buf))
+
+	assert.Contains(t, buf.String(), `level=warn msg="ignoring environment variable" err="invalid value \"bad\" for GCLOUD_SSH_CERT_EXPIRY_WINDOW`)
+	assert.Contains(t, buf.String(), `level=info msg="applied 1 env overrides" vars=[GCLOUD_SSH_PORT]`)
+}
+
+func newEnvTestFlagSet(t testing.TB) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	(&mainFlags{}).RegisterFlags(fs)
+	ssh.DefaultConfig().RegisterFlags(fs)
+	(&pdc.Config{}).RegisterFlags(fs)
+	require.NoError(t, fs.Parse(nil))
+	return fs
+}
+
+func TestEnvVars(t *testing.T) {
+	fs := newEnvTestFlagSet(t)
+
+	assert.True(t, sort.SliceIsSorted(envVars, func(i, j int) bool {
+		return envVars[i].flag < envVars[j].flag
+	}), "envVars must be sorted by flag name")
+
+	flags := map[string]bool{}
+	envs := map[string]bool{}
+	for _, ev := range envVars {
+		assert.NotNil(t, fs.Lookup(ev.flag), "flag %s of %s is not defined", ev.flag, ev.env)
+		assert.False(t, flags[ev.flag], "flag %s has several environment variables", ev.flag)
+		assert.False(t, envs[ev.env], "environment variable %s is listed several times", ev.env)
+		flags[ev.flag] = true
+		envs[ev.env] = true
+	}
+}
+
+func TestApplyEnvVars(t *testing.T) {
+	env := map[string]string{
+		"PORT":    "2222",
+		"WINDOW":  "bad",
+		"UNKNOWN": "x",
+	}
+	lookupEnv := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	vars := []envVar{
+		{flag: "cert-expiry-window", env: "WINDOW"},
+		{flag: "not-a-flag", env: "UNKNOWN"},
+		{flag: "ssh.port", env: "PORT"},
+		{flag: "token", env: "UNSET"},
+	}
+
+	fs := newEnvTestFlagSet(t)
+	o := applyEnvVars(fs, vars, lookupEnv)
+
+	assert.Equal(t, []string{"PORT"}, o.applied)
+	require.Len(t, o.errs, 1)
+	assert.ErrorContains(t, o.errs[0], `invalid value "bad" for WINDOW`)
+	assert.Equal(t, "2222", fs.Lookup("ssh.port").Value.String())
+	assert.Equal(t, "5m0s", fs.Lookup("cert-expiry-window").Value.String())
+	assert.Equal(t, "", fs.Lookup("token").Value.String())
+}
+
+func BenchmarkApplyEnvVars(b *testing.B) {
+	env := map[string]string{
+		"GCLOUD_SSH_PORT":               "2222",
+		"GCLOUD_SSH_CERT_EXPIRY_WINDOW": "10m",
+		"GCLOUD_PDC_SIGNING_TOKEN":      "a,b",
+	}
+	lookupEnv := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	b.Run("none set", func(b *testing.B) {
+		fs := newEnvTestFlagSet(b)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			applyEnvVars(fs, envVars, func(string) (string, bool) { return "", false })
+		}
+	})
+	b.Run("some set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			// Applied variables mark their flags as set, so that they would
+			// be skipped by the next iteration on the same flag set.
+			b.StopTimer()
+			fs := newEnvTestFlagSet(b)
+			b.StartTimer()
+			applyEnvVars(fs, envVars, lookupEnv)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// Exit codes of the agent, so that supervisors can tell failures that are
+// worth restarting for from permanent ones.
+const (
+	exitOK         = 0
+	exitGeneric    = 1
+	exitConfig     = 2
+	exitAuth       = 3
+	exitSSHMissing = 4
+)
+
+// exitCodesUsage documents the exit codes in the -h output.
+const exitCodesUsage = `Exit codes:
+  0	success
+  1	generic error
+  2	invalid configuration
+  3	the token was rejected by the PDC API
+  4	the ssh binary was not found
+`
+
+// exitError is an error that carries the code the agent should exit with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// configError marks err as a configuration error.
+func configError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: exitConfig, err: err}
+}
+
+// exitCode returns the code the agent should exit with for err.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var ee *exitError
+	switch {
+	case errors.As(err, &ee):
+		return ee.code
+	case errors.Is(err, pdc.ErrInvalidCredentials), errors.Is(err, pdc.ErrForbidden):
+		return exitAuth
+	case errors.Is(err, ssh.ErrSSHNotFound):
+		return exitSSHMissing
+	}
+	return exitGeneric
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	testcases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "no error",
+			want: exitOK,
+		},
+		{
+			name: "generic error",
+			err:  errors.New("boom"),
+			want: exitGeneric,
+		},
+		{
+			name: "config error",
+			err:  configureURLs(&mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net"}, ssh.DefaultConfig(), &pdc.Config{}),
+			want: exitConfig,
+		},
+		{
+			name: "auth error from starting the ssh client",
+			err:  fmt.Errorf("invalid service state: Failed, expected: Running, failure: %w", fmt.Errorf("key signing request failed: %w", pdc.ErrInvalidCredentials)),
+			want: exitAuth,
+		},
+		{
+			name: "forbidden token",
+			err:  fmt.Errorf("key signing request failed: %w", pdc.ErrForbidden),
+			want: exitAuth,
+		},
+		{
+			name: "ssh binary missing",
+			err:  ssh.ErrSSHNotFound,
+			want: exitSSHMissing,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, exitCode(tc.err))
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// legacyModeTotal counts the runs in legacy mode, to find agents that still
+// need to be migrated.
+var legacyModeTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "legacy_mode_total",
+	Help: "Number of times the agent was run in the deprecated legacy ssh passthrough mode.",
+})
+
+// subcommands are the commands of the agent. Their flags are never ssh flags.
+var subcommands = []string{checkTargetCommand, rotateKeyCommand, showPubKeyCommand, doctorCommand, signCommand}
+
+// sshOptionRe matches the value of the ssh -o flag, e.g. ConnectTimeout=1 or
+// "ConnectTimeout 1".
+var sshOptionRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(\s*=\s*|\s+)\S`)
+
+// legacyFlags validate the values of the ssh flags that trigger legacy mode.
+var legacyFlags = map[string]func(string) bool{
+	"-p": isSSHPort,
+	"-i": isSSHPath,
+	"-R": isSSHForward,
+	"-o": sshOptionRe.MatchString,
+}
+
+// inLegacyMode reports whether args are passed through to ssh. That is the
+// case if no subcommand is given and one of the ssh flags -p, -i, -R or -o is
+// followed by a value that ssh would accept.
+func inLegacyMode(args []string) bool {
+	for _, a := range args {
+		for _, c := range subcommands {
+			if a == c {
+				return false
+			}
+		}
+	}
+
+	for i := 0; i < len(args)-1; i++ {
+		valid, ok := legacyFlags[args[i]]
+		if ok && valid(args[i+1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// warnLegacyMode reports that the agent runs in legacy mode.
+func warnLegacyMode(logger log.Logger) {
+	legacyModeTotal.Inc()
+	level.Warn(logger).Log("msg", "running in deprecated legacy SSH passthrough mode", "hint", "use the agent flags instead of ssh flags, or set -no-legacy to disable legacy mode")
+}
+
+// registerLegacyMetrics registers the metrics of the legacy mode on reg: the
+// agent metrics, and legacyModeTotal.
+func registerLegacyMetrics(reg prometheus.Registerer, prefix, cluster string) error {
+	return metrics.Register(reg, prefix, cluster, append(ssh.Collectors(), legacyModeTotal)...)
+}
+
+// runLegacySSH runs ssh with the flags passed through to it, and serves the
+// metrics unless the metrics address is empty, until ctx is done.
+func runLegacySSH(ctx context.Context, logger log.Logger, sshConfig *ssh.Config) error {
+	sshClient := ssh.NewClient(sshConfig, logger, nil)
+	// Start the ssh client
+	err := services.StartAndAwaitRunning(ctx, sshClient)
+	if err != nil {
+		level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
+		return err
+	}
+
+	if sshConfig.MetricsAddr != "" {
+		ms := metrics.NewMetricsServer(logger, prometheus.DefaultRegisterer, prometheus.DefaultGatherer, sshConfig.MetricsAddr, sshConfig.MetricsOpenMetrics)
+		ms.RequireAuth(sshConfig.MetricsAuth)
+		if err := ms.Start(); err != nil {
+			if sshConfig.MetricsBindFailureMode == metrics.BindFailureFatal {
+				sshClient.StopAsync()
+				_ = sshClient.AwaitTerminated(context.Background())
+				return err
+			}
+			level.Warn(logger).Log("msg", "cannot start metrics server, running without metrics", "err", err)
+		} else {
+			defer func() {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = ms.Shutdown(shutdownCtx)
+			}()
+		}
+	}
+
+	// Stop the ssh client when ctx is done
+	go func() {
+		<-ctx.Done()
+		sshClient.StopAsync()
+	}()
+
+	// Wait for the ssh client to exit
+	_ = sshClient.AwaitTerminated(context.Background())
+	return sshClient.FailureCase()
+}
+
+func isSSHPort(s string) bool {
+	p, err := strconv.Atoi(s)
+	return err == nil && p > 0 && p <= 65535
+}
+
+func isSSHPath(s string) bool {
+	return s != "" && !strings.HasPrefix(s, "-")
+}
+
+// isSSHForward matches a remote forward spec, e.g. 0, 8080:localhost:80 or a
+// unix socket path.
+func isSSHForward(s string) bool {
+	if !isSSHPath(s) {
+		return false
+	}
+	if _, err := strconv.Atoi(s); err == nil {
+		return true
+	}
+	return strings.ContainsAny(s, ":/")
+}
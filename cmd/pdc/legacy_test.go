@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestInLegacyMode(t *testing.T) {
+	cases := []struct {
+		description string
+		args        []string
+		expected    bool
+	}{
+		{
+			description: "no args",
+			args:        nil,
+			expected:    false,
+		},
+		{
+			description: "modern flags",
+			args:        []string{"-token", "abc", "-cluster", "prod-us-east-0", "-gcloud-hosted-grafana-id", "1"},
+			expected:    false,
+		},
+		{
+			description: "ssh option",
+			args:        []string{"-o", "ConnectTimeout=1"},
+			expected:    true,
+		},
+		{
+			description: "ssh option with a space",
+			args:        []string{"-o", "ConnectTimeout 1"},
+			expected:    true,
+		},
+		{
+			description: "ssh passthrough",
+			args:        []string{"-i", "/home/pdc/.ssh/key", "-p", "22", "-R", "0", "1234@host"},
+			expected:    true,
+		},
+		{
+			description: "remote forward spec",
+			args:        []string{"-R", "8080:localhost:80"},
+			expected:    true,
+		},
+		{
+			description: "-o with a non ssh value",
+			args:        []string{"-token", "abc", "-o", "json"},
+			expected:    false,
+		},
+		{
+			description: "-o as a flag value",
+			args:        []string{"-token", "-o"},
+			expected:    false,
+		},
+		{
+			description: "-o followed by a flag",
+			args:        []string{"-o", "-token", "abc"},
+			expected:    false,
+		},
+		{
+			description: "-p with a non numeric value",
+			args:        []string{"-p", "abc"},
+			expected:    false,
+		},
+		{
+			description: "-p out of range",
+			args:        []string{"-p", "70000"},
+			expected:    false,
+		},
+		{
+			description: "-R with a word",
+			args:        []string{"-R", "json"},
+			expected:    false,
+		},
+		{
+			description: "subcommand with -o",
+			args:        []string{checkTargetCommand, "-o", "ConnectTimeout=1"},
+			expected:    false,
+		},
+		{
+			description: "sign subcommand with -i",
+			args:        []string{signCommand, "-i", "/home/pdc/.ssh/key"},
+			expected:    false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			assert.Equal(t, tt.expected, inLegacyMode(tt.args))
+		})
+	}
+}
+
+func TestWarnLegacyMode(t *testing.T) {
+	before := testutil.ToFloat64(legacyModeTotal)
+
+	var buf bytes.Buffer
+	warnLegacyMode(log.NewLogfmtLogger(&buf))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(legacyModeTotal))
+	assert.Contains(t, buf.String(), "level=warn")
+	assert.Contains(t, buf.String(), `msg="running in deprecated legacy SSH passthrough mode"`)
+}
+
+func TestRunLegacySSH_Metrics(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "metrics.sock")
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755))
+
+	sshConfig := ssh.DefaultConfig()
+	sshConfig.SSHBinary = fakeSSH
+	sshConfig.SkipSSHValidation = true
+	sshConfig.LegacyMode = true
+	sshConfig.Args = []string{"-p", "22", "1@gateway.example.com"}
+	sshConfig.MetricsAddr = "unix://" + socket
+	sshConfig.MetricsPrefix = metrics.DefaultPrefix
+
+	require.NoError(t, registerLegacyMetrics(prometheus.DefaultRegisterer, sshConfig.MetricsPrefix, "prod-us-east-0"))
+	warnLegacyMode(log.NewNopLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- runLegacySSH(ctx, log.NewNopLogger(), sshConfig) }()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	var body string
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://unix/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		body = string(b)
+		return err == nil && resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, body, `pdc_agent_legacy_mode_total{cluster="prod-us-east-0"} `)
+	assert.Contains(t, body, `pdc_agent_cert_sign_success_total{cluster="prod-us-east-0"} 0`)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("legacy mode did not stop")
+	}
+}
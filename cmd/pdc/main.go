@@ -3,24 +3,33 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 
-	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/agent"
+	"github.com/grafana/pdc-agent/pkg/hooks"
+	"github.com/grafana/pdc-agent/pkg/logging"
 	"github.com/grafana/pdc-agent/pkg/metrics"
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/grafana/pdc-agent/pkg/systemd"
+	"github.com/grafana/pdc-agent/pkg/tracing"
 )
 
 // Values set by goreleaser during the build process using ldflags.
@@ -42,18 +51,175 @@ type mainFlags struct {
 	Cluster   string
 	Domain    string
 
+	// DiscoveryURL is queried for the cluster and domain at startup.
+	DiscoveryURL string
+
+	// InstanceID identifies the agent in logs and metrics, when many agents
+	// share a backend. The hostname is used if it is empty.
+	InstanceID string
+
+	// LogDedupeWindow is the window within which identical log lines are
+	// collapsed into one. 0 disables deduplication.
+	LogDedupeWindow time.Duration
+
+	// LogFile, if set, is a file that logs are written to, in addition to
+	// stdout unless LogStdout is false. It is rotated once it reaches
+	// LogFileMaxSizeMB, and LogFileMaxBackups rotated files are kept.
+	LogFile           string
+	LogFileMaxSizeMB  int
+	LogFileMaxBackups int
+	LogStdout         bool
+
+	// LogHeartbeatInterval is how often a summary of the state of the agent
+	// is logged. 0 disables it.
+	LogHeartbeatInterval time.Duration
+
+	// Quiet only logs warnings and errors, regardless of LogLevel, and does
+	// not log the startup banner.
+	Quiet bool
+
+	// NoLegacy disables the detection of the deprecated legacy mode, where all
+	// arguments are passed through to ssh.
+	NoLegacy bool
+
+	// AdminEnabled exposes admin endpoints on the metrics server.
+	AdminEnabled bool
+	// AdminLogLines is the number of recent log lines served by /admin/logs.
+	AdminLogLines int
+
+	// APIURL and GatewayURL, if set, are used instead of the URLs created
+	// from the cluster and domain.
+	APIURL     string
+	GatewayURL string
+	// FallbackGatewayURL, if set, is the gateway to switch to when GatewayURL
+	// cannot be connected to.
+	FallbackGatewayURL string
+
+	// EventsFile is a file or named pipe that tunnel events are appended to.
+	EventsFile string
+
+	// HookOnConnect and HookOnDisconnect are executables that are run when
+	// the tunnel connects or disconnects, and are killed after HookTimeout.
+	HookOnConnect    string
+	HookOnDisconnect string
+	HookTimeout      time.Duration
+
+	// DNSServer, if set, is used instead of the system resolver to resolve
+	// the gateway host at startup.
+	DNSServer string
+	// StartupDNSRetries is how many more times the gateway host is resolved
+	// at startup if it fails, e.g. because DNS is not ready yet during boot.
+	StartupDNSRetries int
+	// StartupDNSRetryInterval is the wait before the first retry. It doubles
+	// after each retry.
+	StartupDNSRetryInterval time.Duration
+
+	// PrintSSHCommand prints the ssh command that the agent would run, and
+	// exits without running it.
+	PrintSSHCommand bool
+
+	// StopFile, if set, is a file that makes the agent shut down gracefully
+	// when it appears, for environments where signals are awkward to send.
+	StopFile string
+
+	// MaxLifetime, if set, is how long the agent runs before it shuts down
+	// and exits successfully.
+	MaxLifetime time.Duration
+
 	// The fields below were added to make local development easier.
 	//
 	// DevMode is true when the agent is being run locally while someone is working on it.
 	DevMode bool
+	// DevHost is the host of the local PDC gateway and API.
+	DevHost string
+	// DevPort is the port of the local PDC gateway.
+	DevPort int
 }
 
 func (mf *mainFlags) RegisterFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&mf.PrintHelp, "h", false, "Print help")
 	fs.StringVar(&mf.LogLevel, "log.level", logLevelinfo, `"debug", "info", "warn" or "error"`)
+	fs.StringVar(&mf.InstanceID, "instance-id", "", "An ID for this agent, added to log lines as instance_id and to the pdc_agent_info metric, to tell agents apart when many share a logging or metrics backend. Defaults to the hostname")
+	fs.DurationVar(&mf.LogDedupeWindow, "log.dedupe-window", 0, "Collapse identical log lines logged within this window into one. Error logs are never collapsed. 0 disables it")
+	fs.DurationVar(&mf.LogHeartbeatInterval, "log.heartbeat-interval", 0, "How often to log a heartbeat line with the tunnel state, reconnect count, certificate expiry and uptime. 0 disables it")
+	fs.BoolVar(&mf.Quiet, "quiet", false, "Only log warnings and errors, regardless of -log.level, and do not log the startup banner")
+	fs.StringVar(&mf.LogFile, "log.file", "", "A file to write logs to. It is rotated when it reaches -log.file.max-size-mb")
+	fs.IntVar(&mf.LogFileMaxSizeMB, "log.file.max-size-mb", 100, "The size in megabytes at which the log file is rotated")
+	fs.IntVar(&mf.LogFileMaxBackups, "log.file.max-backups", 3, "The number of rotated log files to keep")
+	fs.BoolVar(&mf.LogStdout, "log.stdout", true, "Write logs to stdout. Set it to false to only write logs to -log.file")
 	fs.StringVar(&mf.Cluster, "cluster", "", "the PDC cluster to connect to use")
 	fs.StringVar(&mf.Domain, "domain", "grafana.net", "the domain of the PDC cluster")
+	fs.StringVar(&mf.APIURL, "pdc.api-url", "", "The URL of the PDC API. Takes precedence over the URL created from -cluster and -domain")
+	fs.StringVar(&mf.GatewayURL, "ssh.gateway-url", "", "The host of the PDC gateway, or an ssh://host[:port] URL. Takes precedence over the host created from -cluster and -domain")
+	fs.StringVar(&mf.FallbackGatewayURL, "ssh.fallback-gateway-url", "", "The host of a fallback PDC gateway, or an ssh://host[:port] URL, to switch to when the gateway cannot be connected to. See -ssh.fallback-after and -ssh.primary-retry-interval")
+	fs.StringVar(&mf.DiscoveryURL, "discovery.url", "", "An endpoint to query for the cluster and domain at startup. The -cluster and -domain flags are used if discovery fails")
+	fs.BoolVar(&mf.NoLegacy, "no-legacy", false, "Never run in the deprecated legacy mode, where arguments are passed through to ssh")
+	fs.BoolVar(&mf.AdminEnabled, "admin.enabled", false, "Expose admin endpoints, such as POST /admin/renew-cert and GET /admin/logs, on the metrics server")
+	fs.IntVar(&mf.AdminLogLines, "admin.log-lines", 500, "The number of recent log lines served by /admin/logs")
+	fs.StringVar(&mf.EventsFile, "events.file", "", "Append newline-delimited JSON tunnel events (connected, disconnected, reconnecting, cert_renewed) to this file or named pipe")
+	fs.StringVar(&mf.HookOnConnect, "hook.on-connect", "", "An executable to run each time the tunnel connects. It gets the cluster and tunnel state in the PDC_CLUSTER and PDC_TUNNEL_STATE environment variables")
+	fs.StringVar(&mf.HookOnDisconnect, "hook.on-disconnect", "", "An executable to run each time the tunnel disconnects. It gets the cluster and tunnel state in the PDC_CLUSTER and PDC_TUNNEL_STATE environment variables")
+	fs.DurationVar(&mf.HookTimeout, "hook.timeout", hooks.DefaultTimeout, "How long a hook can run before it is killed")
+	fs.StringVar(&mf.DNSServer, "dns.server", "", "A DNS server, as host or host:port, to resolve the gateway host with at startup. The system resolver is used if not set")
+	fs.IntVar(&mf.StartupDNSRetries, "startup.dns-retries", 3, "How many more times to resolve the gateway host at startup if it fails, e.g. while DNS is not ready during boot")
+	fs.DurationVar(&mf.StartupDNSRetryInterval, "startup.dns-retry-interval", 2*time.Second, "The wait before the first retry of resolving the gateway host at startup. It doubles after each retry")
+	fs.BoolVar(&mf.PrintSSHCommand, "print-ssh-command", false, "Print the ssh command that the agent runs, with secrets redacted, and exit without running it")
+	fs.DurationVar(&mf.MaxLifetime, "max-lifetime", 0, "Shut down the tunnel and exit successfully after this duration, e.g. for CI jobs. 0 means the agent runs until it is stopped")
+	fs.StringVar(&mf.StopFile, "stop-file", "", "A file that makes the agent shut down gracefully, as on SIGTERM, when it is created. It is removed once seen")
 	fs.BoolVar(&mf.DevMode, "dev-mode", false, "[DEVELOPMENT ONLY] run the agent in development mode")
+	fs.StringVar(&mf.DevHost, "dev.host", "localhost", "[DEVELOPMENT ONLY] the host of the local PDC gateway and API. Requires -dev-mode")
+	fs.IntVar(&mf.DevPort, "dev.port", 2244, "[DEVELOPMENT ONLY] the port of the local PDC gateway. Requires -dev-mode")
+}
+
+// logLevel returns the effective log level.
+func (mf *mainFlags) logLevel() string {
+	if mf.Quiet {
+		return "warn"
+	}
+	return mf.LogLevel
+}
+
+// instanceID returns the effective instance ID: InstanceID, or the hostname
+// if it is not set. It is empty if the hostname cannot be read.
+func (mf *mainFlags) instanceID() string {
+	if mf.InstanceID != "" {
+		return mf.InstanceID
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// logAgentInfo logs the startup banner. It is logged at debug level in quiet
+// mode.
+func logAgentInfo(logger log.Logger, quiet bool, sshVersion string) {
+	lvl := level.Info
+	if quiet {
+		lvl = level.Debug
+	}
+	lvl(logger).Log("msg", "PDC agent info",
+		"version", fmt.Sprintf("v%s", version),
+		"commit", commit,
+		"date", date,
+		"ssh version", sshVersion,
+		"os", runtime.GOOS,
+		"arch", runtime.GOARCH,
+	)
+}
+
+// sshLogLevel returns the ssh log level: verbosity if it is set, from 0 to
+// 3, and the level derived from the agent log level if it is -1.
+func sshLogLevel(level string, verbosity int) (int, error) {
+	derived, err := logLevelToSSHLogLevel(level)
+	if err != nil {
+		return -1, err
+	}
+	switch {
+	case verbosity == -1:
+		return derived, nil
+	case verbosity < 0 || verbosity > 3:
+		return -1, fmt.Errorf("invalid -ssh.verbosity %d, must be from 0 to 3, or -1", verbosity)
+	}
+	return verbosity, nil
 }
 
 func logLevelToSSHLogLevel(level string) (int, error) {
@@ -68,13 +234,13 @@ func logLevelToSSHLogLevel(level string) (int, error) {
 }
 
 // Tries to get the openssh version. Returns "UNKNOWN" on error.
-func tryGetOpenSSHVersion() string {
+func tryGetOpenSSHVersion(sshCmd string) string {
 	timeoutCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
 	buffer := bytes.NewBuffer([]byte{})
 
-	cmd := exec.CommandContext(timeoutCtx, "ssh", "-V")
+	cmd := exec.CommandContext(timeoutCtx, sshCmd, "-V")
 	// ssh -V outputs to stderr.
 	cmd.Stderr = buffer
 
@@ -87,117 +253,339 @@ func tryGetOpenSSHVersion() string {
 }
 
 func main() {
+	// ssh runs the agent as its askpass program to read the PKCS#11 PIN.
+	if os.Getenv(ssh.AskpassEnv) != "" {
+		fmt.Println(os.Getenv(ssh.AskpassPINEnv))
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == checkTargetCommand {
+		os.Exit(runCheckTarget(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == rotateKeyCommand {
+		os.Exit(runRotateKey(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == showPubKeyCommand {
+		os.Exit(runShowPubKey(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == doctorCommand {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == signCommand {
+		os.Exit(runSign(os.Args[2:]))
+	}
+
 	sshConfig := ssh.DefaultConfig()
 	mf := &mainFlags{}
 	pdcClientCfg := &pdc.Config{}
-
-	usageFn, err := parseFlags(mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
-	if err != nil {
-		fmt.Println("cannot parse flags")
-		os.Exit(1)
+	tracingCfg := &tracing.Config{}
+
+	usageFn, env, err := parseFlags(os.Args[1:], mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags, tracingCfg.RegisterFlags)
+	// ssh flags are not known flags, so they fail parsing in legacy mode.
+	legacyMode := !mf.NoLegacy && inLegacyMode(os.Args[1:])
+	if err != nil && !legacyMode {
+		fmt.Printf("cannot parse flags: %s\n", err)
+		os.Exit(exitConfig)
 	}
+	registerLogSecrets(sshConfig, pdcClientCfg)
 
 	sshConfig.Args = os.Args[1:]
-	sshConfig.LogLevel, err = logLevelToSSHLogLevel(mf.LogLevel)
+	sshConfig.LogLevel, err = sshLogLevel(mf.logLevel(), sshConfig.SSHVerbosity)
 	if err != nil {
 		usageFn()
 		fmt.Printf("setting log level: %s\n", err)
-		os.Exit(1)
+		os.Exit(exitConfig)
 	}
 
-	logger := setupLogger(mf.LogLevel)
+	var logOutputs []io.Writer
+	if mf.LogStdout {
+		logOutputs = append(logOutputs, os.Stdout)
+	}
+	if mf.LogFile != "" {
+		f, err := logging.OpenRotatingFile(mf.LogFile, int64(mf.LogFileMaxSizeMB)<<20, mf.LogFileMaxBackups)
+		if err != nil {
+			fmt.Printf("cannot open log file: %s\n", err)
+			os.Exit(exitConfig)
+		}
+		defer f.Close()
+		logOutputs = append(logOutputs, f)
+	}
+	if len(logOutputs) == 0 {
+		fmt.Println("-log.stdout=false requires -log.file")
+		os.Exit(exitConfig)
+	}
 
-	level.Info(logger).Log("msg", "PDC agent info",
-		"version", fmt.Sprintf("v%s", version),
-		"commit", commit,
-		"date", date,
-		"ssh version", tryGetOpenSSHVersion(),
-		"os", runtime.GOOS,
-		"arch", runtime.GOARCH,
-	)
+	// Keep recent log lines in memory so they can be served by /admin/logs
+	var logLines *logging.RingBuffer
+	if mf.AdminEnabled {
+		logLines = logging.NewRingBuffer(mf.AdminLogLines)
+		logOutputs = append(logOutputs, logLines)
+	}
+	logger := setupLogger(io.MultiWriter(logOutputs...), mf.logLevel(), mf.LogDedupeWindow, mf.instanceID())
+	env.log(logger)
+
+	logAgentInfo(logger, mf.Quiet, tryGetOpenSSHVersion(sshConfig.SSHBinary))
 
 	if mf.PrintHelp {
 		usageFn()
 		return
 	}
 
-	if inLegacyMode() {
+	if err := ssh.CheckSSHBinary(sshConfig.SSHBinary); err != nil {
+		level.Error(logger).Log("err", err, "binary", sshConfig.SSHBinary)
+		os.Exit(exitCode(err))
+	}
+
+	if legacyMode {
+		// Outside of legacy mode, the agent registers its metrics once the
+		// cluster is discovered.
+		if err := registerLegacyMetrics(prometheus.DefaultRegisterer, sshConfig.MetricsPrefix, mf.Cluster); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(exitConfig)
+		}
+		warnLegacyMode(logger)
 		sshConfig.LegacyMode = true
 		err = runLegacyMode(sshConfig)
 		if err != nil {
 			fmt.Printf("error: %s", err)
-			os.Exit(1)
+			os.Exit(exitGeneric)
 		}
 		return
 	}
 
-	apiURL, gatewayURL, err := createURLsFromCluster(mf.Cluster, mf.Domain)
+	applyDiscovery(context.Background(), logger, mf, pdcClientCfg.HostedGrafanaID)
+
+	warnExplicitURLs(logger, mf)
+	if err := configureURLs(mf, sshConfig, pdcClientCfg); err != nil {
+		level.Error(logger).Log("err", err)
+		os.Exit(exitCode(err))
+	}
+	if err := validateConfig(mf, sshConfig, pdcClientCfg); err != nil {
+		level.Error(logger).Log("msg", "invalid configuration", "err", err)
+		os.Exit(exitCode(err))
+	}
+	if err := checkSigningTokens(logger, pdcClientCfg.SigningTokens(), time.Now()); err != nil {
+		level.Error(logger).Log("err", err)
+		os.Exit(exitCode(err))
+	}
+
+	if mf.PrintSSHCommand {
+		if err := printSSHCommand(os.Stdout, logger, sshConfig); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(exitConfig)
+		}
+		return
+	}
+
+	resolver, err := newResolver(mf.DNSServer)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		os.Exit(exitConfig)
+	}
+
+	// DNS failures may be transient, so they are not reported as a
+	// configuration error.
+	err = retryGatewayDNS(context.Background(), logger, mf.StartupDNSRetries, mf.StartupDNSRetryInterval, func(ctx context.Context) error {
+		return checkGatewayDNS(ctx, resolver, sshConfig.GatewayHost())
+	})
 	if err != nil {
 		level.Error(logger).Log("err", err)
-		os.Exit(1)
+		os.Exit(exitGeneric)
+	}
+
+	metrics.SetAgentInfo(metrics.AgentInfo{
+		Version:     version,
+		InstanceID:  mf.instanceID(),
+		Domain:      mf.Domain,
+		GatewayHost: sshConfig.GatewayHost(),
+		APIHost:     pdcClientCfg.URL.Host,
+	})
+
+	shutdownTracing, err := tracing.Setup(context.Background(), *tracingCfg, version)
+	if err != nil {
+		level.Error(logger).Log("msg", "cannot set up tracing", "err", err)
+		os.Exit(exitConfig)
+	}
+
+	err = run(logger, logLines, mf, sshConfig, pdcClientCfg)
+
+	if serr := shutdownTracing(context.Background()); serr != nil {
+		level.Warn(logger).Log("msg", "could not flush traces", "err", serr)
+	}
+
+	if err != nil {
+		level.Error(logger).Log("err", err, "exit_code", exitCode(err))
+		os.Exit(exitCode(err))
+	}
+
+}
+
+// configureURLs sets the PDC API and gateway URLs of the configs from the
+// cluster and domain, or for local development in dev mode. Errors are
+// configuration errors.
+func configureURLs(mf *mainFlags, sshConfig *ssh.Config, pdcClientCfg *pdc.Config) error {
+	return configError(configureURLsFromFlags(mf, sshConfig, pdcClientCfg))
+}
+
+func configureURLsFromFlags(mf *mainFlags, sshConfig *ssh.Config, pdcClientCfg *pdc.Config) error {
+	// The ID is needed to sign certificates with the PDC API, and for the
+	// headers of the local PDC API in dev mode.
+	if mf.DevMode || sshConfig.PreSignedCertFile == "" {
+		if err := validateHostedGrafanaID(pdcClientCfg.HostedGrafanaID); err != nil {
+			return err
+		}
+	}
+
+	apiURL, gatewayURL, err := createURLsFromCluster(mf.Cluster, mf.Domain)
+	if err != nil {
+		return err
+	}
+
+	if mf.APIURL != "" {
+		apiURL, err = parseAPIURL(mf.APIURL)
+		if err != nil {
+			return err
+		}
+	}
+	if mf.GatewayURL != "" {
+		gatewayURL, err = parseGatewayURL("-ssh.gateway-url", mf.GatewayURL, &sshConfig.Port)
+		if err != nil {
+			return err
+		}
+	}
+	if mf.FallbackGatewayURL != "" {
+		sshConfig.FallbackGatewayURL, err = parseGatewayURL("-ssh.fallback-gateway-url", mf.FallbackGatewayURL, &sshConfig.FallbackPort)
+		if err != nil {
+			return err
+		}
 	}
 
 	pdcClientCfg.Version = version
 	pdcClientCfg.URL = apiURL
+	pdcClientCfg.SetAutoKeyID(mf.Cluster)
 	sshConfig.PDC = *pdcClientCfg
 	sshConfig.URL = gatewayURL
 
 	if mf.DevMode {
-		setDevelopmentConfig(sshConfig, pdcClientCfg)
+		return setDevelopmentConfig(mf, sshConfig, pdcClientCfg)
 	}
+	return nil
+}
 
-	err = run(logger, sshConfig, pdcClientCfg)
-	if err != nil {
-		level.Error(logger).Log("err", err)
-		os.Exit(1)
+// validateHostedGrafanaID checks that the Hosted Grafana ID is set and numeric,
+// so that a missing or mistyped ID fails early rather than as an error from
+// the PDC API.
+func validateHostedGrafanaID(id string) error {
+	if id == "" {
+		return errors.New("-gcloud-hosted-grafana-id is required, set it or the GCLOUD_HOSTED_GRAFANA_ID environment variable")
 	}
-
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return fmt.Errorf("-gcloud-hosted-grafana-id must be numeric, got %q. Check the flag or the GCLOUD_HOSTED_GRAFANA_ID environment variable", id)
+	}
+	return nil
 }
 
 // Configures the agent for local development
-func setDevelopmentConfig(sshCfg *ssh.Config, pdcClientCfg *pdc.Config) {
-	pdcClientCfg.URL, _ = url.Parse("http://localhost:9181")
+func setDevelopmentConfig(mf *mainFlags, sshCfg *ssh.Config, pdcClientCfg *pdc.Config) error {
+	// The X-Scope-OrgID header is required by the local PDC API.
+	if err := validateHostedGrafanaID(pdcClientCfg.HostedGrafanaID); err != nil {
+		return err
+	}
+
+	// Accept IPv6 literals with or without brackets.
+	devHost := strings.TrimSuffix(strings.TrimPrefix(mf.DevHost, "["), "]")
+
+	var err error
+	pdcClientCfg.URL, err = url.Parse(fmt.Sprintf("http://%s", net.JoinHostPort(devHost, "9181")))
+	if err != nil {
+		return err
+	}
 
 	pdcClientCfg.DevHeaders = map[string]string{
 		"X-Scope-OrgID":      pdcClientCfg.HostedGrafanaID,
 		"X-Access-Policy-ID": pdcClientCfg.DevNetwork,
 	}
-	pdcClientCfg.SignPublicKeyEndpoint = "/api/v1/sign-public-key"
+	// The local PDC API is not served under the /pdc prefix. Keep an explicitly
+	// configured endpoint.
+	if pdcClientCfg.SignPublicKeyEndpoint == "" || pdcClientCfg.SignPublicKeyEndpoint == pdc.DefaultSignPublicKeyEndpoint {
+		pdcClientCfg.SignPublicKeyEndpoint = "/api/v1/sign-public-key"
+	}
 
-	sshCfg.Port = 2244
-	sshCfg.URL, _ = url.Parse("localhost")
+	sshCfg.Port = mf.DevPort
+	sshCfg.URL, err = parseGatewayHost(devHost)
+	if err != nil {
+		return err
+	}
 	sshCfg.PDC = *pdcClientCfg
+	return nil
 }
 
-func run(logger log.Logger, sshConfig *ssh.Config, pdcConfig *pdc.Config) error {
+func run(logger log.Logger, logLines *logging.RingBuffer, mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	if mf.StopFile != "" {
+		go stopOnFile(ctx, logger, mf.StopFile, stopFilePollInterval, stop)
+	}
 
-	pdcClient, err := pdc.NewClient(pdcConfig, logger)
+	hooksConfig := agent.HooksConfig{
+		OnConnect:    mf.HookOnConnect,
+		OnDisconnect: mf.HookOnDisconnect,
+		Timeout:      mf.HookTimeout,
+	}
+	a, err := agent.New(agent.Config{
+		SSH:          sshConfig,
+		PDC:          pdcConfig,
+		Cluster:      mf.Cluster,
+		Domain:       mf.Domain,
+		InstanceID:   mf.instanceID(),
+		EventsFile:   mf.EventsFile,
+		Hooks:        hooksConfig,
+		AdminEnabled: mf.AdminEnabled,
+		LogLines:     logLines,
+		Registerer:   prometheus.DefaultRegisterer,
+		Gatherer:     prometheus.DefaultGatherer,
+	}, logger)
 	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot initialise PDC client: %s", err))
-		return err
+		level.Error(logger).Log("msg", err)
+		return configError(err)
 	}
 
-	km := ssh.NewKeyManager(sshConfig, logger, pdcClient)
+	// Renew the certificate on demand, without restarting the tunnel.
+	go renewCertOnSIGHUP(ctx, logger, a)
+	// Log the state of the agent on demand, for debugging.
+	go logStateOnSignal(ctx, logger, a)
+	if mf.LogHeartbeatInterval > 0 {
+		go logHeartbeat(ctx, logger, a, mf.LogHeartbeatInterval)
+	}
+	// Tell systemd when the tunnel is up, if the agent is run with Type=notify.
+	go systemd.NewNotifierFromEnv().Run(ctx, logger, a.TunnelState)
 
-	// Create the SSH Service. KeyManager must be in running state when passed to ssh.NewClient
-	sshClient := ssh.NewClient(sshConfig, logger, km)
-	// Start the ssh client
-	err = services.StartAndAwaitRunning(ctx, sshClient)
-	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
-		return err
+	return withMaxLifetime(ctx, logger, mf.MaxLifetime, a.Run)
+}
+
+// withMaxLifetime runs fn with a context that is also cancelled once
+// maxLifetime has passed, if it is set. Whichever of ctx and the maximum
+// lifetime ends first stops fn. Reaching the maximum lifetime is not an error.
+func withMaxLifetime(ctx context.Context, logger log.Logger, maxLifetime time.Duration, fn func(context.Context) error) error {
+	if maxLifetime <= 0 {
+		return fn(ctx)
 	}
 
-	// If ssh client start successfully, start the metrics server
-	ms := metrics.NewMetricsServer(logger, sshConfig.MetricsAddr)
-	go ms.Run()
+	ctx, cancel := context.WithTimeout(ctx, maxLifetime)
+	defer cancel()
 
-	// Wait for the ssh client to exit
-	_ = sshClient.AwaitTerminated(context.Background())
+	expired := func() bool { return errors.Is(ctx.Err(), context.DeadlineExceeded) }
+	stop := context.AfterFunc(ctx, func() {
+		if expired() {
+			level.Info(logger).Log("msg", "maximum lifetime reached, shutting down", "max_lifetime", maxLifetime)
+		}
+	})
+	defer stop()
 
-	return nil
+	err := fn(ctx)
+	if expired() {
+		return nil
+	}
+	return err
 }
 
 func createURLsFromCluster(cluster string, domain string) (api *url.URL, gateway *url.URL, err error) {
@@ -213,9 +601,64 @@ func createURLsFromCluster(cluster string, domain string) (api *url.URL, gateway
 	return
 }
 
-// parseFlags creates a flagset, registers all given flags, and parses. It
-// returns the flagset's usage function and the parsing error.
-func parseFlags(registerers ...func(fs *flag.FlagSet)) (func(), error) {
+// warnExplicitURLs warns when the cluster is set along with URLs that take
+// precedence over it.
+func warnExplicitURLs(logger log.Logger, mf *mainFlags) {
+	if mf.Cluster != "" && (mf.APIURL != "" || mf.GatewayURL != "") {
+		level.Warn(logger).Log("msg", "-pdc.api-url and -ssh.gateway-url take precedence over -cluster", "cluster", mf.Cluster)
+	}
+}
+
+// parseAPIURL parses the -pdc.api-url flag.
+func parseAPIURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -pdc.api-url: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid -pdc.api-url %q, must be an absolute URL such as https://host", s)
+	}
+	return u, nil
+}
+
+// parseGatewayURL parses a gateway URL flag, which is either a host or an
+// ssh://host[:port] URL. A port in the URL is set in port.
+func parseGatewayURL(name, s string, port *int) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		return parseGatewayHost(s)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid %s %q, must be a host or an ssh://host[:port] URL", name, s)
+	}
+	if p := u.Port(); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s port %q: %w", name, p, err)
+		}
+		*port = n
+	}
+	return parseGatewayHost(u.Hostname())
+}
+
+// parseGatewayHost returns the gateway URL for a host. IPv6 literals are
+// bracketed in the URL's host, as they cannot be parsed as a bare URL.
+func parseGatewayHost(host string) (*url.URL, error) {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return &url.URL{Host: "[" + host + "]"}, nil
+	}
+	return url.Parse(host)
+}
+
+// parseFlags creates a flagset, registers all given flags, parses args and
+// applies environment variable overrides. It returns the flagset's usage
+// function, the overrides, and the parsing error, which suggests the closest
+// flag for a mistyped one.
+func parseFlags(args []string, registerers ...func(fs *flag.FlagSet)) (func(), envOverrides, error) {
 	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
 	fs.Usage = func() {
@@ -227,52 +670,69 @@ func parseFlags(registerers ...func(fs *flag.FlagSet)) (func(), error) {
 
 If pdc-agent is run with SSH flags, it will pass all arguments directly through to the "ssh" binary. This is deprecated behaviour.
 
+Commands:
+  %s	check that a datasource can be reached by the agent
+  %s	rotate the key pair of a running agent
+  %s	print the public key submitted for signing, creating the key pair if needed
+  %s	run the preflight checks, and print how to fix failures, without starting the tunnel
+  %s	sign a certificate, write it with the key pair, and print their paths, without starting the tunnel
+
 Run %s <command> -h for more information
-`, prog)
+
+%s`, checkTargetCommand, rotateKeyCommand, showPubKeyCommand, doctorCommand, signCommand, prog, exitCodesUsage)
 	}
 
 	for _, r := range registerers {
 		r(fs)
 	}
 
-	return fs.Usage, fs.Parse(os.Args[1:])
-}
-
-func inLegacyMode() bool {
-	args := os.Args[1:]
-
-	for _, a := range args {
-		if a == "-p" || a == "-i" || a == "-R" || a == "-o" {
-			return true
-		}
-	}
-
-	return false
+	// Environment variables are applied even if parsing fails, as they may
+	// disable the legacy mode that is detected from unknown flags. Malformed
+	// values of fatal ones fail parsing, as the flags would.
+	parseErr := withFlagSuggestion(fs, fs.Parse(args))
+	env := applyEnvOverrides(fs)
+	return fs.Usage, env, errors.Join(parseErr, env.err())
 }
 
 func runLegacyMode(sshConfig *ssh.Config) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	logger := log.NewLogfmtLogger(os.Stdout)
-	sshClient := ssh.NewClient(sshConfig, logger, nil)
-	// Start the ssh client
-	err := services.StartAndAwaitRunning(ctx, sshClient)
+	return runLegacySSH(ctx, log.NewLogfmtLogger(os.Stdout), sshConfig)
+}
+
+// printSSHCommand writes the ssh command that the agent runs for sshConfig to
+// w, with secrets redacted.
+func printSSHCommand(w io.Writer, logger log.Logger, sshConfig *ssh.Config) error {
+	cmd, err := ssh.NewClient(sshConfig, logger, nil).CommandLine()
 	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
 		return err
 	}
-	// Wait for the ssh client to exit
-	_ = sshClient.AwaitTerminated(context.Background())
-	return nil
+	_, err = fmt.Fprintln(w, cmd)
+	return err
 }
 
-// setupLogger with level filter.
-func setupLogger(lvl string) log.Logger {
-	logger := log.NewLogfmtLogger(os.Stdout)
+// logSecrets are the secrets that the loggers of setupLogger redact. They are
+// registered with registerLogSecrets once the configuration is resolved.
+var logSecrets = &logging.Secrets{}
+
+// registerLogSecrets makes the loggers redact the secrets of the configs.
+func registerLogSecrets(sshConfig *ssh.Config, pdcConfig *pdc.Config) {
+	logSecrets.Add(pdcConfig.SigningTokens()...)
+	logSecrets.Add(sshConfig.PKCS11PIN, sshConfig.MetricsAuth.BearerToken, sshConfig.MetricsAuth.BasicPassword)
+}
+
+// setupLogger with level filter, and optional deduplication of repeated lines.
+func setupLogger(w io.Writer, lvl string, dedupeWindow time.Duration, instanceID string) log.Logger {
+	logger := log.NewLogfmtLogger(w)
+	logger = logging.NewRedactLogger(logger, logSecrets)
+	logger = logging.NewDedupeLogger(logger, dedupeWindow)
 	logger = level.NewFilter(logger, level.Allow(level.ParseDefault(lvl, level.DebugValue())))
 	logger = log.With(logger, "caller", log.DefaultCaller)
 	logger = log.With(logger, "ts", log.DefaultTimestamp)
+	if instanceID != "" {
+		logger = log.With(logger, "instance_id", instanceID)
+	}
 
 	return logger
 }
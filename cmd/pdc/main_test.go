@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLogLevelToSSHLogLevel(t *testing.T) {
@@ -58,3 +68,444 @@ func TestLogLevelToSSHLogLevel(t *testing.T) {
 		})
 	}
 }
+
+func TestSSHLogLevel(t *testing.T) {
+	cases := []struct {
+		description   string
+		level         string
+		verbosity     int
+		expectedLevel int
+		expectedErr   string
+	}{
+		{description: "unset verbosity keeps the info mapping", level: "info", verbosity: -1, expectedLevel: 0},
+		{description: "unset verbosity keeps the debug mapping", level: "debug", verbosity: -1, expectedLevel: 3},
+		{description: "verbosity overrides info", level: "info", verbosity: 3, expectedLevel: 3},
+		{description: "verbosity overrides debug", level: "debug", verbosity: 1, expectedLevel: 1},
+		{description: "verbosity 0 silences ssh in debug", level: "debug", verbosity: 0, expectedLevel: 0},
+		{description: "verbosity out of range", level: "info", verbosity: 4, expectedErr: "invalid -ssh.verbosity 4, must be from 0 to 3, or -1"},
+		{description: "unknown level with verbosity", level: "unknown", verbosity: 2, expectedErr: "invalid log level: unknown"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			actual, err := sshLogLevel(tt.level, tt.verbosity)
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedLevel, actual)
+		})
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	cases := []struct {
+		description string
+		args        []string
+		wantBanner  bool
+		wantInfo    bool
+	}{
+		{
+			description: "info level",
+			args:        []string{"-log.level", "info"},
+			wantBanner:  true,
+			wantInfo:    true,
+		},
+		{
+			description: "quiet overrides the log level",
+			args:        []string{"-quiet", "-log.level", "debug"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			mf := &mainFlags{}
+			_, _, err := parseFlags(tt.args, mf.RegisterFlags)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			logger := setupLogger(&buf, mf.logLevel(), 0, "")
+			logAgentInfo(logger, mf.Quiet, "OpenSSH_9.6")
+			level.Info(logger).Log("msg", "info line")
+			level.Error(logger).Log("msg", "error line")
+
+			assert.Equal(t, tt.wantBanner, strings.Contains(buf.String(), "PDC agent info"))
+			assert.Equal(t, tt.wantInfo, strings.Contains(buf.String(), "info line"))
+			assert.Contains(t, buf.String(), "error line")
+		})
+	}
+}
+
+func TestSetupLogger_RedactsSecrets(t *testing.T) {
+	sshCfg := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcCfg := &pdc.Config{}
+	_, _, err := parseFlags([]string{"-token", "glc_redact_test_token"}, mf.RegisterFlags, sshCfg.RegisterFlags, pdcCfg.RegisterFlags)
+	require.NoError(t, err)
+	registerLogSecrets(sshCfg, pdcCfg)
+
+	var buf bytes.Buffer
+	logger := setupLogger(&buf, mf.logLevel(), 0, "")
+	level.Error(logger).Log("msg", "sign request failed", "err", errors.New("invalid token glc_redact_test_token"))
+
+	assert.Contains(t, buf.String(), `err="invalid token ***"`)
+	assert.NotContains(t, buf.String(), "glc_redact_test_token")
+}
+
+func TestInstanceID(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	cases := []struct {
+		description string
+		args        []string
+		want        string
+	}{
+		{description: "defaults to the hostname", want: hostname},
+		{description: "set with -instance-id", args: []string{"-instance-id", "agent-1"}, want: "agent-1"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			mf := &mainFlags{}
+			_, _, err := parseFlags(tt.args, mf.RegisterFlags)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, mf.instanceID())
+
+			var buf bytes.Buffer
+			logger := setupLogger(&buf, mf.logLevel(), 0, mf.instanceID())
+			level.Info(logger).Log("msg", "info line")
+			assert.Contains(t, buf.String(), "instance_id="+tt.want)
+		})
+	}
+}
+
+func TestWithMaxLifetime(t *testing.T) {
+	// runUntilDone behaves like the agent: it runs until its context is done,
+	// and returns the context's error if it is stopped while starting.
+	runUntilDone := func(starting bool) func(context.Context) error {
+		return func(ctx context.Context) error {
+			<-ctx.Done()
+			if starting {
+				return ctx.Err()
+			}
+			return nil
+		}
+	}
+
+	t.Run("exits cleanly after the maximum lifetime", func(t *testing.T) {
+		for _, starting := range []bool{false, true} {
+			start := time.Now()
+			err := withMaxLifetime(context.Background(), log.NewNopLogger(), 50*time.Millisecond, runUntilDone(starting))
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		}
+	})
+
+	t.Run("a signal before the maximum lifetime wins", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := withMaxLifetime(ctx, log.NewNopLogger(), time.Hour, runUntilDone(true))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), time.Minute)
+	})
+
+	t.Run("errors are returned", func(t *testing.T) {
+		want := errors.New("cannot start ssh client")
+		err := withMaxLifetime(context.Background(), log.NewNopLogger(), time.Hour, func(context.Context) error { return want })
+		assert.Equal(t, want, err)
+	})
+
+	t.Run("no maximum lifetime", func(t *testing.T) {
+		err := withMaxLifetime(context.Background(), log.NewNopLogger(), 0, func(ctx context.Context) error {
+			_, ok := ctx.Deadline()
+			assert.False(t, ok)
+			return nil
+		})
+		assert.NoError(t, err)
+	})
+}
+
+func TestSetDevelopmentConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("hosted grafana id is required", func(t *testing.T) {
+		t.Parallel()
+
+		mf := &mainFlags{DevHost: "localhost", DevPort: 2244}
+		err := setDevelopmentConfig(mf, ssh.DefaultConfig(), &pdc.Config{})
+		assert.EqualError(t, err, "-gcloud-hosted-grafana-id is required, set it or the GCLOUD_HOSTED_GRAFANA_ID environment variable")
+	})
+
+	t.Run("host, port and network are set from flags", func(t *testing.T) {
+		t.Parallel()
+
+		mf := &mainFlags{DevHost: "pdc.local", DevPort: 2222}
+		sshCfg := ssh.DefaultConfig()
+		pdcCfg := &pdc.Config{HostedGrafanaID: "1", DevNetwork: "network"}
+
+		assert.NoError(t, setDevelopmentConfig(mf, sshCfg, pdcCfg))
+		assert.Equal(t, "http://pdc.local:9181", pdcCfg.URL.String())
+		assert.Equal(t, "pdc.local", sshCfg.URL.String())
+		assert.Equal(t, 2222, sshCfg.Port)
+		assert.Equal(t, map[string]string{"X-Scope-OrgID": "1", "X-Access-Policy-ID": "network"}, sshCfg.PDC.DevHeaders)
+	})
+
+	for _, host := range []string{"::1", "[::1]"} {
+		host := host
+		t.Run("IPv6 literal host "+host, func(t *testing.T) {
+			t.Parallel()
+
+			mf := &mainFlags{DevHost: host, DevPort: 2222}
+			sshCfg := ssh.DefaultConfig()
+			pdcCfg := &pdc.Config{HostedGrafanaID: "1"}
+
+			assert.NoError(t, setDevelopmentConfig(mf, sshCfg, pdcCfg))
+			assert.Equal(t, "http://[::1]:9181", pdcCfg.URL.String())
+			assert.Equal(t, "::1", sshCfg.GatewayHost())
+		})
+	}
+}
+
+func TestValidateHostedGrafanaID(t *testing.T) {
+	testcases := []struct {
+		name    string
+		id      string
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			wantErr: "-gcloud-hosted-grafana-id is required, set it or the GCLOUD_HOSTED_GRAFANA_ID environment variable",
+		},
+		{
+			name:    "non-numeric",
+			id:      "stack-1",
+			wantErr: `-gcloud-hosted-grafana-id must be numeric, got "stack-1". Check the flag or the GCLOUD_HOSTED_GRAFANA_ID environment variable`,
+		},
+		{
+			name:    "negative",
+			id:      "-1",
+			wantErr: `-gcloud-hosted-grafana-id must be numeric, got "-1". Check the flag or the GCLOUD_HOSTED_GRAFANA_ID environment variable`,
+		},
+		{
+			name: "valid",
+			id:   "123456",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateHostedGrafanaID(tc.id)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestConfigureURLs_HostedGrafanaID(t *testing.T) {
+	t.Run("required to sign certificates", func(t *testing.T) {
+		mf := &mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net"}
+		err := configureURLs(mf, ssh.DefaultConfig(), &pdc.Config{})
+		assert.ErrorContains(t, err, "-gcloud-hosted-grafana-id is required")
+	})
+
+	t.Run("not required with a pre-signed certificate", func(t *testing.T) {
+		mf := &mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net"}
+		sshCfg := ssh.DefaultConfig()
+		sshCfg.PreSignedCertFile = "cert.pub"
+		assert.NoError(t, configureURLs(mf, sshCfg, &pdc.Config{}))
+	})
+}
+
+func TestConfigureURLs_Overrides(t *testing.T) {
+	testcases := []struct {
+		name        string
+		mf          mainFlags
+		wantAPI     string
+		wantGateway string
+		wantPort    int
+		wantErr     string
+	}{
+		{
+			name:        "urls are created from the cluster",
+			mf:          mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net"},
+			wantAPI:     "https://private-datasource-connect-api-prod-us-east-0.grafana.net",
+			wantGateway: "private-datasource-connect-prod-us-east-0.grafana.net",
+			wantPort:    22,
+		},
+		{
+			name:        "explicit urls take precedence over the cluster",
+			mf:          mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net", APIURL: "http://localhost:9181", GatewayURL: "localhost"},
+			wantAPI:     "http://localhost:9181",
+			wantGateway: "localhost",
+			wantPort:    22,
+		},
+		{
+			name:        "only the api url is overridden",
+			mf:          mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net", APIURL: "http://localhost:9181"},
+			wantAPI:     "http://localhost:9181",
+			wantGateway: "private-datasource-connect-prod-us-east-0.grafana.net",
+			wantPort:    22,
+		},
+		{
+			name:        "gateway url with a port",
+			mf:          mainFlags{GatewayURL: "ssh://[::1]:2244", APIURL: "http://localhost:9181"},
+			wantAPI:     "http://localhost:9181",
+			wantGateway: "::1",
+			wantPort:    2244,
+		},
+		{
+			name:    "api url must be absolute",
+			mf:      mainFlags{APIURL: "localhost:9181"},
+			wantErr: "invalid -pdc.api-url",
+		},
+		{
+			name:    "gateway url must be an ssh url",
+			mf:      mainFlags{GatewayURL: "https://localhost"},
+			wantErr: `invalid -ssh.gateway-url "https://localhost"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sshCfg := ssh.DefaultConfig()
+			pdcCfg := &pdc.Config{HostedGrafanaID: "1"}
+
+			err := configureURLs(&tc.mf, sshCfg, pdcCfg)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantAPI, pdcCfg.URL.String())
+			assert.Equal(t, tc.wantGateway, sshCfg.GatewayHost())
+			assert.Equal(t, tc.wantPort, sshCfg.Port)
+		})
+	}
+}
+
+func TestConfigureURLs_FallbackGateway(t *testing.T) {
+	testcases := []struct {
+		name         string
+		fallback     string
+		wantHost     string
+		wantPort     int
+		wantFallback int
+		wantErr      string
+	}{
+		{
+			name:     "fallback host",
+			fallback: "private-datasource-connect-prod-us-east-1.grafana.net",
+			wantHost: "private-datasource-connect-prod-us-east-1.grafana.net",
+			wantPort: 22,
+		},
+		{
+			name:         "fallback url with a port",
+			fallback:     "ssh://fallback.example.com:2222",
+			wantHost:     "fallback.example.com",
+			wantPort:     22,
+			wantFallback: 2222,
+		},
+		{
+			name:     "fallback url must be an ssh url",
+			fallback: "https://fallback.example.com",
+			wantErr:  `invalid -ssh.fallback-gateway-url "https://fallback.example.com"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mf := &mainFlags{Cluster: "prod-us-east-0", Domain: "grafana.net", FallbackGatewayURL: tc.fallback}
+			sshCfg := ssh.DefaultConfig()
+
+			err := configureURLs(mf, sshCfg, &pdc.Config{HostedGrafanaID: "1"})
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "private-datasource-connect-prod-us-east-0.grafana.net", sshCfg.GatewayHost())
+			fb := *sshCfg
+			fb.URL = sshCfg.FallbackGatewayURL
+			assert.Equal(t, tc.wantHost, fb.GatewayHost())
+			assert.Equal(t, tc.wantPort, sshCfg.Port)
+			assert.Equal(t, tc.wantFallback, sshCfg.FallbackPort)
+		})
+	}
+}
+
+func TestNoLegacy(t *testing.T) {
+	cases := []struct {
+		description    string
+		args           []string
+		env            map[string]string
+		expectedLegacy bool
+	}{
+		{
+			description:    "ssh flag without -no-legacy, should run in legacy mode",
+			args:           []string{"-o", "ConnectTimeout=1"},
+			expectedLegacy: true,
+		},
+		{
+			description:    "ssh flag with -no-legacy, should not run in legacy mode",
+			args:           []string{"-no-legacy", "-o", "ConnectTimeout=1"},
+			expectedLegacy: false,
+		},
+		{
+			description:    "ssh flag with env var, should not run in legacy mode",
+			args:           []string{"-o", "ConnectTimeout=1"},
+			env:            map[string]string{"GCLOUD_PDC_NO_LEGACY": "true"},
+			expectedLegacy: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			mf := &mainFlags{}
+			_, _, err := parseFlags(tt.args, mf.RegisterFlags)
+			if !tt.expectedLegacy {
+				// -o is not a known flag, so it is an error rather than legacy mode
+				assert.Error(t, err)
+			}
+
+			assert.Equal(t, tt.expectedLegacy, !mf.NoLegacy && inLegacyMode(tt.args))
+		})
+	}
+}
+
+func TestPrintSSHCommand(t *testing.T) {
+	sshCfg := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcCfg := &pdc.Config{}
+	_, _, err := parseFlags([]string{
+		"-cluster", "prod-us-east-0",
+		"-gcloud-hosted-grafana-id", "1",
+		"-token", "glc_secret",
+		"-ssh-key-file", "/var/lib/pdc/key",
+		"-ssh-flag", "-o ProxyCommand=proxy --token glc_secret %h %p",
+		"-ssh.pkcs11-pin", "1234",
+	}, mf.RegisterFlags, sshCfg.RegisterFlags, pdcCfg.RegisterFlags)
+	require.NoError(t, err)
+	require.NoError(t, configureURLs(mf, sshCfg, pdcCfg))
+
+	var out bytes.Buffer
+	require.NoError(t, printSSHCommand(&out, log.NewNopLogger(), sshCfg))
+	cmd := out.String()
+
+	assert.True(t, strings.HasPrefix(cmd, "ssh -i /var/lib/pdc/key 1@private-datasource-connect-prod-us-east-0.grafana.net -p 22 -R 0 "), cmd)
+	assert.Contains(t, cmd, "-o CertificateFile=/var/lib/pdc/key-cert.pub")
+	assert.Contains(t, cmd, "-o UserKnownHostsFile=/var/lib/pdc/grafana_pdc_known_hosts")
+	assert.Contains(t, cmd, "-o 'ProxyCommand=proxy --token <redacted> %h %p'")
+	assert.NotContains(t, cmd, "glc_secret")
+	assert.True(t, strings.HasSuffix(cmd, "\n"))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// dnsCheckTimeout is how long the gateway host has to resolve at startup.
+const dnsCheckTimeout = 10 * time.Second
+
+// newResolver returns a resolver that sends its queries to server, a host or
+// host:port, instead of the servers configured on the system. The system
+// resolver is returned if server is empty.
+func newResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return net.DefaultResolver, nil
+	}
+
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		// A host without a port, or an IPv6 address, uses the default port.
+		host := strings.Trim(server, "[]")
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DNS server %q: %w", server, err)
+		}
+		addr = net.JoinHostPort(host, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// checkGatewayDNS checks that the gateway host resolves, so that a wrong
+// cluster or domain is reported clearly instead of as an ssh error.
+func checkGatewayDNS(ctx context.Context, resolver *net.Resolver, host string) error {
+	// IP literals, such as an IPv6 gateway address, need no resolving.
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsCheckTimeout)
+	defer cancel()
+
+	if _, err := resolver.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("cannot resolve PDC gateway host %q, verify the -cluster and -domain flags: %w", host, err)
+	}
+	return nil
+}
+
+// retryGatewayDNS calls check, and retries it up to retries times if it
+// fails, waiting interval before the first retry and twice as long before
+// each next one. It returns the last error, or the context error if ctx is
+// done while waiting.
+func retryGatewayDNS(ctx context.Context, logger log.Logger, retries int, interval time.Duration, check func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := check(ctx)
+		if err == nil || attempt > retries {
+			return err
+		}
+		level.Warn(logger).Log("msg", "gateway host did not resolve, retrying", "attempt", attempt, "retries", retries, "retry_in", interval, "err", err)
+
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		interval *= 2
+	}
+}
+
+// checkSigningTokens checks that the signing tokens that are JWTs are neither
+// expired nor not yet valid, so that the agent fails with a clear error
+// instead of the generic error of the PDC API. It returns the error of the
+// last token if none can be used, and only logs the invalid tokens otherwise.
+func checkSigningTokens(logger log.Logger, tokens []string, now time.Time) error {
+	errs := make([]error, len(tokens))
+	usable := false
+	var lastErr error
+	for i, token := range tokens {
+		errs[i] = pdc.CheckTokenValidity(token, now)
+		if errs[i] != nil {
+			lastErr = errs[i]
+		} else {
+			usable = true
+		}
+	}
+	if !usable {
+		return lastErr
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			level.Warn(logger).Log("msg", "signing token is not valid, the PDC API will reject it", "token_index", i, "err", err)
+		}
+	}
+	return nil
+}
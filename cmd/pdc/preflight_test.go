@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckGatewayDNS(t *testing.T) {
+	t.Parallel()
+
+	t.Run("bogus cluster, should return a descriptive error", func(t *testing.T) {
+		t.Parallel()
+
+		_, gatewayURL, err := createURLsFromCluster("bogus", "invalid")
+		require.NoError(t, err)
+
+		err = checkGatewayDNS(context.Background(), net.DefaultResolver, gatewayURL.String())
+
+		var dnsErr *net.DNSError
+		assert.ErrorAs(t, err, &dnsErr)
+		assert.ErrorContains(t, err, `cannot resolve PDC gateway host "private-datasource-connect-bogus.invalid", verify the -cluster and -domain flags`)
+	})
+
+	t.Run("host resolves", func(t *testing.T) {
+		t.Parallel()
+
+		assert.NoError(t, checkGatewayDNS(context.Background(), net.DefaultResolver, "localhost"))
+	})
+	t.Run("IPv6 literal is not resolved", func(t *testing.T) {
+		t.Parallel()
+
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errors.New("no dns")
+			},
+		}
+		assert.NoError(t, checkGatewayDNS(context.Background(), resolver, "2001:db8::1"))
+	})
+}
+
+func TestNewResolver(t *testing.T) {
+	t.Parallel()
+
+	t.Run("system resolver by default", func(t *testing.T) {
+		t.Parallel()
+
+		r, err := newResolver("")
+		require.NoError(t, err)
+		assert.Same(t, net.DefaultResolver, r)
+	})
+
+	t.Run("invalid server", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newResolver("host:port:extra")
+		assert.ErrorContains(t, err, `invalid DNS server "host:port:extra"`)
+	})
+
+	t.Run("queries are sent to the server", func(t *testing.T) {
+		t.Parallel()
+
+		// The stub server records the queries it receives, and never answers.
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+		queried := make(chan struct{}, 1)
+		go func() {
+			buf := make([]byte, 512)
+			if _, _, err := conn.ReadFrom(buf); err == nil {
+				queried <- struct{}{}
+			}
+		}()
+
+		r, err := newResolver(conn.LocalAddr().String())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		assert.Error(t, checkGatewayDNS(ctx, r, "gateway.example.com"))
+
+		select {
+		case <-queried:
+		default:
+			t.Fatal("the DNS server was not queried")
+		}
+	})
+}
+
+func TestRetryGatewayDNS(t *testing.T) {
+	t.Parallel()
+
+	// failing returns a check that fails n times, then succeeds, and the
+	// number of calls.
+	failing := func(n int) (func(context.Context) error, *int) {
+		calls := 0
+		return func(context.Context) error {
+			calls++
+			if calls <= n {
+				return &net.DNSError{Err: "server misbehaving", Name: "gateway.example.com", IsTemporary: true}
+			}
+			return nil
+		}, &calls
+	}
+
+	t.Run("succeeds after two failures", func(t *testing.T) {
+		t.Parallel()
+
+		check, calls := failing(2)
+		var buf bytes.Buffer
+		err := retryGatewayDNS(context.Background(), log.NewLogfmtLogger(&buf), 3, time.Millisecond, check)
+
+		require.NoError(t, err)
+		assert.Equal(t, 3, *calls)
+		assert.Equal(t, 2, strings.Count(buf.String(), "gateway host did not resolve, retrying"))
+		assert.Contains(t, buf.String(), "attempt=2")
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		t.Parallel()
+
+		check, calls := failing(10)
+		err := retryGatewayDNS(context.Background(), log.NewNopLogger(), 2, time.Millisecond, check)
+
+		var dnsErr *net.DNSError
+		assert.ErrorAs(t, err, &dnsErr)
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		t.Parallel()
+
+		check, calls := failing(1)
+		assert.Error(t, retryGatewayDNS(context.Background(), log.NewNopLogger(), 0, time.Millisecond, check))
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("context cancelled while waiting", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		check, calls := failing(10)
+		err := retryGatewayDNS(ctx, log.NewNopLogger(), 3, time.Hour, check)
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, *calls)
+	})
+}
+
+func TestCheckSigningTokens(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// An unsigned JWT that expired at 11:00.
+	expired := "eyJhbGciOiJIUzI1NiJ9.eyJleHAiOjE3MTcyMzk2MDB9.c2ln"
+
+	t.Run("all tokens expired", func(t *testing.T) {
+		err := checkSigningTokens(log.NewNopLogger(), []string{expired}, now)
+		assert.EqualError(t, err, "invalid credentials: signing token expired at 2024-06-01T11:00:00Z")
+		assert.Equal(t, exitAuth, exitCode(err))
+	})
+
+	t.Run("an expired token is logged if another one can be used", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, checkSigningTokens(log.NewLogfmtLogger(&buf), []string{expired, "glc_token"}, now))
+		assert.Contains(t, buf.String(), "token_index=0")
+	})
+
+	t.Run("no tokens", func(t *testing.T) {
+		assert.NoError(t, checkSigningTokens(log.NewNopLogger(), nil, now))
+	})
+}
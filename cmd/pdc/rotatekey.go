@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+)
+
+const rotateKeyCommand = "rotate-key"
+
+type rotateKeyFlags struct {
+	MetricsAddr string
+	Auth        metrics.Auth
+	Timeout     time.Duration
+}
+
+func (rf *rotateKeyFlags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&rf.MetricsAddr, "metrics-addr", ":8090", "The metrics server address of the running agent. Use unix:///path/to.sock for a unix socket")
+	fs.StringVar(&rf.Auth.BearerToken, "metrics.auth.token", "", "The bearer token of the metrics server of the running agent, if it requires one")
+	fs.Func("metrics.auth.basic", "The user:password basic auth credentials of the metrics server of the running agent, if it requires them", rf.Auth.SetBasic)
+	fs.DurationVar(&rf.Timeout, "timeout", time.Minute, "How long to wait for the key to be rotated")
+}
+
+// runRotateKey asks a running agent to rotate its key pair, with its
+// /admin/rotate-key endpoint. It returns the exit code.
+func runRotateKey(args []string) int {
+	rf := &rotateKeyFlags{}
+	_, _, err := parseFlags(args, rf.RegisterFlags)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Printf("cannot parse flags: %s\n", err)
+		return exitConfig
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rf.Timeout)
+	defer cancel()
+
+	if err := requestKeyRotation(ctx, rf.MetricsAddr, rf.Auth); err != nil {
+		fmt.Printf("cannot rotate key: %s\n", err)
+		return exitGeneric
+	}
+
+	fmt.Println("key rotated")
+	return exitOK
+}
+
+// requestKeyRotation calls the /admin/rotate-key endpoint of the agent
+// serving metrics on addr, with the credentials of auth.
+func requestKeyRotation(ctx context.Context, addr string, auth metrics.Auth) error {
+	client := &http.Client{}
+	host := addr
+	if socket, ok := strings.CutPrefix(addr, "unix://"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		host = "unix"
+	} else if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+host+"/admin/rotate-key", nil)
+	if err != nil {
+		return err
+	}
+	auth.SetCredentials(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return errors.New("the agent does not serve admin endpoints, run it with -admin.enabled")
+	case http.StatusUnauthorized:
+		return errors.New("the agent rejected the credentials, set -metrics.auth.token or -metrics.auth.basic as the agent does")
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("agent responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+)
+
+func TestRequestKeyRotation(t *testing.T) {
+	cases := []struct {
+		description string
+		handler     http.HandlerFunc
+		wantErr     string
+	}{
+		{
+			description: "key rotated",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "/admin/rotate-key", r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			description: "admin endpoints disabled",
+			handler:     http.NotFound,
+			wantErr:     "-admin.enabled",
+		},
+		{
+			description: "rotation failed",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "key signing request failed", http.StatusInternalServerError)
+			},
+			wantErr: "500 Internal Server Error: key signing request failed",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			ts := httptest.NewServer(tc.handler)
+			defer ts.Close()
+
+			err := requestKeyRotation(context.Background(), strings.TrimPrefix(ts.URL, "http://"), metrics.Auth{})
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRequestKeyRotation_Auth(t *testing.T) {
+	serverAuth := metrics.Auth{BearerToken: "metrics-token", BasicUser: "admin", BasicPassword: "metrics-password"}
+
+	socket := filepath.Join(t.TempDir(), "metrics.sock")
+	ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.NewRegistry(), prometheus.NewRegistry(), "unix://"+socket, false)
+	ms.Handle("/admin/rotate-key", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ms.RequireAuth(serverAuth)
+	require.NoError(t, ms.Start())
+	t.Cleanup(func() { _ = ms.Shutdown(context.Background()) })
+
+	cases := []struct {
+		description string
+		args        []string
+		wantErr     string
+	}{
+		{
+			description: "bearer token",
+			args:        []string{"-metrics.auth.token", "metrics-token"},
+		},
+		{
+			description: "basic auth",
+			args:        []string{"-metrics.auth.basic", "admin:metrics-password"},
+		},
+		{
+			description: "no credentials",
+			wantErr:     "rejected the credentials",
+		},
+		{
+			description: "wrong token",
+			args:        []string{"-metrics.auth.token", "other-token"},
+			wantErr:     "rejected the credentials",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			rf := &rotateKeyFlags{}
+			_, _, err := parseFlags(tc.args, rf.RegisterFlags)
+			require.NoError(t, err)
+
+			err = requestKeyRotation(context.Background(), "unix://"+socket, rf.Auth)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("credentials from the environment", func(t *testing.T) {
+		t.Setenv("GCLOUD_PDC_METRICS_AUTH_BASIC", "admin:metrics-password")
+
+		rf := &rotateKeyFlags{}
+		_, _, err := parseFlags(nil, rf.RegisterFlags)
+		require.NoError(t, err)
+
+		assert.NoError(t, requestKeyRotation(context.Background(), "unix://"+socket, rf.Auth))
+	})
+}
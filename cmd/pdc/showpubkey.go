@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const showPubKeyCommand = "show-pubkey"
+
+// runShowPubKey prints the public key that the agent submits for signing,
+// creating the key pair if needed. It accepts the flags of the agent, so that
+// it can be run with the same command line. It returns the exit code.
+func runShowPubKey(args []string) int {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+
+	usageFn, env, err := parseFlags(args, mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
+	if err != nil {
+		fmt.Printf("cannot parse flags: %s\n", err)
+		return exitConfig
+	}
+	if mf.PrintHelp {
+		usageFn()
+		return exitOK
+	}
+
+	// The public key is the only output on stdout, so that it can be piped.
+	logger := setupLogger(os.Stderr, mf.logLevel(), 0, mf.instanceID())
+	env.log(logger)
+
+	if err := printPubKey(os.Stdout, logger, sshConfig); err != nil {
+		level.Error(logger).Log("msg", "cannot read public key", "err", err)
+		return exitGeneric
+	}
+	return exitOK
+}
+
+// printPubKey writes the public key of the key pair in cfg to w, in OpenSSH
+// format. The key pair is created if it does not exist.
+func printPubKey(w io.Writer, logger log.Logger, cfg *ssh.Config) error {
+	km := ssh.NewKeyManager(cfg, logger, nil)
+	pub, err := km.PublicKey()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(pub)
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestPrintPubKey(t *testing.T) {
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+
+	var out bytes.Buffer
+	require.NoError(t, printPubKey(&out, log.NewNopLogger(), cfg))
+
+	// The printed key is the public key of the private key on disk.
+	printed, _, _, _, err := gossh.ParseAuthorizedKey(out.Bytes())
+	require.NoError(t, err)
+	kb, err := os.ReadFile(cfg.KeyFile)
+	require.NoError(t, err)
+	signer, err := gossh.ParsePrivateKey(kb)
+	require.NoError(t, err)
+	assert.Equal(t, signer.PublicKey().Marshal(), printed.Marshal())
+
+	// No certificate is signed.
+	assert.NoFileExists(t, cfg.CertFile())
+
+	// The existing key pair is reused.
+	var again bytes.Buffer
+	require.NoError(t, printPubKey(&again, log.NewNopLogger(), cfg))
+	assert.Equal(t, out.String(), again.String())
+}
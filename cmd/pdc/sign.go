@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+const signCommand = "sign"
+
+// runSign creates the key pair if needed, has its certificate signed by the
+// PDC API, and prints the paths of the files written, without starting the
+// tunnel. It accepts the flags of the agent, so that the files can be used by
+// an agent run with the same command line. It returns the exit code.
+func runSign(args []string) int {
+	sshConfig := ssh.DefaultConfig()
+	mf := &mainFlags{}
+	pdcClientCfg := &pdc.Config{}
+
+	usageFn, env, err := parseFlags(args, mf.RegisterFlags, sshConfig.RegisterFlags, pdcClientCfg.RegisterFlags)
+	if err != nil {
+		fmt.Printf("cannot parse flags: %s\n", err)
+		return exitConfig
+	}
+	registerLogSecrets(sshConfig, pdcClientCfg)
+	if mf.PrintHelp {
+		usageFn()
+		return exitOK
+	}
+
+	// The paths are the only output on stdout, so that they can be piped.
+	logger := setupLogger(os.Stderr, mf.logLevel(), 0, mf.instanceID())
+	env.log(logger)
+
+	if sshConfig.PreSignedCertFile != "" {
+		level.Error(logger).Log("msg", "nothing to sign, -pre-signed-cert-file is set")
+		return exitConfig
+	}
+
+	applyDiscovery(context.Background(), logger, mf, pdcClientCfg.HostedGrafanaID)
+
+	warnExplicitURLs(logger, mf)
+	if err := configureURLs(mf, sshConfig, pdcClientCfg); err != nil {
+		level.Error(logger).Log("err", err)
+		return exitCode(err)
+	}
+	if err := validateConfig(mf, sshConfig, pdcClientCfg); err != nil {
+		level.Error(logger).Log("msg", "invalid configuration", "err", err)
+		return exitCode(err)
+	}
+	if err := checkSigningTokens(logger, pdcClientCfg.SigningTokens(), time.Now()); err != nil {
+		level.Error(logger).Log("err", err)
+		return exitCode(err)
+	}
+
+	client, err := pdc.NewClient(pdcClientCfg, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "cannot initialise PDC client", "err", err)
+		return exitConfig
+	}
+
+	if err := signCert(context.Background(), os.Stdout, logger, sshConfig, client); err != nil {
+		level.Error(logger).Log("msg", "cannot sign certificate", "err", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+// signCert ensures that the key pair, certificate and known hosts file in cfg
+// exist and are valid, signing a new certificate with client if needed, and
+// writes their paths to w, one per line.
+func signCert(ctx context.Context, w io.Writer, logger log.Logger, cfg *ssh.Config, client pdc.Client) error {
+	if client == nil {
+		return errors.New("no PDC client to sign the certificate")
+	}
+
+	km := ssh.NewKeyManager(cfg, logger, client)
+	if err := km.CreateKeys(ctx, cfg.ForceKeyFileOverwrite); err != nil {
+		return err
+	}
+
+	var paths []string
+	if cfg.PKCS11Module == "" {
+		// The private key of a PKCS#11 token never leaves the token.
+		paths = append(paths, cfg.KeyFile)
+	}
+	paths = append(paths, cfg.KeyFile+".pub", cfg.CertFile(), filepath.Join(cfg.CacheFileDir(), ssh.KnownHostsFile))
+	for _, p := range paths {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// caSigner is a PDC client that signs any public key with its own CA.
+type caSigner struct {
+	ca gossh.Signer
+}
+
+func (c caSigner) SignSSHKey(_ context.Context, key []byte) (*pdc.SigningResponse, error) {
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cert := gossh.Certificate{
+		Key:         pub,
+		CertType:    gossh.UserCert,
+		ValidAfter:  uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, c.ca); err != nil {
+		return nil, err
+	}
+	return &pdc.SigningResponse{
+		Certificate: cert,
+		KnownHosts:  []byte("@cert-authority * " + string(gossh.MarshalAuthorizedKey(c.ca.PublicKey()))),
+	}, nil
+}
+
+func TestSignCert(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh binary is a shell script")
+	}
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := gossh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	spawned := filepath.Join(dir, "spawned")
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\ntouch "+spawned+"\n"), 0o755))
+
+	cfg := ssh.DefaultConfig()
+	cfg.KeyFile = filepath.Join(dir, "grafana_pdc")
+	cfg.SSHBinary = fakeSSH
+	cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+
+	var out bytes.Buffer
+	require.NoError(t, signCert(context.Background(), &out, log.NewNopLogger(), cfg, caSigner{ca: ca}))
+
+	knownHosts := filepath.Join(dir, ssh.KnownHostsFile)
+	assert.Equal(t, []string{cfg.KeyFile, cfg.KeyFile + ".pub", cfg.CertFile(), knownHosts}, strings.Fields(out.String()))
+	for _, p := range strings.Fields(out.String()) {
+		assert.FileExists(t, p)
+	}
+
+	// The certificate is signed for the key pair on disk.
+	cb, err := os.ReadFile(cfg.CertFile())
+	require.NoError(t, err)
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(cb)
+	require.NoError(t, err)
+	cert, ok := pub.(*gossh.Certificate)
+	require.True(t, ok)
+	assert.Equal(t, ca.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+
+	// The tunnel is not started.
+	assert.NoFileExists(t, spawned)
+}
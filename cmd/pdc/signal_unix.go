@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpStateSignals are the signals that make the agent log its state.
+var dumpStateSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// dumpStateSignals are the signals that make the agent log its state. There
+// is no SIGUSR1 on Windows.
+var dumpStateSignals []os.Signal
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// stopFilePollInterval is how often the stop file is checked for.
+const stopFilePollInterval = time.Second
+
+// stopOnFile checks for the file at path every interval, until ctx is done.
+// Once the file exists, it removes it, so that the agent is not stopped again
+// when it is restarted, and calls stop to shut the agent down as on SIGTERM.
+func stopOnFile(ctx context.Context, logger log.Logger, path string, interval time.Duration, stop func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			level.Info(logger).Log("msg", "stop file found, shutting down", "path", path)
+			if err := os.Remove(path); err != nil {
+				level.Warn(logger).Log("msg", "could not remove stop file", "path", path, "err", err)
+			}
+			stop()
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopOnFile(t *testing.T) {
+	t.Run("creating the file shuts the agent down gracefully", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "stop")
+		var logs bytes.Buffer
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go stopOnFile(ctx, log.NewLogfmtLogger(&logs), path, 10*time.Millisecond, stop)
+
+		// The agent runs until its context is done, and then shuts down.
+		done := make(chan error)
+		go func() {
+			<-ctx.Done()
+			done <- nil
+		}()
+
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("agent was not stopped")
+		}
+		assert.ErrorIs(t, ctx.Err(), context.Canceled)
+		assert.Contains(t, logs.String(), "stop file found, shutting down")
+		assert.NoFileExists(t, path, "stop file must be removed")
+	})
+
+	t.Run("returns when the agent stops", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := false
+		returned := make(chan struct{})
+		go func() {
+			stopOnFile(ctx, log.NewNopLogger(), filepath.Join(t.TempDir(), "stop"), 10*time.Millisecond, func() { stopped = true })
+			close(returned)
+		}()
+
+		cancel()
+		select {
+		case <-returned:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stopOnFile did not return")
+		}
+		assert.False(t, stopped)
+	})
+}
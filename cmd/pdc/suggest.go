@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// undefinedFlagPrefix starts the error of the flag package for unknown flags.
+const undefinedFlagPrefix = "flag provided but not defined: -"
+
+// maxSuggestionDistance is the largest edit distance between an unknown flag
+// and a defined one for it to be suggested. Short names get fewer edits, so
+// that unrelated short flags are not suggested.
+func maxSuggestionDistance(name string) int {
+	return min(2, len(name)/3)
+}
+
+// withFlagSuggestion adds the closest defined flag to the error of an unknown
+// flag, if there is one close enough.
+func withFlagSuggestion(fs *flag.FlagSet, err error) error {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	name, ok := strings.CutPrefix(err.Error(), undefinedFlagPrefix)
+	if !ok {
+		return err
+	}
+	if s := suggestFlag(fs, name); s != "" {
+		return fmt.Errorf("%w, did you mean -%s?", err, s)
+	}
+	return err
+}
+
+// suggestFlag returns the name of the defined flag closest to name, or "" if
+// none is close enough.
+func suggestFlag(fs *flag.FlagSet, name string) string {
+	best, bestDist := "", maxSuggestionDistance(name)+1
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := levenshtein(name, f.Name); d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	return best
+}
+
+// levenshtein returns the number of single character insertions, deletions
+// and substitutions needed to change a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
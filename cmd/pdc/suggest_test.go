@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"cluster", "cluster", 0},
+		{"clustr", "cluster", 1},
+		{"tokne", "token", 2},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range cases {
+		assert.Equal(t, tt.want, levenshtein(tt.a, tt.b), "%q %q", tt.a, tt.b)
+	}
+}
+
+func TestParseFlags_Suggestion(t *testing.T) {
+	cases := []struct {
+		description string
+		args        []string
+		wantErr     string
+	}{
+		{
+			description: "near miss",
+			args:        []string{"-clustr", "prod-us-east-0"},
+			wantErr:     "flag provided but not defined: -clustr, did you mean -cluster?",
+		},
+		{
+			description: "near miss with a value",
+			args:        []string{"-ssh.control-mastr=true"},
+			wantErr:     "flag provided but not defined: -ssh.control-mastr, did you mean -ssh.control-master?",
+		},
+		{
+			description: "nothing close",
+			args:        []string{"-completely-unknown"},
+			wantErr:     "flag provided but not defined: -completely-unknown",
+		},
+		{
+			description: "short flags are not suggested",
+			args:        []string{"-o", "Foo=bar"},
+			wantErr:     "flag provided but not defined: -o",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			mf := &mainFlags{}
+			sshCfg := ssh.DefaultConfig()
+			pdcCfg := &pdc.Config{}
+			_, _, err := parseFlags(tt.args, mf.RegisterFlags, sshCfg.RegisterFlags, pdcCfg.RegisterFlags)
+			require.Error(t, err)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
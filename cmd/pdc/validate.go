@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// validateConfig checks the resolved configuration of the agent, once the
+// URLs are set, including the settings that depend on each other across the
+// configs. All the problems found are returned in one configuration error,
+// so that they can be fixed at once.
+func validateConfig(mf *mainFlags, sshConfig *ssh.Config, pdcConfig *pdc.Config) error {
+	var errs []error
+	if mf.DevMode && (mf.APIURL != "" || mf.GatewayURL != "") {
+		errs = append(errs, errors.New("-pdc.api-url and -ssh.gateway-url cannot be used with -dev-mode, which connects to -dev.host"))
+	}
+	if mf.DevMode && mf.FallbackGatewayURL != "" {
+		errs = append(errs, errors.New("-ssh.fallback-gateway-url cannot be used with -dev-mode"))
+	}
+	if !mf.DevMode && mf.Cluster == "" && (mf.APIURL == "" || mf.GatewayURL == "") {
+		errs = append(errs, errors.New("-cluster is required, unless both -pdc.api-url and -ssh.gateway-url are set"))
+	}
+	if !mf.DevMode && sshConfig.PreSignedCertFile == "" && len(pdcConfig.SigningTokens()) == 0 {
+		errs = append(errs, errors.New("-token is required to sign certificates, set it or the GCLOUD_PDC_SIGNING_TOKEN environment variable, unless -pre-signed-cert-file is set"))
+	}
+	if mf.StartupDNSRetries < 0 {
+		errs = append(errs, fmt.Errorf("-startup.dns-retries must not be negative, got %d", mf.StartupDNSRetries))
+	}
+	if mf.LogHeartbeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("-log.heartbeat-interval must not be negative, got %s", mf.LogHeartbeatInterval))
+	}
+	if mf.HookTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-hook.timeout must not be negative, got %s", mf.HookTimeout))
+	}
+	if mf.MaxLifetime < 0 {
+		errs = append(errs, fmt.Errorf("-max-lifetime must not be negative, got %s", mf.MaxLifetime))
+	}
+	errs = append(errs, sshConfig.Validate(), pdcConfig.Validate())
+	return configError(errors.Join(errs...))
+}
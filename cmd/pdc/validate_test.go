@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// resolvedConfig parses args as the agent does, and sets the URLs.
+func resolvedConfig(t *testing.T, args ...string) (*mainFlags, *ssh.Config, *pdc.Config) {
+	t.Helper()
+	mf := &mainFlags{}
+	sshCfg := ssh.DefaultConfig()
+	pdcCfg := &pdc.Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	mf.RegisterFlags(fs)
+	sshCfg.RegisterFlags(fs)
+	pdcCfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse(args))
+	require.NoError(t, configureURLs(mf, sshCfg, pdcCfg))
+	return mf, sshCfg, pdcCfg
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := []string{"-token", "token", "-gcloud-hosted-grafana-id", "1", "-cluster", "prod-us-east-0"}
+
+	testcases := []struct {
+		name    string
+		args    []string
+		wantErr []string
+	}{
+		{
+			name: "valid",
+			args: valid,
+		},
+		{
+			name: "explicit URLs without cluster",
+			args: []string{"-token", "token", "-gcloud-hosted-grafana-id", "1", "-pdc.api-url", "https://api.example.com", "-ssh.gateway-url", "gateway.example.com"},
+		},
+		{
+			name: "pre-signed certificate without token",
+			args: []string{"-gcloud-hosted-grafana-id", "1", "-cluster", "prod-us-east-0", "-pre-signed-cert-file", "cert.pub"},
+		},
+		{
+			name:    "missing cluster",
+			args:    []string{"-token", "token", "-gcloud-hosted-grafana-id", "1", "-pdc.api-url", "https://api.example.com"},
+			wantErr: []string{"-cluster is required"},
+		},
+		{
+			name:    "dev mode with explicit URLs",
+			args:    []string{"-gcloud-hosted-grafana-id", "1", "-dev-mode", "-ssh.gateway-url", "gateway.example.com"},
+			wantErr: []string{"cannot be used with -dev-mode"},
+		},
+		{
+			name:    "missing token",
+			args:    []string{"-gcloud-hosted-grafana-id", "1", "-cluster", "prod-us-east-0"},
+			wantErr: []string{"-token is required"},
+		},
+		{
+			name:    "expiry window longer than the certificate lifetime",
+			args:    append([]string{"-cert-ttl", "5m", "-cert-expiry-window", "10m"}, valid...),
+			wantErr: []string{"-cert-expiry-window 10m0s must be less than -cert-ttl 5m0s"},
+		},
+		{
+			name:    "PKCS#11 PIN without module",
+			args:    append([]string{"-ssh.pkcs11-pin", "1234"}, valid...),
+			wantErr: []string{"-ssh.pkcs11-pin is set, but -ssh.pkcs11-module is not"},
+		},
+		{
+			name: "all problems are reported at once",
+			args: []string{"-gcloud-hosted-grafana-id", "1", "-startup.dns-retries", "-1", "-ssh.port", "0", "-retrymax", "-1", "-max-lifetime", "-1s", "-hook.timeout", "-1s"},
+			wantErr: []string{
+				"-cluster is required",
+				"-token is required",
+				"-startup.dns-retries must not be negative",
+				"-hook.timeout must not be negative",
+				"-max-lifetime must not be negative",
+				"invalid ssh port 0",
+				"-retrymax must not be negative",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mf, sshCfg, pdcCfg := resolvedConfig(t, tc.args...)
+			err := validateConfig(mf, sshCfg, pdcCfg)
+			if len(tc.wantErr) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, exitConfig, exitCode(err))
+			for _, want := range tc.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
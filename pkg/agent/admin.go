@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/logging"
+)
+
+type certRenewer interface {
+	RenewCert(ctx context.Context) error
+}
+
+type keyRotator interface {
+	RotateKey(ctx context.Context) error
+}
+
+// renewCertHandler returns a handler that signs a new certificate when it
+// receives a POST request.
+func renewCertHandler(logger log.Logger, r certRenewer) http.Handler {
+	return postHandler(logger, "could not renew certificate", r.RenewCert)
+}
+
+// rotateKeyHandler returns a handler that rotates the key pair when it
+// receives a POST request.
+func rotateKeyHandler(logger log.Logger, r keyRotator) http.Handler {
+	return postHandler(logger, "could not rotate key", r.RotateKey)
+}
+
+// postHandler returns a handler that calls fn on POST requests, and responds
+// with 204 if it succeeds.
+func postHandler(logger log.Logger, errMsg string, fn func(ctx context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := fn(req.Context()); err != nil {
+			level.Error(logger).Log("msg", errMsg, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// logsHandler returns a handler that serves the recent log lines, oldest first.
+func logsHandler(lines *logging.RingBuffer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if lines == nil {
+			return
+		}
+		for _, l := range lines.Lines() {
+			_, _ = io.WriteString(w, l+"\n")
+		}
+	})
+}
+
+// status is the JSON response of /admin/status.
+type status struct {
+	TunnelState          string     `json:"tunnel_state"`
+	ConnectedConnections int        `json:"connected_connections"`
+	Reconnects           int64      `json:"reconnects"`
+	LastError            *lastError `json:"last_error,omitempty"`
+	Cert                 certStatus `json:"cert"`
+	Cluster              string     `json:"cluster"`
+	Domain               string     `json:"domain"`
+	APIURL               string     `json:"api_url"`
+	Gateway              string     `json:"gateway"`
+	Version              string     `json:"version"`
+	UptimeSeconds        int64      `json:"uptime_seconds"`
+}
+
+type lastError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// certStatus is the validity window and the principals of the certificate,
+// or the error reading it.
+type certStatus struct {
+	ValidAfter  *time.Time `json:"valid_after,omitempty"`
+	ValidBefore *time.Time `json:"valid_before,omitempty"`
+	Principals  []string   `json:"principals,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func newStatus(st State) status {
+	s := status{
+		TunnelState:          st.TunnelState,
+		ConnectedConnections: st.ConnectedConnections,
+		Reconnects:           st.Reconnects,
+		Cluster:              st.Cluster,
+		Domain:               st.Domain,
+		APIURL:               st.APIURL,
+		Gateway:              st.Gateway,
+		Version:              st.Version,
+		UptimeSeconds:        int64(st.Uptime.Seconds()),
+	}
+	if st.LastErr != nil {
+		s.LastError = &lastError{Message: st.LastErr.Error(), Time: st.LastErrAt.UTC()}
+	}
+	if st.CertErr != nil {
+		s.Cert.Error = st.CertErr.Error()
+	} else {
+		validAfter, validBefore := st.CertValidAfter.UTC(), st.CertValidBefore.UTC()
+		s.Cert.ValidAfter, s.Cert.ValidBefore = &validAfter, &validBefore
+		s.Cert.Principals = st.CertPrincipals
+	}
+	return s
+}
+
+// statusHandler returns a handler that serves the live state of the agent as
+// JSON. It is the programmatic counterpart of the state logged on SIGUSR1.
+func statusHandler(logger log.Logger, state func() State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newStatus(state())); err != nil {
+			level.Warn(logger).Log("msg", "could not write status", "err", err)
+		}
+	})
+}
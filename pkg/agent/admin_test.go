@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogsHandler(t *testing.T) {
+	t.Parallel()
+
+	lines := logging.NewRingBuffer(2)
+	logger := level.NewFilter(log.NewLogfmtLogger(lines), level.AllowInfo())
+
+	level.Info(logger).Log("msg", "first")
+	level.Info(logger).Log("msg", "second")
+	level.Info(logger).Log("msg", "third")
+
+	rec := httptest.NewRecorder()
+	logsHandler(lines).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/logs", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Regexp(t, `^level=info msg=second\nlevel=info msg=third\n$`, rec.Body.String())
+}
+
+func TestStatusHandler(t *testing.T) {
+	t.Parallel()
+
+	validAfter := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		name  string
+		state State
+		want  string
+	}{
+		{
+			name: "connected",
+			state: State{
+				TunnelState:          ssh.StateConnected,
+				ConnectedConnections: 2,
+				Reconnects:           1,
+				LastErr:              errors.New("ssh client exited: exit status 255"),
+				LastErrAt:            validAfter.Add(time.Minute),
+				CertValidAfter:       validAfter,
+				CertValidBefore:      validAfter.Add(time.Hour),
+				CertPrincipals:       []string{"1", "team-a"},
+				Cluster:              "prod-us-east-0",
+				Domain:               "grafana.net",
+				APIURL:               "https://private-datasource-connect-api-prod-us-east-0.grafana.net",
+				Gateway:              "private-datasource-connect-prod-us-east-0.grafana.net:22",
+				Version:              "v1.0.0",
+				Uptime:               90*time.Second + 400*time.Millisecond,
+			},
+			want: `{
+				"tunnel_state": "Connected",
+				"connected_connections": 2,
+				"reconnects": 1,
+				"last_error": {"message": "ssh client exited: exit status 255", "time": "2024-06-01T10:01:00Z"},
+				"cert": {"valid_after": "2024-06-01T10:00:00Z", "valid_before": "2024-06-01T11:00:00Z", "principals": ["1", "team-a"]},
+				"cluster": "prod-us-east-0",
+				"domain": "grafana.net",
+				"api_url": "https://private-datasource-connect-api-prod-us-east-0.grafana.net",
+				"gateway": "private-datasource-connect-prod-us-east-0.grafana.net:22",
+				"version": "v1.0.0",
+				"uptime_seconds": 90
+			}`,
+		},
+		{
+			name: "no certificate and no error yet",
+			state: State{
+				TunnelState: ssh.StateIdle,
+				CertErr:     errors.New("open key-cert.pub: no such file or directory"),
+			},
+			want: `{
+				"tunnel_state": "Idle",
+				"connected_connections": 0,
+				"reconnects": 0,
+				"cert": {"error": "open key-cert.pub: no such file or directory"},
+				"cluster": "",
+				"domain": "",
+				"api_url": "",
+				"gateway": "",
+				"version": "",
+				"uptime_seconds": 0
+			}`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := statusHandler(log.NewNopLogger(), func() State { return tc.state })
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			assert.JSONEq(t, tc.want, rec.Body.String())
+		})
+	}
+
+	t.Run("only GET is allowed", func(t *testing.T) {
+		t.Parallel()
+
+		h := statusHandler(log.NewNopLogger(), func() State { return State{} })
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/status", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+}
@@ -0,0 +1,291 @@
+// Package agent runs the PDC agent: it signs a certificate with the PDC API,
+// keeps an ssh tunnel open to the PDC gateway, and serves metrics. It can be
+// embedded in other programs.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/hooks"
+	"github.com/grafana/pdc-agent/pkg/logging"
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+var tracer = otel.Tracer("github.com/grafana/pdc-agent/pkg/agent")
+
+// Config is the configuration of the agent. The ssh and PDC configs must be
+// fully populated, including the gateway and PDC API URLs.
+type Config struct {
+	SSH *ssh.Config
+	PDC *pdc.Config
+
+	// Cluster and Domain identify the PDC cluster in traces and events.
+	Cluster string
+	Domain  string
+	// InstanceID tells this agent apart from others in pushed metrics.
+	InstanceID string
+
+	// EventsFile is a file or named pipe that tunnel events are appended to.
+	EventsFile string
+	// Hooks are the executables run on tunnel events.
+	Hooks HooksConfig
+
+	// AdminEnabled exposes admin endpoints on the metrics server. It requires
+	// a metrics address.
+	AdminEnabled bool
+	// LogLines are the recent log lines served by /admin/logs.
+	LogLines *logging.RingBuffer
+
+	// Registerer is where New registers the agent metrics, i.e. the tunnel
+	// metrics of ssh.Collectors and the info metric, with the SSH.MetricsPrefix
+	// prefix and a Cluster label. If nil, they are registered on
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+	// Gatherer is what the metrics server serves and the pusher pushes. If
+	// nil, it is the Registerer if that is also a Gatherer, e.g. a
+	// *prometheus.Registry, or prometheus.DefaultGatherer if the Registerer
+	// is nil too.
+	Gatherer prometheus.Gatherer
+}
+
+// HooksConfig configures the executables that are run when the tunnel
+// connects or disconnects. Empty paths run nothing.
+type HooksConfig struct {
+	OnConnect    string
+	OnDisconnect string
+	// Timeout is how long a hook can run before it is killed.
+	Timeout time.Duration
+}
+
+// Agent is a PDC agent.
+type Agent struct {
+	cfg    Config
+	logger log.Logger
+
+	events    *events.Writer
+	hooks     *hooks.Runner
+	km        *ssh.KeyManager
+	sshClient *ssh.Client
+
+	// started is when the agent was created, for its uptime.
+	started time.Time
+	// startSpan traces the startup, from the creation of the agent until
+	// the tunnel is started by Run.
+	startSpan trace.Span
+}
+
+// New returns an agent for cfg. It does not connect to anything until Run is
+// called.
+func New(cfg Config, logger log.Logger) (_ *Agent, err error) {
+	if cfg.SSH == nil || cfg.PDC == nil {
+		return nil, errors.New("ssh and PDC configs are required")
+	}
+	if cfg.AdminEnabled && cfg.SSH.MetricsAddr == "" {
+		return nil, errors.New("admin endpoints are served by the metrics server, which is disabled because the metrics address is empty")
+	}
+
+	// The startup trace begins here, so that creating the PDC client is
+	// traced with the rest of the startup. Run ends it.
+	startCtx, startSpan := tracer.Start(context.Background(), "start agent", trace.WithAttributes(
+		attribute.String("cluster", cfg.Cluster),
+		attribute.String("domain", cfg.Domain),
+	))
+	defer func() {
+		if err != nil {
+			startSpan.RecordError(err)
+			startSpan.SetStatus(codes.Error, err.Error())
+			startSpan.End()
+		}
+	}()
+
+	// The PDC API is not used to sign certificates when a pre-signed
+	// certificate is provided.
+	var pdcClient pdc.Client
+	if cfg.SSH.PreSignedCertFile == "" {
+		_, span := tracer.Start(startCtx, "create pdc client")
+		pdcClient, err = pdc.NewClient(cfg.PDC, logger)
+		span.End()
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialise PDC client: %w", err)
+		}
+	}
+
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+		if cfg.Gatherer == nil {
+			cfg.Gatherer = prometheus.DefaultGatherer
+		}
+	}
+	if cfg.Gatherer == nil {
+		g, ok := cfg.Registerer.(prometheus.Gatherer)
+		if !ok {
+			return nil, errors.New("a Gatherer is required when the Registerer is not one")
+		}
+		cfg.Gatherer = g
+	}
+	if err := metrics.Register(cfg.Registerer, cfg.SSH.MetricsPrefix, cfg.Cluster, ssh.Collectors()...); err != nil {
+		return nil, err
+	}
+
+	a := &Agent{cfg: cfg, logger: logger, started: time.Now(), startSpan: startSpan}
+
+	if cfg.EventsFile != "" {
+		ev, err := events.OpenFile(cfg.EventsFile, cfg.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open events file: %w", err)
+		}
+		a.events = ev
+		cfg.SSH.Events = ev
+	}
+
+	if cfg.Hooks.OnConnect != "" || cfg.Hooks.OnDisconnect != "" {
+		a.hooks = hooks.NewRunner(logger, cfg.Cluster, cfg.Hooks.OnConnect, cfg.Hooks.OnDisconnect, cfg.Hooks.Timeout)
+		cfg.SSH.Hooks = a.hooks
+	}
+
+	a.km = ssh.NewKeyManager(cfg.SSH, logger, pdcClient)
+	a.sshClient = ssh.NewClient(cfg.SSH, logger, a.km)
+	return a, nil
+}
+
+// Run starts the tunnel and the metrics server, unless the metrics address is
+// empty, and blocks until ctx is done and they are stopped. It returns an
+// error if the tunnel cannot be started, if the metrics server cannot listen
+// and its bind failure mode is fatal, or if the tunnel stops on its own, e.g.
+// with ssh.ErrConnectionLimitReached.
+func (a *Agent) Run(ctx context.Context) error {
+	defer func() { _ = a.events.Close() }()
+	// Let the disconnect hook finish before returning.
+	defer a.hooks.Wait()
+	// Metrics are pushed from the start, and once more when the tunnel is
+	// stopped, so that agents that fail to start are also reported.
+	defer a.startMetricsPusher()()
+
+	// The start context carries the span started by New, so that the
+	// certificate signing and the tunnel establishment are traced as part of
+	// the startup.
+	startCtx := trace.ContextWithSpan(ctx, a.startSpan)
+	err := services.StartAndAwaitRunning(startCtx, a.sshClient)
+	if err != nil {
+		a.startSpan.RecordError(err)
+		a.startSpan.SetStatus(codes.Error, err.Error())
+	}
+	a.startSpan.End()
+	if err != nil {
+		level.Error(a.logger).Log("msg", fmt.Sprintf("cannot start ssh client: %s", err))
+		return err
+	}
+
+	// If ssh client start successfully, start the metrics server
+	ms, err := a.startMetricsServer()
+	if err != nil {
+		a.sshClient.StopAsync()
+		_ = a.sshClient.AwaitTerminated(context.Background())
+		return err
+	}
+
+	// Stop the ssh client when ctx is done
+	go func() {
+		<-ctx.Done()
+		a.sshClient.StopAsync()
+	}()
+
+	// Wait for the ssh client to exit
+	_ = a.sshClient.AwaitTerminated(context.Background())
+
+	if ms != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ms.Shutdown(shutdownCtx); err != nil {
+			level.Warn(a.logger).Log("msg", "could not stop metrics server", "err", err)
+		}
+	}
+
+	// The ssh client fails if it stops on its own, e.g. because the
+	// connection limit is reached.
+	return a.sshClient.FailureCase()
+}
+
+// startMetricsServer starts the metrics server, with the admin endpoints if
+// they are enabled. It returns nil if the metrics server is disabled, or if it
+// cannot listen and the bind failure mode is warn. With the fatal mode, the
+// listen error is returned.
+func (a *Agent) startMetricsServer() (*metrics.Server, error) {
+	if a.cfg.SSH.MetricsAddr == "" {
+		level.Info(a.logger).Log("msg", "metrics server disabled")
+		return nil, nil
+	}
+
+	ms := metrics.NewMetricsServer(a.logger, a.cfg.Registerer, a.cfg.Gatherer, a.cfg.SSH.MetricsAddr, a.cfg.SSH.MetricsOpenMetrics)
+	ms.RequireAuth(a.cfg.SSH.MetricsAuth)
+	if a.cfg.AdminEnabled {
+		ms.Handle("/admin/renew-cert", renewCertHandler(a.logger, a))
+		ms.Handle("/admin/rotate-key", rotateKeyHandler(a.logger, a))
+		ms.Handle("/admin/logs", logsHandler(a.cfg.LogLines))
+		ms.Handle("/admin/status", statusHandler(a.logger, a.State))
+	}
+	if err := ms.Start(); err != nil {
+		if a.cfg.SSH.MetricsBindFailureMode == metrics.BindFailureFatal {
+			level.Error(a.logger).Log("msg", "cannot start metrics server", "err", err)
+			return nil, err
+		}
+		level.Warn(a.logger).Log("msg", "cannot start metrics server, running without metrics", "err", err)
+		return nil, nil
+	}
+	return ms, nil
+}
+
+// startMetricsPusher pushes metrics to the Pushgateway, if its URL is set.
+// It returns a function that stops pushing after a final push.
+func (a *Agent) startMetricsPusher() func() {
+	if a.cfg.SSH.MetricsPushURL == "" {
+		return func() {}
+	}
+
+	p := metrics.NewPusher(a.logger, a.cfg.Gatherer, a.cfg.SSH.MetricsPushURL, a.cfg.InstanceID, a.cfg.SSH.MetricsPushInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// RenewCert signs a new certificate, without restarting the tunnel.
+func (a *Agent) RenewCert(ctx context.Context) error {
+	return a.km.RenewCert(ctx)
+}
+
+// RotateKey replaces the key pair and its certificate, and reconnects the
+// tunnel with the new key.
+func (a *Agent) RotateKey(ctx context.Context) error {
+	if err := a.km.RotateKey(ctx); err != nil {
+		return err
+	}
+	a.sshClient.Reconnect()
+	return nil
+}
+
+// TunnelState returns the state of the tunnel, e.g. "Connected".
+func (a *Agent) TunnelState() string {
+	return a.sshClient.TunnelState()
+}
@@ -0,0 +1,538 @@
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/agent"
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use, for the logs
+// of agent goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestConfig returns an agent config for a fake PDC API and gateway, and
+// the path of the file the fake gateway writes the ssh arguments to once it
+// is connected to.
+func newTestConfig(t *testing.T) (agent.Config, string) {
+	t.Helper()
+	dir := t.TempDir()
+	connected := filepath.Join(dir, "connected")
+
+	// The fake gateway is an ssh binary that records that it was run, and
+	// stays connected until it is killed.
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\necho \"$@\" > "+connected+"\nexec sleep 60\n"), 0o755))
+
+	api := newFakePDCAPI(t)
+
+	apiURL, err := url.Parse(api.URL)
+	require.NoError(t, err)
+
+	sshCfg := ssh.DefaultConfig()
+	sshCfg.SSHBinary = fakeSSH
+	sshCfg.SkipSSHValidation = true
+	sshCfg.KeyFile = filepath.Join(dir, "key")
+	sshCfg.URL = &url.URL{Path: "gateway.example.com"}
+	sshCfg.MetricsAddr = "127.0.0.1:0"
+	sshCfg.MetricsPrefix = metrics.DefaultPrefix
+	pdcCfg := &pdc.Config{URL: apiURL, HostedGrafanaID: "1"}
+	sshCfg.PDC = *pdcCfg
+
+	return agent.Config{
+		SSH:        sshCfg,
+		PDC:        pdcCfg,
+		Cluster:    "test",
+		EventsFile: filepath.Join(dir, "events"),
+	}, connected
+}
+
+func TestAgent_Run(t *testing.T) {
+	cfg, connected := newTestConfig(t)
+	sshCfg := cfg.SSH
+
+	a, err := agent.New(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+
+	// The certificate is signed, and the gateway is connected to with it.
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(connected)
+		return err == nil && len(b) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, sshCfg.KeyFile+"-cert.pub")
+	assert.Equal(t, []string{"1", "team-a"}, a.State().CertPrincipals)
+
+	b, err := os.ReadFile(connected)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "1@gateway.example.com")
+
+	// Rotating the key reconnects to the gateway with the new key.
+	key, err := os.ReadFile(sshCfg.KeyFile)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(connected))
+	require.NoError(t, a.RotateKey(ctx))
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(connected)
+		return err == nil && len(b) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	rotated, err := os.ReadFile(sshCfg.KeyFile)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, rotated)
+
+	// The agent stops when the context is canceled.
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	assert.Equal(t, ssh.StateTerminating, a.TunnelState())
+}
+
+func TestAgent_Run_ServesMetrics(t *testing.T) {
+	testcases := []struct {
+		name     string
+		registry *prometheus.Registry
+		// wantGo is whether the Go runtime metrics of the default registry
+		// are served.
+		wantGo bool
+	}{
+		{name: "default registry", wantGo: true},
+		{name: "custom registry", registry: prometheus.NewRegistry()},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, connected := newTestConfig(t)
+			socket := filepath.Join(t.TempDir(), "metrics.sock")
+			cfg.SSH.MetricsAddr = "unix://" + socket
+			if tc.registry != nil {
+				cfg.Registerer = tc.registry
+			}
+
+			a, err := agent.New(cfg, log.NewNopLogger())
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- a.Run(ctx) }()
+
+			assert.Eventually(t, func() bool {
+				b, err := os.ReadFile(connected)
+				return err == nil && len(b) > 0
+			}, 5*time.Second, 10*time.Millisecond)
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socket)
+					},
+				},
+			}
+			var body string
+			require.Eventually(t, func() bool {
+				resp, err := client.Get("http://unix/metrics")
+				if err != nil {
+					return false
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				body = string(b)
+				return err == nil && resp.StatusCode == http.StatusOK
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// The tunnel metrics are served with the cluster label.
+			assert.Regexp(t, `\npdc_agent_cert_sign_success_total\{cluster="test"\} [1-9]`, body)
+			assert.Contains(t, body, `pdc_agent_tunnel_connected_connections{cluster="test"}`)
+			assert.Equal(t, tc.wantGo, strings.Contains(body, "go_goroutines"))
+
+			cancel()
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("agent did not stop")
+			}
+		})
+	}
+}
+
+func TestAgent_Run_MetricsDisabled(t *testing.T) {
+	cfg, connected := newTestConfig(t)
+	cfg.SSH.MetricsAddr = ""
+
+	var buf syncBuffer
+	a, err := agent.New(cfg, log.NewLogfmtLogger(&buf))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(connected)
+		return err == nil && len(b) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+
+	// No listener was opened, and no server was stopped.
+	assert.Contains(t, buf.String(), "metrics server disabled")
+	assert.NotContains(t, buf.String(), "Starting serving metrics")
+	assert.NotContains(t, buf.String(), "Stopping serving metrics")
+}
+
+func TestAgent_Run_MetricsPortBound(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		wantErr bool
+		wantLog string
+	}{
+		{mode: metrics.BindFailureWarn, wantLog: "running without metrics"},
+		{mode: metrics.BindFailureFatal, wantErr: true, wantLog: "cannot start metrics server"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			cfg, connected := newTestConfig(t)
+			cfg.SSH.MetricsAddr = ln.Addr().String()
+			cfg.SSH.MetricsBindFailureMode = tc.mode
+
+			var buf syncBuffer
+			a, err := agent.New(cfg, log.NewLogfmtLogger(&buf))
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() { done <- a.Run(ctx) }()
+
+			if tc.wantErr {
+				// The agent stops the tunnel, and returns the bind error.
+				select {
+				case err := <-done:
+					assert.ErrorContains(t, err, "address already in use")
+				case <-time.After(5 * time.Second):
+					t.Fatal("agent did not stop")
+				}
+				assert.Equal(t, ssh.StateTerminating, a.TunnelState())
+				assert.Contains(t, buf.String(), tc.wantLog)
+				return
+			}
+
+			// The tunnel keeps running without the metrics server.
+			assert.Eventually(t, func() bool {
+				b, err := os.ReadFile(connected)
+				return err == nil && len(b) > 0
+			}, 5*time.Second, 10*time.Millisecond)
+
+			cancel()
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("agent did not stop")
+			}
+			assert.Contains(t, buf.String(), tc.wantLog)
+		})
+	}
+}
+
+func TestAgent_Run_MetricsPush(t *testing.T) {
+	var mu sync.Mutex
+	var pushes []string
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pushes = append(pushes, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+	}))
+	defer pushgateway.Close()
+
+	cfg, connected := newTestConfig(t)
+	cfg.InstanceID = "agent-1"
+	cfg.SSH.MetricsPushURL = pushgateway.URL
+	cfg.SSH.MetricsPushInterval = 0
+
+	a, err := agent.New(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(connected)
+		return err == nil && len(b) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+
+	// The metrics are pushed once the agent is stopped.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"PUT /metrics/job/pdc-agent/instance/agent-1"}, pushes)
+}
+
+func TestAgent_State(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.PDC.URL.User = url.UserPassword("user", "secret")
+	cfg.PDC.URL.RawQuery = "token=secret"
+	cfg.SSH.Port = 2222
+
+	a, err := agent.New(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	st := a.State()
+	assert.Equal(t, ssh.StateIdle, st.TunnelState)
+	assert.NotContains(t, st.APIURL, "secret")
+	assert.Equal(t, "http://"+cfg.PDC.URL.Host, st.APIURL)
+	assert.Equal(t, "gateway.example.com:2222", st.Gateway)
+	assert.Equal(t, "test", st.Cluster)
+	assert.NoError(t, st.LastErr, "no connection has failed yet")
+	assert.Error(t, st.CertErr, "no certificate has been signed yet")
+}
+
+func TestNew(t *testing.T) {
+	t.Run("configs are required", func(t *testing.T) {
+		_, err := agent.New(agent.Config{}, log.NewNopLogger())
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid PDC config", func(t *testing.T) {
+		_, err := agent.New(agent.Config{SSH: ssh.DefaultConfig(), PDC: &pdc.Config{}}, log.NewNopLogger())
+		assert.ErrorContains(t, err, "cannot initialise PDC client")
+	})
+
+	t.Run("admin endpoints require the metrics server", func(t *testing.T) {
+		cfg, _ := newTestConfig(t)
+		cfg.SSH.MetricsAddr = ""
+		cfg.AdminEnabled = true
+		_, err := agent.New(cfg, log.NewNopLogger())
+		assert.ErrorContains(t, err, "the metrics server")
+	})
+
+	t.Run("metrics are registered on the registerer", func(t *testing.T) {
+		cfg, _ := newTestConfig(t)
+		cfg.SSH.MetricsPrefix = "team_a_pdc"
+		reg := prometheus.NewRegistry()
+		cfg.Registerer = reg
+		_, err := agent.New(cfg, log.NewNopLogger())
+		require.NoError(t, err)
+
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		// clusters is the cluster label of each metric, by metric name.
+		clusters := map[string]string{}
+		for _, mf := range mfs {
+			for _, lp := range mf.GetMetric()[0].GetLabel() {
+				if lp.GetName() == "cluster" {
+					clusters[mf.GetName()] = lp.GetValue()
+				}
+			}
+		}
+		assert.Equal(t, "test", clusters["team_a_pdc_cert_sign_success_total"])
+	})
+
+	t.Run("a registerer that is not a gatherer requires a gatherer", func(t *testing.T) {
+		cfg, _ := newTestConfig(t)
+		cfg.Registerer = prometheus.WrapRegistererWith(prometheus.Labels{"team": "a"}, prometheus.NewRegistry())
+		_, err := agent.New(cfg, log.NewNopLogger())
+		assert.ErrorContains(t, err, "a Gatherer is required")
+	})
+
+	t.Run("invalid metrics prefix", func(t *testing.T) {
+		cfg, _ := newTestConfig(t)
+		cfg.SSH.MetricsPrefix = "pdc-agent"
+		cfg.Registerer = prometheus.NewRegistry()
+		_, err := agent.New(cfg, log.NewNopLogger())
+		assert.ErrorContains(t, err, `registering metrics with prefix "pdc-agent"`)
+	})
+}
+
+// newFakePDCAPI returns a PDC API that signs any public key with a new CA.
+func newFakePDCAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := gossh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			PublicKey string `json:"publicKey"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pub, _, _, _, err := gossh.ParseAuthorizedKey([]byte(req.PublicKey))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cert := &gossh.Certificate{
+			Key:             pub,
+			CertType:        gossh.UserCert,
+			ValidPrincipals: []string{"1", "team-a"},
+			ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: gossh.MarshalAuthorizedKey(cert)})
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"certificate": string(certPEM),
+			"known_hosts": "@cert-authority * " + string(gossh.MarshalAuthorizedKey(ca.PublicKey())),
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestAgent_Run_Tracing(t *testing.T) {
+	// The tracers of the packages delegate to the first global provider that
+	// is set, so it is shared by the test cases.
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	testcases := []struct {
+		name              string
+		sshScript         string
+		wantConnectStatus codes.Code
+	}{
+		{
+			name:              "tunnel connected",
+			sshScript:         "exec sleep 60",
+			wantConnectStatus: codes.Unset,
+		},
+		{
+			name:              "ssh exits before connecting",
+			sshScript:         "exit 255",
+			wantConnectStatus: codes.Error,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			require.NoError(t, os.WriteFile(cfg.SSH.SSHBinary, []byte("#!/bin/sh\n"+tc.sshScript+"\n"), 0o755))
+
+			before := len(sr.Ended())
+			spans := func() map[string]sdktrace.ReadOnlySpan {
+				m := map[string]sdktrace.ReadOnlySpan{}
+				for _, s := range sr.Ended()[before:] {
+					m[s.Name()] = s
+				}
+				return m
+			}
+
+			a, err := agent.New(cfg, log.NewNopLogger())
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- a.Run(ctx) }()
+
+			// The tunnel is connected once ssh has been running for a while.
+			assert.Eventually(t, func() bool {
+				_, ok := spans()["establish ssh tunnel"]
+				return ok
+			}, 10*time.Second, 10*time.Millisecond)
+
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("agent did not stop")
+			}
+
+			// The startup is a single trace.
+			got := spans()
+			root := got["start agent"]
+			require.NotNil(t, root)
+			assert.False(t, root.Parent().IsValid())
+			parents := map[string]string{
+				"create pdc client":    "start agent",
+				"start ssh client":     "start agent",
+				"sign certificate":     "start ssh client",
+				"establish ssh tunnel": "start agent",
+			}
+			for name, parent := range parents {
+				span := got[name]
+				require.NotNil(t, span, name)
+				assert.Equal(t, root.SpanContext().TraceID(), span.SpanContext().TraceID(), name)
+				assert.Equal(t, got[parent].SpanContext().SpanID(), span.Parent().SpanID(), name)
+			}
+			assert.Equal(t, tc.wantConnectStatus, got["establish ssh tunnel"].Status().Code)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// State is a snapshot of the state of the agent, for debugging. It does not
+// contain secrets.
+type State struct {
+	TunnelState          string
+	ConnectedConnections int
+	// Reconnects is the number of times an ssh connection was restarted.
+	Reconnects int64
+	// LastErr is the last error of an ssh connection, at LastErrAt. It is nil
+	// if there was none.
+	LastErr   error
+	LastErrAt time.Time
+
+	// CertValidAfter and CertValidBefore are the validity window of the
+	// certificate, and CertPrincipals are the principals it grants. CertErr
+	// is set instead if it cannot be read.
+	CertValidAfter  time.Time
+	CertValidBefore time.Time
+	CertPrincipals  []string
+	CertErr         error
+
+	// Cluster and Domain identify the PDC cluster.
+	Cluster string
+	Domain  string
+	// APIURL is the URL of the PDC API, without credentials or query.
+	APIURL string
+	// Gateway is the host and port of the PDC gateway.
+	Gateway string
+
+	Version string
+	Uptime  time.Duration
+}
+
+// State returns a snapshot of the state of the agent. It is safe to call at
+// any time.
+func (a *Agent) State() State {
+	st := State{
+		TunnelState:          a.sshClient.TunnelState(),
+		ConnectedConnections: a.sshClient.ConnectedCount(),
+		Reconnects:           a.sshClient.ReconnectCount(),
+		Cluster:              a.cfg.Cluster,
+		Domain:               a.cfg.Domain,
+		APIURL:               redactURL(a.cfg.PDC.URL),
+		Gateway:              net.JoinHostPort(a.cfg.SSH.GatewayHost(), strconv.Itoa(a.cfg.SSH.Port)),
+		Version:              a.cfg.PDC.Version,
+		Uptime:               time.Since(a.started),
+	}
+	st.LastErrAt, st.LastErr = a.sshClient.LastError()
+	st.CertValidAfter, st.CertValidBefore, st.CertErr = a.km.CertValidity()
+	if st.CertErr == nil {
+		st.CertPrincipals, st.CertErr = a.km.CertPrincipals()
+	}
+	return st
+}
+
+// redactURL returns u without its user info, query and fragment, which can
+// contain credentials.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	r.User = nil
+	r.RawQuery = ""
+	r.Fragment = ""
+	r.RawFragment = ""
+	return r.String()
+}
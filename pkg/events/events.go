@@ -0,0 +1,77 @@
+// Package events writes machine-readable tunnel events, one JSON object per
+// line, for automation that reacts to the tunnel going up or down.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events written by the agent.
+const (
+	Connected    = "connected"
+	Disconnected = "disconnected"
+	Reconnecting = "reconnecting"
+	CertRenewed  = "cert_renewed"
+)
+
+type event struct {
+	TS      time.Time `json:"ts"`
+	Event   string    `json:"event"`
+	Cluster string    `json:"cluster"`
+}
+
+// Writer writes events to an io.Writer. A nil *Writer discards events.
+type Writer struct {
+	mu      sync.Mutex
+	w       io.Writer
+	cluster string
+	now     func() time.Time
+}
+
+// NewWriter returns a Writer that writes events for cluster to w.
+func NewWriter(w io.Writer, cluster string) *Writer {
+	return &Writer{w: w, cluster: cluster, now: time.Now}
+}
+
+// OpenFile opens path in append mode, creating it if needed, and returns a
+// Writer for it. path can also be a named pipe.
+func OpenFile(path, cluster string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(f, cluster), nil
+}
+
+// Emit writes an event. Each event is written with a single call to the
+// underlying writer, so it is not buffered.
+func (w *Writer) Emit(name string) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b, err := json.Marshal(event{TS: w.now().UTC(), Event: name, Cluster: w.cluster})
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying writer, if it is an io.Closer.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
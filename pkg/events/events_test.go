@@ -0,0 +1,37 @@
+package events
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	require.NoError(t, os.WriteFile(path, []byte("{\"existing\":true}\n"), 0o644))
+
+	w, err := OpenFile(path, "prod-us-east-0")
+	require.NoError(t, err)
+	w.now = func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	require.NoError(t, w.Emit(Connected))
+	require.NoError(t, w.Emit(Disconnected))
+	require.NoError(t, w.Close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"existing":true}
+{"ts":"2024-01-01T00:00:00Z","event":"connected","cluster":"prod-us-east-0"}
+{"ts":"2024-01-01T00:00:00Z","event":"disconnected","cluster":"prod-us-east-0"}
+`, string(b))
+}
+
+func TestNilWriter(t *testing.T) {
+	var w *Writer
+	assert.NoError(t, w.Emit(Connected))
+	assert.NoError(t, w.Close())
+}
@@ -0,0 +1,116 @@
+// Package hooks runs user executables when the tunnel connects or
+// disconnects, e.g. to update a local load balancer.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/events"
+)
+
+// Environment variables that hooks are run with, in addition to the
+// environment of the agent.
+const (
+	EventEnv   = "PDC_HOOK_EVENT"
+	ClusterEnv = "PDC_CLUSTER"
+	StateEnv   = "PDC_TUNNEL_STATE"
+)
+
+// DefaultTimeout is how long a hook can run before it is killed.
+const DefaultTimeout = 10 * time.Second
+
+// Runner runs the hooks of tunnel events. A nil *Runner runs nothing.
+type Runner struct {
+	logger       log.Logger
+	cluster      string
+	onConnect    string
+	onDisconnect string
+	timeout      time.Duration
+
+	wg sync.WaitGroup
+}
+
+// NewRunner returns a Runner that runs onConnect when the tunnel connects,
+// and onDisconnect when it disconnects, if they are set. Hooks are killed
+// after timeout, or DefaultTimeout if it is not positive.
+func NewRunner(logger log.Logger, cluster, onConnect, onDisconnect string, timeout time.Duration) *Runner {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Runner{
+		logger:       log.With(logger, "component", "hooks"),
+		cluster:      cluster,
+		onConnect:    onConnect,
+		onDisconnect: onDisconnect,
+		timeout:      timeout,
+	}
+}
+
+// Run starts the hook of event, if there is one, with state as the new state
+// of the tunnel. It does not wait for the hook to finish, so that a slow hook
+// does not hold up the tunnel. Failures are logged.
+func (r *Runner) Run(event, state string) {
+	if r == nil {
+		return
+	}
+
+	var path string
+	switch event {
+	case events.Connected:
+		path = r.onConnect
+	case events.Disconnected:
+		path = r.onDisconnect
+	}
+	if path == "" {
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.run(path, event, state)
+	}()
+}
+
+func (r *Runner) run(path, event, state string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(),
+		EventEnv+"="+event,
+		ClusterEnv+"="+r.cluster,
+		StateEnv+"="+state,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		level.Warn(r.logger).Log("msg", "hook timed out", "event", event, "hook", path, "timeout", r.timeout)
+		return
+	}
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "hook failed", "event", event, "hook", path, "err", err, "output", bytes.TrimSpace(out.Bytes()))
+		return
+	}
+	level.Debug(r.logger).Log("msg", "hook ran", "event", event, "hook", path, "duration", time.Since(start))
+}
+
+// Wait waits for the running hooks to finish.
+func (r *Runner) Wait() {
+	if r == nil {
+		return
+	}
+	r.wg.Wait()
+}
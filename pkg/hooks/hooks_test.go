@@ -0,0 +1,97 @@
+package hooks
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/events"
+)
+
+// writeScript writes an executable shell script to dir.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755))
+	return path
+}
+
+func TestRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts in tests")
+	}
+
+	t.Run("runs the connect hook with the event in its environment", func(t *testing.T) {
+		dir := t.TempDir()
+		marker := filepath.Join(dir, "marker")
+		onConnect := writeScript(t, dir, "on-connect", `echo "$PDC_HOOK_EVENT $PDC_CLUSTER $PDC_TUNNEL_STATE" > `+marker)
+
+		r := NewRunner(log.NewNopLogger(), "prod-us-east-0", onConnect, "", time.Second)
+		r.Run(events.Connected, "Connected")
+		r.Wait()
+
+		b, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "connected prod-us-east-0 Connected\n", string(b))
+	})
+
+	t.Run("events without a hook run nothing", func(t *testing.T) {
+		dir := t.TempDir()
+		marker := filepath.Join(dir, "marker")
+		onConnect := writeScript(t, dir, "on-connect", "touch "+marker)
+
+		r := NewRunner(log.NewNopLogger(), "prod-us-east-0", onConnect, "", time.Second)
+		r.Run(events.Disconnected, "Reconnecting")
+		r.Run(events.Reconnecting, "Reconnecting")
+		r.Wait()
+
+		assert.NoFileExists(t, marker)
+	})
+
+	t.Run("failures are logged", func(t *testing.T) {
+		onDisconnect := writeScript(t, t.TempDir(), "on-disconnect", "echo oops; exit 3")
+
+		buf := &bytes.Buffer{}
+		r := NewRunner(log.NewLogfmtLogger(buf), "prod-us-east-0", "", onDisconnect, time.Second)
+		r.Run(events.Disconnected, "Reconnecting")
+		r.Wait()
+
+		assert.Contains(t, buf.String(), `msg="hook failed" event=disconnected`)
+		assert.Contains(t, buf.String(), "err=\"exit status 3\" output=oops")
+	})
+
+	t.Run("slow hooks are killed", func(t *testing.T) {
+		onConnect := writeScript(t, t.TempDir(), "on-connect", "exec sleep 10")
+
+		buf := &bytes.Buffer{}
+		r := NewRunner(log.NewLogfmtLogger(buf), "prod-us-east-0", onConnect, "", 50*time.Millisecond)
+		start := time.Now()
+		r.Run(events.Connected, "Connected")
+		r.Wait()
+
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Contains(t, buf.String(), `msg="hook timed out"`)
+	})
+
+	t.Run("missing hooks are logged", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		r := NewRunner(log.NewLogfmtLogger(buf), "prod-us-east-0", filepath.Join(t.TempDir(), "missing"), "", time.Second)
+		r.Run(events.Connected, "Connected")
+		r.Wait()
+
+		assert.Contains(t, buf.String(), `msg="hook failed"`)
+	})
+}
+
+func TestNilRunner(t *testing.T) {
+	var r *Runner
+	r.Run(events.Connected, "Connected")
+	r.Wait()
+}
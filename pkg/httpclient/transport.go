@@ -1,19 +1,26 @@
 package httpclient
 
 import (
+	"fmt"
 	"net/http"
+	"runtime"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// UserAgent returns the user-agent of the agent, e.g.
+// "pdc-agent/1.2.3 (linux/amd64)".
+func UserAgent(version string) string {
+	return fmt.Sprintf("pdc-agent/%s (%s/%s)", version, runtime.GOOS, runtime.GOARCH)
+}
+
 // UserAgentTransport provides a transport with a set user-agent. It wraps
 // http.DefaultTransport if rt is nil
-func UserAgentTransport(rt http.RoundTripper, version string) http.RoundTripper {
+func UserAgentTransport(rt http.RoundTripper, ua string) http.RoundTripper {
 	if rt == nil {
 		rt = http.DefaultTransport
 	}
 
-	ua := "pdc-httpclient pdc-agent " + version
 	tr := promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
 		if req.UserAgent() == "" {
 			req.Header.Set("User-Agent", ua)
@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// dedupeIgnoredKeys are not considered when comparing log lines.
+var dedupeIgnoredKeys = map[string]bool{
+	"ts":     true,
+	"caller": true,
+}
+
+// dedupeLogger drops log lines that are identical to a line logged within the
+// window. The next time the line is logged after the window has passed, it is
+// logged with the number of lines that were dropped. If it is not logged
+// again, the last dropped line is logged with that number once the window has
+// passed, the next time the entries are swept.
+type dedupeLogger struct {
+	next   log.Logger
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	seen      map[string]*dedupeEntry
+	lastSweep time.Time
+}
+
+type dedupeEntry struct {
+	first   time.Time
+	dropped int
+	// last is the last dropped line.
+	last []interface{}
+}
+
+// NewDedupeLogger returns a logger that collapses identical log lines within
+// window. Error level lines are always logged. If window is 0, next is
+// returned unchanged.
+func NewDedupeLogger(next log.Logger, window time.Duration) log.Logger {
+	if window <= 0 {
+		return next
+	}
+
+	return &dedupeLogger{
+		next:   next,
+		window: window,
+		now:    time.Now,
+		seen:   map[string]*dedupeEntry{},
+	}
+}
+
+func (l *dedupeLogger) Log(keyvals ...interface{}) error {
+	key, isError := dedupeKey(keyvals)
+	if isError {
+		return l.next.Log(keyvals...)
+	}
+
+	l.mu.Lock()
+	now := l.now()
+
+	e, ok := l.seen[key]
+	suppressed := ok && now.Sub(e.first) < l.window
+	dropped := 0
+	if suppressed {
+		e.dropped++
+		e.last = append([]interface{}(nil), keyvals...)
+	} else {
+		if ok {
+			dropped = e.dropped
+		}
+		l.seen[key] = &dedupeEntry{first: now}
+	}
+	// The entry of this line is updated first, so that a line logged again
+	// after the window reports its dropped lines itself.
+	expired := l.sweep(now)
+	l.mu.Unlock()
+
+	for _, e := range expired {
+		_ = l.next.Log(append(e.last, "repeated", e.dropped)...)
+	}
+	if suppressed {
+		return nil
+	}
+	if dropped > 0 {
+		keyvals = append(keyvals, "repeated", dropped)
+	}
+	return l.next.Log(keyvals...)
+}
+
+// sweep removes expired entries, so that the map does not grow with one-off
+// log lines. It returns the removed entries that had dropped lines, oldest
+// first, for their counts to be logged. It must be called with mu held.
+func (l *dedupeLogger) sweep(now time.Time) []*dedupeEntry {
+	if now.Sub(l.lastSweep) < l.window {
+		return nil
+	}
+	l.lastSweep = now
+
+	var expired []*dedupeEntry
+	for k, e := range l.seen {
+		if now.Sub(e.first) < l.window {
+			continue
+		}
+		delete(l.seen, k)
+		if e.dropped > 0 {
+			expired = append(expired, e)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].first.Before(expired[j].first) })
+	return expired
+}
+
+// dedupeKey returns the key used to compare log lines, and whether the line is
+// logged at error level.
+func dedupeKey(keyvals []interface{}) (string, bool) {
+	var sb strings.Builder
+	isError := false
+
+	for i := 0; i < len(keyvals); i += 2 {
+		k := fmt.Sprint(keyvals[i])
+		var v interface{}
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+
+		if keyvals[i] == level.Key() && v == level.ErrorValue() {
+			isError = true
+		}
+		if dedupeIgnoredKeys[k] {
+			continue
+		}
+
+		fmt.Fprintf(&sb, "%s=%v ", k, v)
+	}
+
+	return sb.String(), isError
+}
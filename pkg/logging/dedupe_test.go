@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeLogger(t *testing.T) {
+	t.Run("identical lines within the window are logged once", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		now := time.Now()
+		logger := NewDedupeLogger(log.NewLogfmtLogger(buf), time.Minute)
+		logger.(*dedupeLogger).now = func() time.Time { return now }
+		logger = log.With(logger, "ts", log.DefaultTimestamp)
+
+		for i := 0; i < 5; i++ {
+			level.Info(logger).Log("msg", "ssh client exited. restarting", "exitCode", 255)
+			now = now.Add(time.Second)
+		}
+		level.Info(logger).Log("msg", "ssh client exited. restarting", "exitCode", 1)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Len(t, lines, 2)
+		assert.Contains(t, lines[0], "exitCode=255")
+		assert.Contains(t, lines[1], "exitCode=1")
+	})
+
+	t.Run("a line logged after the window includes the number of dropped lines", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		now := time.Now()
+		logger := NewDedupeLogger(log.NewLogfmtLogger(buf), time.Minute)
+		logger.(*dedupeLogger).now = func() time.Time { return now }
+
+		for i := 0; i < 4; i++ {
+			level.Info(logger).Log("msg", "ssh client exited. restarting")
+		}
+		now = now.Add(time.Minute)
+		level.Info(logger).Log("msg", "ssh client exited. restarting")
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Len(t, lines, 2)
+		assert.NotContains(t, lines[0], "repeated")
+		assert.Contains(t, lines[1], "repeated=3")
+	})
+
+	t.Run("dropped lines are reported once the window has passed", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		now := time.Now()
+		logger := NewDedupeLogger(log.NewLogfmtLogger(buf), time.Minute)
+		logger.(*dedupeLogger).now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			level.Info(logger).Log("msg", "ssh client exited. restarting", "attempt", 1)
+			now = now.Add(time.Second)
+		}
+		// The line is not logged again, and the next line sweeps the
+		// expired entries.
+		now = now.Add(time.Minute)
+		level.Info(logger).Log("msg", "tunnel connected")
+		// The count is only reported once.
+		now = now.Add(time.Minute)
+		level.Info(logger).Log("msg", "tunnel connected")
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Equal(t, []string{
+			`level=info msg="ssh client exited. restarting" attempt=1`,
+			`level=info msg="ssh client exited. restarting" attempt=1 repeated=2`,
+			`level=info msg="tunnel connected"`,
+			`level=info msg="tunnel connected"`,
+		}, lines)
+	})
+
+	t.Run("error lines are always logged", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger := NewDedupeLogger(log.NewLogfmtLogger(buf), time.Minute)
+
+		for i := 0; i < 3; i++ {
+			level.Error(logger).Log("msg", "could not check or generate certificate")
+		}
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Len(t, lines, 3)
+	})
+
+	t.Run("a window of 0 disables deduplication", func(t *testing.T) {
+		next := log.NewNopLogger()
+		assert.Equal(t, next, NewDedupeLogger(next, 0))
+	})
+}
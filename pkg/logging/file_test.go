@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	t.Run("file is rotated when it is full", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.log")
+		r, err := OpenRotatingFile(path, 100, 2)
+		require.NoError(t, err)
+		defer r.Close()
+
+		// Each line is 10 bytes, so 10 lines fill a file.
+		for i := 0; i < 25; i++ {
+			_, err := fmt.Fprintf(r, "line %04d\n", i)
+			require.NoError(t, err)
+		}
+
+		assertFileLines(t, path, "line 0020", "line 0024")
+		assertFileLines(t, path+".1", "line 0010", "line 0019")
+		assertFileLines(t, path+".2", "line 0000", "line 0009")
+	})
+
+	t.Run("only maxBackups files are kept", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.log")
+		r, err := OpenRotatingFile(path, 100, 1)
+		require.NoError(t, err)
+		defer r.Close()
+
+		for i := 0; i < 25; i++ {
+			_, err := fmt.Fprintf(r, "line %04d\n", i)
+			require.NoError(t, err)
+		}
+
+		assertFileLines(t, path+".1", "line 0010", "line 0019")
+		assert.NoFileExists(t, path+".2")
+	})
+
+	t.Run("existing file is appended to", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.log")
+		require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", 95)+"\n"), 0644))
+
+		r, err := OpenRotatingFile(path, 100, 1)
+		require.NoError(t, err)
+		defer r.Close()
+
+		_, err = fmt.Fprintf(r, "line %04d\n", 0)
+		require.NoError(t, err)
+
+		assertFileLines(t, path, "line 0000", "line 0000")
+		assert.FileExists(t, path+".1")
+	})
+
+	t.Run("invalid size", func(t *testing.T) {
+		_, err := OpenRotatingFile(filepath.Join(t.TempDir(), "agent.log"), 0, 1)
+		assert.Error(t, err)
+	})
+}
+
+// assertFileLines checks the first and last lines of a file.
+func assertFileLines(t *testing.T, path, first, last string) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	assert.Equal(t, first, lines[0])
+	assert.Equal(t, last, lines[len(lines)-1])
+}
@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+)
+
+// Redacted replaces secrets in log lines.
+const Redacted = "***"
+
+// minSecretLen is the length below which secrets are not redacted, as they
+// would also match unrelated values, such as digits of timestamps.
+const minSecretLen = 8
+
+// Secrets are the secrets that redacting loggers replace. Secrets can be added
+// at any time, e.g. once the configuration is resolved, and are redacted from
+// the lines logged after that.
+type Secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// Add registers secrets. Empty and short secrets are ignored.
+func (s *Secrets) Add(secrets ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLen {
+			s.values = append(s.values, secret)
+		}
+	}
+}
+
+func (s *Secrets) snapshot() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values
+}
+
+// redactLogger replaces the secrets found in the values of log lines.
+type redactLogger struct {
+	next    log.Logger
+	secrets *Secrets
+}
+
+// NewRedactLogger returns a logger that replaces secrets in the values of log
+// lines with Redacted, as a defense in depth against secrets that end up in
+// errors or debug output. Values that are not strings are checked as they are
+// formatted by logfmt, and are only replaced if they contain a secret.
+func NewRedactLogger(next log.Logger, secrets *Secrets) log.Logger {
+	return &redactLogger{next: next, secrets: secrets}
+}
+
+func (l *redactLogger) Log(keyvals ...interface{}) error {
+	secrets := l.secrets.snapshot()
+	if len(secrets) == 0 {
+		return l.next.Log(keyvals...)
+	}
+
+	var redactedKeyvals []interface{}
+	for i := 1; i < len(keyvals); i += 2 {
+		s, ok := redactValue(keyvals[i], secrets)
+		if !ok {
+			continue
+		}
+		// Copy the line before changing it, as keyvals may be shared with
+		// the caller.
+		if redactedKeyvals == nil {
+			redactedKeyvals = append([]interface{}{}, keyvals...)
+		}
+		redactedKeyvals[i] = s
+	}
+	if redactedKeyvals == nil {
+		return l.next.Log(keyvals...)
+	}
+	return l.next.Log(redactedKeyvals...)
+}
+
+// redactValue returns v formatted with its secrets redacted, and true, if it
+// contains any of secrets.
+func redactValue(v interface{}, secrets []string) (string, bool) {
+	s := formatValue(v)
+	found := false
+	for _, secret := range secrets {
+		if strings.Contains(s, secret) {
+			s = strings.ReplaceAll(s, secret, Redacted)
+			found = true
+		}
+	}
+	return s, found
+}
+
+// formatValue formats v as logfmt does. Errors and Stringers that panic, e.g.
+// nil pointers, are formatted as an empty string.
+func formatValue(v interface{}) (s string) {
+	defer func() {
+		if recover() != nil {
+			s = ""
+		}
+	}()
+
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "glc_secret_token"
+
+func TestRedactLogger(t *testing.T) {
+	testcases := []struct {
+		name    string
+		keyvals []interface{}
+		want    string
+	}{
+		{
+			name:    "string value",
+			keyvals: []interface{}{"msg", "using token " + testSecret},
+			want:    "msg=\"using token ***\"\n",
+		},
+		{
+			name:    "error value",
+			keyvals: []interface{}{"err", fmt.Errorf("sign request with %s: %w", testSecret, errors.New("unauthorized"))},
+			want:    "err=\"sign request with ***: unauthorized\"\n",
+		},
+		{
+			name:    "Stringer value",
+			keyvals: []interface{}{"url", &url.URL{Scheme: "https", Host: "api", RawQuery: "token=" + testSecret}},
+			want:    "url=\"https://api?token=***\"\n",
+		},
+		{
+			name:    "other value",
+			keyvals: []interface{}{"args", []string{"-token", testSecret}},
+			want:    "args=\"[-token ***]\"\n",
+		},
+		{
+			name:    "no secret",
+			keyvals: []interface{}{"msg", "connected", "connections", 2},
+			want:    "msg=connected connections=2\n",
+		},
+		{
+			name:    "nil error",
+			keyvals: []interface{}{"err", error(nil)},
+			want:    "err=null\n",
+		},
+	}
+
+	secrets := &Secrets{}
+	secrets.Add(testSecret)
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := NewRedactLogger(log.NewLogfmtLogger(&buf), secrets)
+			require.NoError(t, logger.Log(tc.keyvals...))
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestRedactLogger_Secrets(t *testing.T) {
+	var buf bytes.Buffer
+	secrets := &Secrets{}
+	logger := NewRedactLogger(log.NewLogfmtLogger(&buf), secrets)
+
+	// Secrets are only redacted once they are added.
+	require.NoError(t, logger.Log("msg", testSecret))
+	secrets.Add(testSecret, "", "1234")
+	require.NoError(t, logger.Log("msg", testSecret))
+
+	// Short secrets are not redacted, as they match unrelated values.
+	require.NoError(t, logger.Log("ts", "2024-01-01T12:34:56Z"))
+
+	assert.Equal(t, "msg="+testSecret+"\nmsg=***\nts=2024-01-01T12:34:56Z\n", buf.String())
+}
+
+func TestRedactLogger_KeyvalsNotModified(t *testing.T) {
+	secrets := &Secrets{}
+	secrets.Add(testSecret)
+	logger := NewRedactLogger(log.NewNopLogger(), secrets)
+
+	keyvals := []interface{}{"msg", testSecret}
+	require.NoError(t, logger.Log(keyvals...))
+	assert.Equal(t, testSecret, keyvals[1])
+}
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBuffer(t *testing.T) {
+	t.Run("lines are returned oldest first", func(t *testing.T) {
+		r := NewRingBuffer(3)
+		_, _ = r.Write([]byte("a\n"))
+		_, _ = r.Write([]byte("b\n"))
+
+		assert.Equal(t, []string{"a", "b"}, r.Lines())
+	})
+
+	t.Run("only the last lines are kept", func(t *testing.T) {
+		r := NewRingBuffer(3)
+		for i := 0; i < 5; i++ {
+			_, _ = fmt.Fprintf(r, "line %d\n", i)
+		}
+
+		assert.Equal(t, []string{"line 2", "line 3", "line 4"}, r.Lines())
+	})
+
+	t.Run("a write with more than one line", func(t *testing.T) {
+		r := NewRingBuffer(3)
+		_, _ = r.Write([]byte("a\nb\n"))
+
+		assert.Equal(t, []string{"a", "b"}, r.Lines())
+	})
+}
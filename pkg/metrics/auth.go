@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Auth are the credentials that requests to the metrics server must have. A
+// request is authorized if it has any of the credentials that are set.
+type Auth struct {
+	// BearerToken is the token of the Authorization: Bearer header.
+	BearerToken string
+	// BasicUser and BasicPassword are the credentials of basic auth.
+	BasicUser     string
+	BasicPassword string
+}
+
+// Enabled returns true if requests need credentials.
+func (a Auth) Enabled() bool {
+	return a.BearerToken != "" || a.BasicUser != ""
+}
+
+// SetBasic sets the basic auth credentials from user:password.
+func (a *Auth) SetBasic(s string) error {
+	user, password, ok := strings.Cut(s, ":")
+	if !ok || user == "" || password == "" {
+		return errors.New("invalid -metrics.auth.basic, must be user:password")
+	}
+	a.BasicUser = user
+	a.BasicPassword = password
+	return nil
+}
+
+// SetCredentials adds the credentials of a to r, the bearer token if it is
+// set, and basic auth otherwise.
+func (a Auth) SetCredentials(r *http.Request) {
+	switch {
+	case a.BearerToken != "":
+		r.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	case a.BasicUser != "":
+		r.SetBasicAuth(a.BasicUser, a.BasicPassword)
+	}
+}
+
+// authorized returns true if r has the credentials of a.
+func (a Auth) authorized(r *http.Request) bool {
+	if a.BearerToken != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && equal(token, a.BearerToken) {
+			return true
+		}
+	}
+	if a.BasicUser != "" {
+		if user, password, ok := r.BasicAuth(); ok && equal(user, a.BasicUser) && equal(password, a.BasicPassword) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns a handler that replies 401 to requests without the
+// credentials of a, and passes the others to h.
+func (a Auth) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			if a.BasicUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="pdc-agent"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// equal compares secrets in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// RequireAuth makes all the endpoints of the server, including the handlers
+// added with Handle, require the credentials of auth. It must be called
+// before Run.
+func (s *Server) RequireAuth(auth Auth) {
+	if auth.Enabled() {
+		s.httpServer.Handler = auth.wrap(s.mux)
+	}
+}
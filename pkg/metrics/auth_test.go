@@ -0,0 +1,116 @@
+package metrics_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startAuthServer starts a metrics server with auth and an admin handler, on
+// a unix socket, and returns a client for it.
+func startAuthServer(t *testing.T, auth metrics.Auth) *http.Client {
+	t.Helper()
+	socket := path.Join(t.TempDir(), "metrics.sock")
+
+	ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.DefaultRegisterer, prometheus.DefaultGatherer, "unix://"+socket, false)
+	ms.Handle("/admin/logs", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ms.RequireAuth(auth)
+	go ms.Run()
+	t.Cleanup(func() { _ = ms.Shutdown(context.Background()) })
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+func TestServer_RequireAuth(t *testing.T) {
+	testcases := []struct {
+		name       string
+		auth       metrics.Auth
+		setAuth    func(r *http.Request)
+		wantStatus int
+	}{
+		{
+			name:       "no auth configured",
+			setAuth:    func(r *http.Request) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "valid bearer token",
+			auth:       metrics.Auth{BearerToken: "secret"},
+			setAuth:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong bearer token",
+			auth:       metrics.Auth{BearerToken: "secret"},
+			setAuth:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing credentials",
+			auth:       metrics.Auth{BearerToken: "secret"},
+			setAuth:    func(r *http.Request) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "valid basic auth",
+			auth:       metrics.Auth{BasicUser: "prometheus", BasicPassword: "secret"},
+			setAuth:    func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong basic auth password",
+			auth:       metrics.Auth{BasicUser: "prometheus", BasicPassword: "secret"},
+			setAuth:    func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "either credential is accepted when both are set",
+			auth:       metrics.Auth{BearerToken: "token", BasicUser: "prometheus", BasicPassword: "secret"},
+			setAuth:    func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") },
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := startAuthServer(t, tc.auth)
+
+			for _, endpoint := range []string{"/metrics", "/admin/logs"} {
+				req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://unix"+endpoint, nil)
+				require.NoError(t, err)
+				tc.setAuth(req)
+
+				resp, err := client.Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				assert.Equal(t, tc.wantStatus, resp.StatusCode, endpoint)
+				if tc.wantStatus == http.StatusUnauthorized {
+					assert.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var agentInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "info",
+	Help: "Information about the agent and the PDC cluster it connects to. The value is always 1.",
+}, []string{"version", "instance_id", "domain", "gateway_host", "api_host"})
+
+// AgentInfo is exposed as labels of the pdc_agent_info metric. It must not
+// contain secrets. The cluster is the cluster label of all metrics, see
+// Register.
+type AgentInfo struct {
+	Version     string
+	InstanceID  string
+	Domain      string
+	GatewayHost string
+	APIHost     string
+}
+
+// SetAgentInfo sets the labels of the pdc_agent_info metric.
+func SetAgentInfo(info AgentInfo) {
+	agentInfo.Reset()
+	agentInfo.WithLabelValues(info.Version, info.InstanceID, info.Domain, info.GatewayHost, info.APIHost).Set(1)
+}
@@ -0,0 +1,49 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetAgentInfo(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, metrics.Register(reg, metrics.DefaultPrefix, "prod-us-east-0"))
+
+	metrics.SetAgentInfo(metrics.AgentInfo{
+		Version:     "v1.0.0",
+		InstanceID:  "agent-1",
+		Domain:      "grafana.net",
+		GatewayHost: "private-datasource-connect-prod-us-east-0.grafana.net",
+		APIHost:     "private-datasource-connect-api-prod-us-east-0.grafana.net",
+	})
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	labels := map[string]string{}
+	var value float64
+	for _, mf := range mfs {
+		if mf.GetName() != "pdc_agent_info" {
+			continue
+		}
+		require.Len(t, mf.GetMetric(), 1)
+		for _, lp := range mf.GetMetric()[0].GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		value = mf.GetMetric()[0].GetGauge().GetValue()
+	}
+
+	assert.Equal(t, map[string]string{
+		"version":      "v1.0.0",
+		"instance_id":  "agent-1",
+		"cluster":      "prod-us-east-0",
+		"domain":       "grafana.net",
+		"gateway_host": "private-datasource-connect-prod-us-east-0.grafana.net",
+		"api_host":     "private-datasource-connect-api-prod-us-east-0.grafana.net",
+	}, labels)
+	assert.Equal(t, float64(1), value)
+}
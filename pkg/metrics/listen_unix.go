@@ -0,0 +1,23 @@
+//go:build !windows
+
+package metrics
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketUmask makes the socket file only accessible to the owner and group.
+const socketUmask = 0o117
+
+// listenUnix listens on the unix socket at path. The socket file is created
+// with permissions 0660, so that only the owner and group can connect to it.
+// The umask is set before the file is created, rather than the file being
+// chmodded after, so that it is never accessible to others. The umask is
+// process wide, so files created by other goroutines in the meantime can
+// only get narrower permissions.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(socketUmask)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,9 @@
+package metrics
+
+import "net"
+
+// listenUnix listens on the unix socket at path. Windows has no file modes to
+// restrict access to the socket with.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
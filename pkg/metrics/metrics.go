@@ -1,25 +1,43 @@
 package metrics
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// unixSocketPrefix is the prefix of metrics addresses that are unix sockets,
+// e.g. unix:///var/run/pdc-agent/metrics.sock
+const unixSocketPrefix = "unix://"
+
 type Server struct {
 	httpServer *http.Server
+	mux        *http.ServeMux
 	logger     log.Logger
 }
 
-func NewMetricsServer(logger log.Logger, addr string) *Server {
+// NewMetricsServer returns a server for the metrics of g. The metrics of the
+// server itself are registered on reg. If openMetrics is true, the
+// OpenMetrics format is served to clients that accept it.
+func NewMetricsServer(logger log.Logger, reg prometheus.Registerer, g prometheus.Gatherer, addr string, openMetrics bool) *Server {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		reg,
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{EnableOpenMetrics: openMetrics}),
+	))
 
 	return &Server{
 		logger: logger,
+		mux:    mux,
 		httpServer: &http.Server{
 			Addr:    addr,
 			Handler: mux,
@@ -27,9 +45,86 @@ func NewMetricsServer(logger log.Logger, addr string) *Server {
 	}
 }
 
+// Handle registers an additional handler on the server. It must be called
+// before Run.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Behaviours of the agent when the metrics server cannot listen on its
+// address, e.g. because the port is already bound.
+const (
+	// BindFailureWarn logs a warning, and runs the agent without metrics.
+	BindFailureWarn = "warn"
+	// BindFailureFatal stops the agent with the error.
+	BindFailureFatal = "fatal"
+)
+
+// CheckBindFailureMode returns an error if mode is not a known bind failure
+// mode.
+func CheckBindFailureMode(mode string) error {
+	switch mode {
+	case BindFailureWarn, BindFailureFatal:
+		return nil
+	}
+	return fmt.Errorf("invalid -metrics.bind-failure-mode %q, must be %q or %q", mode, BindFailureWarn, BindFailureFatal)
+}
+
+// Run listens on the server address and serves requests until the server is
+// shut down. Errors are logged.
 func (s *Server) Run() {
 	level.Info(s.logger).Log("msg", "Starting serving metrics", "addr", s.httpServer.Addr)
-	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+
+	ln, err := s.listen()
+	if err != nil {
+		level.Info(s.logger).Log("msg", "failed to run metrics server", "err", err)
+		return
+	}
+	s.serve(ln)
+}
+
+// Start listens on the server address, and serves requests in the background
+// until the server is shut down. Unlike Run, it returns the error if the
+// server cannot listen, e.g. because the port is already bound.
+func (s *Server) Start() error {
+	level.Info(s.logger).Log("msg", "Starting serving metrics", "addr", s.httpServer.Addr)
+
+	ln, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("listening on metrics address %q: %w", s.httpServer.Addr, err)
+	}
+	go s.serve(ln)
+	return nil
+}
+
+func (s *Server) serve(ln net.Listener) {
+	if err := s.httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		level.Info(s.logger).Log("msg", "failed to run metrics server", "err", err)
 	}
 }
+
+// Shutdown gracefully stops the server and closes its listener.
+func (s *Server) Shutdown(ctx context.Context) error {
+	level.Info(s.logger).Log("msg", "Stopping serving metrics", "addr", s.httpServer.Addr)
+	return s.httpServer.Shutdown(ctx)
+}
+
+// listen listens on a unix socket if the address has the unix:// prefix, and
+// on TCP otherwise. The unix socket file is removed when the listener is closed.
+func (s *Server) listen() (net.Listener, error) {
+	socket, ok := strings.CutPrefix(s.httpServer.Addr, unixSocketPrefix)
+	if !ok {
+		addr := s.httpServer.Addr
+		if addr == "" {
+			addr = ":http"
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	// remove a socket file left behind by a previous run
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return listenUnix(socket)
+}
@@ -0,0 +1,158 @@
+package metrics_test
+
+import (
+	"context"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_UnixSocket(t *testing.T) {
+	socket := path.Join(t.TempDir(), "metrics.sock")
+
+	ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.DefaultRegisterer, prometheus.DefaultGatherer, "unix://"+socket, false)
+	require.NoError(t, ms.Start())
+	t.Cleanup(func() { _ = ms.Shutdown(context.Background()) })
+
+	fi, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://unix/metrics", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	socket := path.Join(t.TempDir(), "metrics.sock")
+
+	ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.DefaultRegisterer, prometheus.DefaultGatherer, "unix://"+socket, false)
+	done := make(chan struct{})
+	go func() {
+		ms.Run()
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ms.Shutdown(context.Background()))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+
+	_, err := net.Dial("unix", socket)
+	assert.Error(t, err)
+	_, err = os.Stat(socket)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestServer_OpenMetrics(t *testing.T) {
+	testcases := []struct {
+		name            string
+		openMetrics     bool
+		wantContentType string
+	}{
+		{
+			name:            "classic text format by default",
+			wantContentType: "text/plain",
+		},
+		{
+			name:            "OpenMetrics format when enabled",
+			openMetrics:     true,
+			wantContentType: "application/openmetrics-text",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			socket := path.Join(t.TempDir(), "metrics.sock")
+
+			ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.DefaultRegisterer, prometheus.DefaultGatherer, "unix://"+socket, tc.openMetrics)
+			go ms.Run()
+			t.Cleanup(func() { _ = ms.Shutdown(context.Background()) })
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socket)
+					},
+				},
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://unix/metrics", nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+
+			var resp *http.Response
+			require.Eventually(t, func() bool {
+				resp, err = client.Do(req)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantContentType, mediaType)
+		})
+	}
+}
+
+func TestServer_Start(t *testing.T) {
+	t.Run("serves in the background", func(t *testing.T) {
+		ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.DefaultRegisterer, prometheus.DefaultGatherer, "127.0.0.1:0", false)
+		require.NoError(t, ms.Start())
+		assert.NoError(t, ms.Shutdown(context.Background()))
+	})
+
+	t.Run("returns the error of a bound port", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		ms := metrics.NewMetricsServer(log.NewNopLogger(), prometheus.DefaultRegisterer, prometheus.DefaultGatherer, ln.Addr().String(), false)
+		err = ms.Start()
+		assert.ErrorContains(t, err, "listening on metrics address")
+		assert.ErrorContains(t, err, "address already in use")
+	})
+}
+
+func TestCheckBindFailureMode(t *testing.T) {
+	assert.NoError(t, metrics.CheckBindFailureMode(metrics.BindFailureWarn))
+	assert.NoError(t, metrics.CheckBindFailureMode(metrics.BindFailureFatal))
+	assert.EqualError(t, metrics.CheckBindFailureMode("ignore"), `invalid -metrics.bind-failure-mode "ignore", must be "warn" or "fatal"`)
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushJob is the job label of the metrics pushed to a Pushgateway.
+const PushJob = "pdc-agent"
+
+// pushTimeout is how long a push to the Pushgateway can take.
+const pushTimeout = 10 * time.Second
+
+// Pusher pushes metrics to a Prometheus Pushgateway, for agents that do not
+// live long enough to be scraped.
+type Pusher struct {
+	logger   log.Logger
+	pusher   *push.Pusher
+	url      string
+	interval time.Duration
+}
+
+// NewPusher returns a pusher of the metrics of g to the Pushgateway at
+// pushURL,
+// every interval. The metrics are grouped by the instance label, so that
+// agents sharing a Pushgateway do not replace each other's metrics.
+func NewPusher(logger log.Logger, g prometheus.Gatherer, pushURL, instance string, interval time.Duration) *Pusher {
+	p := push.New(pushURL, PushJob).Gatherer(g)
+	if instance != "" {
+		p = p.Grouping("instance", instance)
+	}
+	return &Pusher{logger: logger, pusher: p, url: redactURL(pushURL), interval: interval}
+}
+
+// redactURL hides the password of the Pushgateway URL, so that it can be
+// logged.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// Run pushes the metrics every interval until ctx is done, then pushes them
+// once more, so that the final values are kept. If the interval is 0, the
+// metrics are only pushed when ctx is done.
+func (p *Pusher) Run(ctx context.Context) {
+	level.Info(p.logger).Log("msg", "pushing metrics", "url", p.url, "interval", p.interval)
+
+	// A nil channel never receives, so without an interval only the final
+	// push is made.
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.push(context.WithoutCancel(ctx))
+			return
+		case <-tick:
+			p.push(ctx)
+		}
+	}
+}
+
+// push pushes the metrics, replacing the ones previously pushed for the
+// agent. Failures are logged, as the next push may succeed.
+func (p *Pusher) push(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+
+	if err := p.pusher.PushContext(ctx); err != nil {
+		level.Warn(p.logger).Log("msg", "could not push metrics", "url", p.url, "err", err)
+		return
+	}
+	level.Debug(p.logger).Log("msg", "pushed metrics", "url", p.url)
+}
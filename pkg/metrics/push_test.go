@@ -0,0 +1,130 @@
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+)
+
+// fakePushgateway records the pushes it receives.
+type fakePushgateway struct {
+	mu     sync.Mutex
+	paths  []string
+	bodies [][]byte
+	status int
+}
+
+func newFakePushgateway(t *testing.T, status int) (*fakePushgateway, string) {
+	t.Helper()
+	pg := &fakePushgateway{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pg.mu.Lock()
+		pg.paths = append(pg.paths, r.Method+" "+r.URL.Path)
+		pg.bodies = append(pg.bodies, b)
+		pg.mu.Unlock()
+		w.WriteHeader(pg.status)
+	}))
+	t.Cleanup(srv.Close)
+	return pg, srv.URL
+}
+
+func (pg *fakePushgateway) pushes() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return len(pg.paths)
+}
+
+func newPushRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "pushed_total", Help: "A test counter."})
+	require.NoError(t, reg.Register(c))
+	return reg
+}
+
+// runPusher runs p until the returned function is called, which waits for
+// Run to return.
+func runPusher(p *metrics.Pusher) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestPusher(t *testing.T) {
+	t.Run("pushes periodically and at shutdown", func(t *testing.T) {
+		pg, url := newFakePushgateway(t, http.StatusOK)
+		reg := newPushRegistry(t)
+
+		stop := runPusher(metrics.NewPusher(log.NewNopLogger(), reg, url, "agent-1", 10*time.Millisecond))
+		assert.Eventually(t, func() bool { return pg.pushes() >= 2 }, 5*time.Second, 5*time.Millisecond)
+
+		before := pg.pushes()
+		stop()
+		n := pg.pushes()
+		assert.Greater(t, n, before, "pushed at shutdown")
+
+		pg.mu.Lock()
+		defer pg.mu.Unlock()
+		for _, p := range pg.paths {
+			assert.Equal(t, "PUT /metrics/job/pdc-agent/instance/agent-1", p)
+		}
+		// The final push has the metrics of the registry.
+		assert.Contains(t, string(pg.bodies[n-1]), "pushed_total")
+	})
+
+	t.Run("without an interval, only pushes at shutdown", func(t *testing.T) {
+		pg, url := newFakePushgateway(t, http.StatusOK)
+		reg := newPushRegistry(t)
+
+		stop := runPusher(metrics.NewPusher(log.NewNopLogger(), reg, url, "agent-1", 0))
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 0, pg.pushes())
+
+		stop()
+		assert.Equal(t, 1, pg.pushes())
+	})
+
+	t.Run("failed pushes are logged", func(t *testing.T) {
+		pg, url := newFakePushgateway(t, http.StatusInternalServerError)
+		reg := newPushRegistry(t)
+
+		var buf bytes.Buffer
+		stop := runPusher(metrics.NewPusher(log.NewLogfmtLogger(log.NewSyncWriter(&buf)), reg, url, "agent-1", 0))
+		stop()
+
+		assert.Equal(t, 1, pg.pushes())
+		assert.Contains(t, buf.String(), "could not push metrics")
+	})
+
+	t.Run("the password of the URL is not logged", func(t *testing.T) {
+		_, url := newFakePushgateway(t, http.StatusOK)
+		reg := newPushRegistry(t)
+
+		var buf bytes.Buffer
+		stop := runPusher(metrics.NewPusher(log.NewLogfmtLogger(log.NewSyncWriter(&buf)), reg, "http://user:secret@"+url[len("http://"):], "agent-1", 0))
+		stop()
+
+		assert.Contains(t, buf.String(), "user:xxxxx@")
+		assert.NotContains(t, buf.String(), "secret")
+	})
+}
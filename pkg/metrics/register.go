@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultPrefix is the default prefix of the names of the agent metrics.
+const DefaultPrefix = "pdc_agent"
+
+// Register registers the agent metrics, and cs, on reg. Their names are
+// prefixed with prefix and an underscore, unless prefix is empty, and they
+// have a cluster label if cluster is set. Metrics that are already registered
+// on reg the same way are skipped, so that several agents can run in a
+// process.
+func Register(reg prometheus.Registerer, prefix, cluster string, cs ...prometheus.Collector) error {
+	if prefix != "" {
+		reg = prometheus.WrapRegistererWithPrefix(prefix+"_", reg)
+	}
+	if cluster != "" {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"cluster": cluster}, reg)
+	}
+
+	for _, c := range append([]prometheus.Collector{agentInfo}, cs...) {
+		if err := reg.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if errors.As(err, &are) && are.ExistingCollector == c {
+				continue
+			}
+			return fmt.Errorf("registering metrics with prefix %q: %w", prefix, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+)
+
+func TestRegister(t *testing.T) {
+	// gather returns the cluster label of each metric, by metric name.
+	gather := func(t *testing.T, reg *prometheus.Registry) map[string]string {
+		t.Helper()
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+
+		clusters := map[string]string{}
+		for _, mf := range mfs {
+			clusters[mf.GetName()] = ""
+			for _, lp := range mf.GetMetric()[0].GetLabel() {
+				if lp.GetName() == "cluster" {
+					clusters[mf.GetName()] = lp.GetValue()
+				}
+			}
+		}
+		return clusters
+	}
+
+	newCounter := func() prometheus.Counter {
+		c := prometheus.NewCounter(prometheus.CounterOpts{Name: "cert_sign_success_total", Help: "help"})
+		c.Inc()
+		return c
+	}
+	metrics.SetAgentInfo(metrics.AgentInfo{Version: "v1.0.0"})
+
+	t.Run("custom prefix and cluster label", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		require.NoError(t, metrics.Register(reg, "team_a_pdc", "prod-us-east-0", newCounter()))
+
+		assert.Equal(t, map[string]string{
+			"team_a_pdc_info":                    "prod-us-east-0",
+			"team_a_pdc_cert_sign_success_total": "prod-us-east-0",
+		}, gather(t, reg))
+	})
+
+	t.Run("default prefix without a cluster", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		require.NoError(t, metrics.Register(reg, metrics.DefaultPrefix, "", newCounter()))
+
+		assert.Equal(t, map[string]string{
+			"pdc_agent_info":                    "",
+			"pdc_agent_cert_sign_success_total": "",
+		}, gather(t, reg))
+	})
+
+	t.Run("registered twice", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		c := newCounter()
+		require.NoError(t, metrics.Register(reg, metrics.DefaultPrefix, "prod-us-east-0", c))
+		require.NoError(t, metrics.Register(reg, metrics.DefaultPrefix, "prod-us-east-0", c))
+
+		assert.Equal(t, map[string]string{
+			"pdc_agent_info":                    "prod-us-east-0",
+			"pdc_agent_cert_sign_success_total": "prod-us-east-0",
+		}, gather(t, reg))
+	})
+
+	t.Run("invalid prefix", func(t *testing.T) {
+		err := metrics.Register(prometheus.NewRegistry(), "pdc-agent", "")
+		assert.ErrorContains(t, err, `registering metrics with prefix "pdc-agent"`)
+	})
+}
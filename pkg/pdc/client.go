@@ -12,7 +12,12 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -22,27 +27,72 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// DefaultSignPublicKeyEndpoint is the path of the PDC API endpoint used to sign
+// public keys.
+const DefaultSignPublicKeyEndpoint = "/pdc/api/v1/sign-public-key"
+
 var (
 	// ErrInternal indicates the item could not be processed.
 	ErrInternal = errors.New("internal error")
 	// ErrInvalidCredentials indicates the auth token is incorrect
 	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrForbidden indicates the auth token is not allowed to perform the request
+	ErrForbidden = errors.New("forbidden")
 )
 
 // Config describes all properties that can be configured for the PDC package
 type Config struct {
-	Token           string
+	Token string
+	// FallbackTokens are tried in order after Token when signing, if it is
+	// rejected, until one is accepted.
+	FallbackTokens  []string
 	HostedGrafanaID string
 	URL             *url.URL
 	RetryMax        int
 
+	// SendHostname includes the hostname of the agent in sign requests, so
+	// that certificates can be correlated to hosts in the PDC API audit logs.
+	SendHostname bool
+	// Labels are included in sign requests for auditing.
+	Labels map[string]string
+	// KeyID, if set, is requested as the key id of signed certificates, so
+	// that the gateway can identify the agent, e.g. by team or host.
+	KeyID string
+	// AutoKeyID sets KeyID from the version, cluster and hostname if it is
+	// not set, see SetAutoKeyID.
+	AutoKeyID bool
+
+	// RequestedCertTTL is the validity requested for signed certificates. The
+	// PDC API may return a certificate with a shorter lifetime. 0 means the
+	// server default is used.
+	RequestedCertTTL time.Duration
+
+	// MaxIdleConns is the number of idle connections to the PDC API kept for
+	// reuse. 0 keeps the default of the HTTP transport.
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection to the PDC API is kept.
+	// 0 keeps the default of the HTTP transport.
+	IdleConnTimeout time.Duration
+
 	// The version of pdc-agent thats running, defined by goreleaser during the build process.
 	Version string
 
-	// The PDC api endpoint used to sign public keys.
-	// It is not a constant only to make it easier to override the endpoint in local development.
+	// UserAgent overrides the User-Agent header sent to the PDC API. By
+	// default it is built from Version and the OS and architecture.
+	UserAgent string
+
+	// The PDC api endpoint used to sign public keys. It can be overridden for
+	// deployments that mount the PDC API under a path prefix, and in local development.
 	SignPublicKeyEndpoint string
 
+	// ExtraHeaders are included in each request to the PDC API, e.g. for an
+	// API gateway in front of it. They cannot set the reserved headers.
+	ExtraHeaders map[string]string
+
+	// FollowRedirects follows redirects of the PDC API to other hosts, with
+	// the token. Redirects to the same host are always followed.
+	FollowRedirects bool
+
 	// Used for local development.
 	// Contains headers that are included in each http request send to the pdc api.
 	DevHeaders map[string]string
@@ -54,11 +104,160 @@ type Config struct {
 
 func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
 	var deprecated string
-	fs.StringVar(&cfg.Token, "token", "", "The token to use to authenticate with Grafana Cloud. It must have the pdc-signing:write scope")
+	cfg.FallbackTokens = []string{}
+	fs.Func("token", "The token to use to authenticate with Grafana Cloud. It must have the pdc-signing:write scope. Can be set more than once, or to a comma-separated list, to fall back to the next token if one is rejected", cfg.addTokens)
 	fs.StringVar(&cfg.HostedGrafanaID, "gcloud-hosted-grafana-id", "", "The ID of the Hosted Grafana instance to connect to")
 	fs.StringVar(&cfg.DevNetwork, "dev-network", "", "[DEVELOPMENT ONLY] the network the agent will connect to")
+	fs.StringVar(&cfg.DevNetwork, "dev.network", "", "[DEVELOPMENT ONLY] the network the agent will connect to. Alias of -dev-network")
 	fs.StringVar(&deprecated, "network", "", "DEPRECATED: The name of the PDC network to connect to")
 	fs.IntVar(&cfg.RetryMax, "retrymax", 4, "The max num of retries for http requests")
+	cfg.Labels = map[string]string{}
+	fs.BoolVar(&cfg.SendHostname, "send-hostname", false, "Include the hostname of the agent in sign requests, for auditing")
+	fs.StringVar(&cfg.KeyID, "cert-key-id", "", "The key id to request for signed certificates, for auditing on the gateway. At most 64 letters, digits or _.@:/- characters")
+	fs.BoolVar(&cfg.AutoKeyID, "cert-key-id-auto", false, "Request pdc-agent/<version>/<cluster>/<hostname> as the key id of signed certificates, unless -cert-key-id is set")
+	cfg.ExtraHeaders = map[string]string{}
+	fs.Func("pdc.header", "A key=value header to include in each request to the PDC API, e.g. for an API gateway in front of it. Can be set more than once", cfg.addHeader)
+	fs.Func("labels", "key=value labels to include in sign requests, for auditing. Can be set more than once, or to a comma-separated list", cfg.addLabels)
+	fs.StringVar(&cfg.SignPublicKeyEndpoint, "sign-public-key-endpoint", DefaultSignPublicKeyEndpoint, "The path of the PDC API endpoint used to sign public keys. Set it when the PDC API is served under a path prefix")
+	fs.DurationVar(&cfg.RequestedCertTTL, "cert-ttl", 0, "The validity to request for signed certificates. 0 means the PDC API default is used")
+	fs.IntVar(&cfg.MaxIdleConns, "api.max-idle-conns", DefaultMaxIdleConns, "The number of idle connections to the PDC API kept for reuse")
+	fs.DurationVar(&cfg.IdleConnTimeout, "api.idle-conn-timeout", DefaultIdleConnTimeout, "How long an idle connection to the PDC API is kept for reuse")
+	fs.BoolVar(&cfg.FollowRedirects, "api.follow-redirects", false, "Follow redirects of the PDC API to other hosts, sending them the token. Redirects to the same host are always followed")
+}
+
+// Defaults of the connection pool to the PDC API.
+const (
+	DefaultMaxIdleConns    = 10
+	DefaultIdleConnTimeout = 90 * time.Second
+)
+
+// configureTransport applies the connection pool settings to t. All requests
+// go to the PDC API, so the limit of idle connections per host is the same as
+// the total limit.
+func (cfg *Config) configureTransport(t *http.Transport) {
+	if cfg.MaxIdleConns > 0 {
+		t.MaxIdleConns = cfg.MaxIdleConns
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+}
+
+// addTokens sets Token to the first token of the -token flags, and adds the
+// others to FallbackTokens.
+func (cfg *Config) addTokens(s string) error {
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "":
+		case cfg.Token == "":
+			cfg.Token = t
+		default:
+			cfg.FallbackTokens = append(cfg.FallbackTokens, t)
+		}
+	}
+	return nil
+}
+
+// SigningTokens returns the tokens to sign with, in the order they are tried:
+// Token, then FallbackTokens.
+func (cfg Config) SigningTokens() []string {
+	var tokens []string
+	for _, t := range append([]string{cfg.Token}, cfg.FallbackTokens...) {
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// Limits of the labels included in sign requests.
+const (
+	maxLabels          = 16
+	maxLabelValueBytes = 256
+	maxHostnameBytes   = 253
+)
+
+var labelKeyRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]{0,62}$`)
+
+var keyIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.@:/-]{1,64}$`)
+
+func (cfg *Config) addLabels(s string) error {
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("invalid label %q, must be key=value", kv)
+		}
+		if !labelKeyRegexp.MatchString(k) {
+			return fmt.Errorf("invalid label key %q, must match %s", k, labelKeyRegexp)
+		}
+		if len(v) > maxLabelValueBytes {
+			return fmt.Errorf("label %q is too long, values must be at most %d bytes", k, maxLabelValueBytes)
+		}
+		if strings.IndexFunc(v, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			return fmt.Errorf("label %q contains non-printable characters", k)
+		}
+		cfg.Labels[k] = v
+	}
+	if len(cfg.Labels) > maxLabels {
+		return fmt.Errorf("too many labels, at most %d are allowed", maxLabels)
+	}
+	return nil
+}
+
+// reservedHeaders are set by the client, and cannot be set with -pdc.header.
+var reservedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Host":                true,
+	IdempotencyKeyHeader:  true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Transfer-Encoding":   true,
+	"User-Agent":          true,
+}
+
+// headerNameRegexp matches the token characters of RFC 9110, section 5.6.2.
+var headerNameRegexp = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+func (cfg *Config) addHeader(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	if !ok {
+		return fmt.Errorf("invalid header %q, must be key=value", s)
+	}
+	if !headerNameRegexp.MatchString(k) {
+		return fmt.Errorf("invalid header name %q", k)
+	}
+	k = http.CanonicalHeaderKey(k)
+	if reservedHeaders[k] {
+		return fmt.Errorf("header %q is set by the agent and cannot be overridden", k)
+	}
+	if strings.IndexFunc(v, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return fmt.Errorf("header %q contains non-printable characters", k)
+	}
+	cfg.ExtraHeaders[k] = v
+	return nil
+}
+
+// sanitizeHostname drops characters that are not valid in a hostname, and
+// truncates it to the maximum length of a hostname.
+func sanitizeHostname(h string) string {
+	h = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, h)
+	if len(h) > maxHostnameBytes {
+		h = h[:maxHostnameBytes]
+	}
+	return h
 }
 
 // Client is a PDC API client
@@ -115,7 +314,13 @@ func NewClient(cfg *Config, logger log.Logger) (Client, error) {
 
 	// If the value has not been set for testing.
 	if cfg.SignPublicKeyEndpoint == "" {
-		cfg.SignPublicKeyEndpoint = "/pdc/api/v1/sign-public-key"
+		cfg.SignPublicKeyEndpoint = DefaultSignPublicKeyEndpoint
+	}
+	if err := cfg.checkSignPublicKeyEndpoint(); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkKeyID(); err != nil {
+		return nil, err
 	}
 
 	rc := retryablehttp.NewClient()
@@ -124,27 +329,75 @@ func NewClient(cfg *Config, logger log.Logger) (Client, error) {
 	}
 	rc.Logger = &logAdapter{logger}
 	rc.CheckRetry = retryablehttp.ErrorPropagatedRetryPolicy
+	rc.Backoff = retryAfterBackoff{logger: logger, now: time.Now}.backoff
+	if t, ok := rc.HTTPClient.Transport.(*http.Transport); ok {
+		cfg.configureTransport(t)
+	}
 	hc := rc.StandardClient()
 
-	hc.Transport = httpclient.UserAgentTransport(hc.Transport, cfg.Version)
+	ua := cfg.UserAgent
+	if ua == "" {
+		ua = httpclient.UserAgent(cfg.Version)
+	}
+	hc.Transport = httpclient.UserAgentTransport(hc.Transport, ua)
+
+	var hostname string
+	if cfg.SendHostname {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get hostname: %w", err)
+		}
+		hostname = sanitizeHostname(h)
+	}
 
-	return &pdcClient{
+	c := &pdcClient{
 		cfg:        cfg,
 		httpClient: hc,
 		logger:     logger,
-	}, nil
+		hostname:   hostname,
+	}
+	// Redirects are returned by the retrying client, and handled by the
+	// outer client, so that checkRedirect sees the request they come from.
+	rc.HTTPClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	hc.CheckRedirect = c.checkRedirect
+	return c, nil
 }
 
 type pdcClient struct {
 	cfg        *Config
 	httpClient *http.Client
 	logger     log.Logger
+	hostname   string
 }
 
 func (c *pdcClient) SignSSHKey(ctx context.Context, key []byte) (*SigningResponse, error) {
-	resp, err := c.call(ctx, http.MethodPost, c.cfg.SignPublicKeyEndpoint, nil, map[string]string{
+	body := map[string]any{
 		"publicKey": string(key),
-	})
+	}
+	if c.cfg.RequestedCertTTL > 0 {
+		body["ttl"] = c.cfg.RequestedCertTTL.String()
+	}
+	if c.hostname != "" {
+		body["hostname"] = c.hostname
+	}
+	if len(c.cfg.Labels) > 0 {
+		body["labels"] = c.cfg.Labels
+	}
+	if c.cfg.KeyID != "" {
+		body["keyId"] = c.cfg.KeyID
+	}
+
+	// The key is the same for the retries and token fallbacks of this sign
+	// request, so that the PDC API can tell them apart from new requests, and
+	// does not sign twice if a response is lost.
+	idempotencyKey, err := newIdempotencyKey()
+	if err != nil {
+		level.Error(c.logger).Log("msg", "error creating idempotency key", "err", err)
+		return nil, ErrInternal
+	}
+	headers := map[string]string{IdempotencyKeyHeader: idempotencyKey}
+
+	resp, err := c.callWithTokens(ctx, http.MethodPost, c.cfg.SignPublicKeyEndpoint, nil, body, headers)
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +411,32 @@ func (c *pdcClient) SignSSHKey(ctx context.Context, key []byte) (*SigningRespons
 	return sr, nil
 }
 
-func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[string]string, body map[string]string) ([]byte, error) {
+// callWithTokens calls the PDC API with each token in turn, until one is not
+// rejected. If all tokens are rejected, the error of the last one is returned.
+func (c *pdcClient) callWithTokens(ctx context.Context, method, rpath string, params map[string]string, body map[string]any, headers map[string]string) ([]byte, error) {
+	tokens := c.cfg.SigningTokens()
+	if len(tokens) == 0 {
+		tokens = []string{""}
+	}
+
+	var resp []byte
+	var err error
+	for i, token := range tokens {
+		resp, err = c.call(ctx, method, rpath, params, body, headers, token)
+		if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrForbidden) {
+			level.Warn(c.logger).Log("msg", "token was rejected by PDC API", "token_index", i, "err", err)
+			continue
+		}
+		if err == nil && len(tokens) > 1 {
+			level.Info(c.logger).Log("msg", "token was accepted by PDC API", "token_index", i)
+		}
+		return resp, err
+	}
+
+	return resp, err
+}
+
+func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[string]string, body map[string]any, headers map[string]string, token string) ([]byte, error) {
 
 	url := *c.cfg.URL
 	url.Path = path.Join(url.Path, rpath)
@@ -184,7 +462,7 @@ func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[s
 	b := []byte{}
 	buf := bytes.NewBuffer(b)
 	encoder := base64.NewEncoder(base64.StdEncoding, buf)
-	_, werr := encoder.Write([]byte(c.cfg.HostedGrafanaID + ":" + c.cfg.Token))
+	_, werr := encoder.Write([]byte(c.cfg.HostedGrafanaID + ":" + token))
 	err = encoder.Close()
 	if werr != nil || err != nil {
 		level.Error(c.logger).Log("msg", "error encoding Authorization header", "err", err)
@@ -193,6 +471,12 @@ func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[s
 
 	req.Header.Add("Authorization", "Basic "+buf.String())
 
+	for header, value := range c.cfg.ExtraHeaders {
+		req.Header.Set(header, value)
+	}
+	for header, value := range headers {
+		req.Header.Set(header, value)
+	}
 	for header, value := range c.cfg.DevHeaders {
 		req.Header.Add(header, value)
 	}
@@ -213,6 +497,8 @@ func (c *pdcClient) call(ctx context.Context, method, rpath string, params map[s
 		return respB, nil
 	case http.StatusUnauthorized:
 		return respB, ErrInvalidCredentials
+	case http.StatusForbidden:
+		return respB, ErrForbidden
 	default:
 		level.Error(c.logger).Log("msg", "unknown response from PDC API", "code", resp.StatusCode)
 		return respB, ErrInternal
@@ -1,11 +1,30 @@
 package pdc_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 var cert = `
@@ -108,3 +127,614 @@ func TestSigningResponse_UnmarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_SignSSHKey(t *testing.T) {
+	testcases := []struct {
+		name             string
+		requestedCertTTL time.Duration
+		wantBody         map[string]string
+	}{
+		{
+			name:     "no ttl requested: only the public key is sent",
+			wantBody: map[string]string{"publicKey": "key"},
+		},
+		{
+			name:             "ttl requested: ttl is sent with the public key",
+			requestedCertTTL: 30 * time.Minute,
+			wantBody:         map[string]string{"publicKey": "key", "ttl": "30m0s"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body map[string]string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+				enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+				assert.NoError(t, err)
+				_, _ = w.Write(enc)
+			}))
+			defer ts.Close()
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			c, err := pdc.NewClient(&pdc.Config{URL: u, RequestedCertTTL: tc.requestedCertTTL}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			_, err = c.SignSSHKey(context.Background(), []byte("key"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantBody, body)
+		})
+	}
+}
+
+func TestClient_SignSSHKeyMetadata(t *testing.T) {
+	var body struct {
+		Hostname string            `json:"hostname"`
+		Labels   map[string]string `json:"labels"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	cfg := &pdc.Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-send-hostname", "-labels", "env=prod,team=db"}))
+	cfg.URL = u
+
+	c, err := pdc.NewClient(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = c.SignSSHKey(context.Background(), []byte("key"))
+	require.NoError(t, err)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, hostname, body.Hostname)
+	assert.Equal(t, map[string]string{"env": "prod", "team": "db"}, body.Labels)
+}
+
+func TestConfig_Labels(t *testing.T) {
+	testcases := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "valid labels",
+			args: []string{"-labels", "env=prod, team=db", "-labels", "region=eu"},
+			want: map[string]string{"env": "prod", "team": "db", "region": "eu"},
+		},
+		{
+			name:    "missing value separator",
+			args:    []string{"-labels", "env"},
+			wantErr: `invalid label "env", must be key=value`,
+		},
+		{
+			name:    "invalid key",
+			args:    []string{"-labels", "1env=prod"},
+			wantErr: `invalid label key "1env"`,
+		},
+		{
+			name:    "oversized value",
+			args:    []string{"-labels", "env=" + strings.Repeat("a", 257)},
+			wantErr: `label "env" is too long, values must be at most 256 bytes`,
+		},
+		{
+			name:    "non-printable value",
+			args:    []string{"-labels", "env=pr\x00od"},
+			wantErr: `label "env" contains non-printable characters`,
+		},
+		{
+			name:    "too many labels",
+			args:    []string{"-labels", manyLabels(17)},
+			wantErr: "too many labels, at most 16 are allowed",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &pdc.Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+
+			err := fs.Parse(tc.args)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, cfg.Labels)
+		})
+	}
+}
+
+func TestClient_ExtraHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+
+		enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	cfg := &pdc.Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-pdc.header", "x-api-key=secret", "-pdc.header", "X-Tenant=a,b"}))
+	cfg.URL = u
+	cfg.Token = "token"
+
+	c, err := pdc.NewClient(cfg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	_, err = c.SignSSHKey(context.Background(), []byte("key"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "secret", got.Get("X-Api-Key"))
+	assert.Equal(t, "a,b", got.Get("X-Tenant"))
+	assert.True(t, strings.HasPrefix(got.Get("Authorization"), "Basic "))
+}
+
+func TestConfig_Headers(t *testing.T) {
+	testcases := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "valid headers",
+			args: []string{"-pdc.header", "x-scope-orgid=1", "-pdc.header", "X-Route = eu "},
+			want: map[string]string{"X-Scope-Orgid": "1", "X-Route": "eu"},
+		},
+		{
+			name:    "missing value separator",
+			args:    []string{"-pdc.header", "X-Route"},
+			wantErr: `invalid header "X-Route", must be key=value`,
+		},
+		{
+			name:    "invalid name",
+			args:    []string{"-pdc.header", "X Route=eu"},
+			wantErr: `invalid header name "X Route"`,
+		},
+		{
+			name:    "reserved header",
+			args:    []string{"-pdc.header", "authorization=Bearer x"},
+			wantErr: `header "Authorization" is set by the agent and cannot be overridden`,
+		},
+		{
+			name:    "non-printable value",
+			args:    []string{"-pdc.header", "X-Route=e\r\nu"},
+			wantErr: `header "X-Route" contains non-printable characters`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &pdc.Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+
+			err := fs.Parse(tc.args)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, cfg.ExtraHeaders)
+		})
+	}
+}
+
+func manyLabels(n int) string {
+	labels := make([]string, n)
+	for i := range labels {
+		labels[i] = fmt.Sprintf("l%d=v", i)
+	}
+	return strings.Join(labels, ",")
+}
+
+func TestClient_SignPublicKeyEndpoint(t *testing.T) {
+	testcases := []struct {
+		name     string
+		endpoint string
+		wantPath string
+		wantErr  string
+	}{
+		{
+			name:     "default endpoint",
+			wantPath: "/pdc/api/v1/sign-public-key",
+		},
+		{
+			name:     "endpoint with a path prefix",
+			endpoint: "/prefix/pdc/api/v1/sign-public-key",
+			wantPath: "/prefix/pdc/api/v1/sign-public-key",
+		},
+		{
+			name:     "endpoint must start with a slash",
+			endpoint: "pdc/api/v1/sign-public-key",
+			wantErr:  `-sign-public-key-endpoint must start with /, got "pdc/api/v1/sign-public-key"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotPath string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+
+				enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+				assert.NoError(t, err)
+				_, _ = w.Write(enc)
+			}))
+			defer ts.Close()
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			c, err := pdc.NewClient(&pdc.Config{URL: u, SignPublicKeyEndpoint: tc.endpoint}, log.NewNopLogger())
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			_, err = c.SignSSHKey(context.Background(), []byte("key"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantPath, gotPath)
+		})
+	}
+}
+
+func TestClient_UserAgent(t *testing.T) {
+	testcases := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{
+			name: "default user agent contains the version",
+			want: "pdc-agent/1.2.3 (" + runtime.GOOS + "/" + runtime.GOARCH + ")",
+		},
+		{
+			name:      "user agent can be overridden",
+			userAgent: "test-agent",
+			want:      "test-agent",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.UserAgent()
+
+				enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+				assert.NoError(t, err)
+				_, _ = w.Write(enc)
+			}))
+			defer ts.Close()
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			c, err := pdc.NewClient(&pdc.Config{URL: u, Version: "1.2.3", UserAgent: tc.userAgent}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			_, err = c.SignSSHKey(context.Background(), []byte("key"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestClient_SignSSHKeyTokens(t *testing.T) {
+	testcases := []struct {
+		name       string
+		tokens     []string
+		validToken string
+		wantErr    error
+		wantCalls  int
+	}{
+		{
+			name:       "first token succeeds",
+			tokens:     []string{"a", "b"},
+			validToken: "a",
+			wantCalls:  1,
+		},
+		{
+			name:       "first token is rejected: fall back to the second",
+			tokens:     []string{"a", "b"},
+			validToken: "b",
+			wantCalls:  2,
+		},
+		{
+			name:       "all tokens are rejected",
+			tokens:     []string{"a", "b"},
+			validToken: "c",
+			wantErr:    pdc.ErrForbidden,
+			wantCalls:  2,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				_, token, _ := r.BasicAuth()
+				if token != tc.validToken {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+
+				enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+				assert.NoError(t, err)
+				_, _ = w.Write(enc)
+			}))
+			defer ts.Close()
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			c, err := pdc.NewClient(&pdc.Config{URL: u, HostedGrafanaID: "1", Token: tc.tokens[0], FallbackTokens: tc.tokens[1:]}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			_, err = c.SignSSHKey(context.Background(), []byte("key"))
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantCalls, calls)
+		})
+	}
+}
+
+func TestConfig_Tokens(t *testing.T) {
+	cfg := &pdc.Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+
+	require.NoError(t, fs.Parse([]string{"-token", "a, b", "-token", "c"}))
+	assert.Equal(t, "a", cfg.Token)
+	assert.Equal(t, []string{"b", "c"}, cfg.FallbackTokens)
+	assert.Equal(t, []string{"a", "b", "c"}, cfg.SigningTokens())
+}
+
+func TestConfig_SigningTokens(t *testing.T) {
+	// Programs embedding the package can still set only Token.
+	assert.Equal(t, []string{"a"}, pdc.Config{Token: "a"}.SigningTokens())
+	assert.Equal(t, []string{"b"}, pdc.Config{FallbackTokens: []string{"b"}}.SigningTokens())
+	assert.Empty(t, pdc.Config{}.SigningTokens())
+}
+
+func TestClient_KeyID(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	// The mock PDC API signs the public key with the requested key id.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			PublicKey string `json:"publicKey"`
+			KeyID     string `json:"keyId"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body.PublicKey))
+		assert.NoError(t, err)
+
+		c := &ssh.Certificate{
+			Key:         pub,
+			KeyId:       body.KeyID,
+			CertType:    ssh.UserCert,
+			ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		assert.NoError(t, c.SignCert(rand.Reader, ca))
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ssh.MarshalAuthorizedKey(c)})
+		_ = json.NewEncoder(w).Encode(map[string]string{"known_hosts": "kh", "certificate": string(certPEM)})
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	t.Run("key id is sent", func(t *testing.T) {
+		c, err := pdc.NewClient(&pdc.Config{URL: u, KeyID: "team-db@host01"}, log.NewNopLogger())
+		require.NoError(t, err)
+
+		resp, err := c.SignSSHKey(context.Background(), ssh.MarshalAuthorizedKey(sshPub))
+		require.NoError(t, err)
+		assert.Equal(t, "team-db@host01", resp.Certificate.KeyId)
+	})
+
+	t.Run("key id is not sent by default", func(t *testing.T) {
+		c, err := pdc.NewClient(&pdc.Config{URL: u}, log.NewNopLogger())
+		require.NoError(t, err)
+
+		resp, err := c.SignSSHKey(context.Background(), ssh.MarshalAuthorizedKey(sshPub))
+		require.NoError(t, err)
+		assert.Empty(t, resp.Certificate.KeyId)
+	})
+
+	for _, invalid := range []string{"team db", "team#db", strings.Repeat("a", 65)} {
+		t.Run("invalid key id "+invalid, func(t *testing.T) {
+			_, err := pdc.NewClient(&pdc.Config{URL: u, KeyID: invalid}, log.NewNopLogger())
+			assert.ErrorContains(t, err, "invalid -cert-key-id")
+		})
+	}
+}
+
+func TestClient_IdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(pdc.IdempotencyKeyHeader))
+
+		// The first request of each sign request times out on the server.
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		fail = true
+		enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	c, err := pdc.NewClient(&pdc.Config{URL: u, HostedGrafanaID: "1", Token: "token"}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = c.SignSSHKey(context.Background(), []byte("key"))
+		require.NoError(t, err)
+	}
+
+	require.Len(t, keys, 4)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, keys[0])
+	assert.Equal(t, keys[0], keys[1], "retries of a sign request must reuse its key")
+	assert.Equal(t, keys[2], keys[3], "retries of a sign request must reuse its key")
+	assert.NotEqual(t, keys[0], keys[2], "sign requests must have different keys")
+}
+
+func TestClient_Redirects(t *testing.T) {
+	// newAPI returns a PDC API that records the Authorization header of the
+	// sign requests it receives.
+	newAPI := func(t *testing.T, auth *string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != pdc.DefaultSignPublicKeyEndpoint {
+				http.Redirect(w, r, pdc.DefaultSignPublicKeyEndpoint, http.StatusTemporaryRedirect)
+				return
+			}
+			*auth = r.Header.Get("Authorization")
+			enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+			assert.NoError(t, err)
+			_, _ = w.Write(enc)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	// newRedirector returns a server that redirects all requests to target.
+	newRedirector := func(t *testing.T, target string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target+r.URL.Path, http.StatusTemporaryRedirect)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	sign := func(t *testing.T, apiURL string, followRedirects bool, logs *bytes.Buffer) error {
+		u, err := url.Parse(apiURL)
+		require.NoError(t, err)
+		cfg := &pdc.Config{
+			URL:                   u,
+			HostedGrafanaID:       "1",
+			Token:                 "token",
+			RetryMax:              1,
+			SignPublicKeyEndpoint: "/old" + pdc.DefaultSignPublicKeyEndpoint,
+			FollowRedirects:       followRedirects,
+		}
+		c, err := pdc.NewClient(cfg, log.NewLogfmtLogger(logs))
+		require.NoError(t, err)
+		_, err = c.SignSSHKey(context.Background(), []byte("key"))
+		return err
+	}
+
+	t.Run("a redirect to the same host is followed with the token", func(t *testing.T) {
+		var auth string
+		api := newAPI(t, &auth)
+
+		require.NoError(t, sign(t, api.URL, false, &bytes.Buffer{}))
+		assert.True(t, strings.HasPrefix(auth, "Basic "), "the token is sent")
+	})
+
+	t.Run("a redirect to another host is not followed by default", func(t *testing.T) {
+		var auth string
+		api := newAPI(t, &auth)
+		redirector := newRedirector(t, api.URL)
+
+		var logs bytes.Buffer
+		err := sign(t, redirector.URL, false, &logs)
+		assert.ErrorIs(t, err, pdc.ErrInternal)
+		assert.Empty(t, auth, "the other host must not be called")
+		assert.Contains(t, logs.String(), "PDC API redirected to another host, not following it")
+		assert.Contains(t, logs.String(), "location="+api.URL+"/old"+pdc.DefaultSignPublicKeyEndpoint)
+	})
+
+	t.Run("a redirect to another host is followed with the token when opted in", func(t *testing.T) {
+		var auth string
+		api := newAPI(t, &auth)
+		redirector := newRedirector(t, api.URL)
+
+		require.NoError(t, sign(t, redirector.URL, true, &bytes.Buffer{}))
+		assert.True(t, strings.HasPrefix(auth, "Basic "), "the token is sent")
+	})
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+
+		// The first request is rate limited.
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		enc, err := json.Marshal(map[string]string{"known_hosts": "kh", "certificate": cert})
+		assert.NoError(t, err)
+		_, _ = w.Write(enc)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	var logs bytes.Buffer
+	c, err := pdc.NewClient(&pdc.Config{URL: u, HostedGrafanaID: "1", Token: "token"}, log.NewLogfmtLogger(log.NewSyncWriter(&logs)))
+	require.NoError(t, err)
+
+	_, err = c.SignSSHKey(context.Background(), []byte("key"))
+	require.NoError(t, err)
+
+	require.Len(t, times, 2)
+	assert.GreaterOrEqual(t, times[1].Sub(times[0]), time.Second, "the retry must wait as directed by Retry-After")
+	assert.Contains(t, logs.String(), "waiting as directed by Retry-After")
+}
@@ -0,0 +1,49 @@
+package pdc
+
+import (
+	"os"
+	"strings"
+)
+
+// maxKeyIDLength is the maximum length of a key id, see keyIDRegexp.
+const maxKeyIDLength = 64
+
+// SetAutoKeyID sets KeyID to pdc-agent/<version>/<cluster>/<hostname> if
+// AutoKeyID is set and KeyID is not, so that the gateway audit logs show
+// which agent connected without more configuration.
+func (cfg *Config) SetAutoKeyID(cluster string) {
+	if !cfg.AutoKeyID || cfg.KeyID != "" {
+		return
+	}
+	hostname, _ := os.Hostname()
+	cfg.KeyID = agentKeyID(cfg.Version, cluster, hostname)
+}
+
+// agentKeyID returns pdc-agent/<version>/<cluster>/<hostname>, with the
+// characters that a key id cannot have replaced with _, truncated to
+// maxKeyIDLength. Unknown parts are "unknown".
+func agentKeyID(version, cluster, hostname string) string {
+	parts := []string{"pdc-agent"}
+	for _, p := range []string{version, cluster, hostname} {
+		if p == "" {
+			p = "unknown"
+		}
+		parts = append(parts, strings.Map(keyIDRune, p))
+	}
+	id := strings.Join(parts, "/")
+	if len(id) > maxKeyIDLength {
+		id = id[:maxKeyIDLength]
+	}
+	return id
+}
+
+// keyIDRune returns r if a key id can have it, and _ otherwise.
+func keyIDRune(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return r
+	case strings.ContainsRune("_.@:-", r):
+		return r
+	}
+	return '_'
+}
@@ -0,0 +1,78 @@
+package pdc
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentKeyID(t *testing.T) {
+	testcases := []struct {
+		name     string
+		version  string
+		cluster  string
+		hostname string
+		want     string
+	}{
+		{
+			name:     "built from version, cluster and hostname",
+			version:  "v0.0.40",
+			cluster:  "prod-us-east-0",
+			hostname: "db-proxy-01.internal",
+			want:     "pdc-agent/v0.0.40/prod-us-east-0/db-proxy-01.internal",
+		},
+		{
+			name:     "invalid characters are replaced",
+			version:  "v0.0.40+dirty",
+			cluster:  "prod-us-east-0",
+			hostname: "host 01",
+			want:     "pdc-agent/v0.0.40_dirty/prod-us-east-0/host_01",
+		},
+		{
+			name: "unknown parts",
+			want: "pdc-agent/unknown/unknown/unknown",
+		},
+		{
+			name:     "truncated to the maximum length",
+			version:  "v0.0.40",
+			cluster:  "prod-us-east-0",
+			hostname: strings.Repeat("h", 100),
+			want:     "pdc-agent/v0.0.40/prod-us-east-0/" + strings.Repeat("h", 31),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := agentKeyID(tc.version, tc.cluster, tc.hostname)
+			assert.Equal(t, tc.want, got)
+			assert.Regexp(t, keyIDRegexp, got)
+		})
+	}
+}
+
+func TestConfig_SetAutoKeyID(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := &Config{Version: "v0.0.40"}
+		cfg.SetAutoKeyID("prod-us-east-0")
+		assert.Empty(t, cfg.KeyID)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		cfg := &Config{Version: "v0.0.40", AutoKeyID: true}
+		cfg.SetAutoKeyID("prod-us-east-0")
+		assert.Equal(t, agentKeyID("v0.0.40", "prod-us-east-0", hostname), cfg.KeyID)
+		assert.True(t, strings.HasPrefix(cfg.KeyID, "pdc-agent/v0.0.40/prod-us-east-0/"))
+	})
+
+	t.Run("an explicit key id takes precedence", func(t *testing.T) {
+		cfg := &Config{Version: "v0.0.40", AutoKeyID: true, KeyID: "team-db@host01"}
+		cfg.SetAutoKeyID("prod-us-east-0")
+		assert.Equal(t, "team-db@host01", cfg.KeyID)
+	})
+}
@@ -0,0 +1,40 @@
+package pdc
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+)
+
+// maxRedirects is the number of redirects followed for a request to the PDC
+// API, as in the default HTTP client.
+const maxRedirects = 10
+
+// checkRedirect is the redirect policy of requests to the PDC API. Redirects
+// to the same scheme and host are followed. Redirects to another origin are
+// not, so that the token and the extra headers are not sent to it, unless
+// FollowRedirects is set. The redirect response is returned instead, and
+// fails the request.
+func (c *pdcClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	from := via[0].URL
+	if req.URL.Scheme == from.Scheme && req.URL.Host == from.Host {
+		return nil
+	}
+	if !c.cfg.FollowRedirects {
+		level.Warn(c.logger).Log("msg", "PDC API redirected to another host, not following it. Set -api.follow-redirects to follow it", "from", from.Host, "location", req.URL.Redacted())
+		return http.ErrUseLastResponse
+	}
+
+	// The HTTP client drops the Authorization header on redirects to other
+	// domains. Following them is opted in, so keep it.
+	level.Info(c.logger).Log("msg", "following PDC API redirect to another host", "from", from.Host, "location", req.URL.Redacted())
+	if auth := via[0].Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
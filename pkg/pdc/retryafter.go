@@ -0,0 +1,69 @@
+package pdc
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// maxRetryAfter caps the wait directed by a Retry-After header, so that a
+// misconfigured server cannot hold a sign request for hours.
+const maxRetryAfter = 5 * time.Minute
+
+// retryAfterBackoff waits as directed by the Retry-After header of rate
+// limited (429) and unavailable (503) responses of the PDC API before
+// retrying, and uses the exponential backoff of the retrying client
+// otherwise.
+type retryAfterBackoff struct {
+	logger log.Logger
+	now    func() time.Time
+}
+
+func (b retryAfterBackoff) backoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), b.now()); ok {
+			if wait > maxRetryAfter {
+				level.Warn(b.logger).Log("msg", "Retry-After of the PDC API is too long, waiting the maximum", "retry_after", wait, "max", maxRetryAfter)
+				wait = maxRetryAfter
+			}
+			level.Info(b.logger).Log("msg", "PDC API asked to retry later, waiting as directed by Retry-After", "status", resp.StatusCode, "wait", wait)
+			return wait
+		}
+	}
+	return retryablehttp.DefaultBackoff(min, max, attemptNum, nil)
+}
+
+// maxRetryAfterSeconds is the largest number of seconds of a Retry-After
+// header that fits in a time.Duration.
+const maxRetryAfterSeconds = math.MaxInt64 / int64(time.Second)
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or
+// an HTTP date, into the time to wait from now. A date in the past means no
+// wait. It returns false if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > maxRetryAfterSeconds {
+			seconds = maxRetryAfterSeconds
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
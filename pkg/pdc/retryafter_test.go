@@ -0,0 +1,111 @@
+package pdc
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	testcases := []struct {
+		name   string
+		header string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "seconds", header: "120", want: 2 * time.Minute, wantOK: true},
+		{name: "zero seconds", header: "0", want: 0, wantOK: true},
+		{name: "HTTP date", header: "Sat, 01 Jun 2024 10:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{name: "obsolete HTTP date format", header: "Saturday, 01-Jun-24 10:01:00 GMT", want: time.Minute, wantOK: true},
+		{name: "HTTP date in the past", header: "Sat, 01 Jun 2024 09:00:00 GMT", want: 0, wantOK: true},
+		{name: "huge number of seconds", header: "99999999999999999", want: time.Duration(maxRetryAfterSeconds) * time.Second, wantOK: true},
+		{name: "missing", header: ""},
+		{name: "negative seconds", header: "-1"},
+		{name: "invalid", header: "soon"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tc.header, now)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRetryAfterBackoff(t *testing.T) {
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	response := func(code int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: code, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	testcases := []struct {
+		name    string
+		resp    *http.Response
+		want    time.Duration
+		wantLog string
+	}{
+		{
+			name:    "429 with seconds",
+			resp:    response(http.StatusTooManyRequests, "7"),
+			want:    7 * time.Second,
+			wantLog: `msg="PDC API asked to retry later, waiting as directed by Retry-After" status=429 wait=7s`,
+		},
+		{
+			name:    "429 with an HTTP date",
+			resp:    response(http.StatusTooManyRequests, "Sat, 01 Jun 2024 10:00:45 GMT"),
+			want:    45 * time.Second,
+			wantLog: `status=429 wait=45s`,
+		},
+		{
+			name:    "503 with seconds",
+			resp:    response(http.StatusServiceUnavailable, "3"),
+			want:    3 * time.Second,
+			wantLog: `status=503 wait=3s`,
+		},
+		{
+			name:    "too long",
+			resp:    response(http.StatusTooManyRequests, "86400"),
+			want:    maxRetryAfter,
+			wantLog: `msg="Retry-After of the PDC API is too long, waiting the maximum"`,
+		},
+		{
+			name: "429 without Retry-After uses the exponential backoff",
+			resp: response(http.StatusTooManyRequests, ""),
+			want: 4 * time.Second,
+		},
+		{
+			name: "Retry-After of other responses is ignored",
+			resp: response(http.StatusInternalServerError, "60"),
+			want: 4 * time.Second,
+		},
+		{
+			name: "no response",
+			want: 4 * time.Second,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			b := retryAfterBackoff{logger: log.NewLogfmtLogger(&buf), now: func() time.Time { return now }}
+
+			assert.Equal(t, tc.want, b.backoff(time.Second, 30*time.Second, 2, tc.resp))
+			if tc.wantLog != "" {
+				assert.Contains(t, buf.String(), tc.wantLog)
+			} else {
+				assert.Empty(t, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package pdc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tokenTimeLeeway is how far a token can be past its expiry, or before its
+// not-before time, before it is reported, to allow for clock skew.
+const tokenTimeLeeway = time.Minute
+
+// CheckTokenValidity returns an error wrapping ErrInvalidCredentials if token
+// is a JWT that is expired or not yet valid at now. The signature is not
+// verified, that is left to the PDC API. Tokens that are not JWTs, or that
+// have no exp or nbf claims, are not checked.
+func CheckTokenValidity(token string, now time.Time) error {
+	claims, ok := parseJWTClaims(token)
+	if !ok {
+		return nil
+	}
+	if claims.Exp != nil {
+		exp := time.Unix(int64(*claims.Exp), 0)
+		if now.After(exp.Add(tokenTimeLeeway)) {
+			return fmt.Errorf("%w: signing token expired at %s", ErrInvalidCredentials, exp.UTC().Format(time.RFC3339))
+		}
+	}
+	if claims.Nbf != nil {
+		nbf := time.Unix(int64(*claims.Nbf), 0)
+		if now.Before(nbf.Add(-tokenTimeLeeway)) {
+			return fmt.Errorf("%w: signing token is not valid until %s", ErrInvalidCredentials, nbf.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// jwtClaims are the registered JWT claims that CheckTokenValidity checks.
+// They are numbers of seconds since the epoch.
+type jwtClaims struct {
+	Exp *float64 `json:"exp"`
+	Nbf *float64 `json:"nbf"`
+}
+
+// parseJWTClaims returns the claims of token, if it looks like a JWT: three
+// base64url parts, of which the first one is a JSON header with an alg.
+func parseJWTClaims(token string) (jwtClaims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, false
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if !decodeJWTPart(parts[0], &header) || header.Alg == "" {
+		return jwtClaims{}, false
+	}
+
+	var claims jwtClaims
+	if !decodeJWTPart(parts[1], &claims) {
+		return jwtClaims{}, false
+	}
+	return claims, true
+}
+
+func decodeJWTPart(part string, v any) bool {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
@@ -0,0 +1,72 @@
+package pdc
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newJWT returns an unsigned JWT with the claims, as JSON.
+func newJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestCheckTokenValidity(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testcases := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "valid JWT",
+			token: newJWT(`{"exp":1717246800,"nbf":1717239600}`), // 13:00 and 11:00
+		},
+		{
+			name:    "expired JWT",
+			token:   newJWT(`{"exp":1717239600}`), // 11:00
+			wantErr: "invalid credentials: signing token expired at 2024-06-01T11:00:00Z",
+		},
+		{
+			name:  "expired within the clock skew leeway",
+			token: newJWT(`{"exp":1717243170}`), // 11:59:30
+		},
+		{
+			name:    "JWT not yet valid",
+			token:   newJWT(`{"nbf":1717246800}`), // 13:00
+			wantErr: "invalid credentials: signing token is not valid until 2024-06-01T13:00:00Z",
+		},
+		{
+			name:  "JWT without time claims",
+			token: newJWT(`{"sub":"1"}`),
+		},
+		{
+			name:  "not a JWT",
+			token: "glc_eyJvIjoiMSIsIm4iOiJwZGMiLCJrIjoiYWJjIn0=",
+		},
+		{
+			name:  "three parts that are not base64",
+			token: "not.a.jwt",
+		},
+		{
+			name:  "empty token",
+			token: "",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckTokenValidity(tc.token, now)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.wantErr)
+			assert.ErrorIs(t, err, ErrInvalidCredentials)
+		})
+	}
+}
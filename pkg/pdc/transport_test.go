@@ -0,0 +1,30 @@
+package pdc
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_ConfigureTransport(t *testing.T) {
+	t.Run("provided values", func(t *testing.T) {
+		cfg := &Config{MaxIdleConns: 32, IdleConnTimeout: 5 * time.Minute}
+		tr := &http.Transport{}
+		cfg.configureTransport(tr)
+
+		assert.Equal(t, 32, tr.MaxIdleConns)
+		assert.Equal(t, 32, tr.MaxIdleConnsPerHost)
+		assert.Equal(t, 5*time.Minute, tr.IdleConnTimeout)
+	})
+
+	t.Run("unset values keep the transport defaults", func(t *testing.T) {
+		tr := &http.Transport{MaxIdleConns: 100, MaxIdleConnsPerHost: 2, IdleConnTimeout: time.Minute}
+		(&Config{}).configureTransport(tr)
+
+		assert.Equal(t, 100, tr.MaxIdleConns)
+		assert.Equal(t, 2, tr.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+	})
+}
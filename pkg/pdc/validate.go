@@ -0,0 +1,55 @@
+package pdc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the config, and returns all the problems found, joined in
+// one error, rather than only the first one.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.URL == nil {
+		errs = append(errs, errors.New("the PDC API URL is not set"))
+	} else if cfg.URL.Scheme == "" || cfg.URL.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid PDC API URL %q, must be an absolute URL such as https://host", cfg.URL))
+	}
+	if cfg.HostedGrafanaID != "" {
+		if _, err := strconv.ParseUint(cfg.HostedGrafanaID, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("-gcloud-hosted-grafana-id must be numeric, got %q", cfg.HostedGrafanaID))
+		}
+	}
+	if cfg.RetryMax < 0 {
+		errs = append(errs, fmt.Errorf("-retrymax must not be negative, got %d", cfg.RetryMax))
+	}
+	if cfg.RequestedCertTTL < 0 {
+		errs = append(errs, fmt.Errorf("-cert-ttl must not be negative, got %s", cfg.RequestedCertTTL))
+	}
+	if cfg.MaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("-api.max-idle-conns must not be negative, got %d", cfg.MaxIdleConns))
+	}
+	if cfg.IdleConnTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-api.idle-conn-timeout must not be negative, got %s", cfg.IdleConnTimeout))
+	}
+	errs = append(errs, cfg.checkSignPublicKeyEndpoint(), cfg.checkKeyID())
+	return errors.Join(errs...)
+}
+
+// checkSignPublicKeyEndpoint returns an error if SignPublicKeyEndpoint is set
+// and is not a path.
+func (cfg *Config) checkSignPublicKeyEndpoint() error {
+	if cfg.SignPublicKeyEndpoint != "" && !strings.HasPrefix(cfg.SignPublicKeyEndpoint, "/") {
+		return fmt.Errorf("-sign-public-key-endpoint must start with /, got %q", cfg.SignPublicKeyEndpoint)
+	}
+	return nil
+}
+
+// checkKeyID returns an error if KeyID is set and is not a valid key id.
+func (cfg *Config) checkKeyID() error {
+	if cfg.KeyID != "" && !keyIDRegexp.MatchString(cfg.KeyID) {
+		return fmt.Errorf("invalid -cert-key-id %q, must match %s", cfg.KeyID, keyIDRegexp)
+	}
+	return nil
+}
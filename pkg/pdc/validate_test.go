@@ -0,0 +1,68 @@
+package pdc
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	validConfig := func() *Config {
+		u, _ := url.Parse("https://private-datasource-connect-api-prod-us-east-0.grafana.net")
+		return &Config{HostedGrafanaID: "1", URL: u, SignPublicKeyEndpoint: DefaultSignPublicKeyEndpoint}
+	}
+
+	testcases := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr []string
+	}{
+		{
+			name:   "valid",
+			modify: func(cfg *Config) {},
+		},
+		{
+			name:    "URL not set",
+			modify:  func(cfg *Config) { cfg.URL = nil },
+			wantErr: []string{"the PDC API URL is not set"},
+		},
+		{
+			name:    "relative URL",
+			modify:  func(cfg *Config) { cfg.URL = &url.URL{Path: "api.example.com"} },
+			wantErr: []string{`invalid PDC API URL "api.example.com"`},
+		},
+		{
+			name: "all problems are reported",
+			modify: func(cfg *Config) {
+				cfg.HostedGrafanaID = "abc"
+				cfg.RequestedCertTTL = -time.Minute
+				cfg.SignPublicKeyEndpoint = "sign"
+				cfg.KeyID = "team db"
+			},
+			wantErr: []string{
+				`-gcloud-hosted-grafana-id must be numeric, got "abc"`,
+				"-cert-ttl must not be negative",
+				"-sign-public-key-endpoint must start with /",
+				`invalid -cert-key-id "team db"`,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.modify(cfg)
+
+			err := cfg.Validate()
+			if len(tc.wantErr) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, want := range tc.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"math"
+	"math/rand"
 	"time"
 
 	"github.com/grafana/pdc-agent/pkg/random"
@@ -47,3 +49,21 @@ type ResetBackoffError struct{}
 func (e ResetBackoffError) Error() string {
 	return "ResetBackoffError"
 }
+
+// Jitter sleeps for a random duration in [0, max). It returns early with the
+// context error if ctx is done first.
+func Jitter(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(max))))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -30,3 +31,32 @@ func TestForever(t *testing.T) {
 		assert.Equal(t, 1000, attempts)
 	})
 }
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sleep is bounded by max", func(t *testing.T) {
+		t.Parallel()
+
+		start := time.Now()
+		assert.NoError(t, Jitter(context.Background(), 50*time.Millisecond))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("sleep aborts when the context is canceled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		start := time.Now()
+		assert.ErrorIs(t, Jitter(ctx, time.Hour), context.Canceled)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("no sleep when max is 0", func(t *testing.T) {
+		t.Parallel()
+
+		assert.NoError(t, Jitter(context.Background(), 0))
+	})
+}
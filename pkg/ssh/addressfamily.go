@@ -0,0 +1,41 @@
+package ssh
+
+import "fmt"
+
+// Address families of the connections to the gateway, as accepted by the ssh
+// AddressFamily option.
+const (
+	AddressFamilyAny   = "any"
+	AddressFamilyInet  = "inet"
+	AddressFamilyInet6 = "inet6"
+)
+
+func (cfg *Config) setAddressFamily(s string) error {
+	if err := checkAddressFamily(s); err != nil {
+		return err
+	}
+	cfg.AddressFamily = s
+	return nil
+}
+
+// checkAddressFamily returns an error if s is not an address family accepted
+// by ssh.
+func checkAddressFamily(s string) error {
+	switch s {
+	case AddressFamilyAny, AddressFamilyInet, AddressFamilyInet6:
+		return nil
+	}
+	return fmt.Errorf("invalid address family %q, must be one of %s, %s or %s", s, AddressFamilyAny, AddressFamilyInet, AddressFamilyInet6)
+}
+
+// dialNetwork returns the network of the connections the agent opens to the
+// gateway, so that they use the same address family as ssh.
+func (cfg Config) dialNetwork() string {
+	switch cfg.AddressFamily {
+	case AddressFamilyInet:
+		return "tcp4"
+	case AddressFamilyInet6:
+		return "tcp6"
+	}
+	return "tcp"
+}
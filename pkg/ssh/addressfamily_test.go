@@ -0,0 +1,75 @@
+package ssh
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_AddressFamily(t *testing.T) {
+	testcases := []struct {
+		name        string
+		args        []string
+		wantNetwork string
+		wantOption  string
+	}{
+		{name: "default", args: nil, wantNetwork: "tcp"},
+		{name: "any", args: []string{"-ssh.address-family", "any"}, wantNetwork: "tcp"},
+		{name: "inet", args: []string{"-ssh.address-family", "inet"}, wantNetwork: "tcp4", wantOption: "AddressFamily=inet"},
+		{name: "inet6", args: []string{"-ssh.address-family", "inet6"}, wantNetwork: "tcp6", wantOption: "AddressFamily=inet6"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			cfg.RegisterFlags(fs)
+			require.NoError(t, fs.Parse(tc.args))
+			cfg.URL = &url.URL{Host: "host.grafana.net"}
+
+			assert.Equal(t, tc.wantNetwork, cfg.dialNetwork())
+
+			flags, err := NewClient(cfg, log.NewNopLogger(), nil).SSHFlagsFromConfig()
+			require.NoError(t, err)
+			if tc.wantOption != "" {
+				assert.Contains(t, flags, tc.wantOption)
+			} else {
+				assert.NotContains(t, strings.Join(flags, " "), "AddressFamily")
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := &Config{}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.RegisterFlags(fs)
+		assert.ErrorContains(t, fs.Parse([]string{"-ssh.address-family", "ipv4"}), `invalid address family "ipv4"`)
+	})
+}
+
+func TestClient_CheckGatewayAddressFamily(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+
+	newClient := func(family string) *Client {
+		cfg := DefaultConfig()
+		cfg.URL = &url.URL{Host: addr.IP.String()}
+		cfg.Port = addr.Port
+		cfg.AddressFamily = family
+		return NewClient(cfg, log.NewNopLogger(), nil)
+	}
+
+	assert.NoError(t, newClient(AddressFamilyInet).checkGateway(context.Background()))
+	assert.Error(t, newClient(AddressFamilyInet6).checkGateway(context.Background()), "an IPv4 address cannot be dialed over IPv6")
+}
@@ -0,0 +1,31 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// algorithmListRegexp matches a comma-separated list of ssh algorithm names,
+// optionally prefixed with +, - or ^ to append to, remove from, or prepend to
+// the default list of ssh.
+var algorithmListRegexp = regexp.MustCompile(`^[+\-^]?[A-Za-z0-9@._-]+(,[A-Za-z0-9@._-]+)*$`)
+
+// algorithmOptions returns the ssh options that restrict the ciphers, MACs
+// and key exchange algorithms of the tunnel, for the lists that are set.
+func (cfg Config) algorithmOptions() (map[string]string, error) {
+	options := map[string]string{}
+	for _, o := range []struct{ flag, option, value string }{
+		{"-ssh.ciphers", "Ciphers", cfg.Ciphers},
+		{"-ssh.macs", "MACs", cfg.MACs},
+		{"-ssh.kex-algorithms", "KexAlgorithms", cfg.KexAlgorithms},
+	} {
+		if o.value == "" {
+			continue
+		}
+		if !algorithmListRegexp.MatchString(o.value) {
+			return nil, fmt.Errorf("invalid %s %q, must be a comma-separated list of algorithms, such as aes256-gcm@openssh.com,aes128-gcm@openssh.com", o.flag, o.value)
+		}
+		options[o.option] = o.value
+	}
+	return options, nil
+}
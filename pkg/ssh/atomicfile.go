@@ -0,0 +1,57 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// tempSuffix is the suffix of the temporary file that a file is written to
+// before it is renamed into place.
+const tempSuffix = ".tmp"
+
+// writeFileAtomic replaces a file with data, so that readers see either the
+// previous or the new contents in full, even if the agent is killed while
+// writing. The data is written to a temporary file in the same directory,
+// flushed to disk, and renamed over the file.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + tempSuffix
+	if err := writeFileSync(tmp, data); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(name))
+	return nil
+}
+
+// writeFileSync writes data to a file and flushes it to disk, so that it is
+// complete before it is renamed.
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes a directory to disk, so that a rename in it is durable.
+// Directories cannot be synced on all platforms, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
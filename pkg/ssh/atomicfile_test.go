@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	t.Run("file is replaced", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		require.NoError(t, km.writeCertFile([]byte("new")))
+
+		b, err := km.readCertFile()
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new"), b)
+		assert.NoFileExists(t, km.certFile()+tempSuffix)
+
+		fi, err := os.Stat(km.certFile())
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	})
+
+	t.Run("killed while writing: the previous files survive", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		before := assertMatchingKeyFiles(t, km)
+
+		// A partial write is left behind in the temporary files, as if the
+		// agent was killed before renaming them.
+		for _, f := range []string{km.cfg.KeyFile, km.certFile()} {
+			b, err := os.ReadFile(f)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(f+tempSuffix, b[:len(b)/2], 0600))
+		}
+
+		after := assertMatchingKeyFiles(t, km)
+		assert.True(t, keysEqual(before, after))
+		assert.False(t, km.newKeysRequired())
+		assert.False(t, km.newCertRequired())
+
+		// The next write replaces the partial temporary file.
+		require.NoError(t, km.CreateKeys(context.Background(), true))
+		assertMatchingKeyFiles(t, km)
+		assert.NoFileExists(t, km.cfg.KeyFile+tempSuffix)
+		assert.NoFileExists(t, km.certFile()+tempSuffix)
+	})
+
+	t.Run("failed write: the previous file survives", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		before, err := km.readKeyFile()
+		require.NoError(t, err)
+
+		// The temporary file cannot be created.
+		require.NoError(t, os.Mkdir(km.cfg.KeyFile+tempSuffix, 0700))
+		require.NoError(t, os.WriteFile(km.cfg.KeyFile+tempSuffix+"/x", nil, 0600))
+
+		assert.Error(t, km.writeKeyFile([]byte("partial")))
+
+		after, err := km.readKeyFile()
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+	})
+}
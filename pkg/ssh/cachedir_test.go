@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+func TestConfig_CacheDirFlag(t *testing.T) {
+	parse := func(t *testing.T, args ...string) *Config {
+		t.Helper()
+		cfg := &Config{}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg.RegisterFlags(fs)
+		require.NoError(t, fs.Parse(args))
+		return cfg
+	}
+
+	t.Run("key pair in the cache dir", func(t *testing.T) {
+		cfg := parse(t, "-ssh.cache-dir", "/var/lib/pdc")
+		assert.Equal(t, "/var/lib/pdc/grafana_pdc", cfg.KeyFile)
+		assert.Equal(t, "/var/lib/pdc/grafana_pdc-cert.pub", cfg.CertFile())
+	})
+
+	t.Run("key file takes precedence", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"-ssh-key-file", "/etc/pdc/key", "-ssh.cache-dir", "/var/lib/pdc"},
+			{"-ssh.cache-dir", "/var/lib/pdc", "-ssh-key-file", "/etc/pdc/key"},
+		} {
+			cfg := parse(t, args...)
+			assert.Equal(t, "/etc/pdc/key", cfg.KeyFile, args)
+			assert.Equal(t, "/var/lib/pdc/key-cert.pub", cfg.CertFile(), args)
+			assert.Equal(t, "/var/lib/pdc/"+KnownHostsFile, cfg.knownHostsFile(), args)
+		}
+	})
+
+	t.Run("no cache dir", func(t *testing.T) {
+		cfg := parse(t, "-ssh-key-file", "/etc/pdc/key")
+		assert.Equal(t, "/etc/pdc/key-cert.pub", cfg.CertFile())
+		assert.Equal(t, "/etc/pdc/"+KnownHostsFile, cfg.knownHostsFile())
+	})
+}
+
+func TestKeyManager_CacheDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on windows")
+	}
+
+	newKeyManager := func(t *testing.T, keyFile, cacheDir string) *KeyManager {
+		cfg := DefaultConfig()
+		cfg.KeyFile = keyFile
+		cfg.CacheDir = cacheDir
+		cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+		return NewKeyManager(cfg, log.NewNopLogger(), newSigningClient(t))
+	}
+	assertPerm := func(t *testing.T, name string, want os.FileMode) {
+		t.Helper()
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, fi.Mode().Perm(), name)
+	}
+
+	t.Run("artifacts are written under the cache dir", func(t *testing.T) {
+		cacheDir := filepath.Join(t.TempDir(), "cache")
+		km := newKeyManager(t, path.Join(cacheDir, "grafana_pdc"), cacheDir)
+
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+
+		assertPerm(t, cacheDir, 0700)
+		assertPerm(t, path.Join(cacheDir, "grafana_pdc"), 0600)
+		for _, f := range []string{"grafana_pdc.pub", "grafana_pdc-cert.pub", "grafana_pdc_hash", KnownHostsFile} {
+			assert.FileExists(t, path.Join(cacheDir, f))
+		}
+		assertMatchingKeyFiles(t, km)
+	})
+
+	t.Run("key file outside the cache dir", func(t *testing.T) {
+		keyDir := t.TempDir()
+		cacheDir := filepath.Join(t.TempDir(), "cache")
+		km := newKeyManager(t, path.Join(keyDir, "key"), cacheDir)
+
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+
+		assertPerm(t, cacheDir, 0700)
+		assertPerm(t, path.Join(keyDir, "key"), 0600)
+		assert.FileExists(t, path.Join(keyDir, "key.pub"))
+		assert.NoFileExists(t, path.Join(keyDir, "key-cert.pub"))
+		assert.FileExists(t, path.Join(cacheDir, "key-cert.pub"))
+		assert.FileExists(t, path.Join(cacheDir, KnownHostsFile))
+		assertMatchingKeyFiles(t, km)
+
+		// The existing certificate is reused.
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+		assert.False(t, km.newCertRequired())
+	})
+}
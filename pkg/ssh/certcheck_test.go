@@ -0,0 +1,37 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyManager_CertCheckPeriod(t *testing.T) {
+	testcases := []struct {
+		name    string
+		period  time.Duration
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "zero uses the default", period: 0, want: defaultCertCheckPeriod},
+		{name: "negative is rejected", period: -time.Minute, wantErr: true},
+		{name: "tiny is raised to the minimum", period: time.Millisecond, want: minCertCheckPeriod},
+		{name: "normal is used as is", period: 5 * time.Minute, want: 5 * time.Minute},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			km := NewKeyManager(&Config{CertCheckCertExpiryPeriod: tc.period}, log.NewNopLogger(), nil)
+
+			got, err := km.certCheckPeriod()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
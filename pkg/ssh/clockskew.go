@@ -0,0 +1,39 @@
+package ssh
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/ssh"
+)
+
+// clockSkewTolerance is how far the local clock can be behind the clock of
+// the PDC API before a freshly signed certificate is considered not yet valid.
+// Larger skews are logged as warnings.
+const clockSkewTolerance = time.Minute
+
+// notYetValid returns true if cert is not valid yet at now, a unix time,
+// allowing for clockSkewTolerance.
+func notYetValid(now uint64, cert *ssh.Certificate) bool {
+	return now+uint64(clockSkewTolerance.Seconds()) < cert.ValidAfter
+}
+
+// checkClockSkew warns if a freshly signed certificate shows that the local
+// clock is skewed: the certificate is not valid yet, or has already expired,
+// according to the local clock. The PDC API signs certificates that are valid
+// from about the time of signing, so a skewed clock would make the agent
+// discard them and request new ones.
+func (km KeyManager) checkClockSkew(cert *ssh.Certificate) {
+	now := km.now()
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+
+	switch {
+	case now.Add(clockSkewTolerance).Before(validAfter):
+		level.Warn(km.logger).Log("msg", "local clock is behind the PDC API, the new certificate is not valid yet. Sync the clock with NTP",
+			"skew", validAfter.Sub(now).Round(time.Second), "local_time", now.UTC().Format(time.RFC3339), "valid_after", validAfter.UTC().Format(time.RFC3339))
+	case now.After(validBefore):
+		level.Warn(km.logger).Log("msg", "local clock is ahead of the PDC API, the new certificate has already expired. Sync the clock with NTP",
+			"skew", now.Sub(validBefore).Round(time.Second), "local_time", now.UTC().Format(time.RFC3339), "valid_before", validBefore.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+func TestKeyManager_ClockSkew(t *testing.T) {
+	testcases := []struct {
+		name     string
+		skew     time.Duration
+		wantWarn string
+	}{
+		{
+			name: "no skew",
+		},
+		{
+			name: "small skew is tolerated",
+			// The signing client backdates certificates by a minute.
+			skew: -90 * time.Second,
+		},
+		{
+			name:     "clock behind",
+			skew:     -time.Hour,
+			wantWarn: "local clock is behind the PDC API",
+		},
+		{
+			name:     "clock ahead",
+			skew:     2 * time.Hour,
+			wantWarn: "local clock is ahead of the PDC API",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := DefaultConfig()
+			cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+			cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+			km := NewKeyManager(cfg, log.NewLogfmtLogger(&buf), newSigningClient(t))
+			km.now = func() time.Time { return time.Now().Add(tc.skew) }
+
+			require.NoError(t, km.CreateKeys(context.Background(), false))
+
+			if tc.wantWarn == "" {
+				assert.NotContains(t, buf.String(), "Sync the clock with NTP")
+				assert.True(t, km.certValid())
+				return
+			}
+			assert.Contains(t, buf.String(), tc.wantWarn)
+			assert.Contains(t, buf.String(), "Sync the clock with NTP")
+		})
+	}
+}
+
+func TestNotYetValid(t *testing.T) {
+	now := time.Now()
+	cert := &ssh.Certificate{ValidAfter: uint64(now.Unix())}
+
+	assert.False(t, notYetValid(uint64(now.Unix()), cert))
+	assert.False(t, notYetValid(uint64(now.Add(-30*time.Second).Unix()), cert))
+	assert.True(t, notYetValid(uint64(now.Add(-2*time.Minute).Unix()), cert))
+}
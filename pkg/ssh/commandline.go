@@ -0,0 +1,48 @@
+package ssh
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redacted replaces secrets in printed ssh commands.
+const redacted = "<redacted>"
+
+// shellSafeRe matches arguments that need no quoting in a POSIX shell.
+var shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9@%+=:,./_-]+$`)
+
+// CommandLine returns the ssh command that the agent runs, quoted for a POSIX
+// shell, without running it. Secrets of the configuration, the signing
+// tokens and the PKCS#11 PIN, are redacted. Paths, such as the key file, are
+// not secrets and are shown.
+func (s *Client) CommandLine() (string, error) {
+	flags, err := s.SSHFlagsFromConfig()
+	if err != nil {
+		return "", err
+	}
+
+	secrets := append([]string{s.cfg.PKCS11PIN}, s.cfg.PDC.SigningTokens()...)
+	args := append([]string{s.SSHCmd}, flags...)
+	for i, a := range args {
+		args[i] = shellQuote(redactSecrets(a, secrets))
+	}
+	return strings.Join(args, " "), nil
+}
+
+// redactSecrets replaces the secrets found in s.
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,26 @@
+package ssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"-R":                        "-R",
+		"1@gateway.example.com":     "1@gateway.example.com",
+		"CertificateFile=/a/b-cert": "CertificateFile=/a/b-cert",
+		"ProxyCommand=nc %h %p":     "'ProxyCommand=nc %h %p'",
+		"it's":                      `'it'\''s'`,
+		"":                          "''",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, shellQuote(in), in)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	assert.Equal(t, "a <redacted> b <redacted>", redactSecrets("a tok1 b 1234", []string{"", "tok1", "1234"}))
+	assert.Equal(t, "nothing", redactSecrets("nothing", nil))
+}
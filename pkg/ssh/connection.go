@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/retry"
+)
+
+// connection is one of the ssh connections of the client. Each runs its own
+// ssh command, and is restarted independently of the others.
+type connection struct {
+	logger log.Logger
+	state  *tunnelState
+
+	// cancelCmd stops the running ssh command.
+	mu        sync.Mutex
+	cancelCmd context.CancelFunc
+}
+
+// stop stops the running ssh command, if any. The connection is restarted.
+func (c *connection) stop() {
+	c.mu.Lock()
+	cancel := c.cancelCmd
+	c.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// runConnection runs the ssh command of c until it exits. It is called in a
+// retry loop, and returns an error to back off before the next attempt.
+func (s *Client) runConnection(ctx context.Context, c *connection, gw *gateway) error {
+	if !c.state.TransitionFrom(StateConnecting, StateIdle) {
+		c.state.Transition(StateReconnecting)
+		s.reconnects.Add(1)
+	}
+
+	// The command has its own context, so that it can be restarted when
+	// the tunnel is unhealthy.
+	cmdCtx, cancelCmd := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.cancelCmd = cancelCmd
+	c.mu.Unlock()
+	cmd := s.command(cmdCtx, gw.flags)
+	loggerWriter := newLoggerWriterAdapter(c.logger)
+	if s.cfg.SSHVerbosity > 0 {
+		loggerWriter.logLevel = level.Info
+	}
+	cmd.Stdout = loggerWriter
+	cmd.Stderr = loggerWriter
+	if s.cfg.TunnelHealthCheckPeriod > 0 {
+		go s.watchTunnel(cmdCtx, cancelCmd)
+	}
+	start := time.Now()
+	connected, cmdErr := c.runCmd(cmd, func() { s.endConnectSpan(nil) })
+	ran := time.Since(start)
+	cancelCmd()
+	loggerWriter.Flush()
+	if ctx.Err() != nil {
+		c.state.Transition(StateTerminating)
+		return nil // context was canceled
+	}
+
+	c.state.Transition(StateBackoff)
+
+	if !connected {
+		err := errors.New("ssh client exited before the tunnel connected")
+		if cmdErr != nil {
+			err = fmt.Errorf("%w: %w", err, cmdErr)
+		}
+		s.endConnectSpan(err)
+	}
+
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == ConnectionAlreadyExistsCode {
+		level.Debug(c.logger).Log("msg", "server already had a connection for this tunnelID. trying a different server")
+		return retry.ResetBackoffError{}
+	}
+
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == ConnectionLimitReachedCode {
+		level.Error(c.logger).Log("msg", "limit of connections for stack and network reached. stopping")
+		c.state.Transition(StateTerminating)
+		s.setLastError(ErrConnectionLimitReached)
+		s.fatal <- ErrConnectionLimitReached
+		// The connection is not retried.
+		return nil
+	}
+
+	s.gateways.attempted(gw, connected)
+
+	level.Info(c.logger).Log("msg", "ssh client exited. restarting", "exitCode", cmd.ProcessState.ExitCode())
+	if cmdErr != nil {
+		s.setLastError(fmt.Errorf("ssh client exited: %w", cmdErr))
+	} else {
+		s.setLastError(errors.New("ssh client exited"))
+	}
+
+	// Check keys and cert validity before restart, create new cert if required.
+	// This covers the case where a certificate has become invalid since the last start.
+	// Do not return here: we want to keep trying to connect in case the PDC API
+	// is temporarily unavailable.
+	//
+	// They keymanager has logic to perform a background key refresh, but this
+	// logic should stay in place in case that is disabled.
+	if s.km != nil {
+		s.keysMu.Lock()
+		err := s.km.CreateKeys(ctx, false)
+		s.keysMu.Unlock()
+		if err != nil {
+			level.Error(c.logger).Log("msg", "could not check or generate certificate", "error", err)
+			s.setLastError(fmt.Errorf("could not check or generate certificate: %w", err))
+		}
+	}
+	// A connection that switches gateway does not wait longer because of the
+	// failures on the previous gateway.
+	if s.gateways.current() != gw {
+		return retry.ResetBackoffError{}
+	}
+	// A connection that was stable does not make the next reconnect wait
+	// longer, as its failure is unrelated to the previous ones.
+	if s.cfg.ReconnectStableThreshold > 0 && ran >= s.cfg.ReconnectStableThreshold {
+		level.Debug(c.logger).Log("msg", "connection was stable. resetting reconnect backoff", "duration", ran)
+		return retry.ResetBackoffError{}
+	}
+	return fmt.Errorf("ssh client exited")
+}
+
+// runCmd runs the ssh command, and moves the connection to the connected
+// state, and calls onConnected, once the command has been running for
+// connectedAfter. It returns whether the connection got connected.
+func (c *connection) runCmd(cmd *exec.Cmd, onConnected func()) (bool, error) {
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+
+	t := time.AfterFunc(connectedAfter, func() {
+		c.state.TransitionFrom(StateConnected, StateConnecting, StateReconnecting)
+		onConnected()
+	})
+	err := cmd.Wait()
+	// The timer can no longer be stopped once it has fired.
+	return !t.Stop(), err
+}
+
+// stateRank orders the tunnel states from the most to the least connected.
+var stateRank = []string{StateConnected, StateConnecting, StateReconnecting, StateBackoff, StateIdle, StateTerminating}
+
+// aggregateState returns the most connected of states, so that the tunnel is
+// reported as connected as long as one of its connections is.
+func aggregateState(states []string) string {
+	for _, r := range stateRank {
+		for _, st := range states {
+			if st == r {
+				return r
+			}
+		}
+	}
+	return StateIdle
+}
@@ -0,0 +1,165 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/retry"
+)
+
+func TestClient_ConnectionPool(t *testing.T) {
+	old := connectedAfter
+	connectedAfter = 10 * time.Millisecond
+	t.Cleanup(func() { connectedAfter = old })
+
+	dir := t.TempDir()
+	pids := filepath.Join(dir, "pids")
+
+	// The fake gateway records the pid of each ssh command, which stays
+	// connected until it is killed.
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\necho $$ >> "+pids+"\nexec sleep 60\n"), 0o755))
+
+	cfg := &Config{
+		Args:              []string{"gateway"},
+		LegacyMode:        true,
+		SkipSSHValidation: true,
+		SSHBinary:         fakeSSH,
+		ConnectionCount:   2,
+	}
+	c := NewClient(cfg, log.NewNopLogger(), nil)
+
+	ctx := context.Background()
+	require.NoError(t, c.StartAsync(ctx))
+	require.NoError(t, c.AwaitRunning(ctx))
+	defer func() {
+		c.StopAsync()
+		_ = c.AwaitTerminated(ctx)
+	}()
+
+	readPids := func() []string {
+		b, _ := os.ReadFile(pids)
+		return strings.Fields(string(b))
+	}
+
+	// Both ssh commands are started and tracked.
+	assert.Eventually(t, func() bool {
+		return len(readPids()) == 2 && c.ConnectedCount() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, StateConnected, c.TunnelState())
+
+	// When one ssh command exits, only that connection is restarted, and the
+	// tunnel stays connected with the other one.
+	pid, err := strconv.Atoi(readPids()[0])
+	require.NoError(t, err)
+	proc, err := os.FindProcess(pid)
+	require.NoError(t, err)
+	require.NoError(t, proc.Kill())
+
+	assert.Eventually(t, func() bool {
+		return c.ConnectedCount() == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, StateConnected, c.TunnelState())
+
+	assert.Eventually(t, func() bool {
+		return len(readPids()) == 3 && c.ConnectedCount() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClient_ConnectionLimitReached(t *testing.T) {
+	dir := t.TempDir()
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\nexit "+strconv.Itoa(ConnectionLimitReachedCode)+"\n"), 0o755))
+
+	cfg := &Config{
+		Args:              []string{"gateway"},
+		LegacyMode:        true,
+		SkipSSHValidation: true,
+		SSHBinary:         fakeSSH,
+	}
+	c := NewClient(cfg, log.NewNopLogger(), nil)
+
+	ctx := context.Background()
+	require.NoError(t, c.StartAsync(ctx))
+
+	// The client fails instead of exiting the process, and is not restarted.
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.Error(t, c.AwaitTerminated(tctx))
+	assert.ErrorIs(t, c.FailureCase(), ErrConnectionLimitReached)
+	assert.Equal(t, StateTerminating, c.TunnelState())
+}
+
+func TestAggregateState(t *testing.T) {
+	testcases := []struct {
+		states []string
+		want   string
+	}{
+		{states: []string{StateIdle}, want: StateIdle},
+		{states: []string{StateConnected, StateBackoff}, want: StateConnected},
+		{states: []string{StateBackoff, StateReconnecting}, want: StateReconnecting},
+		{states: []string{StateTerminating, StateTerminating}, want: StateTerminating},
+	}
+
+	for _, tc := range testcases {
+		t.Run(strings.Join(tc.states, ","), func(t *testing.T) {
+			assert.Equal(t, tc.want, aggregateState(tc.states))
+		})
+	}
+}
+
+func TestClient_ReconnectStableThreshold(t *testing.T) {
+	testcases := []struct {
+		name      string
+		script    string
+		threshold time.Duration
+		wantReset bool
+	}{
+		{
+			name:      "stable connection resets the backoff",
+			script:    "sleep 0.2\nexit 1",
+			threshold: 100 * time.Millisecond,
+			wantReset: true,
+		},
+		{
+			name:      "flapping connection keeps the backoff",
+			script:    "exit 1",
+			threshold: 100 * time.Millisecond,
+		},
+		{
+			name:      "reset is disabled",
+			script:    "sleep 0.2\nexit 1",
+			threshold: 0,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeSSH := filepath.Join(t.TempDir(), "ssh")
+			require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\n"+tc.script+"\n"), 0o755))
+
+			cfg := &Config{
+				Args:                     []string{"gateway"},
+				LegacyMode:               true,
+				SkipSSHValidation:        true,
+				SSHBinary:                fakeSSH,
+				ReconnectStableThreshold: tc.threshold,
+			}
+			c := NewClient(cfg, log.NewNopLogger(), nil)
+
+			err := c.runConnection(context.Background(), c.conns[0], c.gateways.current())
+			require.Error(t, err)
+			assert.Equal(t, tc.wantReset, errors.Is(err, retry.ResetBackoffError{}))
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// ControlDir is the directory, in CacheFileDir, of the control sockets of
+// ssh connection multiplexing.
+const ControlDir = "grafana_pdc_control"
+
+// controlDir returns the path of ControlDir.
+func (cfg Config) controlDir() string {
+	return path.Join(cfg.CacheFileDir(), ControlDir)
+}
+
+// controlPath returns the ssh ControlPath. %C is a hash of the connection
+// parameters, which keeps the socket path short enough for unix sockets.
+func (cfg Config) controlPath() string {
+	return path.Join(cfg.controlDir(), "%C")
+}
+
+// ensureControlDir creates ControlDir with permissions for its owner only,
+// as anyone who can connect to a control socket can use the connection.
+func (cfg Config) ensureControlDir() error {
+	if err := cfg.ensureCacheDir(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.controlDir(), 0700); err != nil {
+		return fmt.Errorf("creating ssh control directory: %w", err)
+	}
+	return nil
+}
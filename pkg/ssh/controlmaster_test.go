@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_ControlMaster(t *testing.T) {
+	newConfig := func(t *testing.T) *Config {
+		cfg := DefaultConfig()
+		cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+		cfg.URL = &url.URL{Host: "host.grafana.net"}
+		return cfg
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		flags, err := NewClient(newConfig(t), log.NewNopLogger(), nil).SSHFlagsFromConfig()
+		require.NoError(t, err)
+		assert.NotContains(t, strings.Join(flags, " "), "ControlMaster=")
+	})
+
+	t.Run("the control path is in the managed directory", func(t *testing.T) {
+		cfg := newConfig(t)
+		cfg.CacheDir = filepath.Join(t.TempDir(), "cache")
+		cfg.ControlMaster = true
+
+		flags, err := NewClient(cfg, log.NewNopLogger(), nil).SSHFlagsFromConfig()
+		require.NoError(t, err)
+		assert.Contains(t, flags, "ControlMaster=auto")
+
+		controlPath := filepath.Join(cfg.CacheDir, ControlDir, "%C")
+		assert.Contains(t, flags, "ControlPath="+controlPath)
+		rel, err := filepath.Rel(cfg.CacheFileDir(), controlPath)
+		require.NoError(t, err)
+		assert.False(t, strings.HasPrefix(rel, ".."), "control path %s is outside of %s", controlPath, cfg.CacheFileDir())
+
+		require.NoError(t, cfg.ensureControlDir())
+		fi, err := os.Stat(filepath.Dir(controlPath))
+		require.NoError(t, err)
+		assert.True(t, fi.IsDir())
+		if runtime.GOOS != "windows" {
+			assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+		}
+	})
+
+	t.Run("an explicit -ssh-flag takes precedence", func(t *testing.T) {
+		cfg := newConfig(t)
+		cfg.ControlMaster = true
+		cfg.SSHFlags = []string{"-o ControlMaster=no"}
+
+		flags, err := NewClient(cfg, log.NewNopLogger(), nil).SSHFlagsFromConfig()
+		require.NoError(t, err)
+		assert.Contains(t, flags, "ControlMaster=no")
+		assert.NotContains(t, flags, "ControlMaster=auto")
+	})
+}
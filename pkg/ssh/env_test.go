@@ -0,0 +1,50 @@
+package ssh
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_CleanEnv(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv("HOME", "/home/pdc")
+	t.Setenv("GCLOUD_PDC_SIGNING_TOKEN", "secret")
+
+	t.Run("disabled: the environment is inherited", func(t *testing.T) {
+		cfg := DefaultConfig()
+		c := NewClient(cfg, log.NewNopLogger(), nil)
+
+		cmd := c.command(context.Background(), nil)
+		assert.Nil(t, cmd.Env)
+	})
+
+	t.Run("enabled: only allowed variables are passed", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.CleanEnv = true
+		c := NewClient(cfg, log.NewNopLogger(), nil)
+
+		cmd := c.command(context.Background(), nil)
+		assert.Contains(t, cmd.Env, "PATH=/usr/bin")
+		assert.Contains(t, cmd.Env, "HOME=/home/pdc")
+		for _, kv := range cmd.Env {
+			name, _, _ := strings.Cut(kv, "=")
+			assert.Contains(t, cleanEnvVars, name)
+		}
+	})
+	t.Run("PKCS#11 PIN is passed to the askpass program", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.CleanEnv = true
+		cfg.PKCS11PIN = "1234"
+		c := NewClient(cfg, log.NewNopLogger(), nil)
+
+		cmd := c.command(context.Background(), nil)
+		assert.Contains(t, cmd.Env, "PATH=/usr/bin")
+		assert.Contains(t, cmd.Env, "SSH_ASKPASS_REQUIRE=force")
+		assert.Contains(t, cmd.Env, AskpassPINEnv+"=1234")
+		assert.NotContains(t, cmd.Env, "GCLOUD_PDC_SIGNING_TOKEN=secret")
+	})
+}
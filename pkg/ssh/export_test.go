@@ -0,0 +1,14 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+// SetMinCertCheckPeriod lowers the minimum certificate check period for the
+// duration of a test. Tests using it must not be parallel.
+func SetMinCertCheckPeriod(t *testing.T, d time.Duration) {
+	old := minCertCheckPeriod
+	minCertCheckPeriod = d
+	t.Cleanup(func() { minCertCheckPeriod = old })
+}
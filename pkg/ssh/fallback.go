@@ -0,0 +1,194 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Names of the gateways, as reported by the gateway_active metric.
+const (
+	GatewayPrimary  = "primary"
+	GatewayFallback = "fallback"
+)
+
+// gateway is a gateway that the ssh connections can connect to.
+type gateway struct {
+	name string
+	// addr is the host:port of the gateway, for the checks made by the agent.
+	addr string
+	// flags are the flags of the ssh command that connects to the gateway.
+	flags []string
+}
+
+// gatewayAddr returns the host:port of the gateway of cfg.
+func (cfg Config) gatewayAddr() string {
+	return net.JoinHostPort(cfg.GatewayHost(), strconv.Itoa(cfg.Port))
+}
+
+// fallbackConfig returns a copy of cfg that connects to the fallback gateway,
+// or nil if there is none.
+func (cfg Config) fallbackConfig() *Config {
+	if cfg.FallbackGatewayURL == nil {
+		return nil
+	}
+	fb := cfg
+	fb.URL = cfg.FallbackGatewayURL
+	if cfg.FallbackPort != 0 {
+		fb.Port = cfg.FallbackPort
+	}
+	return &fb
+}
+
+// checkFallback returns the problems of the fallback gateway settings.
+func (cfg Config) checkFallback() error {
+	var errs []error
+	if err := cfg.fallbackConfig().checkPort(); err != nil {
+		errs = append(errs, fmt.Errorf("fallback gateway: %w", err))
+	}
+	if cfg.FallbackAfter < 1 {
+		errs = append(errs, fmt.Errorf("-ssh.fallback-after must be at least 1, got %d", cfg.FallbackAfter))
+	}
+	if cfg.PrimaryRetryInterval < 0 {
+		errs = append(errs, fmt.Errorf("-ssh.primary-retry-interval must not be negative, got %s", cfg.PrimaryRetryInterval))
+	}
+	if cfg.HostKeyFingerprint != "" {
+		errs = append(errs, errors.New("-ssh.fallback-gateway-url cannot be used with -ssh.host-key-fingerprint, which only pins the host key of the primary gateway"))
+	}
+	return errors.Join(errs...)
+}
+
+// gateways selects the gateway that the ssh connections use. Without a
+// fallback gateway, it is always the primary one.
+type gateways struct {
+	logger        log.Logger
+	failoverAfter int
+
+	primary *gateway
+	// fallback is nil if no fallback gateway is set.
+	fallback *gateway
+
+	mu       sync.Mutex
+	active   *gateway
+	failures int
+}
+
+func newGateways(logger log.Logger, cfg *Config) *gateways {
+	primary := &gateway{name: GatewayPrimary, addr: cfg.gatewayAddr()}
+	return &gateways{
+		logger:        logger,
+		failoverAfter: max(cfg.FallbackAfter, 1),
+		primary:       primary,
+		active:        primary,
+	}
+}
+
+// current returns the gateway that new ssh connections connect to.
+func (g *gateways) current() *gateway {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active
+}
+
+// attempted records the result of an attempt to connect to gw. After
+// failoverAfter consecutive failed attempts, the connections switch to the
+// other gateway.
+func (g *gateways) attempted(gw *gateway, connected bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Attempts made before the last switch are not counted.
+	if g.fallback == nil || gw != g.active {
+		return
+	}
+	if connected {
+		g.failures = 0
+		return
+	}
+	g.failures++
+	if g.failures < g.failoverAfter {
+		return
+	}
+
+	next := g.fallback
+	if g.active == g.fallback {
+		next = g.primary
+	}
+	level.Warn(g.logger).Log("msg", "cannot connect to gateway. switching gateway", "from", g.active.name, "to", next.name, "failures", g.failures)
+	g.switchTo(next)
+}
+
+// failBack switches back to the primary gateway, and returns whether the
+// fallback gateway was in use.
+func (g *gateways) failBack() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.fallback == nil || g.active != g.fallback {
+		return false
+	}
+	g.switchTo(g.primary)
+	return true
+}
+
+// switchTo makes gw the active gateway. It must be called with mu held.
+func (g *gateways) switchTo(gw *gateway) {
+	g.active = gw
+	g.failures = 0
+	g.updateMetrics()
+}
+
+// updateMetrics sets the gateway_active metric. It must be called with mu
+// held.
+func (g *gateways) updateMetrics() {
+	for _, gw := range []*gateway{g.primary, g.fallback} {
+		if gw == nil {
+			continue
+		}
+		v := 0.0
+		if gw == g.active {
+			v = 1
+		}
+		gatewayActive.WithLabelValues(gw.name).Set(v)
+	}
+}
+
+// watchPrimary checks every PrimaryRetryInterval, until ctx is done, if the
+// primary gateway can be reached while the fallback gateway is used. Once it
+// can, the connections are restarted on the primary gateway.
+func (s *Client) watchPrimary(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PrimaryRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if s.gateways.current() != s.gateways.fallback {
+			continue
+		}
+		if err := s.checkPrimary(ctx); err != nil {
+			level.Debug(s.logger).Log("msg", "primary gateway is still unreachable", "err", err)
+			continue
+		}
+		if s.gateways.failBack() {
+			level.Info(s.logger).Log("msg", "primary gateway is reachable again. switching back to it")
+			s.Reconnect()
+		}
+	}
+}
+
+// checkPrimaryGateway opens, and immediately closes, a TCP connection to the
+// primary gateway.
+func (s *Client) checkPrimaryGateway(ctx context.Context) error {
+	return s.dialGateway(ctx, s.gateways.primary.addr)
+}
@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGateways_Attempted(t *testing.T) {
+	cfg := &Config{URL: &url.URL{Path: "primary.test"}, Port: 22, FallbackAfter: 2}
+	g := newGateways(log.NewNopLogger(), cfg)
+
+	// Without a fallback gateway, the primary one is always used.
+	for i := 0; i < 3; i++ {
+		g.attempted(g.primary, false)
+	}
+	assert.Same(t, g.primary, g.current())
+
+	g.fallback = &gateway{name: GatewayFallback}
+
+	// A connection resets the failures.
+	g.attempted(g.primary, false)
+	g.attempted(g.primary, true)
+	g.attempted(g.primary, false)
+	assert.Same(t, g.primary, g.current())
+
+	g.attempted(g.primary, false)
+	assert.Same(t, g.fallback, g.current())
+
+	// Attempts made on the previous gateway are not counted.
+	g.attempted(g.primary, false)
+	g.attempted(g.primary, false)
+	assert.Same(t, g.fallback, g.current())
+
+	// The connections alternate back to the primary gateway if the fallback
+	// one fails too.
+	g.attempted(g.fallback, false)
+	g.attempted(g.fallback, false)
+	assert.Same(t, g.primary, g.current())
+
+	assert.False(t, g.failBack())
+	g.attempted(g.primary, false)
+	g.attempted(g.primary, false)
+	assert.True(t, g.failBack())
+	assert.Same(t, g.primary, g.current())
+}
+
+func TestClient_FallbackGateway(t *testing.T) {
+	old := connectedAfter
+	connectedAfter = 10 * time.Millisecond
+	t.Cleanup(func() { connectedAfter = old })
+
+	dir := t.TempDir()
+	up := filepath.Join(dir, "primary-up")
+	attempts := filepath.Join(dir, "attempts")
+
+	// The fake ssh cannot connect to the primary gateway until up exists,
+	// and stays connected to the fallback gateway.
+	fakeSSH := filepath.Join(dir, "ssh")
+	script := `#!/bin/sh
+for a in "$@"; do
+	case "$a" in
+	*@primary.test) echo primary >> ` + attempts + `; [ -f ` + up + ` ] || exit 255; exec sleep 60 ;;
+	*@fallback.test) echo fallback >> ` + attempts + `; exec sleep 60 ;;
+	esac
+done
+exit 1
+`
+	require.NoError(t, os.WriteFile(fakeSSH, []byte(script), 0o755))
+
+	cfg := &Config{
+		URL:                  &url.URL{Path: "primary.test"},
+		FallbackGatewayURL:   &url.URL{Path: "fallback.test"},
+		FallbackAfter:        2,
+		PrimaryRetryInterval: 10 * time.Millisecond,
+		Port:                 22,
+		KeyFile:              filepath.Join(dir, "grafana_pdc"),
+		SkipSSHValidation:    true,
+		SSHBinary:            fakeSSH,
+	}
+	cfg.PDC.HostedGrafanaID = "1"
+	c := NewClient(cfg, log.NewNopLogger(), nil)
+	c.checkPrimary = func(context.Context) error {
+		if _, err := os.Stat(up); err != nil {
+			return errors.New("primary gateway is down")
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	require.NoError(t, c.StartAsync(ctx))
+	require.NoError(t, c.AwaitRunning(ctx))
+	defer func() {
+		c.StopAsync()
+		_ = c.AwaitTerminated(ctx)
+	}()
+
+	readAttempts := func() []string {
+		b, _ := os.ReadFile(attempts)
+		return strings.Fields(string(b))
+	}
+
+	// The primary gateway is down, so the connection fails over to the
+	// fallback gateway after 2 attempts.
+	assert.Eventually(t, func() bool {
+		return c.ConnectedCount() == 1 && c.gateways.current() == c.gateways.fallback
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"primary", "primary", "fallback"}, readAttempts())
+	assert.Equal(t, 0.0, testutil.ToFloat64(gatewayActive.WithLabelValues(GatewayPrimary)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(gatewayActive.WithLabelValues(GatewayFallback)))
+
+	// Once the primary gateway is back, the connection switches back to it.
+	require.NoError(t, os.WriteFile(up, nil, 0o600))
+	assert.Eventually(t, func() bool {
+		a := readAttempts()
+		return c.ConnectedCount() == 1 && a[len(a)-1] == GatewayPrimary
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Same(t, c.gateways.primary, c.gateways.current())
+	assert.Equal(t, 1.0, testutil.ToFloat64(gatewayActive.WithLabelValues(GatewayPrimary)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(gatewayActive.WithLabelValues(GatewayFallback)))
+}
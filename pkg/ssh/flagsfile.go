@@ -0,0 +1,45 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// addSSHFlagsFile appends the flags in the file at path to SSHFlags, as if
+// each was set with -ssh-flag.
+func (cfg *Config) addSSHFlagsFile(path string) error {
+	flags, err := readSSHFlagsFile(path)
+	if err != nil {
+		return err
+	}
+	cfg.SSHFlags = append(cfg.SSHFlags, flags...)
+	return nil
+}
+
+// readSSHFlagsFile reads a file with one ssh flag per line, e.g.
+// "-o ServerAliveCountMax=5". Leading and trailing spaces are trimmed, and
+// blank lines and lines starting with # are skipped. Lines are not split or
+// unquoted, so a value can contain spaces and quotes.
+func readSSHFlagsFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading ssh flags file: %w", err)
+	}
+
+	var flags []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		flags = append(flags, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading ssh flags file: %w", err)
+	}
+	return flags, nil
+}
@@ -0,0 +1,48 @@
+package ssh
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_SSHFlagsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh-flags")
+	require.NoError(t, os.WriteFile(path, []byte(`# keep the tunnel up on flaky links
+-o ServerAliveCountMax=5
+
+  -o ProxyCommand=nc -X connect -x "proxy.internal:3128" %h %p  
+	# an indented comment
+-vv
+`), 0o644))
+
+	parse := func(args ...string) (*Config, error) {
+		cfg := DefaultConfig()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.RegisterFlags(fs)
+		return cfg, fs.Parse(args)
+	}
+
+	t.Run("flags are appended in order with the -ssh-flag flags", func(t *testing.T) {
+		cfg, err := parse("-ssh-flag", "-4", "-ssh.flags-file", path, "-ssh-flag", "-o ConnectTimeout=5")
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"-4",
+			"-o ServerAliveCountMax=5",
+			`-o ProxyCommand=nc -X connect -x "proxy.internal:3128" %h %p`,
+			"-vv",
+			"-o ConnectTimeout=5",
+		}, cfg.SSHFlags)
+	})
+
+	t.Run("a missing file is an error", func(t *testing.T) {
+		_, err := parse("-ssh.flags-file", filepath.Join(t.TempDir(), "missing"))
+		assert.ErrorContains(t, err, "reading ssh flags file")
+	})
+}
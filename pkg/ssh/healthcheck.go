@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// healthCheckTimeout is how long a single tunnel health check can take.
+const healthCheckTimeout = 5 * time.Second
+
+// defaultDialKeepAlive is the default TCP keepalive period of the connections
+// to the gateway, the same as the ssh ServerAliveInterval.
+const defaultDialKeepAlive = 15 * time.Second
+
+// dialer returns the dialer for the connections the agent opens to the
+// gateway. Keepalives detect half-open connections.
+func (cfg Config) dialer() *net.Dialer {
+	keepAlive := cfg.DialKeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultDialKeepAlive
+	}
+	return &net.Dialer{KeepAlive: keepAlive}
+}
+
+// checkGateway opens, and immediately closes, a TCP connection to the gateway
+// used by the tunnel, on the port used by the tunnel.
+func (s *Client) checkGateway(ctx context.Context) error {
+	return s.dialGateway(ctx, s.gateways.current().addr)
+}
+
+// dialGateway opens, and immediately closes, a TCP connection to the gateway
+// at addr.
+func (s *Client) dialGateway(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	conn, err := s.cfg.dialer().DialContext(ctx, s.cfg.dialNetwork(), addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// watchTunnel runs the tunnel health check every TunnelHealthCheckPeriod until
+// ctx is done. It calls restart once the check has failed
+// TunnelHealthCheckFailures times in a row, so that an ssh command that is
+// still running but no longer connected is replaced.
+func (s *Client) watchTunnel(ctx context.Context, restart func()) {
+	maxFailures := s.cfg.TunnelHealthCheckFailures
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+
+	ticker := time.NewTicker(s.cfg.TunnelHealthCheckPeriod)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.healthCheck(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failures++
+				level.Warn(s.logger).Log("msg", "tunnel health check failed", "failures", failures, "err", err)
+				if failures >= maxFailures {
+					level.Warn(s.logger).Log("msg", "tunnel is unhealthy. restarting ssh client", "failures", failures)
+					tunnelHealthCheckRestartsTotal.Inc()
+					restart()
+					return
+				}
+				continue
+			}
+			failures = 0
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_TunnelHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	starts := filepath.Join(dir, "starts")
+
+	// The ssh command stays running, as with a dead connection that keepalives
+	// have not detected yet.
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\necho start >> "+starts+"\nexec sleep 60\n"), 0o755))
+
+	cfg := &Config{
+		Args:                      []string{"gateway"},
+		LegacyMode:                true,
+		SkipSSHValidation:         true,
+		SSHBinary:                 fakeSSH,
+		TunnelHealthCheckPeriod:   10 * time.Millisecond,
+		TunnelHealthCheckFailures: 2,
+	}
+	c := NewClient(cfg, log.NewNopLogger(), nil)
+
+	c.healthCheck = func(ctx context.Context) error {
+		return errors.New("gateway unreachable")
+	}
+
+	ctx := context.Background()
+	require.NoError(t, c.StartAsync(ctx))
+	require.NoError(t, c.AwaitRunning(ctx))
+	defer func() {
+		c.StopAsync()
+		_ = c.AwaitTerminated(ctx)
+	}()
+
+	// The ssh command is restarted after the health check fails.
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(starts)
+		return err == nil && strings.Count(string(b), "start") >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClient_TunnelHealthCheckRecovers(t *testing.T) {
+	c := NewClient(&Config{TunnelHealthCheckPeriod: time.Millisecond, TunnelHealthCheckFailures: 3}, log.NewNopLogger(), nil)
+
+	// Failures that are not consecutive do not restart the ssh command.
+	results := []error{errors.New("1"), errors.New("2"), nil, errors.New("3"), errors.New("4")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	i := 0
+	c.healthCheck = func(ctx context.Context) error {
+		if i == len(results) {
+			cancel()
+			return nil
+		}
+		err := results[i]
+		i++
+		return err
+	}
+
+	restarted := false
+	c.watchTunnel(ctx, func() { restarted = true })
+	assert.False(t, restarted)
+}
+
+func TestConfig_Dialer(t *testing.T) {
+	cases := []struct {
+		description   string
+		dialKeepAlive time.Duration
+		expected      time.Duration
+	}{
+		{description: "unset uses the default", dialKeepAlive: 0, expected: defaultDialKeepAlive},
+		{description: "custom period", dialKeepAlive: 5 * time.Second, expected: 5 * time.Second},
+		{description: "negative period disables keepalives", dialKeepAlive: -1, expected: -1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			cfg := Config{DialKeepAlive: tt.dialKeepAlive}
+			assert.Equal(t, tt.expected, cfg.dialer().KeepAlive)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// PinnedKnownHostsFile is the known hosts file that ssh uses when the gateway
+// host key is pinned. It only contains the pinned key.
+const PinnedKnownHostsFile = "grafana_pdc_pinned_known_hosts"
+
+// hostKeyTimeout is how long fetching a host key of the gateway can take.
+const hostKeyTimeout = 5 * time.Second
+
+// hostKeyAlgorithms are the host key algorithms that the gateway is asked
+// for, one at a time, to find the pinned key among its host keys.
+var hostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+}
+
+// errHostKeyFetched aborts the handshake once the host key is known.
+var errHostKeyFetched = errors.New("host key fetched")
+
+// pinnedKnownHostsFile returns the path of PinnedKnownHostsFile.
+func (cfg Config) pinnedKnownHostsFile() string {
+	return path.Join(cfg.CacheFileDir(), PinnedKnownHostsFile)
+}
+
+// hostKeyFingerprint returns the SHA256 fingerprint of a host key. The
+// fingerprint of a host certificate is the one of its key.
+func hostKeyFingerprint(key ssh.PublicKey) string {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// fetchHostKey returns the host key that the gateway presents for algo. The
+// connection is closed before authentication.
+func (s *Client) fetchHostKey(ctx context.Context, algo string) (ssh.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, hostKeyTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(s.cfg.GatewayHost(), strconv.Itoa(s.cfg.Port))
+	conn, err := s.cfg.dialer().DialContext(ctx, s.cfg.dialNetwork(), addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var hostKey ssh.PublicKey
+	_, _, _, err = ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:              s.cfg.sshUser(),
+		HostKeyAlgorithms: []string{algo},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyFetched
+		},
+	})
+	if hostKey == nil {
+		return nil, err
+	}
+	return hostKey, nil
+}
+
+// pinHostKey checks that the gateway has a host key with the fingerprint
+// HostKeyFingerprint, and writes it to PinnedKnownHostsFile, so that ssh
+// refuses any other host key.
+func (s *Client) pinHostKey(ctx context.Context) error {
+	want := s.cfg.HostKeyFingerprint
+	if !strings.HasPrefix(want, "SHA256:") {
+		return fmt.Errorf("invalid host key fingerprint %q, must be a SHA256 fingerprint as printed by ssh-keygen -l, e.g. SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8", want)
+	}
+
+	var found []string
+	var lastErr error
+	for _, algo := range hostKeyAlgorithms {
+		key, err := s.fetchHostKey(ctx, algo)
+		if err != nil {
+			// The gateway may not have a key for every algorithm.
+			lastErr = err
+			continue
+		}
+		got := hostKeyFingerprint(key)
+		if got != want {
+			found = append(found, got)
+			continue
+		}
+
+		if cert, ok := key.(*ssh.Certificate); ok {
+			key = cert.Key
+		}
+		host := knownhosts.Normalize(net.JoinHostPort(s.cfg.GatewayHost(), strconv.Itoa(s.cfg.Port)))
+		line := knownhosts.Line([]string{host}, key) + "\n"
+		if err := s.cfg.ensureCacheDir(); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.cfg.pinnedKnownHostsFile(), []byte(line)); err != nil {
+			return fmt.Errorf("writing pinned known hosts file: %w", err)
+		}
+		level.Info(s.logger).Log("msg", "gateway host key matches the pinned fingerprint", "fingerprint", want)
+		return nil
+	}
+
+	if len(found) == 0 {
+		return fmt.Errorf("could not fetch the gateway host key: %w", lastErr)
+	}
+	level.Error(s.logger).Log("msg", "gateway host key does not match the pinned fingerprint", "expected", want, "actual", fmt.Sprint(found))
+	return fmt.Errorf("gateway host key fingerprint does not match the pinned fingerprint %s, the gateway has %v", want, found)
+}
@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newFakeGateway starts an ssh server with an ed25519 host key, that rejects
+// all clients after the key exchange, and returns its address and host key.
+func newFakeGateway(t *testing.T) (*net.TCPAddr, ssh.PublicKey) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("denied")
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _, _, _ = ssh.NewServerConn(conn, cfg)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr), signer.PublicKey()
+}
+
+func newPinningClient(t *testing.T, addr *net.TCPAddr, fingerprint string) *Client {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+	cfg.URL = &url.URL{Host: addr.IP.String()}
+	cfg.Port = addr.Port
+	cfg.HostKeyFingerprint = fingerprint
+	return NewClient(cfg, log.NewNopLogger(), nil)
+}
+
+func TestClient_PinHostKey(t *testing.T) {
+	addr, hostKey := newFakeGateway(t)
+
+	t.Run("matching fingerprint is pinned", func(t *testing.T) {
+		c := newPinningClient(t, addr, ssh.FingerprintSHA256(hostKey))
+
+		require.NoError(t, c.pinHostKey(context.Background()))
+
+		b, err := os.ReadFile(c.cfg.pinnedKnownHostsFile())
+		require.NoError(t, err)
+		assert.Equal(t, "[127.0.0.1]:"+strconv.Itoa(addr.Port)+" "+string(ssh.MarshalAuthorizedKey(hostKey)), string(b))
+	})
+
+	t.Run("mismatching fingerprint fails", func(t *testing.T) {
+		_, other := newFakeGateway(t)
+		c := newPinningClient(t, addr, ssh.FingerprintSHA256(other))
+
+		err := c.pinHostKey(context.Background())
+		assert.ErrorContains(t, err, "does not match the pinned fingerprint "+ssh.FingerprintSHA256(other))
+		assert.ErrorContains(t, err, ssh.FingerprintSHA256(hostKey))
+		assert.NoFileExists(t, c.cfg.pinnedKnownHostsFile())
+	})
+
+	t.Run("invalid fingerprint", func(t *testing.T) {
+		c := newPinningClient(t, addr, "nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8")
+		assert.ErrorContains(t, c.pinHostKey(context.Background()), "invalid host key fingerprint")
+	})
+
+	t.Run("ssh only trusts the pinned key", func(t *testing.T) {
+		c := newPinningClient(t, addr, ssh.FingerprintSHA256(hostKey))
+
+		flags, err := c.SSHFlagsFromConfig()
+		require.NoError(t, err)
+		joined := strings.Join(flags, " ")
+		assert.Contains(t, joined, "-o StrictHostKeyChecking=yes")
+		assert.Contains(t, joined, "-o UserKnownHostsFile="+c.cfg.pinnedKnownHostsFile())
+	})
+
+	t.Run("user cannot override the pinned host key options", func(t *testing.T) {
+		for _, f := range []string{
+			"-o StrictHostKeyChecking=no",
+			"-o UserKnownHostsFile=/dev/null",
+			"-o userknownhostsfile=/dev/null",
+			"-o GlobalKnownHostsFile=/etc/ssh/other_known_hosts",
+			"-o KnownHostsCommand=/bin/true",
+		} {
+			c := newPinningClient(t, addr, ssh.FingerprintSHA256(hostKey))
+			c.cfg.SSHFlags = []string{f}
+
+			_, err := c.SSHFlagsFromConfig()
+			assert.ErrorContains(t, err, "cannot be set with -ssh.host-key-fingerprint", f)
+		}
+	})
+
+	t.Run("host key options can be set without pinning", func(t *testing.T) {
+		c := newPinningClient(t, addr, "")
+		c.cfg.SSHFlags = []string{"-o StrictHostKeyChecking=no"}
+
+		flags, err := c.SSHFlagsFromConfig()
+		require.NoError(t, err)
+		assert.Contains(t, strings.Join(flags, " "), "-o StrictHostKeyChecking=no")
+	})
+}
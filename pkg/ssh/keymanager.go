@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
@@ -9,14 +10,22 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
+	"github.com/grafana/pdc-agent/pkg/events"
 	"github.com/grafana/pdc-agent/pkg/pdc"
+	"github.com/grafana/pdc-agent/pkg/retry"
 	"github.com/mikesmitty/edkey"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -24,8 +33,16 @@ const (
 	// SSHKeySize is the size of the SSH key.
 	SSHKeySize     = 4096
 	KnownHostsFile = "grafana_pdc_known_hosts"
+
+	// defaultCertCheckPeriod is how often the certificate is checked when
+	// CertCheckCertExpiryPeriod is unset.
+	defaultCertCheckPeriod = time.Minute
 )
 
+// minCertCheckPeriod is the shortest allowed certificate check period. It is a
+// variable so that tests can lower it.
+var minCertCheckPeriod = 10 * time.Second
+
 // TODO
 // KeyManager implements KeyManager. If needed, it gets new certificates signed
 // by the PDC API.
@@ -36,15 +53,41 @@ type KeyManager struct {
 	cfg    *Config
 	client pdc.Client
 	logger log.Logger
+
+	// keys provides the key pair that certificates are signed for.
+	keys KeySource
+
+	// renewMu serialises on-demand certificate renewals.
+	renewMu *sync.Mutex
+	// signLimiter enforces MinSignInterval between sign requests.
+	signLimiter *signLimiter
+
+	// now returns the local time. It can be skewed in tests.
+	now func() time.Time
+	// renewSeed, in [0, 1), picks the point at which certificates are
+	// renewed within CertRenewJitter.
+	renewSeed float64
+}
+
+// signLimiter records when the last sign request was made. Its mutex is held
+// for the whole of a sign request, so that concurrent requests are coalesced.
+type signLimiter struct {
+	mu   sync.Mutex
+	last time.Time
 }
 
 // NewKeyManager returns a new KeyManager in an idle state
 func NewKeyManager(cfg *Config, logger log.Logger, client pdc.Client) *KeyManager {
 	km := KeyManager{
-		cfg:    cfg,
-		client: client,
-		logger: logger,
+		cfg:         cfg,
+		client:      client,
+		logger:      logger,
+		renewMu:     &sync.Mutex{},
+		signLimiter: &signLimiter{},
+		now:         time.Now,
+		renewSeed:   hostSeed(),
 	}
+	km.keys = newKeySource(&km)
 
 	return &km
 }
@@ -53,22 +96,54 @@ func NewKeyManager(cfg *Config, logger log.Logger, client pdc.Client) *KeyManage
 // certificate refresh goroutine.
 func (km *KeyManager) Start(ctx context.Context) error {
 	level.Debug(km.logger).Log("msg", "starting key manager")
-	err := km.CreateKeys(ctx, km.cfg.ForceKeyFileOverwrite)
+
+	period, err := km.certCheckPeriod()
 	if err != nil {
 		return err
 	}
+	if err := km.cfg.checkCertRenewJitter(); err != nil {
+		return err
+	}
+
+	if km.cfg.StartupJitter > 0 {
+		level.Debug(km.logger).Log("msg", "waiting before the first certificate check", "max", km.cfg.StartupJitter)
+		if err := retry.Jitter(ctx, km.cfg.StartupJitter); err != nil {
+			return err
+		}
+	}
 
-	go km.backgroundCertRefresh(ctx)
+	err = km.createKeysAtStartup(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := km.CheckKeyFilePermissions(); err != nil {
+		return err
+	}
+
+	go km.backgroundCertRefresh(ctx, period)
 	return nil
 }
 
-func (km *KeyManager) backgroundCertRefresh(ctx context.Context) {
-	if km.cfg.CertCheckCertExpiryPeriod == 0 {
-		level.Debug(km.logger).Log("msg", "CertCheckCertExpiryPeriod is 0, will not refresh certificate in the background")
-		return
-	}
+// certCheckPeriod returns how often the certificate is checked in the
+// background. An unset period uses the default, and periods that would make
+// the check spin are raised to minCertCheckPeriod.
+func (km *KeyManager) certCheckPeriod() (time.Duration, error) {
+	p := km.cfg.CertCheckCertExpiryPeriod
+	switch {
+	case p < 0:
+		return 0, fmt.Errorf("invalid certificate check period %s, it must not be negative", p)
+	case p == 0:
+		return defaultCertCheckPeriod, nil
+	case p < minCertCheckPeriod:
+		level.Warn(km.logger).Log("msg", "certificate check period is too small, using the minimum", "period", p, "min", minCertCheckPeriod)
+		return minCertCheckPeriod, nil
+	}
+	return p, nil
+}
 
-	ticker := time.NewTicker(km.cfg.CertCheckCertExpiryPeriod)
+func (km *KeyManager) backgroundCertRefresh(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
 	for {
 		select {
 		case <-ticker.C:
@@ -84,10 +159,43 @@ func (km *KeyManager) backgroundCertRefresh(ctx context.Context) {
 	}
 }
 
+// RenewCert signs a new certificate, regardless of the validity of the current
+// one. The ssh client uses the new certificate the next time it connects.
+// It is safe to call concurrently.
+func (km *KeyManager) RenewCert(ctx context.Context) error {
+	if km.cfg.PreSignedCertFile != "" {
+		return errors.New("cannot renew a pre-signed certificate")
+	}
+
+	km.renewMu.Lock()
+	defer km.renewMu.Unlock()
+
+	level.Info(km.logger).Log("msg", "renewing certificate on demand")
+	if err := km.ensureCertExists(ctx, true); err != nil {
+		return fmt.Errorf("renewing certificate: %w", err)
+	}
+	return nil
+}
+
 // CreateKeys checks that the SSH public key, private key, certificate and known_hosts
 // files for existence and validity, and generates new ones if required.
 func (km *KeyManager) CreateKeys(ctx context.Context, forceNewKeys bool) error {
-	newCertRequired, err := km.ensureKeysExist(forceNewKeys)
+	if km.cfg.PreSignedCertFile != "" {
+		return km.checkPreSignedCert()
+	}
+
+	if err := km.cfg.ensureCacheDir(); err != nil {
+		return err
+	}
+	if err := km.recoverRotation(); err != nil {
+		return fmt.Errorf("recovering interrupted key rotation: %w", err)
+	}
+
+	if km.cfg.PKCS11Module == "" && km.incompleteKeyPair() {
+		forceNewKeys = true
+	}
+
+	newCertRequired, err := km.keys.EnsureKey(forceNewKeys)
 	if err != nil {
 		return err
 	}
@@ -112,10 +220,14 @@ func (km *KeyManager) CreateKeys(ctx context.Context, forceNewKeys bool) error {
 // EnsureCertExists checks for the existence of a valid SSH certificate and
 // regenerates one if it cannot find one, or if forceCreate is true.
 func (km KeyManager) ensureCertExists(ctx context.Context, forceCreate bool) error {
+	if km.cfg.PreSignedCertFile != "" {
+		return km.checkPreSignedCert()
+	}
+
 	newCertRequired := forceCreate
 
 	if newCertRequired {
-		err := km.generateCert(ctx)
+		err := km.generateCert(ctx, true)
 		if err != nil {
 			return fmt.Errorf("failed to generate new certificate: %w", err)
 		}
@@ -127,13 +239,68 @@ func (km KeyManager) ensureCertExists(ctx context.Context, forceCreate bool) err
 		return nil
 	}
 
-	err := km.generateCert(ctx)
+	err := km.generateCert(ctx, false)
 	if err != nil {
 		return fmt.Errorf("failed to generate new certificate: %w", err)
 	}
 	return nil
 }
 
+// CheckKeyFilePermissions returns an error if the private key file can be
+// accessed by users other than its owner. File permissions are not checked on
+// Windows, nor when the private key is in a PKCS#11 token.
+func (km KeyManager) CheckKeyFilePermissions() error {
+	if km.cfg.SkipKeyPermCheck || km.cfg.PKCS11Module != "" || runtime.GOOS == "windows" {
+		return nil
+	}
+
+	fi, err := os.Stat(km.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("checking private key file permissions: %w", err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("private key file %s has permissions %#o, it must not be accessible by group or others (0600)", km.cfg.KeyFile, perm)
+	}
+	return nil
+}
+
+// checkPreSignedCert checks that the private key and the pre-signed certificate
+// can be read, and that the certificate is valid. It warns when the certificate
+// is about to expire, since it cannot be renewed by the agent.
+func (km KeyManager) checkPreSignedCert() error {
+	if _, err := km.readKeyFile(); err != nil {
+		return fmt.Errorf("reading private key file: %w", err)
+	}
+
+	cb, err := os.ReadFile(km.cfg.PreSignedCertFile)
+	if err != nil {
+		return fmt.Errorf("reading pre-signed certificate file: %w", err)
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+	if err != nil {
+		return fmt.Errorf("parsing pre-signed certificate: %w", err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return errors.New("pre-signed certificate is incorrect format")
+	}
+
+	now := uint64(km.now().Unix())
+	validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339)
+
+	if now < cert.ValidAfter {
+		return errors.New("pre-signed certificate is not yet valid")
+	}
+	if now > cert.ValidBefore {
+		return fmt.Errorf("pre-signed certificate expired at %s", validBefore)
+	}
+	if now > (cert.ValidBefore - uint64(km.certExpiryWindow(cert).Seconds())) {
+		level.Warn(km.logger).Log("msg", "pre-signed certificate is about to expire", "valid_before", validBefore)
+	}
+
+	return nil
+}
+
 // ensureKeysExist checks for the existence of valid SSH keys. If they exist,
 // it does nothing. If they don't, it creates them. It returns a boolean
 // indicating whether new keys were created, and an error.
@@ -174,12 +341,39 @@ func (km KeyManager) newKeysRequired() bool {
 		return true
 	}
 
-	_, _, _, _, err = ssh.ParseAuthorizedKey(pbk)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pbk)
 	if err != nil {
 		level.Info(km.logger).Log("msg", "new keys required: could not parse public key")
 		return true
 	}
 
+	if signer, err := ssh.ParsePrivateKey(kb); err == nil && !keysEqual(signer.PublicKey(), pub) {
+		level.Info(km.logger).Log("msg", "new keys required: public key does not match private key")
+		return true
+	}
+
+	return false
+}
+
+// incompleteKeyPair returns true if the certificate file exists, but the
+// private key is missing or cannot be parsed. The certificate is then for a
+// key that is gone, so both are regenerated. A private key without a
+// certificate is not incomplete: it is signed as is, as after the show-pubkey
+// command.
+func (km KeyManager) incompleteKeyPair() bool {
+	if _, err := km.readCertFile(); err != nil {
+		return false
+	}
+
+	kb, err := km.readKeyFile()
+	if err != nil {
+		level.Warn(km.logger).Log("msg", "incomplete key pair: the certificate exists but the private key cannot be read. Creating a new key pair and certificate", "err", err)
+		return true
+	}
+	if _, err := ssh.ParsePrivateKey(kb); err != nil {
+		level.Warn(km.logger).Log("msg", "incomplete key pair: the certificate exists but the private key cannot be parsed. Creating a new key pair and certificate", "err", err)
+		return true
+	}
 	return false
 }
 
@@ -200,26 +394,37 @@ func (km KeyManager) newCertRequired() bool {
 		return true
 	}
 
-	now := uint64(time.Now().Unix())
+	now := uint64(km.now().Unix())
 
 	if now > cert.ValidBefore {
 		level.Info(km.logger).Log("msg", "new certificate required: certificate validity has expired")
 		return true
 	}
 
-	if now > (cert.ValidBefore - uint64(km.cfg.CertExpiryWindow.Seconds())) {
+	if now > (cert.ValidBefore - uint64(km.certExpiryWindow(cert).Seconds())) {
 		level.Info(km.logger).Log("msg", "new certificate required: certificate is about to expire")
 		return true
 	}
 
-	if now < cert.ValidAfter {
+	if notYetValid(now, cert) {
 		level.Info(km.logger).Log("msg", "new certificate required: certificate is not yet valid")
 		return true
 	}
 
+	pbk, err := km.readPubKeyFile()
+	if err != nil {
+		level.Info(km.logger).Log("msg", "new certificate required: could not read public key file")
+		return true
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pbk)
+	if err != nil || !keysEqual(cert.Key, pub) {
+		level.Warn(km.logger).Log("msg", "mismatched key pair: the certificate is not for the private key. Signing a new certificate")
+		return true
+	}
+
 	level.Debug(km.logger).Log("msg", "found existing valid certificate")
 
-	kh, err := os.ReadFile(path.Join(km.cfg.KeyFileDir(), KnownHostsFile))
+	kh, err := os.ReadFile(km.cfg.knownHostsFile())
 	if err != nil {
 		level.Info(km.logger).Log("msg", "fetching new certificate: cannot not read known hosts file")
 		return true
@@ -234,6 +439,119 @@ func (km KeyManager) newCertRequired() bool {
 	return false
 }
 
+// checkPrincipal returns an error if ExpectedPrincipals are set and cert
+// grants none of them. Certificates can grant several principals, e.g. one per
+// namespace of an access policy, and any expected one is enough. The gateway
+// would otherwise accept the connection and deny the tunnel.
+func (km KeyManager) checkPrincipal(cert *ssh.Certificate) error {
+	want := km.cfg.ExpectedPrincipals
+	if len(want) == 0 {
+		return nil
+	}
+	for _, p := range cert.ValidPrincipals {
+		if slices.Contains(want, p) {
+			return nil
+		}
+	}
+
+	level.Error(km.logger).Log("msg", "signed certificate does not grant the expected principal", "expected", strings.Join(want, ","), "actual", strings.Join(cert.ValidPrincipals, ","))
+	if len(want) == 1 {
+		return fmt.Errorf("signed certificate does not grant principal %q, it grants %q", want[0], cert.ValidPrincipals)
+	}
+	return fmt.Errorf("signed certificate grants none of the principals %q, it grants %q", want, cert.ValidPrincipals)
+}
+
+// certValid returns true if the certificate file contains a certificate that
+// is currently valid, even if it is within the expiry window.
+func (km KeyManager) certValid() bool {
+	cb, err := km.readCertFile()
+	if err != nil {
+		return false
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+	if err != nil {
+		return false
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return false
+	}
+
+	now := uint64(km.now().Unix())
+	return !notYetValid(now, cert) && now < cert.ValidBefore
+}
+
+// certForCurrentKey returns true if the certificate file contains a
+// certificate for the current public key, and not for a key that was replaced.
+func (km KeyManager) certForCurrentKey() bool {
+	cert, err := km.readCert()
+	if err != nil {
+		return false
+	}
+	pbk, err := km.keys.PublicKey()
+	if err != nil {
+		return false
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pbk)
+	return err == nil && keysEqual(cert.Key, pub)
+}
+
+// CertValidity returns the validity window of the certificate used to
+// connect to the gateway.
+func (km KeyManager) CertValidity() (validAfter, validBefore time.Time, err error) {
+	cert, err := km.readCert()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return time.Unix(int64(cert.ValidAfter), 0).UTC(), time.Unix(int64(cert.ValidBefore), 0).UTC(), nil
+}
+
+// CertPrincipals returns the principals granted by the certificate used to
+// connect to the gateway.
+func (km KeyManager) CertPrincipals() ([]string, error) {
+	cert, err := km.readCert()
+	if err != nil {
+		return nil, err
+	}
+	return cert.ValidPrincipals, nil
+}
+
+// readCert reads and parses the certificate used to connect to the gateway.
+func (km KeyManager) readCert() (*ssh.Certificate, error) {
+	cb, err := os.ReadFile(km.cfg.CertFile())
+	if err != nil {
+		return nil, err
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("certificate is incorrect format")
+	}
+	return cert, nil
+}
+
+// certExpiryWindow returns the time before the certificate expires that it
+// should be renewed: CertExpiryWindow, plus the renewal jitter of the agent.
+// When a certificate TTL is requested, the window is clamped to half of the
+// certificate's lifetime, so that short-lived certificates are not renewed
+// immediately after being signed. The lifetime is taken from the certificate
+// itself, so a shorter lifetime returned by the server is honored.
+func (km KeyManager) certExpiryWindow(cert *ssh.Certificate) time.Duration {
+	window := km.cfg.CertExpiryWindow + km.renewJitter(cert)
+	if km.cfg.PDC.RequestedCertTTL <= 0 || cert.ValidBefore <= cert.ValidAfter {
+		return window
+	}
+
+	lifetime := time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second
+	if window > lifetime/2 {
+		return lifetime / 2
+	}
+	return window
+}
+
 // argumentsHashIsDifferent returns true when specific arguments
 // passed to the pdc agent are different from the previous arguments.
 func (km KeyManager) argumentsHashIsDifferent(hash string) bool {
@@ -248,7 +566,7 @@ func (km KeyManager) argumentsHashIsDifferent(hash string) bool {
 	return contents != hash
 }
 
-// argumentsHash returns a hash of the values that end up in the principals field of the certificate.
+// argumentsHash returns a hash of the values that end up in the principals and key id fields of the certificate.
 func (km KeyManager) argumentsHash() string {
 	value := km.cfg.PDC.HostedGrafanaID
 
@@ -256,45 +574,112 @@ func (km KeyManager) argumentsHash() string {
 		value = fmt.Sprintf("%s/%s", value, km.cfg.PDC.DevNetwork)
 	}
 
+	// The key id is only hashed when set, so that the hash of agents that
+	// do not set it is unchanged.
+	if km.cfg.PDC.KeyID != "" {
+		value = fmt.Sprintf("%s#%s", value, km.cfg.PDC.KeyID)
+	}
+
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
 }
 
 func (km KeyManager) generateKeyPair() error {
+	pemPrivKey, pubKey, err := newKeyPair()
+	if err != nil {
+		return err
+	}
 
-	// Generate a new private/public keypair for OpenSSH
-	pubKey, privKey, _ := ed25519.GenerateKey(rand.Reader)
-	sshPubKey, _ := ssh.NewPublicKey(pubKey)
+	err = km.writeKeyFile(pemPrivKey)
+	if err != nil {
+		return err
+	}
+
+	return km.writePubKeyFile(pubKey)
+}
+
+// newKeyPair generates a new private/public keypair for OpenSSH. The public
+// key is in authorized_keys file format.
+func newKeyPair() ([]byte, []byte, error) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	sshPubKey, err := ssh.NewPublicKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	pemKey := &pem.Block{
 		Type:  "OPENSSH PRIVATE KEY",
 		Bytes: edkey.MarshalED25519PrivateKey(privKey),
 	}
-	pemPrivKey := pem.EncodeToMemory(pemKey)
+	return pem.EncodeToMemory(pemKey), ssh.MarshalAuthorizedKey(sshPubKey), nil
+}
 
-	err := km.writeKeyFile(pemPrivKey)
-	if err != nil {
+// keysEqual returns true if a and b are the same public key.
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// generateCert signs a new certificate, at most once per MinSignInterval.
+// Within the interval, the current certificate is reused if it is still valid
+// for the current key, unless force is set, e.g. for renewals on demand, in
+// which case the request waits for the interval to pass.
+func (km KeyManager) generateCert(ctx context.Context, force bool) error {
+	level.Info(km.logger).Log("msg", "generating new certificate")
+
+	km.signLimiter.mu.Lock()
+	defer km.signLimiter.mu.Unlock()
+
+	if wait := km.cfg.MinSignInterval - time.Since(km.signLimiter.last); wait > 0 {
+		if !force && km.certValid() && km.certForCurrentKey() {
+			level.Info(km.logger).Log("msg", "sign request throttled, reusing the current certificate", "min_interval", km.cfg.MinSignInterval)
+			return nil
+		}
+		level.Info(km.logger).Log("msg", "sign request throttled, waiting", "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	km.signLimiter.last = time.Now()
+
+	ctx, span := tracer.Start(ctx, "sign certificate")
+	defer span.End()
+
+	if err := km.signCert(ctx); err != nil {
+		certSignFailureTotal.WithLabelValues(signFailureCategory(err)).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return err
 	}
 
-	// public key should be in authorized_keys file format
-	return km.writePubKeyFile(ssh.MarshalAuthorizedKey(sshPubKey))
+	certSignSuccessTotal.Inc()
+	if err := km.cfg.Events.Emit(events.CertRenewed); err != nil {
+		level.Warn(km.logger).Log("msg", "could not write event", "event", events.CertRenewed, "err", err)
+	}
+	return nil
 }
 
-func (km KeyManager) generateCert(ctx context.Context) error {
-	level.Info(km.logger).Log("msg", "generating new certificate")
-
-	pbk, err := km.readPubKeyFile()
+// signCert requests a new certificate from the PDC API and writes it, along
+// with the known hosts file, to disk. If ctx is done while the request is in
+// flight, it gets SignShutdownGrace to finish, and nothing is written if it
+// does not.
+func (km KeyManager) signCert(ctx context.Context) error {
+	pbk, err := km.keys.PublicKey()
 	if err != nil {
 		return fmt.Errorf("could not read public ssh key file: %w", err)
 	}
 
-	resp, err := km.client.SignSSHKey(ctx, pbk)
+	signCtx, cancel := withShutdownGrace(ctx, km.cfg.SignShutdownGrace)
+	defer cancel()
+	resp, err := km.requestCert(signCtx, pbk)
 	if err != nil {
-		return fmt.Errorf("key signing request failed: %w", err)
+		return err
 	}
-
-	if resp == nil {
-		return errors.New("received empty response from PDC API")
+	if err := signCtx.Err(); err != nil {
+		return fmt.Errorf("sign request aborted at shutdown: %w", err)
 	}
 
 	// write response to file
@@ -302,53 +687,77 @@ func (km KeyManager) generateCert(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to write known hosts file: %w", err)
 	}
-	err = km.writeCertFile(ssh.MarshalAuthorizedKey(&resp.Certificate))
+	return km.writeCertFile(ssh.MarshalAuthorizedKey(&resp.Certificate))
+}
+
+// requestCert requests a certificate for the public key pbk from the PDC API.
+func (km KeyManager) requestCert(ctx context.Context, pbk []byte) (*pdc.SigningResponse, error) {
+	resp, err := km.client.SignSSHKey(ctx, pbk)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("key signing request failed: %w", err)
 	}
 
-	return nil
+	if resp == nil {
+		return nil, errors.New("received empty response from PDC API")
+	}
+
+	if err := km.checkPrincipal(&resp.Certificate); err != nil {
+		return nil, err
+	}
+
+	km.checkClockSkew(&resp.Certificate)
+
+	validAfter := time.Unix(int64(resp.Certificate.ValidAfter), 0).UTC().Format(time.RFC3339)
+	validBefore := time.Unix(int64(resp.Certificate.ValidBefore), 0).UTC().Format(time.RFC3339)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("cert.valid_after", validAfter),
+		attribute.String("cert.valid_before", validBefore),
+	)
+	level.Info(km.logger).Log("msg", "new certificate signed", "valid_after", validAfter, "valid_before", validBefore)
+
+	return resp, nil
 }
 
 func (km KeyManager) readKeyFile() ([]byte, error) {
 	return os.ReadFile(km.cfg.KeyFile)
 }
 
+func (km KeyManager) pubKeyFile() string {
+	return km.cfg.KeyFile + ".pub"
+}
+
+func (km KeyManager) certFile() string {
+	return km.cfg.cacheFile("-cert.pub")
+}
+
 func (km KeyManager) readPubKeyFile() ([]byte, error) {
-	path := km.cfg.KeyFile + ".pub"
-	return os.ReadFile(path)
+	return os.ReadFile(km.pubKeyFile())
 }
 
 func (km KeyManager) readCertFile() ([]byte, error) {
-	path := km.cfg.KeyFile + "-cert.pub"
-	return os.ReadFile(path)
+	return os.ReadFile(km.certFile())
 }
 
 func (km KeyManager) readHashFile() ([]byte, error) {
-	path := km.cfg.KeyFile + "_hash"
-	return os.ReadFile(path)
+	return os.ReadFile(km.cfg.cacheFile("_hash"))
 }
 
 func (km KeyManager) writeKeyFile(data []byte) error {
-	return os.WriteFile(km.cfg.KeyFile, data, 0600)
+	return writeFileAtomic(km.cfg.KeyFile, data)
 }
 
 func (km KeyManager) writePubKeyFile(data []byte) error {
-	path := km.cfg.KeyFile + ".pub"
-	return os.WriteFile(path, data, 0600)
+	return writeFileAtomic(km.pubKeyFile(), data)
 }
 
 func (km KeyManager) writeKnownHostsFile(data []byte) error {
-	path := path.Join(km.cfg.KeyFileDir(), KnownHostsFile)
-	return os.WriteFile(path, data, 0600)
+	return writeFileAtomic(km.cfg.knownHostsFile(), data)
 }
 
 func (km KeyManager) writeCertFile(data []byte) error {
-	path := path.Join(km.cfg.KeyFile + "-cert.pub")
-	return os.WriteFile(path, data, 0600)
+	return writeFileAtomic(km.certFile(), data)
 }
 
 func (km KeyManager) writeHashFile(data []byte) error {
-	path := path.Join(km.cfg.KeyFile + "_hash")
-	return os.WriteFile(path, data, 0600)
+	return writeFileAtomic(km.cfg.cacheFile("_hash"), data)
 }
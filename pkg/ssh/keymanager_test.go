@@ -22,8 +22,14 @@ import (
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/grafana/pdc-agent/pkg/ssh"
 	"github.com/mikesmitty/edkey"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
@@ -388,8 +394,417 @@ func TestKeyManager_EnsureKeysExist(t *testing.T) {
 	}
 }
 
+func TestKeyManager_RequestedCertTTL(t *testing.T) {
+	testcases := []struct {
+		name             string
+		requestedCertTTL time.Duration
+		wantSigningCalls int
+	}{
+		{
+			name:             "no ttl requested: expiry window is not clamped, expect signing request",
+			wantSigningCalls: 1,
+		},
+		{
+			name:             "ttl requested: expiry window is clamped to half the cert lifetime, no signing request",
+			requestedCertTTL: 10 * time.Minute,
+			wantSigningCalls: 0,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			pdcCfg := pdc.Config{HostedGrafanaID: "1", RequestedCertTTL: tc.requestedCertTTL}
+			cfg := ssh.DefaultConfig()
+			cfg.KeyFile = path.Join(t.TempDir(), "testkey")
+			// the window is larger than the remaining validity of the cert
+			cfg.CertExpiryWindow = 8 * time.Minute
+
+			m := newMockPDC(t, http.MethodPost, "/pdc/api/v1/sign-public-key", http.StatusOK)
+			pdcCfg.URL = m.URL()
+			cfg.PDC = pdcCfg
+
+			// cert with a 10m lifetime and 6m of remaining validity
+			privKey, pubKey, cert, kh := generateKeys("6m", "-4m")
+			_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
+			_ = os.WriteFile(cfg.KeyFile+pubSuffix, pubKey, 0644)
+			_ = os.WriteFile(cfg.KeyFile+certSuffix, cert, 0644)
+			_ = os.WriteFile(path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile), kh, 0644)
+			_ = os.WriteFile(cfg.KeyFile+hashSuffix, []byte("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), 0644)
+
+			logger := log.NewNopLogger()
+			client, err := pdc.NewClient(&pdcCfg, logger)
+			require.Nil(t, err)
+
+			km := ssh.NewKeyManager(cfg, logger, client)
+			require.Nil(t, km.CreateKeys(context.Background(), false))
+
+			assert.Equal(t, tc.wantSigningCalls, m.CalledCount())
+		})
+	}
+}
+
+func TestKeyManager_SignMetrics(t *testing.T) {
+	testcases := []struct {
+		name            string
+		apiResponseCode int
+		wantErr         bool
+		wantMetric      string
+		wantLabels      map[string]string
+	}{
+		{
+			name:            "signing succeeds: success counter increments",
+			apiResponseCode: http.StatusOK,
+			wantMetric:      "pdc_agent_cert_sign_success_total",
+		},
+		{
+			name:            "signing is forbidden: failure counter increments as unauthorized",
+			apiResponseCode: http.StatusForbidden,
+			wantErr:         true,
+			wantMetric:      "pdc_agent_cert_sign_failure_total",
+			wantLabels:      map[string]string{"category": "unauthorized"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			pdcCfg := pdc.Config{HostedGrafanaID: "1"}
+			cfg := ssh.DefaultConfig()
+			cfg.KeyFile = path.Join(t.TempDir(), "testkey")
+
+			m := newMockPDC(t, http.MethodPost, "/pdc/api/v1/sign-public-key", tc.apiResponseCode)
+			pdcCfg.URL = m.URL()
+			cfg.PDC = pdcCfg
+
+			logger := log.NewNopLogger()
+			client, err := pdc.NewClient(&pdcCfg, logger)
+			require.Nil(t, err)
+
+			before := counterValue(t, tc.wantMetric, tc.wantLabels)
+
+			km := ssh.NewKeyManager(cfg, logger, client)
+			err = km.CreateKeys(context.Background(), false)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, before+1, counterValue(t, tc.wantMetric, tc.wantLabels))
+		})
+	}
+}
+
+// counterValue returns the value of the counter with the given name and labels
+// from the default prometheus registry, or 0 if it has not been observed yet.
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if labels[lp.GetName()] != lp.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestKeyManager_RenewCert(t *testing.T) {
+	ctx := context.Background()
+	sut := testKeyManager(t)
+	require.NoError(t, sut.km.CreateKeys(ctx, false))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, sut.km.RenewCert(ctx))
+		}()
+	}
+	wg.Wait()
+
+	// one signing request when keys are created, and one per renewal
+	assert.Equal(t, 4, sut.pdc.CalledCount())
+	assertExpectedFiles(t, sut.sshCfg)
+}
+
+func TestKeyManager_MinSignInterval(t *testing.T) {
+	t.Parallel()
+
+	t.Run("request within the interval reuses a valid certificate", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		sut := testKeyManager(t)
+		sut.sshCfg.MinSignInterval = time.Minute
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+
+		// a certificate for the current key, valid but within the expiry
+		// window
+		privKey, pubKey, cert, _ := generateKeys("30s", "")
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile, privKey, 0600))
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+pubSuffix, pubKey, 0644))
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+certSuffix, cert, 0644))
+
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+		assert.Equal(t, 1, sut.pdc.CalledCount())
+	})
+
+	t.Run("request within the interval waits when the certificate is for another key", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		sut := testKeyManager(t)
+		sut.sshCfg.MinSignInterval = 300 * time.Millisecond
+
+		// a valid certificate, for a key that is not the current one, e.g.
+		// after the key was rotated
+		_, _, cert, _ := generateKeys("", "")
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+certSuffix, cert, 0644))
+
+		start := time.Now()
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+		assert.Equal(t, 2, sut.pdc.CalledCount())
+	})
+
+	t.Run("renewal on demand within the interval waits for a new certificate", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		sut := testKeyManager(t)
+		sut.sshCfg.MinSignInterval = 300 * time.Millisecond
+
+		// a valid certificate for the current key, as signed at startup
+		privKey, pubKey, cert, _ := generateKeys("", "")
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile, privKey, 0600))
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+pubSuffix, pubKey, 0644))
+		require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+certSuffix, cert, 0644))
+
+		start := time.Now()
+		require.NoError(t, sut.km.RenewCert(ctx))
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+		assert.Equal(t, 2, sut.pdc.CalledCount())
+	})
+
+	t.Run("request within the interval waits when the certificate is invalid", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		// the mock PDC API returns an expired certificate
+		sut := testKeyManager(t)
+		sut.sshCfg.MinSignInterval = 300 * time.Millisecond
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+
+		start := time.Now()
+		require.NoError(t, sut.km.RenewCert(ctx))
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+		assert.Equal(t, 2, sut.pdc.CalledCount())
+	})
+
+	t.Run("request after the interval is not delayed", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		sut := testKeyManager(t)
+		sut.sshCfg.MinSignInterval = 50 * time.Millisecond
+		require.NoError(t, sut.km.CreateKeys(ctx, false))
+
+		<-time.After(100 * time.Millisecond)
+		require.NoError(t, sut.km.RenewCert(ctx))
+		assert.Equal(t, 2, sut.pdc.CalledCount())
+	})
+}
+
+func TestKeyManager_Tracing(t *testing.T) {
+	// The tracer of the package delegates to the first global provider that
+	// is set, so it is shared by the test cases.
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	testcases := []struct {
+		name            string
+		apiResponseCode int
+		wantStatus      codes.Code
+		wantAttrs       []string
+	}{
+		{
+			name:            "signed certificate",
+			apiResponseCode: http.StatusOK,
+			wantStatus:      codes.Unset,
+			wantAttrs:       []string{"cert.valid_after", "cert.valid_before"},
+		},
+		{
+			name:            "failed sign request",
+			apiResponseCode: http.StatusForbidden,
+			wantStatus:      codes.Error,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			pdcCfg := pdc.Config{HostedGrafanaID: "1"}
+			cfg := ssh.DefaultConfig()
+			cfg.KeyFile = path.Join(t.TempDir(), "testkey")
+			m := newMockPDC(t, http.MethodPost, "/pdc/api/v1/sign-public-key", tc.apiResponseCode)
+			pdcCfg.URL = m.URL()
+			cfg.PDC = pdcCfg
+
+			logger := log.NewNopLogger()
+			client, err := pdc.NewClient(&pdcCfg, logger)
+			require.NoError(t, err)
+
+			before := len(sr.Ended())
+			err = ssh.NewKeyManager(cfg, logger, client).CreateKeys(context.Background(), false)
+			if tc.wantStatus == codes.Error {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			spans := sr.Ended()[before:]
+			require.Len(t, spans, 1)
+			span := spans[0]
+			assert.Equal(t, "sign certificate", span.Name())
+			assert.Equal(t, tc.wantStatus, span.Status().Code)
+
+			attrs := map[string]string{}
+			for _, kv := range span.Attributes() {
+				attrs[string(kv.Key)] = kv.Value.AsString()
+			}
+			for _, a := range tc.wantAttrs {
+				assert.NotEmpty(t, attrs[a], a)
+			}
+			if tc.wantStatus == codes.Error {
+				assert.NotEmpty(t, span.Status().Description)
+				require.NotEmpty(t, span.Events())
+				assert.Equal(t, "exception", span.Events()[0].Name)
+			}
+		})
+	}
+}
+
+func TestKeyManager_PreSignedCert(t *testing.T) {
+	testcases := []struct {
+		name        string
+		validBefore string
+		validAfter  string
+		wantErr     bool
+	}{
+		{
+			name: "valid pre-signed cert: no signing request",
+		},
+		{
+			name:        "pre-signed cert is about to expire: no signing request",
+			validBefore: "1m",
+		},
+		{
+			name:        "pre-signed cert has expired: expect error and no signing request",
+			validBefore: "-10m",
+			validAfter:  "-1h",
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sut := testKeyManager(t)
+
+			privKey, _, cert, _ := generateKeys(tc.validBefore, tc.validAfter)
+			_ = os.WriteFile(sut.sshCfg.KeyFile, privKey, 0600)
+			sut.sshCfg.PreSignedCertFile = path.Join(t.TempDir(), "presigned-cert.pub")
+			_ = os.WriteFile(sut.sshCfg.PreSignedCertFile, cert, 0644)
+
+			ctx := context.Background()
+			err := sut.km.CreateKeys(ctx, false)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Error(t, sut.km.RenewCert(ctx))
+			assert.Equal(t, 0, sut.pdc.CalledCount())
+		})
+	}
+
+	t.Run("no pdc client is required", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.KeyFile = path.Join(t.TempDir(), "testkey")
+		cfg.PreSignedCertFile = path.Join(t.TempDir(), "presigned-cert.pub")
+
+		privKey, _, cert, _ := generateKeys("", "")
+		_ = os.WriteFile(cfg.KeyFile, privKey, 0600)
+		_ = os.WriteFile(cfg.PreSignedCertFile, cert, 0644)
+
+		km := ssh.NewKeyManager(cfg, log.NewNopLogger(), nil)
+		assert.NoError(t, km.CreateKeys(context.Background(), false))
+	})
+}
+
+func TestKeyManager_KeyFilePermissions(t *testing.T) {
+	testcases := []struct {
+		name             string
+		perm             os.FileMode
+		skipKeyPermCheck bool
+		wantErr          bool
+	}{
+		{
+			name: "key file is only readable by owner",
+			perm: 0600,
+		},
+		{
+			name:    "key file is readable by group and others: expect error",
+			perm:    0644,
+			wantErr: true,
+		},
+		{
+			name:             "key file is readable by group and others, check is skipped",
+			perm:             0644,
+			skipKeyPermCheck: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sut := testKeyManager(t)
+			sut.sshCfg.SkipKeyPermCheck = tc.skipKeyPermCheck
+
+			privKey, pubKey, _, _ := generateKeys("", "")
+			require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile, privKey, tc.perm))
+			require.NoError(t, os.Chmod(sut.sshCfg.KeyFile, tc.perm))
+			require.NoError(t, os.WriteFile(sut.sshCfg.KeyFile+pubSuffix, pubKey, 0644))
+
+			err := sut.km.Start(ctx)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "it must not be accessible by group or others")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestBackgroundRefresh(t *testing.T) {
-	t.Run("refresh is 0, do not refresh", func(t *testing.T) {
+	t.Run("refresh is 0, the default period is used", func(t *testing.T) {
 		ctx := context.Background()
 		sut := testKeyManager(t)
 		sut.sshCfg.CertCheckCertExpiryPeriod = 0
@@ -397,11 +812,34 @@ func TestBackgroundRefresh(t *testing.T) {
 		require.Nil(t, sut.km.Start(ctx))
 		<-time.After(2 * time.Second)
 
-		// key signing is only called once (at start)
+		// key signing is only called once (at start), as the default period is 1m
+		assert.Equal(t, 1, sut.pdc.CalledCount())
+	})
+
+	t.Run("refresh is negative, start fails", func(t *testing.T) {
+		sut := testKeyManager(t)
+		sut.sshCfg.CertCheckCertExpiryPeriod = -time.Second
+
+		err := sut.km.Start(context.Background())
+		assert.EqualError(t, err, "invalid certificate check period -1s, it must not be negative")
+		assert.Equal(t, 0, sut.pdc.CalledCount())
+	})
+
+	t.Run("refresh is below the minimum, the minimum is used", func(t *testing.T) {
+		ctx := context.Background()
+		sut := testKeyManager(t)
+		sut.sshCfg.CertCheckCertExpiryPeriod = time.Millisecond
+
+		require.Nil(t, sut.km.Start(ctx))
+		<-time.After(500 * time.Millisecond)
+
+		// key signing is only called once (at start), as the minimum is 10s
 		assert.Equal(t, 1, sut.pdc.CalledCount())
 	})
 
 	t.Run("new cert requested whenever cert is within expiry window", func(t *testing.T) {
+		ssh.SetMinCertCheckPeriod(t, 0)
+
 		ctx := context.Background()
 		// given a keymanager with a cert that is always expired
 		sut := testKeyManager(t)
@@ -0,0 +1,160 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeySource provides the key pair that certificates are signed for.
+type KeySource interface {
+	// EnsureKey makes sure that a usable key pair exists, and creates one if
+	// needed or if force is true. It returns whether the key pair changed.
+	EnsureKey(force bool) (bool, error)
+	// PublicKey returns the public key, in authorized_keys format.
+	PublicKey() ([]byte, error)
+}
+
+// newKeySource returns the key source for the config: the PKCS#11 token if
+// PKCS11Module is set, and key files otherwise.
+func newKeySource(km *KeyManager) KeySource {
+	if km.cfg.PKCS11Module != "" {
+		return &pkcs11KeySource{cfg: km.cfg, logger: km.logger, keygen: sshKeygenBinary(km.cfg.SSHBinary)}
+	}
+	return fileKeySource{km: km}
+}
+
+// PublicKey ensures that a key pair exists, creating one if needed, and
+// returns its public key in authorized_keys format. Unlike CreateKeys, it
+// does not sign a certificate, so the PDC API is not called.
+func (km *KeyManager) PublicKey() ([]byte, error) {
+	km.renewMu.Lock()
+	defer km.renewMu.Unlock()
+
+	if err := km.cfg.ensureCacheDir(); err != nil {
+		return nil, err
+	}
+	if err := km.recoverRotation(); err != nil {
+		return nil, fmt.Errorf("recovering interrupted key rotation: %w", err)
+	}
+	if _, err := km.keys.EnsureKey(false); err != nil {
+		return nil, err
+	}
+	return km.keys.PublicKey()
+}
+
+// fileKeySource is a key pair generated by the agent and stored in KeyFile.
+type fileKeySource struct {
+	km *KeyManager
+}
+
+func (s fileKeySource) EnsureKey(force bool) (bool, error) {
+	return s.km.ensureKeysExist(force)
+}
+
+func (s fileKeySource) PublicKey() ([]byte, error) {
+	return s.km.readPubKeyFile()
+}
+
+// pkcs11ListTimeout is how long listing the keys of a PKCS#11 token can take.
+const pkcs11ListTimeout = 30 * time.Second
+
+// pkcs11KeySource is a key pair stored in a PKCS#11 token. The private key
+// never leaves the token: ssh signs with it through the PKCS#11 module. The
+// public key is listed with ssh-keygen and written to the public key file, so
+// that certificates can be checked against it.
+type pkcs11KeySource struct {
+	cfg    *Config
+	logger log.Logger
+	keygen string
+}
+
+// EnsureKey lists the public key of the token. Keys cannot be created in the
+// token, so force only rereads it.
+func (s *pkcs11KeySource) EnsureKey(_ bool) (bool, error) {
+	pub, err := s.listPublicKey()
+	if err != nil {
+		return false, fmt.Errorf("reading public key from PKCS#11 token: %w", err)
+	}
+
+	path := s.cfg.KeyFile + ".pub"
+	current, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(current, pub) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(s.cfg.KeyFileDir(), 0774); err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	level.Info(s.logger).Log("msg", "using public key from PKCS#11 token", "module", s.cfg.PKCS11Module)
+	return true, writeFileAtomic(path, pub)
+}
+
+func (s *pkcs11KeySource) PublicKey() ([]byte, error) {
+	return os.ReadFile(s.cfg.KeyFile + ".pub")
+}
+
+// listPublicKey returns the first public key of the token, in
+// authorized_keys format.
+func (s *pkcs11KeySource) listPublicKey() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pkcs11ListTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.keygen, "-D", s.cfg.PKCS11Module)
+	cmd.Env = append(os.Environ(), askpassEnv(s.cfg.PKCS11PIN)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -D %s: %w: %s", s.keygen, s.cfg.PKCS11Module, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(out)
+	if err != nil {
+		return nil, errors.New("no public key found in PKCS#11 token")
+	}
+	return ssh.MarshalAuthorizedKey(pub), nil
+}
+
+// sshKeygenBinary returns the ssh-keygen binary next to the ssh binary.
+func sshKeygenBinary(sshBinary string) string {
+	if sshBinary == "" || filepath.Base(sshBinary) == sshBinary {
+		return "ssh-keygen"
+	}
+	return filepath.Join(filepath.Dir(sshBinary), "ssh-keygen")
+}
+
+// Environment variables used to pass the PKCS#11 PIN to ssh. ssh runs its
+// askpass program, the agent binary itself, to read the PIN, and the agent
+// prints it when AskpassEnv is set.
+const (
+	AskpassEnv    = "PDC_AGENT_ASKPASS"
+	AskpassPINEnv = "PDC_AGENT_ASKPASS_PIN"
+)
+
+// askpassEnv returns the environment variables that make ssh read pin from
+// the agent binary, if pin is set.
+func askpassEnv(pin string) []string {
+	if pin == "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	return []string{
+		"SSH_ASKPASS=" + exe,
+		"SSH_ASKPASS_REQUIRE=force",
+		AskpassEnv + "=1",
+		AskpassPINEnv + "=" + pin,
+	}
+}
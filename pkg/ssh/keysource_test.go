@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// mockKeySource is a key source whose private key is only held in memory,
+// like a key in a token.
+type mockKeySource struct {
+	signer ssh.Signer
+	forced []bool
+}
+
+func newMockKeySource(t *testing.T) *mockKeySource {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return &mockKeySource{signer: signer}
+}
+
+func (m *mockKeySource) EnsureKey(force bool) (bool, error) {
+	m.forced = append(m.forced, force)
+	return false, nil
+}
+
+func (m *mockKeySource) PublicKey() ([]byte, error) {
+	return ssh.MarshalAuthorizedKey(m.signer.PublicKey()), nil
+}
+
+func TestKeyManager_KeySource(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+	cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+	km := NewKeyManager(cfg, log.NewNopLogger(), newSigningClient(t))
+	keys := newMockKeySource(t)
+	km.keys = keys
+
+	require.NoError(t, km.CreateKeys(context.Background(), true))
+
+	assert.Equal(t, []bool{true}, keys.forced)
+	assert.NoFileExists(t, cfg.KeyFile, "private key must not be written")
+
+	cb, err := km.readCertFile()
+	require.NoError(t, err)
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+	require.NoError(t, err)
+	cert, ok := pk.(*ssh.Certificate)
+	require.True(t, ok)
+	assert.True(t, keysEqual(cert.Key, keys.signer.PublicKey()), "certificate is not for the key source's key")
+}
+
+// writeFakeSSHKeygen writes a script that prints out when run with -D, and
+// returns its path.
+func writeFakeSSHKeygen(t *testing.T, out string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	path := filepath.Join(t.TempDir(), "ssh-keygen")
+	script := "#!/bin/sh\n[ \"$1\" = \"-D\" ] || exit 1\nprintf '%s' '" + out + "'\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0700))
+	return path
+}
+
+func TestPKCS11KeySource(t *testing.T) {
+	newSource := func(t *testing.T, keygen string) *pkcs11KeySource {
+		cfg := DefaultConfig()
+		cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+		cfg.PKCS11Module = "/usr/lib/libpkcs11.so"
+		return &pkcs11KeySource{cfg: cfg, logger: log.NewNopLogger(), keygen: keygen}
+	}
+
+	t.Run("public key of the token is written", func(t *testing.T) {
+		keys := newMockKeySource(t)
+		pub, err := keys.PublicKey()
+		require.NoError(t, err)
+		s := newSource(t, writeFakeSSHKeygen(t, string(pub)))
+
+		changed, err := s.EnsureKey(false)
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		b, err := s.PublicKey()
+		require.NoError(t, err)
+		assert.Equal(t, pub, b)
+
+		changed, err = s.EnsureKey(true)
+		require.NoError(t, err)
+		assert.False(t, changed, "unchanged key must not require a new certificate")
+	})
+
+	t.Run("token without keys", func(t *testing.T) {
+		s := newSource(t, writeFakeSSHKeygen(t, ""))
+		_, err := s.EnsureKey(false)
+		assert.ErrorContains(t, err, "no public key found in PKCS#11 token")
+	})
+
+	t.Run("ssh-keygen fails", func(t *testing.T) {
+		s := newSource(t, filepath.Join(t.TempDir(), "missing"))
+		_, err := s.EnsureKey(false)
+		assert.ErrorContains(t, err, "reading public key from PKCS#11 token")
+	})
+}
+
+func TestSSHKeygenBinary(t *testing.T) {
+	assert.Equal(t, "ssh-keygen", sshKeygenBinary(""))
+	assert.Equal(t, "ssh-keygen", sshKeygenBinary("ssh"))
+	assert.Equal(t, "/opt/openssh/bin/ssh-keygen", sshKeygenBinary("/opt/openssh/bin/ssh"))
+}
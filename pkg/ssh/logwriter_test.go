@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerWriterAdapter(t *testing.T) {
+	t.Run("lines are logged at debug level with component=ssh", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := newLoggerWriterAdapter(log.NewLogfmtLogger(buf))
+
+		_, err := w.Write([]byte("debug1: some message\r\ndebug2: another message\r\n"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "level=debug component=ssh msg=\"debug1: some message\"\nlevel=debug component=ssh msg=\"debug2: another message\"\n", buf.String())
+	})
+
+	t.Run("lines split across writes are logged once complete", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := newLoggerWriterAdapter(log.NewLogfmtLogger(buf))
+
+		_, _ = w.Write([]byte("debug1: some "))
+		assert.Empty(t, buf.String())
+		_, _ = w.Write([]byte("message\r\ndebug1: partial"))
+		assert.Equal(t, "level=debug component=ssh msg=\"debug1: some message\"\n", buf.String())
+
+		w.Flush()
+		assert.Contains(t, buf.String(), "msg=\"debug1: partial\"")
+	})
+
+	t.Run("debug lines are filtered by the log level", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger := level.NewFilter(log.NewLogfmtLogger(buf), level.AllowInfo())
+		w := newLoggerWriterAdapter(logger)
+
+		_, _ = w.Write([]byte("debug1: some message\r\n"))
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("lines can be logged at info level", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger := level.NewFilter(log.NewLogfmtLogger(buf), level.AllowInfo())
+		w := newLoggerWriterAdapter(logger)
+		w.logLevel = level.Info
+
+		_, _ = w.Write([]byte("debug1: some message\r\n"))
+		assert.Equal(t, "level=info component=ssh msg=\"debug1: some message\"\n", buf.String())
+	})
+
+	t.Run("large output from a process does not block", func(t *testing.T) {
+		var lines strings.Builder
+		for i := 0; i < 10000; i++ {
+			fmt.Fprintf(&lines, "debug3: line %d\r\n", i)
+		}
+
+		buf := &bytes.Buffer{}
+		w := newLoggerWriterAdapter(log.NewLogfmtLogger(buf))
+
+		cmd := exec.Command("cat")
+		cmd.Stdin = strings.NewReader(lines.String())
+		cmd.Stdout = w
+		cmd.Stderr = w
+		require.NoError(t, cmd.Run())
+		w.Flush()
+
+		assert.Equal(t, 10000, strings.Count(buf.String(), "\n"))
+		assert.Contains(t, buf.String(), "msg=\"debug3: line 9999\"")
+	})
+}
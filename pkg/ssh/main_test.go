@@ -0,0 +1,20 @@
+package ssh_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// TestMain registers the metrics of the package with the default prefix, as
+// the agent does, so that tests can read them from the default registry.
+func TestMain(m *testing.M) {
+	if err := metrics.Register(prometheus.DefaultRegisterer, metrics.DefaultPrefix, "", ssh.Collectors()...); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
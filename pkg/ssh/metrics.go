@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// Categories used to label certificate signing failures.
+const (
+	signFailureUnauthorized = "unauthorized"
+	signFailureTransient    = "transient"
+	signFailureOther        = "other"
+)
+
+var (
+	certSignSuccessTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cert_sign_success_total",
+		Help: "Total number of successful certificate signing requests.",
+	})
+	certSignFailureTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cert_sign_failure_total",
+		Help: "Total number of failed certificate signing requests, by error category.",
+	}, []string{"category"})
+	tunnelHealthCheckRestartsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_health_check_restarts_total",
+		Help: "Number of times the ssh client was restarted because the tunnel health check failed.",
+	})
+	tunnelConnectedConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_connected_connections",
+		Help: "Number of ssh connections to the gateway that are connected.",
+	})
+	tunnelStateDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tunnel_state_duration_seconds",
+		Help:    "Time spent in each tunnel state, observed when the state is left.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"state"})
+	reconnectConsecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "reconnect_consecutive_failures",
+		Help: "Number of ssh connection attempts that failed since a connection last connected.",
+	})
+	backoffSecondsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "backoff_seconds_total",
+		Help: "Total time spent waiting in backoff between ssh connection attempts, in seconds.",
+	})
+	gatewayActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_active",
+		Help: "Whether the ssh connections use the gateway, 1, or not, 0, by gateway: primary or fallback.",
+	}, []string{"gateway"})
+)
+
+// Collectors returns the metrics of the package. They are not registered, so
+// that their names can be prefixed, see metrics.Register.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		certSignSuccessTotal,
+		certSignFailureTotal,
+		tunnelHealthCheckRestartsTotal,
+		tunnelConnectedConnections,
+		tunnelStateDurationSeconds,
+		reconnectConsecutiveFailures,
+		backoffSecondsTotal,
+		gatewayActive,
+	}
+}
+
+// signFailureCategory maps a certificate signing error to a coarse category.
+func signFailureCategory(err error) string {
+	switch {
+	case errors.Is(err, pdc.ErrInvalidCredentials), errors.Is(err, pdc.ErrForbidden):
+		return signFailureUnauthorized
+	case errors.Is(err, pdc.ErrInternal):
+		return signFailureTransient
+	default:
+		return signFailureOther
+	}
+}
@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+func TestKeyManager_ExpectedPrincipal(t *testing.T) {
+	testcases := []struct {
+		name       string
+		expected   []string
+		principals []string
+		wantErr    string
+	}{
+		{
+			name:       "no expected principal",
+			principals: []string{"other"},
+		},
+		{
+			name:       "matching principal",
+			expected:   []string{"1"},
+			principals: []string{"other", "1"},
+		},
+		{
+			name:       "mismatching principal",
+			expected:   []string{"1"},
+			principals: []string{"2", "3"},
+			wantErr:    `signed certificate does not grant principal "1", it grants ["2" "3"]`,
+		},
+		{
+			name:     "no principals",
+			expected: []string{"1"},
+			wantErr:  `signed certificate does not grant principal "1"`,
+		},
+		{
+			name:       "any of several expected principals",
+			expected:   []string{"1", "team-b"},
+			principals: []string{"team-a", "team-b"},
+		},
+		{
+			name:       "none of several expected principals",
+			expected:   []string{"1", "team-c"},
+			principals: []string{"team-a", "team-b"},
+			wantErr:    `signed certificate grants none of the principals ["1" "team-c"], it grants ["team-a" "team-b"]`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := DefaultConfig()
+			cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+			cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+			cfg.ExpectedPrincipals = tc.expected
+			client := newSigningClient(t)
+			client.principals = tc.principals
+			km := NewKeyManager(cfg, log.NewLogfmtLogger(&buf), client)
+
+			err := km.CreateKeys(context.Background(), false)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				assert.FileExists(t, km.certFile())
+
+				// All the principals of the certificate are reported.
+				principals, err := km.CertPrincipals()
+				require.NoError(t, err)
+				assert.Equal(t, tc.principals, principals)
+				return
+			}
+
+			assert.ErrorContains(t, err, tc.wantErr)
+			assert.NoFileExists(t, km.certFile())
+			assert.Contains(t, buf.String(), "expected="+strings.Join(tc.expected, ","))
+		})
+	}
+}
+
+func TestConfig_ExpectedPrincipalsFlag(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+
+	require.NoError(t, fs.Parse([]string{"-cert-expected-principal", "1", "-cert-expected-principal", "team-a, team-b,"}))
+	assert.Equal(t, []string{"1", "team-a", "team-b"}, cfg.ExpectedPrincipals)
+}
@@ -0,0 +1,48 @@
+package ssh
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxCertRenewJitter is the upper bound of CertRenewJitter. Larger values
+// could renew certificates right after they are signed.
+const maxCertRenewJitter = 0.5
+
+// checkCertRenewJitter returns an error if CertRenewJitter is out of range.
+func (cfg Config) checkCertRenewJitter() error {
+	if cfg.CertRenewJitter < 0 || cfg.CertRenewJitter >= maxCertRenewJitter {
+		return fmt.Errorf("invalid certificate renewal jitter %v, it must be at least 0 and less than %v", cfg.CertRenewJitter, maxCertRenewJitter)
+	}
+	return nil
+}
+
+// hostSeed returns a number in [0, 1) derived from the hostname, so that an
+// agent renews its certificates at the same point of their lifetime on every
+// check, while agents on different hosts are spread out. A random number is
+// used if the hostname is unknown.
+func hostSeed() float64 {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return rand.Float64()
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(host))
+	// The 53 high bits fit exactly in the mantissa of a float64.
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// renewJitter returns how long before the expiry window cert is renewed: a
+// fraction of its lifetime, up to CertRenewJitter, fixed by the host seed.
+func (km KeyManager) renewJitter(cert *ssh.Certificate) time.Duration {
+	if km.cfg.CertRenewJitter <= 0 || cert.ValidBefore <= cert.ValidAfter {
+		return 0
+	}
+	lifetime := time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second
+	return time.Duration(km.renewSeed * km.cfg.CertRenewJitter * float64(lifetime))
+}
@@ -0,0 +1,63 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostSeed(t *testing.T) {
+	seed := hostSeed()
+	assert.GreaterOrEqual(t, seed, 0.0)
+	assert.Less(t, seed, 1.0)
+	assert.Equal(t, seed, hostSeed(), "seed must be fixed for the host")
+}
+
+func TestKeyManager_CertExpiryWindow_Jitter(t *testing.T) {
+	lifetime := 10 * time.Hour
+	cert := &ssh.Certificate{ValidAfter: 1_000_000, ValidBefore: 1_000_000 + uint64(lifetime.Seconds())}
+
+	for _, seed := range []float64{0, 0.25, 0.5, 0.999} {
+		km := KeyManager{cfg: &Config{CertExpiryWindow: 5 * time.Minute, CertRenewJitter: 0.2}, renewSeed: seed}
+		window := km.certExpiryWindow(cert)
+
+		assert.GreaterOrEqual(t, window, 5*time.Minute, "seed %v", seed)
+		assert.Less(t, window, 5*time.Minute+2*time.Hour, "seed %v", seed)
+		assert.Equal(t, 5*time.Minute+time.Duration(seed*0.2*float64(lifetime)), window, "seed %v", seed)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		km := KeyManager{cfg: &Config{CertExpiryWindow: 5 * time.Minute}, renewSeed: 0.5}
+		assert.Equal(t, 5*time.Minute, km.certExpiryWindow(cert))
+	})
+}
+
+func TestKeyManager_RenewalTime_Jitter(t *testing.T) {
+	km := newRotationKeyManager(t)
+	km.cfg.CertExpiryWindow = 5 * time.Minute
+	km.cfg.CertRenewJitter = 0.2
+	km.renewSeed = 0.5
+
+	validAfter, validBefore, err := km.CertValidity()
+	require.NoError(t, err)
+	lifetime := validBefore.Sub(validAfter)
+	renewAt := validBefore.Add(-5*time.Minute - time.Duration(0.1*float64(lifetime)))
+
+	km.now = func() time.Time { return renewAt.Add(-30 * time.Second) }
+	assert.False(t, km.newCertRequired(), "renewed before the jittered point")
+
+	km.now = func() time.Time { return renewAt.Add(30 * time.Second) }
+	assert.True(t, km.newCertRequired(), "not renewed after the jittered point")
+}
+
+func TestConfig_CheckCertRenewJitter(t *testing.T) {
+	for _, j := range []float64{0, 0.2, 0.49} {
+		assert.NoError(t, Config{CertRenewJitter: j}.checkCertRenewJitter())
+	}
+	for _, j := range []float64{-0.1, 0.5, 1} {
+		assert.Error(t, Config{CertRenewJitter: j}.checkCertRenewJitter())
+	}
+}
@@ -0,0 +1,151 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// stagedSuffix is appended to the names of the files written by a key
+// rotation, until they replace the current files.
+const stagedSuffix = ".new"
+
+// RotateKey generates a new key pair, gets it signed by the PDC API, and
+// replaces the private key, public key and certificate files. The ssh client
+// uses the new key the next time it connects.
+//
+// The new files are staged next to the current ones, and renamed over them
+// once they have all been written. If the agent stops during the renames, the
+// rotation is completed the next time the keys are checked. It is safe to call
+// concurrently.
+func (km *KeyManager) RotateKey(ctx context.Context) error {
+	if km.cfg.PreSignedCertFile != "" {
+		return errors.New("cannot rotate the key of a pre-signed certificate")
+	}
+	if km.cfg.PKCS11Module != "" {
+		return errors.New("cannot rotate a key stored in a PKCS#11 token")
+	}
+
+	km.renewMu.Lock()
+	defer km.renewMu.Unlock()
+
+	level.Info(km.logger).Log("msg", "rotating key")
+
+	if err := km.recoverRotation(); err != nil {
+		return fmt.Errorf("recovering interrupted key rotation: %w", err)
+	}
+
+	privKey, pubKey, err := newKeyPair()
+	if err != nil {
+		return fmt.Errorf("generating key pair: %w", err)
+	}
+
+	resp, err := km.signRotatedKey(ctx, pubKey)
+	if err != nil {
+		return fmt.Errorf("rotating key: %w", err)
+	}
+
+	if err := km.writeKnownHostsFile(resp.KnownHosts); err != nil {
+		return fmt.Errorf("failed to write known hosts file: %w", err)
+	}
+
+	// The private key is staged last: a staged private key means that the
+	// other files have been staged too.
+	staged := map[string][]byte{
+		km.certFile():   ssh.MarshalAuthorizedKey(&resp.Certificate),
+		km.pubKeyFile(): pubKey,
+		km.cfg.KeyFile:  privKey,
+	}
+	for _, f := range km.rotationFiles() {
+		if err := writeFileSync(f+stagedSuffix, staged[f]); err != nil {
+			return fmt.Errorf("staging rotated key files: %w", err)
+		}
+	}
+
+	if err := km.commitRotation(); err != nil {
+		return fmt.Errorf("replacing key files: %w", err)
+	}
+
+	level.Info(km.logger).Log("msg", "key rotated")
+	if err := km.cfg.Events.Emit(events.CertRenewed); err != nil {
+		level.Warn(km.logger).Log("msg", "could not write event", "event", events.CertRenewed, "err", err)
+	}
+	return nil
+}
+
+// signRotatedKey requests a certificate for a new public key. It counts
+// towards MinSignInterval, but never reuses the current certificate, which is
+// for the old key.
+func (km *KeyManager) signRotatedKey(ctx context.Context, pubKey []byte) (*pdc.SigningResponse, error) {
+	km.signLimiter.mu.Lock()
+	defer km.signLimiter.mu.Unlock()
+
+	if wait := km.cfg.MinSignInterval - time.Since(km.signLimiter.last); wait > 0 {
+		level.Info(km.logger).Log("msg", "sign request throttled, waiting", "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	km.signLimiter.last = time.Now()
+
+	ctx, span := tracer.Start(ctx, "sign rotated key")
+	defer span.End()
+
+	resp, err := km.requestCert(ctx, pubKey)
+	if err != nil {
+		certSignFailureTotal.WithLabelValues(signFailureCategory(err)).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	certSignSuccessTotal.Inc()
+	return resp, nil
+}
+
+// rotationFiles are the files replaced by a key rotation, in the order they
+// are staged and renamed. The private key is last.
+func (km KeyManager) rotationFiles() []string {
+	return []string{km.certFile(), km.pubKeyFile(), km.cfg.KeyFile}
+}
+
+// commitRotation renames the staged files over the current ones. Files that
+// are not staged were renamed by an earlier, interrupted, commit.
+func (km KeyManager) commitRotation() error {
+	for _, f := range km.rotationFiles() {
+		err := os.Rename(f+stagedSuffix, f)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverRotation cleans up after a key rotation that was interrupted. If the
+// private key was staged, all the files were staged, and the rotation is
+// completed. Otherwise the staged files are removed and the current files are
+// kept.
+func (km KeyManager) recoverRotation() error {
+	if _, err := os.Stat(km.cfg.KeyFile + stagedSuffix); err == nil {
+		level.Warn(km.logger).Log("msg", "completing interrupted key rotation")
+		return km.commitRotation()
+	}
+
+	for _, f := range km.rotationFiles() {
+		err := os.Remove(f + stagedSuffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
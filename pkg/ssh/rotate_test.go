@@ -0,0 +1,244 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// signingClient is a PDC client that signs any public key with its own CA.
+type signingClient struct {
+	ca         ssh.Signer
+	principals []string
+}
+
+func newSigningClient(t *testing.T) *signingClient {
+	t.Helper()
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	return &signingClient{ca: ca}
+}
+
+func (c *signingClient) SignSSHKey(_ context.Context, key []byte) (*pdc.SigningResponse, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cert := ssh.Certificate{
+		Key:             pub,
+		ValidPrincipals: c.principals,
+		CertType:        ssh.UserCert,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, c.ca); err != nil {
+		return nil, err
+	}
+	return &pdc.SigningResponse{
+		Certificate: cert,
+		KnownHosts:  []byte("@cert-authority * " + string(ssh.MarshalAuthorizedKey(c.ca.PublicKey()))),
+	}, nil
+}
+
+func newRotationKeyManager(t *testing.T) *KeyManager {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+	cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+	km := NewKeyManager(cfg, log.NewNopLogger(), newSigningClient(t))
+	require.NoError(t, km.CreateKeys(context.Background(), false))
+	return km
+}
+
+// assertMatchingKeyFiles checks that the private key, public key and
+// certificate files are for the same key, and returns the public key.
+func assertMatchingKeyFiles(t *testing.T, km *KeyManager) ssh.PublicKey {
+	t.Helper()
+
+	kb, err := km.readKeyFile()
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(kb)
+	require.NoError(t, err)
+
+	pbk, err := km.readPubKeyFile()
+	require.NoError(t, err)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pbk)
+	require.NoError(t, err)
+
+	cb, err := km.readCertFile()
+	require.NoError(t, err)
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(cb)
+	require.NoError(t, err)
+	cert, ok := pk.(*ssh.Certificate)
+	require.True(t, ok)
+
+	assert.True(t, keysEqual(signer.PublicKey(), pub), "public key does not match private key")
+	assert.True(t, keysEqual(cert.Key, pub), "certificate does not match public key")
+	return pub
+}
+
+func assertNoStagedFiles(t *testing.T, km *KeyManager) {
+	t.Helper()
+	for _, f := range km.rotationFiles() {
+		assert.NoFileExists(t, f+stagedSuffix)
+	}
+}
+
+func TestKeyManager_RotateKey(t *testing.T) {
+	km := newRotationKeyManager(t)
+	before := assertMatchingKeyFiles(t, km)
+
+	require.NoError(t, km.RotateKey(context.Background()))
+
+	after := assertMatchingKeyFiles(t, km)
+	assert.False(t, keysEqual(before, after), "key was not rotated")
+	assertNoStagedFiles(t, km)
+}
+
+func TestKeyManager_RecoverRotation(t *testing.T) {
+	// stage writes a staged rotation of km's files, for a new key, and returns
+	// the staged contents.
+	stage := func(t *testing.T, km *KeyManager) map[string][]byte {
+		t.Helper()
+		priv, pub, err := newKeyPair()
+		require.NoError(t, err)
+		resp, err := km.client.SignSSHKey(context.Background(), pub)
+		require.NoError(t, err)
+		return map[string][]byte{
+			km.certFile():   ssh.MarshalAuthorizedKey(&resp.Certificate),
+			km.pubKeyFile(): pub,
+			km.cfg.KeyFile:  priv,
+		}
+	}
+
+	t.Run("all files staged, none renamed", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		staged := stage(t, km)
+		for f, b := range staged {
+			require.NoError(t, os.WriteFile(f+stagedSuffix, b, 0600))
+		}
+
+		require.NoError(t, km.recoverRotation())
+
+		assertMatchingKeyFiles(t, km)
+		assertNoStagedFiles(t, km)
+		kb, err := km.readKeyFile()
+		require.NoError(t, err)
+		assert.Equal(t, staged[km.cfg.KeyFile], kb)
+	})
+
+	t.Run("crash after renaming the certificate", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		staged := stage(t, km)
+		for f, b := range staged {
+			require.NoError(t, os.WriteFile(f+stagedSuffix, b, 0600))
+		}
+		require.NoError(t, os.Rename(km.certFile()+stagedSuffix, km.certFile()))
+
+		require.NoError(t, km.recoverRotation())
+
+		assertMatchingKeyFiles(t, km)
+		assertNoStagedFiles(t, km)
+		kb, err := km.readKeyFile()
+		require.NoError(t, err)
+		assert.Equal(t, staged[km.cfg.KeyFile], kb)
+	})
+
+	t.Run("crash before staging the private key", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		before, err := km.readKeyFile()
+		require.NoError(t, err)
+
+		staged := stage(t, km)
+		require.NoError(t, os.WriteFile(km.certFile()+stagedSuffix, staged[km.certFile()], 0600))
+		require.NoError(t, os.WriteFile(km.pubKeyFile()+stagedSuffix, staged[km.pubKeyFile()], 0600))
+
+		require.NoError(t, km.recoverRotation())
+
+		assertMatchingKeyFiles(t, km)
+		assertNoStagedFiles(t, km)
+		kb, err := km.readKeyFile()
+		require.NoError(t, err)
+		assert.Equal(t, before, kb)
+	})
+}
+
+func TestKeyManager_MismatchedKeyFiles(t *testing.T) {
+	t.Run("certificate for another key is replaced", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		_, pub, err := newKeyPair()
+		require.NoError(t, err)
+		resp, err := km.client.SignSSHKey(context.Background(), pub)
+		require.NoError(t, err)
+		require.NoError(t, km.writeCertFile(ssh.MarshalAuthorizedKey(&resp.Certificate)))
+
+		var logs bytes.Buffer
+		km.logger = log.NewLogfmtLogger(&logs)
+		assert.True(t, km.newCertRequired())
+		assert.Contains(t, logs.String(), "level=warn")
+		assert.Contains(t, logs.String(), "mismatched key pair")
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+		assertMatchingKeyFiles(t, km)
+	})
+
+	t.Run("private key without certificate is signed as is", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		before := assertMatchingKeyFiles(t, km)
+		require.NoError(t, os.Remove(km.cfg.CertFile()))
+
+		assert.False(t, km.incompleteKeyPair())
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+		assert.True(t, keysEqual(before, assertMatchingKeyFiles(t, km)), "key pair must be kept")
+	})
+
+	t.Run("certificate without private key is replaced with a new key pair", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		var logs bytes.Buffer
+		km.logger = log.NewLogfmtLogger(&logs)
+		before := assertMatchingKeyFiles(t, km)
+		require.NoError(t, os.Remove(km.cfg.KeyFile))
+		require.NoError(t, os.Remove(km.cfg.KeyFile+".pub"))
+
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+		assert.False(t, keysEqual(before, assertMatchingKeyFiles(t, km)), "key pair must be new")
+		assert.Contains(t, logs.String(), "level=warn")
+		assert.Contains(t, logs.String(), "incomplete key pair")
+	})
+
+	t.Run("certificate with unparsable private key is replaced with a new key pair", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		var logs bytes.Buffer
+		km.logger = log.NewLogfmtLogger(&logs)
+		before := assertMatchingKeyFiles(t, km)
+		require.NoError(t, os.WriteFile(km.cfg.KeyFile, []byte("not a key"), 0600))
+
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+		assert.False(t, keysEqual(before, assertMatchingKeyFiles(t, km)), "key pair must be new")
+		assert.Contains(t, logs.String(), "incomplete key pair")
+	})
+
+	t.Run("public key for another private key is replaced", func(t *testing.T) {
+		km := newRotationKeyManager(t)
+		_, pub, err := newKeyPair()
+		require.NoError(t, err)
+		require.NoError(t, km.writePubKeyFile(pub))
+
+		assert.True(t, km.newKeysRequired())
+		require.NoError(t, km.CreateKeys(context.Background(), false))
+		assertMatchingKeyFiles(t, km)
+	})
+}
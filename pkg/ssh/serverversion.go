@@ -0,0 +1,92 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// serverIdentTimeout is how long reading the identification string of the
+// gateway can take.
+const serverIdentTimeout = 5 * time.Second
+
+// maxServerIdentLines is the number of lines read from the gateway before
+// giving up on finding its identification string. Servers may send other
+// lines before it (RFC 4253, section 4.2).
+const maxServerIdentLines = 20
+
+// serverIdent is the identification string an ssh server sends when a client
+// connects, e.g. "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13".
+type serverIdent struct {
+	ProtocolVersion string
+	SoftwareVersion string
+	Comments        string
+}
+
+// parseServerIdent parses an ssh identification string.
+func parseServerIdent(line string) (serverIdent, error) {
+	line = strings.TrimRight(line, "\r\n")
+	rest, ok := strings.CutPrefix(line, "SSH-")
+	if !ok {
+		return serverIdent{}, fmt.Errorf("invalid ssh identification string %q", line)
+	}
+	proto, rest, ok := strings.Cut(rest, "-")
+	if !ok || proto == "" || rest == "" {
+		return serverIdent{}, fmt.Errorf("invalid ssh identification string %q", line)
+	}
+	software, comments, _ := strings.Cut(rest, " ")
+	return serverIdent{ProtocolVersion: proto, SoftwareVersion: software, Comments: comments}, nil
+}
+
+// readServerIdent connects to the gateway and reads its identification
+// string. The connection is closed before the key exchange.
+func (s *Client) readServerIdent(ctx context.Context) (serverIdent, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverIdentTimeout)
+	defer cancel()
+
+	conn, err := s.cfg.dialer().DialContext(ctx, s.cfg.dialNetwork(), net.JoinHostPort(s.cfg.GatewayHost(), strconv.Itoa(s.cfg.Port)))
+	if err != nil {
+		return serverIdent{}, err
+	}
+	defer conn.Close()
+	// The read does not watch ctx, so the client does not wait for the
+	// timeout when it stops.
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	for i := 0; i < maxServerIdentLines; i++ {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			return parseServerIdent(line)
+		}
+		if err != nil {
+			return serverIdent{}, err
+		}
+	}
+	return serverIdent{}, fmt.Errorf("no ssh identification string in the first %d lines", maxServerIdentLines)
+}
+
+// logServerIdent logs the ssh server version of the gateway, to help debug
+// client and server version mismatches.
+func (s *Client) logServerIdent(ctx context.Context) {
+	id, err := s.readServerIdent(ctx)
+	if err != nil {
+		level.Debug(s.logger).Log("msg", "could not read the gateway ssh server version", "err", err)
+		return
+	}
+	level.Info(s.logger).Log("msg", "gateway ssh server",
+		"protocol_version", id.ProtocolVersion,
+		"software_version", id.SoftwareVersion,
+		"comments", id.Comments,
+	)
+}
@@ -0,0 +1,138 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServerIdent(t *testing.T) {
+	cases := []struct {
+		description string
+		line        string
+		expected    serverIdent
+		expectedErr string
+	}{
+		{
+			description: "with comments",
+			line:        "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n",
+			expected:    serverIdent{ProtocolVersion: "2.0", SoftwareVersion: "OpenSSH_9.6p1", Comments: "Ubuntu-3ubuntu13"},
+		},
+		{
+			description: "without comments",
+			line:        "SSH-2.0-pdc-gateway_1.4\r\n",
+			expected:    serverIdent{ProtocolVersion: "2.0", SoftwareVersion: "pdc-gateway_1.4"},
+		},
+		{
+			description: "not an identification string",
+			line:        "HTTP/1.1 400 Bad Request\r\n",
+			expectedErr: `invalid ssh identification string "HTTP/1.1 400 Bad Request"`,
+		},
+		{
+			description: "missing software version",
+			line:        "SSH-2.0\r\n",
+			expectedErr: `invalid ssh identification string "SSH-2.0"`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			id, err := parseServerIdent(tt.line)
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, id)
+		})
+	}
+}
+
+func TestClient_LogServerIdent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Servers may send other lines before the identification string.
+		_, _ = conn.Write([]byte("Welcome to the gateway\r\nSSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"))
+	}()
+
+	cfg := DefaultConfig()
+	cfg.URL = &url.URL{Host: "127.0.0.1"}
+	cfg.Port = l.Addr().(*net.TCPAddr).Port
+	buf := &bytes.Buffer{}
+	c := NewClient(cfg, log.NewLogfmtLogger(buf), nil)
+
+	c.logServerIdent(context.Background())
+
+	assert.Contains(t, buf.String(), `level=info msg="gateway ssh server" protocol_version=2.0 software_version=OpenSSH_9.6p1 comments=Ubuntu-3ubuntu13`)
+}
+
+func TestClient_StopWaitsForServerIdent(t *testing.T) {
+	// The gateway accepts connections but never sends its identification
+	// string.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	dir := t.TempDir()
+	fakeSSH := filepath.Join(dir, "ssh")
+	require.NoError(t, os.WriteFile(fakeSSH, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755))
+
+	cfg := DefaultConfig()
+	cfg.KeyFile = filepath.Join(dir, "key")
+	cfg.URL = &url.URL{Host: "127.0.0.1"}
+	cfg.Port = l.Addr().(*net.TCPAddr).Port
+	cfg.SSHBinary = fakeSSH
+	cfg.SkipSSHValidation = true
+
+	var identDone atomic.Bool
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if keyvals[i] == "msg" && keyvals[i+1] == "could not read the gateway ssh server version" {
+				identDone.Store(true)
+			}
+		}
+		return nil
+	})
+	c := NewClient(cfg, logger, nil)
+
+	ctx := context.Background()
+	require.NoError(t, services.StartAndAwaitRunning(ctx, c))
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the gateway was not dialed")
+	}
+
+	start := time.Now()
+	require.NoError(t, services.StopAndAwaitTerminated(ctx, c))
+	assert.Less(t, time.Since(start), serverIdentTimeout)
+	assert.True(t, identDone.Load(), "the client stopped before reading the server version")
+}
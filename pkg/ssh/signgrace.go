@@ -0,0 +1,26 @@
+package ssh
+
+import (
+	"context"
+	"time"
+)
+
+// withShutdownGrace returns a context that is cancelled grace after parent is
+// done, so that a sign request in flight at shutdown can finish, instead of
+// being abandoned half way. The returned cancel func must be called to
+// release its resources.
+func withShutdownGrace(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	if grace <= 0 {
+		return context.WithCancel(parent)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(parent))
+	stop := context.AfterFunc(parent, func() {
+		timer := time.AfterFunc(grace, func() { cancel(context.Cause(parent)) })
+		context.AfterFunc(ctx, func() { timer.Stop() })
+	})
+	return ctx, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
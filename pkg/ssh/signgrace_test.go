@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// slowSigningClient is a signing client whose sign requests block until
+// release is closed, or until their context is done.
+type slowSigningClient struct {
+	*signingClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *slowSigningClient) SignSSHKey(ctx context.Context, key []byte) (*pdc.SigningResponse, error) {
+	close(c.started)
+	select {
+	case <-c.release:
+		return c.signingClient.SignSSHKey(ctx, key)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestKeyManager_SignShutdownGrace(t *testing.T) {
+	testcases := []struct {
+		name   string
+		grace  time.Duration
+		finish bool // whether the sign request finishes after the shutdown
+		// wantRenewed is whether a new certificate is saved. The current one
+		// is kept otherwise.
+		wantRenewed bool
+	}{
+		{name: "a request that finishes within the grace is saved", grace: time.Minute, finish: true, wantRenewed: true},
+		{name: "a request that outlasts the grace is aborted", grace: 50 * time.Millisecond},
+		{name: "without a grace, the request is aborted at once", grace: 0, finish: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			km := newRotationKeyManager(t)
+			km.cfg.SignShutdownGrace = tc.grace
+			km.cfg.MinSignInterval = 0
+			before, err := km.readCertFile()
+			require.NoError(t, err)
+
+			client := &slowSigningClient{signingClient: newSigningClient(t), started: make(chan struct{}), release: make(chan struct{})}
+			km.client = client
+
+			// Shut down while the sign request is in flight.
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- km.RenewCert(ctx) }()
+			<-client.started
+			cancel()
+			if tc.finish {
+				close(client.release)
+			}
+			err = <-done
+
+			after, rerr := km.readCertFile()
+			require.NoError(t, rerr)
+			if tc.wantRenewed {
+				require.NoError(t, err)
+				assert.NotEqual(t, before, after)
+			} else {
+				assert.ErrorIs(t, err, context.Canceled)
+				assert.Equal(t, before, after, "the certificate file must not change")
+			}
+			assertMatchingKeyFiles(t, km)
+		})
+	}
+}
+
+func TestWithShutdownGrace(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := withShutdownGrace(parent, 50*time.Millisecond)
+	defer cancel()
+
+	cancelParent()
+	assert.NoError(t, ctx.Err(), "the grace has not passed yet")
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled after the grace")
+	}
+	assert.ErrorIs(t, context.Cause(ctx), context.Canceled)
+}
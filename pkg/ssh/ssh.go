@@ -11,19 +11,39 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
 	"github.com/grafana/dskit/services"
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/hooks"
+	"github.com/grafana/pdc-agent/pkg/metrics"
 	"github.com/grafana/pdc-agent/pkg/pdc"
 	"github.com/grafana/pdc-agent/pkg/retry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/grafana/pdc-agent/pkg/ssh")
+
+// ErrSSHNotFound is returned when the ssh binary cannot be resolved.
+var ErrSSHNotFound = errors.New("OpenSSH client not found on PATH; install openssh-client")
+
+// ErrConnectionLimitReached is the failure of the client when the gateway
+// refuses a connection because the limit of connections for the stack and
+// network is reached. Reconnecting would not help.
+var ErrConnectionLimitReached = errors.New("limit of connections for stack and network reached")
+
 const (
 	// The exit code sent by the pdc server when the connection limit is reached.
 	ConnectionLimitReachedCode  = 254
@@ -41,16 +61,142 @@ type Config struct {
 	PDC               pdc.Config
 	LegacyMode        bool
 	SkipSSHValidation bool
+	// User is the username of the ssh connections to the gateway, with
+	// UserHostedGrafanaID replaced. If empty, it is the hosted Grafana ID.
+	User string
+	// AllowedSSHOptions restricts which options can be set with `-o` in SSHFlags.
+	// If empty, any option is allowed.
+	AllowedSSHOptions []string
+	// CacheDir, if set, is the directory of the certificate, known hosts and
+	// other files generated by the agent. The -ssh.cache-dir flag also puts
+	// the key pair in it, unless -ssh-key-file is set.
+	CacheDir string
+	// keyFileSet is true if -ssh-key-file was set.
+	keyFileSet bool
+	// SSHBinary is the name or path of the ssh(1) binary to run.
+	SSHBinary string
+	// SkipKeyPermCheck disables the check that the private key file is only
+	// readable by its owner.
+	SkipKeyPermCheck bool
+	// CleanEnv runs ssh with only the environment variables in
+	// cleanEnvVars, instead of the full environment of the agent.
+	CleanEnv bool
 	// ForceKeyFileOverwrite forces a new ssh key pair to be generated.
 	ForceKeyFileOverwrite bool
 	// CertExpiryWindow is the time before the certificate expires to renew it.
 	CertExpiryWindow time.Duration
+	// CertRenewJitter is the largest fraction of the certificate lifetime by
+	// which renewals are brought forward from the expiry window, to spread the
+	// renewals of a fleet of agents. The fraction used is fixed per host.
+	CertRenewJitter float64
 	// CertCheckCertExpiryPeriod is how often to check that the current certificate
 	// is valid and regenerate it if necessary.
 	CertCheckCertExpiryPeriod time.Duration
 	URL                       *url.URL
-	// MetricsAddr is the port to expose metrics on
+	// FallbackGatewayURL, if set, is the gateway that the ssh connections
+	// switch to after FallbackAfter failed attempts to connect to URL. It
+	// uses FallbackPort, or Port if FallbackPort is 0.
+	FallbackGatewayURL *url.URL
+	FallbackPort       int
+	// FallbackAfter is the number of consecutive failed connection attempts
+	// after which the ssh connections switch to the other gateway.
+	FallbackAfter int
+	// PrimaryRetryInterval is how often to check if the gateway in URL can be
+	// reached again while the fallback gateway is used. 0 disables the check,
+	// and the connections only switch back after failing on the fallback.
+	PrimaryRetryInterval time.Duration
+	// MinSignInterval is the minimum time between two certificate sign
+	// requests. A request within the interval reuses the current certificate
+	// if it is still valid, and waits otherwise.
+	MinSignInterval time.Duration
+	// SignShutdownGrace is how long a sign request in flight when the agent
+	// shuts down can take to finish. Its certificate is saved if it does, and
+	// it is aborted without writing anything otherwise.
+	SignShutdownGrace time.Duration
+	// TunnelHealthCheckPeriod is how often to check that the gateway can still
+	// be reached while the ssh command is running. 0 disables the check.
+	TunnelHealthCheckPeriod time.Duration
+	// TunnelHealthCheckFailures is the number of consecutive failed health
+	// checks after which the ssh command is restarted.
+	TunnelHealthCheckFailures int
+	// ReconnectStableThreshold is how long an ssh connection must last for
+	// the reconnect backoff to be reset to its minimum when it exits. 0
+	// disables the reset.
+	ReconnectStableThreshold time.Duration
+	// DialKeepAlive is the TCP keepalive period of the connections the agent
+	// opens to the gateway itself, to check it. 0 uses defaultDialKeepAlive,
+	// and a negative period disables keepalives.
+	DialKeepAlive time.Duration
+	// StartupJitter is the maximum random delay before the first certificate
+	// signing request, to spread load when many agents start at once.
+	StartupJitter time.Duration
+	// WaitForAPI retries the startup certificate check with backoff until it
+	// succeeds, instead of failing the start, e.g. while the PDC API is down.
+	WaitForAPI bool
+	// PreSignedCertFile is the path to a certificate that was signed out of band.
+	// If set, the agent does not call the PDC API to sign certificates, and uses
+	// this certificate with the private key in KeyFile.
+	PreSignedCertFile string
+	// MetricsAddr is the port to expose metrics on. If empty, the metrics
+	// server is not started.
 	MetricsAddr string
+	// MetricsOpenMetrics serves metrics in the OpenMetrics format to clients
+	// that accept it.
+	MetricsOpenMetrics bool
+	// MetricsPrefix is the prefix of the names of the agent metrics.
+	MetricsPrefix string
+	// MetricsAuth, if set, are the credentials that requests to the metrics
+	// server must have.
+	MetricsAuth metrics.Auth
+	// MetricsBindFailureMode is what the agent does when the metrics server
+	// cannot listen on MetricsAddr, metrics.BindFailureWarn or
+	// metrics.BindFailureFatal.
+	MetricsBindFailureMode string
+	// MetricsPushURL, if set, is the URL of a Prometheus Pushgateway that
+	// metrics are pushed to every MetricsPushInterval and at shutdown.
+	MetricsPushURL      string
+	MetricsPushInterval time.Duration
+	// Events, if set, receives tunnel and certificate events.
+	Events *events.Writer
+	// Hooks, if set, runs the hooks of tunnel events.
+	Hooks *hooks.Runner
+	// HostKeyFingerprint, if set, is the SHA256 fingerprint of the gateway
+	// host key. ssh only accepts that host key.
+	HostKeyFingerprint string
+	// Compression enables ssh compression on the tunnel. It saves bandwidth
+	// on slow links, at the cost of CPU on the agent and the gateway.
+	Compression bool
+	// ControlMaster enables ssh connection multiplexing, with a control
+	// socket in ControlDir, so that a connection can reuse the master
+	// connection of another one instead of a new handshake.
+	ControlMaster bool
+	// Ciphers, MACs and KexAlgorithms, if set, are comma-separated lists of
+	// the algorithms that ssh may use for the tunnel, e.g. to comply with a
+	// crypto policy.
+	Ciphers       string
+	MACs          string
+	KexAlgorithms string
+	// SSHVerbosity, if 0 to 3, is the ssh log level, set by main instead of
+	// the level derived from the agent log level. -1 keeps the derived level.
+	// If it is above 0, the ssh output is logged at info level, so that it is
+	// logged regardless of the agent log level.
+	SSHVerbosity int
+	// AddressFamily restricts the connections to the gateway to IPv4, with
+	// AddressFamilyInet, or IPv6, with AddressFamilyInet6. Empty means
+	// AddressFamilyAny.
+	AddressFamily string
+	// ExpectedPrincipals, if set, are the principals that signed certificates
+	// may grant. The agent does not use certificates that grant none of them.
+	ExpectedPrincipals []string
+	// ConnectionCount is the number of parallel ssh connections to open to
+	// the gateway. Each is restarted independently. Values below 1 mean 1.
+	ConnectionCount int
+	// PKCS11Module, if set, is the path to a PKCS#11 library. The private key
+	// is kept in the token instead of KeyFile, and ssh signs with it through
+	// the library. KeyFile is still used for the public key and certificate.
+	PKCS11Module string
+	// PKCS11PIN is the PIN of the PKCS#11 token, if it needs one.
+	PKCS11PIN string
 }
 
 // DefaultConfig returns a Config with some sensible defaults set
@@ -61,10 +207,11 @@ func DefaultConfig() *Config {
 		root = ""
 	}
 	return &Config{
-		Port:     22,
-		LogLevel: 2,
-		PDC:      pdc.Config{},
-		KeyFile:  path.Join(root, ".ssh/grafana_pdc"),
+		Port:      22,
+		LogLevel:  2,
+		PDC:       pdc.Config{},
+		KeyFile:   path.Join(root, ".ssh/grafana_pdc"),
+		SSHBinary: "ssh",
 	}
 }
 
@@ -74,18 +221,60 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	def := DefaultConfig()
 
 	cfg.SSHFlags = []string{}
-	f.StringVar(&cfg.KeyFile, "ssh-key-file", def.KeyFile, "The path to the SSH key file.")
+	cfg.AllowedSSHOptions = []string{}
+	cfg.KeyFile = def.KeyFile
+	f.Var(keyFileFlag{cfg}, "ssh-key-file", "The path to the SSH key file.")
+	f.Func("ssh.cache-dir", "A directory for the key pair, certificate and known hosts files, created with 0700 permissions if missing. -ssh-key-file takes precedence for the key pair", cfg.setCacheDir)
+	f.IntVar(&cfg.Port, "ssh.port", def.Port, "The port of the PDC gateway.")
+	f.StringVar(&cfg.User, "ssh.user", "", "The ssh username of the connections to the PDC gateway, for gateways that expect a specific user. "+UserHostedGrafanaID+" is replaced with the hosted Grafana ID. Defaults to the hosted Grafana ID")
+	f.StringVar(&cfg.SSHBinary, "ssh-binary", def.SSHBinary, "The name or path of the ssh binary to run.")
 	f.IntVar(&deprecatedInt, "log-level", def.LogLevel, "[DEPRECATED] Use the log.level flag. The level of log verbosity. The maximum is 3.")
 	// use default log level if invalid
 	if cfg.LogLevel > 3 {
 		cfg.LogLevel = def.LogLevel
 	}
+	f.IntVar(&cfg.SSHVerbosity, "ssh.verbosity", -1, "The ssh log level, from 0 to 3 for -vvv, regardless of -log.level. -1 derives it from -log.level")
 	f.BoolVar(&cfg.SkipSSHValidation, "skip-ssh-validation", false, "Ignore openssh minimum version constraints.")
 	f.Func("ssh-flag", "Additional flags to be passed to ssh. Can be set more than once.", cfg.addSSHFlag)
+	f.Func("ssh.flags-file", "A file with additional flags to be passed to ssh, one per line, as with -ssh-flag. Blank lines and lines starting with # are skipped", cfg.addSSHFlagsFile)
+	f.Func("ssh-allowed-option", "An ssh option that may be set with -ssh-flag=\"-o Name=value\", or another ssh flag, such as -4, that may be set as is. Can be set more than once. If not set, all options and flags are allowed.", cfg.addAllowedSSHOption)
+	f.BoolVar(&cfg.SkipKeyPermCheck, "skip-key-perm-check", false, "Do not check that the private key file is only readable by its owner")
+	f.IntVar(&cfg.ConnectionCount, "ssh.connections", 1, "The number of parallel ssh connections to open to the gateway, for more throughput")
+	f.BoolVar(&cfg.CleanEnv, "ssh.clean-env", false, "Run ssh with only the PATH, HOME, USER, LOGNAME and TMPDIR environment variables, instead of the full environment of the agent")
+	f.StringVar(&cfg.PKCS11Module, "ssh.pkcs11-module", "", "The path to a PKCS#11 library. If set, the private key is read from the token instead of -ssh-key-file")
+	f.StringVar(&cfg.PKCS11PIN, "ssh.pkcs11-pin", "", "The PIN of the PKCS#11 token")
 	f.BoolVar(&cfg.ForceKeyFileOverwrite, "force-key-file-overwrite", false, "Force a new ssh key pair to be generated")
 	f.DurationVar(&cfg.CertExpiryWindow, "cert-expiry-window", 5*time.Minute, "The time before the certificate expires to renew it.")
-	f.DurationVar(&cfg.CertCheckCertExpiryPeriod, "cert-check-expiry-period", 1*time.Minute, "How often to check certificate validity. 0 means it is only checked at start")
-	f.StringVar(&cfg.MetricsAddr, "metrics-addr", ":8090", "HTTP server address to expose metrics on")
+	f.Float64Var(&cfg.CertRenewJitter, "cert-renew-jitter", 0.2, "Renew the certificate up to this fraction of its lifetime before -cert-expiry-window, at a point fixed per host, so that a fleet of agents does not renew at once. Must be less than 0.5. 0 disables it")
+	f.DurationVar(&cfg.CertCheckCertExpiryPeriod, "cert-check-expiry-period", 1*time.Minute, "How often to check certificate validity. 0 means the default of 1m is used. Periods below 10s are raised to 10s")
+	f.BoolVar(&cfg.Compression, "ssh.compression", false, "Compress the traffic of the tunnel. It can help on bandwidth-constrained links, but costs CPU, and slows fast links down")
+	f.BoolVar(&cfg.ControlMaster, "ssh.control-master", false, "Enable ssh connection multiplexing, with -o ControlMaster=auto and a control socket in the cache directory, so that a reconnect can reuse a master connection that is still up")
+	cfg.AddressFamily = AddressFamilyAny
+	f.Func("ssh.address-family", "The address family of the connections to the gateway: any, inet for IPv4 only, or inet6 for IPv6 only. Use inet on dual-stack hosts with a broken IPv6 path. Default: any", cfg.setAddressFamily)
+	f.StringVar(&cfg.Ciphers, "ssh.ciphers", "", "A comma-separated list of the ciphers that ssh may use, passed as -o Ciphers=. If not set, the ssh defaults are used")
+	f.StringVar(&cfg.MACs, "ssh.macs", "", "A comma-separated list of the MAC algorithms that ssh may use, passed as -o MACs=. If not set, the ssh defaults are used")
+	f.StringVar(&cfg.KexAlgorithms, "ssh.kex-algorithms", "", "A comma-separated list of the key exchange algorithms that ssh may use, passed as -o KexAlgorithms=. If not set, the ssh defaults are used")
+	f.StringVar(&cfg.HostKeyFingerprint, "ssh.host-key-fingerprint", "", "The SHA256 fingerprint of the gateway host key, e.g. SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8. If set, ssh refuses any other host key")
+	f.Func("cert-expected-principal", "A principal that signed certificates must grant, e.g. the hosted Grafana ID. Can be set more than once, or to a comma-separated list, to accept certificates that grant any of them. The agent fails to start if the certificate grants none of them", cfg.addExpectedPrincipals)
+	f.DurationVar(&cfg.MinSignInterval, "cert-min-sign-interval", 10*time.Second, "The minimum time between two certificate sign requests. Requests within the interval reuse the current certificate if it is still valid, and wait otherwise. Renewals on demand always wait")
+	f.DurationVar(&cfg.SignShutdownGrace, "cert-sign-shutdown-grace", 5*time.Second, "How long a certificate sign request in flight at shutdown can take to finish before it is aborted. 0 aborts it at once")
+	f.DurationVar(&cfg.TunnelHealthCheckPeriod, "ssh.health-check-period", 0, "How often to check that the gateway can still be reached while the tunnel is up. 0 disables the check")
+	f.IntVar(&cfg.TunnelHealthCheckFailures, "ssh.health-check-failures", 3, "The number of consecutive failed health checks after which the ssh client is restarted")
+	f.IntVar(&cfg.FallbackAfter, "ssh.fallback-after", 3, "The number of consecutive failed connection attempts after which the ssh connections switch between the gateway and -ssh.fallback-gateway-url")
+	f.DurationVar(&cfg.PrimaryRetryInterval, "ssh.primary-retry-interval", 5*time.Minute, "How often to check if the gateway can be reached again while -ssh.fallback-gateway-url is used, to switch back to it. 0 disables the check")
+	f.DurationVar(&cfg.ReconnectStableThreshold, "ssh.reconnect-stable-threshold", time.Minute, "How long an ssh connection must last for the reconnect backoff to be reset to its minimum when it exits. 0 disables the reset")
+	f.DurationVar(&cfg.DialKeepAlive, "ssh.dial-keepalive", defaultDialKeepAlive, "The TCP keepalive period of the health check and version check connections to the gateway. A negative period disables keepalives")
+	f.DurationVar(&cfg.StartupJitter, "startup.jitter", 0, "Wait a random duration up to this value before the first certificate signing request. 0 means no delay")
+	f.BoolVar(&cfg.WaitForAPI, "startup.wait-for-api", false, "If the certificate cannot be signed at startup, retry with backoff until the PDC API recovers, instead of exiting. Rejected tokens still make the agent exit")
+	f.StringVar(&cfg.PreSignedCertFile, "pre-signed-cert-file", "", "The path to a certificate signed out of band. If set, the PDC API is not called to sign certificates")
+	f.StringVar(&cfg.MetricsAddr, "metrics-addr", ":8090", "HTTP server address to expose metrics on. Use unix:///path/to.sock to listen on a unix socket. Set it to an empty string to disable the metrics server")
+	f.StringVar(&cfg.MetricsBindFailureMode, "metrics.bind-failure-mode", metrics.BindFailureWarn, `What to do when the metrics server cannot listen on -metrics-addr, e.g. because the port is already in use: "warn" logs a warning and runs the agent without the metrics server, "fatal" stops the agent with an error`)
+	f.BoolVar(&cfg.MetricsOpenMetrics, "metrics.openmetrics", false, "Serve metrics in the OpenMetrics format to clients that accept it")
+	f.StringVar(&cfg.MetricsPrefix, "metrics.prefix", metrics.DefaultPrefix, "The prefix of the names of the agent metrics")
+	f.StringVar(&cfg.MetricsAuth.BearerToken, "metrics.auth.token", "", "A bearer token that requests to the metrics server, including the admin endpoints, must have. If not set, requests are not authenticated")
+	f.Func("metrics.auth.basic", "user:password basic auth credentials that requests to the metrics server, including the admin endpoints, must have. If not set, requests are not authenticated", cfg.MetricsAuth.SetBasic)
+	f.StringVar(&cfg.MetricsPushURL, "metrics.push.url", "", "The URL of a Prometheus Pushgateway to push metrics to, for agents that are not scraped, e.g. in CI. Credentials can be set in the URL. If not set, metrics are not pushed")
+	f.DurationVar(&cfg.MetricsPushInterval, "metrics.push.interval", 30*time.Second, "How often to push metrics to -metrics.push.url. Metrics are also pushed at shutdown. 0 only pushes them at shutdown")
 }
 
 func (cfg Config) KeyFileDir() string {
@@ -93,11 +282,156 @@ func (cfg Config) KeyFileDir() string {
 	return dir
 }
 
+// keyFileFlag sets KeyFile, and records that it was set, so that
+// -ssh.cache-dir does not move the key pair.
+type keyFileFlag struct {
+	cfg *Config
+}
+
+func (f keyFileFlag) String() string {
+	if f.cfg == nil {
+		return ""
+	}
+	return f.cfg.KeyFile
+}
+
+func (f keyFileFlag) Set(s string) error {
+	f.cfg.KeyFile = s
+	f.cfg.keyFileSet = true
+	return nil
+}
+
+// setCacheDir sets CacheDir, and moves the key pair into it, unless the key
+// file was set.
+func (cfg *Config) setCacheDir(dir string) error {
+	cfg.CacheDir = dir
+	if !cfg.keyFileSet && dir != "" {
+		cfg.KeyFile = path.Join(dir, path.Base(DefaultConfig().KeyFile))
+	}
+	return nil
+}
+
+// ensureCacheDir creates CacheDir, if set, with permissions for its owner
+// only.
+func (cfg Config) ensureCacheDir() error {
+	if cfg.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return fmt.Errorf("creating cache directory: %w", err)
+	}
+	return nil
+}
+
+// CacheFileDir returns the directory of the files generated by the agent,
+// other than the key pair: CacheDir if set, and the directory of KeyFile
+// otherwise.
+func (cfg Config) CacheFileDir() string {
+	if cfg.CacheDir == "" {
+		return cfg.KeyFileDir()
+	}
+	return cfg.CacheDir
+}
+
+// cacheFile returns the path of a generated file named after the key file,
+// with suffix, in CacheFileDir.
+func (cfg Config) cacheFile(suffix string) string {
+	if cfg.CacheDir == "" {
+		return cfg.KeyFile + suffix
+	}
+	return path.Join(cfg.CacheDir, path.Base(cfg.KeyFile)+suffix)
+}
+
+// knownHostsFile returns the path of KnownHostsFile.
+func (cfg Config) knownHostsFile() string {
+	return path.Join(cfg.CacheFileDir(), KnownHostsFile)
+}
+
+// CertFile returns the path of the certificate used to connect to the gateway.
+func (cfg Config) CertFile() string {
+	if cfg.PreSignedCertFile != "" {
+		return cfg.PreSignedCertFile
+	}
+	return cfg.cacheFile("-cert.pub")
+}
+
+// GatewayHost returns the host of the gateway. IPv6 literals are returned
+// without brackets, as expected by ssh(1) and net.JoinHostPort.
+func (cfg Config) GatewayHost() string {
+	if cfg.URL == nil {
+		return ""
+	}
+	if cfg.URL.Host != "" {
+		return cfg.URL.Hostname()
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(cfg.URL.String(), "["), "]")
+}
+
+// CheckSSHBinary returns ErrSSHNotFound if the given ssh binary cannot be
+// resolved to an executable file.
+func CheckSSHBinary(sshCmd string) error {
+	if _, err := exec.LookPath(sshCmd); err != nil {
+		return ErrSSHNotFound
+	}
+	return nil
+}
+
 func (cfg *Config) addSSHFlag(s string) error {
 	cfg.SSHFlags = append(cfg.SSHFlags, s)
 	return nil
 }
 
+func (cfg *Config) addExpectedPrincipals(s string) error {
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.ExpectedPrincipals = append(cfg.ExpectedPrincipals, p)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) addAllowedSSHOption(s string) error {
+	cfg.AllowedSSHOptions = append(cfg.AllowedSSHOptions, s)
+	return nil
+}
+
+// sshFlagAllowed returns whether an ssh flag that is not an option, e.g. -4,
+// is allowed. With an allowlist, it must be in it exactly, flag and value.
+func (cfg Config) sshFlagAllowed(flag string) bool {
+	if len(cfg.AllowedSSHOptions) == 0 {
+		return true
+	}
+	return slices.Contains(cfg.AllowedSSHOptions, flag)
+}
+
+// sshOptionAllowed returns true if the option can be set by the user.
+// ssh option names are case-insensitive.
+func (cfg Config) sshOptionAllowed(name string) bool {
+	if len(cfg.AllowedSSHOptions) == 0 {
+		return true
+	}
+	for _, o := range cfg.AllowedSSHOptions {
+		if strings.EqualFold(o, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostKeyOptions are the ssh options that decide which gateway host keys are
+// trusted. They are set by the agent when the host key is pinned.
+var hostKeyOptions = []string{"StrictHostKeyChecking", "UserKnownHostsFile", "GlobalKnownHostsFile", "KnownHostsCommand"}
+
+// hostKeyOption returns whether name is one of hostKeyOptions.
+func hostKeyOption(name string) bool {
+	for _, o := range hostKeyOptions {
+		if strings.EqualFold(o, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // Client is a client for ssh. It configures and runs ssh commands
 type Client struct {
 	*services.BasicService
@@ -105,24 +439,86 @@ type Client struct {
 	SSHCmd string // SSH command to run, defaults to "ssh". Require for testing.
 	logger log.Logger
 	km     *KeyManager
+	conns  []*connection
+
+	// healthCheck checks the tunnel when TunnelHealthCheckPeriod is set.
+	healthCheck func(ctx context.Context) error
+	// checkPrimary checks the primary gateway while the fallback gateway is
+	// used.
+	checkPrimary func(ctx context.Context) error
+
+	// gateways selects the gateway that the connections use.
+	gateways *gateways
+
+	// keysMu serialises the key checks made by the connections when they
+	// restart.
+	keysMu sync.Mutex
+
+	// reconnects is the number of times a connection was restarted.
+	reconnects atomic.Int64
+
+	// lastErr is the last error of a connection, and when it happened.
+	lastErrMu sync.Mutex
+	lastErr   error
+	lastErrAt time.Time
+
+	// fatal receives the errors of connections that stopped retrying, which
+	// stop the client.
+	fatal chan error
+
+	// background tracks the goroutines started with the client that are not
+	// connections, so that stopping waits for them.
+	background sync.WaitGroup
+
+	// connectSpan traces the establishment of the tunnel, until a connection
+	// is connected or fails.
+	connectSpan    trace.Span
+	connectSpanEnd sync.Once
 }
 
 // NewClient returns a new SSH client in an idle state
 func NewClient(cfg *Config, logger log.Logger, km *KeyManager) *Client {
+	sshCmd := cfg.SSHBinary
+	if sshCmd == "" {
+		sshCmd = "ssh"
+	}
+
 	client := &Client{
 		cfg:    cfg,
-		SSHCmd: "ssh",
+		SSHCmd: sshCmd,
 		logger: logger,
 		km:     km,
 	}
+	client.healthCheck = client.checkGateway
+	client.checkPrimary = client.checkPrimaryGateway
+	client.gateways = newGateways(logger, cfg)
 
-	client.BasicService = services.NewIdleService(client.starting, client.stopping)
+	count := cfg.ConnectionCount
+	if count < 1 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		connLogger := logger
+		if count > 1 {
+			connLogger = log.With(logger, "connection", i)
+		}
+		client.conns = append(client.conns, &connection{
+			logger: connLogger,
+			state:  newTunnelState(connLogger, cfg.Events, cfg.Hooks),
+		})
+	}
+
+	client.fatal = make(chan error, len(client.conns))
+	client.BasicService = services.NewBasicService(client.starting, client.running, client.stopping)
 	return client
 }
 
 func (s *Client) starting(ctx context.Context) error {
 	level.Info(s.logger).Log("msg", "starting ssh client")
 
+	spanCtx, span := tracer.Start(ctx, "start ssh client")
+	defer span.End()
+
 	if !s.cfg.SkipSSHValidation {
 		if err := validateSSHVersion(ctx, s.logger, s.SSHCmd); err != nil {
 			return fmt.Errorf("invalid SSH version: %w", err)
@@ -130,15 +526,28 @@ func (s *Client) starting(ctx context.Context) error {
 	}
 
 	// check keys and cert validity before start, create new cert if required
-	// This will exit if it fails, rather than endlessly retrying to sign keys.
+	// This will exit if it fails, rather than endlessly retrying to sign keys,
+	// unless WaitForAPI is set.
 	if s.km != nil {
-		err := s.km.Start(ctx)
+		err := s.km.Start(spanCtx)
 		if err != nil {
 			level.Error(s.logger).Log("msg", "could not check or generate certificate", "error", err)
 			return err
 		}
 	}
 
+	if s.cfg.HostKeyFingerprint != "" && !s.cfg.LegacyMode {
+		if err := s.pinHostKey(spanCtx); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.ControlMaster && !s.cfg.LegacyMode {
+		if err := s.cfg.ensureControlDir(); err != nil {
+			return err
+		}
+	}
+
 	// Attempt to parse SSH flags before triggering the goroutine, so we can exit
 	// if the parsing fails
 	flags, err := s.SSHFlagsFromConfig()
@@ -148,91 +557,251 @@ func (s *Client) starting(ctx context.Context) error {
 	}
 	level.Debug(s.logger).Log("msg", fmt.Sprintf("parsed flags: %s", flags))
 
-	retryOpts := retry.Opts{MaxBackoff: 16 * time.Second, InitialBackoff: 1 * time.Second}
-	go retry.Forever(retryOpts, func() error {
-		cmd := exec.CommandContext(ctx, s.SSHCmd, flags...)
-		loggerWriter := newLoggerWriterAdapter(s.logger)
-		cmd.Stdout = loggerWriter
-		cmd.Stderr = loggerWriter
-		_ = cmd.Run()
-		if ctx.Err() != nil {
-			return nil // context was canceled
-		}
+	s.gateways.primary.flags = flags
 
-		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == ConnectionAlreadyExistsCode {
-			level.Debug(s.logger).Log("msg", "server already had a connection for this tunnelID. trying a different server")
-			return retry.ResetBackoffError{}
-		}
-
-		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == ConnectionLimitReachedCode {
-			level.Info(s.logger).Log("msg", "limit of connections for stack and network reached. exiting")
-			os.Exit(1)
-		}
+	// The gateway is not known in legacy mode.
+	if !s.cfg.LegacyMode {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.logServerIdent(ctx)
+		}()
 
-		level.Info(s.logger).Log("msg", "ssh client exited. restarting", "exitCode", cmd.ProcessState.ExitCode())
-
-		// Check keys and cert validity before restart, create new cert if required.
-		// This covers the case where a certificate has become invalid since the last start.
-		// Do not return here: we want to keep trying to connect in case the PDC API
-		// is temporarily unavailable.
-		//
-		// They keymanager has logic to perform a background key refresh, but this
-		// logic should stay in place in case that is disabled.
-		if s.km != nil {
-			err := s.km.CreateKeys(ctx, false)
+		if fb := s.cfg.fallbackConfig(); fb != nil {
+			fbFlags, err := fb.sshFlags(s.logger)
 			if err != nil {
-				level.Error(s.logger).Log("msg", "could not check or generate certificate", "error", err)
+				level.Error(s.logger).Log("msg", fmt.Sprintf("could not parse flags of the fallback gateway: %s", err))
+				return err
+			}
+			s.gateways.fallback = &gateway{name: GatewayFallback, addr: fb.gatewayAddr(), flags: fbFlags}
+			if s.cfg.PrimaryRetryInterval > 0 {
+				s.background.Add(1)
+				go func() {
+					defer s.background.Done()
+					s.watchPrimary(ctx)
+				}()
 			}
 		}
-		return fmt.Errorf("ssh client exited")
-	})
+	}
+	s.gateways.mu.Lock()
+	s.gateways.updateMetrics()
+	s.gateways.mu.Unlock()
+
+	// The span outlives the start of the client, as the tunnel is connected
+	// once the ssh command has been running for connectedAfter.
+	_, s.connectSpan = tracer.Start(ctx, "establish ssh tunnel", trace.WithAttributes(
+		attribute.String("gateway", s.gateways.current().addr),
+	))
+
+	retryOpts := retry.Opts{MaxBackoff: 16 * time.Second, InitialBackoff: 1 * time.Second}
+	for _, c := range s.conns {
+		c := c
+		go retry.Forever(retryOpts, func() error {
+			return s.runConnection(ctx, c, s.gateways.current())
+		})
+	}
 
 	return nil
 }
 
+// cleanEnvVars are the environment variables passed to ssh when CleanEnv is
+// set. ssh needs PATH to run ProxyCommand and similar, and HOME, USER and
+// LOGNAME to find the user's ssh config. TMPDIR is kept for temporary files.
+var cleanEnvVars = []string{"PATH", "HOME", "USER", "LOGNAME", "TMPDIR"}
+
+// command returns the ssh command to run.
+func (s *Client) command(ctx context.Context, flags []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, s.SSHCmd, flags...)
+	if s.cfg.CleanEnv {
+		// A non-nil empty Env runs the command with no environment at all.
+		cmd.Env = []string{}
+		for _, name := range cleanEnvVars {
+			if v, ok := os.LookupEnv(name); ok {
+				cmd.Env = append(cmd.Env, name+"="+v)
+			}
+		}
+	}
+	if env := askpassEnv(s.cfg.PKCS11PIN); env != nil {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	return cmd
+}
+
+// TunnelState returns the current state of the tunnel, e.g. "Connected".
+// It is distinct from State, which is the state of the service. With more
+// than one connection, it is the most connected state of any of them.
+func (s *Client) TunnelState() string {
+	states := make([]string, len(s.conns))
+	for i, c := range s.conns {
+		states[i] = c.state.Current()
+	}
+	return aggregateState(states)
+}
+
+// ConnectedCount returns the number of ssh connections that are connected.
+func (s *Client) ConnectedCount() int {
+	n := 0
+	for _, c := range s.conns {
+		if c.state.Current() == StateConnected {
+			n++
+		}
+	}
+	return n
+}
+
+// ReconnectCount returns the number of times an ssh connection was restarted
+// since the client started.
+func (s *Client) ReconnectCount() int64 {
+	return s.reconnects.Load()
+}
+
+// LastError returns when the last error of a connection happened, e.g. an
+// ssh command that exited, and the error. It returns a nil error if there was
+// none.
+func (s *Client) LastError() (time.Time, error) {
+	s.lastErrMu.Lock()
+	defer s.lastErrMu.Unlock()
+	return s.lastErrAt, s.lastErr
+}
+
+func (s *Client) setLastError(err error) {
+	s.lastErrMu.Lock()
+	defer s.lastErrMu.Unlock()
+	s.lastErr = err
+	s.lastErrAt = time.Now()
+}
+
+// Reconnect stops the running ssh commands, so that the tunnel reconnects with
+// the current key and certificate.
+func (s *Client) Reconnect() {
+	level.Info(s.logger).Log("msg", "reconnecting ssh client")
+	for _, c := range s.conns {
+		c.stop()
+	}
+}
+
+// running waits until the client is stopped, or until a connection fails in
+// a way that reconnecting cannot fix, which fails the client.
+func (s *Client) running(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-s.fatal:
+		return err
+	}
+}
+
 func (s *Client) stopping(err error) error {
 	level.Info(s.logger).Log("msg", "stopping ssh client")
+	for _, c := range s.conns {
+		c.state.Transition(StateTerminating)
+	}
+	s.background.Wait()
+	s.endConnectSpan(errors.New("ssh client stopped before the tunnel connected"))
 	return err
 }
 
+// endConnectSpan ends the span of the tunnel establishment, with err if it
+// failed. Only the first call has an effect.
+func (s *Client) endConnectSpan(err error) {
+	if s.connectSpan == nil {
+		return
+	}
+	s.connectSpanEnd.Do(func() {
+		if err != nil {
+			s.connectSpan.RecordError(err)
+			s.connectSpan.SetStatus(codes.Error, err.Error())
+		}
+		s.connectSpan.End()
+	})
+}
+
 // SSHFlagsFromConfig generates the array of flags to pass to the ssh command.
 // It does not stop default flags from being overidden, but only the first instance
 // of `-o` flags are used.
 func (s *Client) SSHFlagsFromConfig() ([]string, error) {
-	if s.cfg.LegacyMode {
-		level.Warn(s.logger).Log("msg", "running in legacy mode")
-		return s.cfg.Args, nil
+	return s.cfg.sshFlags(s.logger)
+}
+
+// sshFlags generates the flags to pass to the ssh command to connect to the
+// gateway of cfg.
+func (cfg *Config) sshFlags(logger log.Logger) ([]string, error) {
+	if cfg.LegacyMode {
+		level.Warn(logger).Log("msg", "running in legacy mode")
+		return cfg.Args, nil
 	}
 
-	keyFileArr := strings.Split(s.cfg.KeyFile, "/")
-	keyFileDir := strings.Join(keyFileArr[:len(keyFileArr)-1], "/")
+	if err := cfg.checkPort(); err != nil {
+		return nil, err
+	}
 
 	logLevelFlag := ""
-	if s.cfg.LogLevel > 0 {
-		logLevelFlag = "-" + strings.Repeat("v", s.cfg.LogLevel)
+	if cfg.LogLevel > 0 {
+		logLevelFlag = "-" + strings.Repeat("v", cfg.LogLevel)
 	}
 
-	gwURL := s.cfg.URL
-	user := fmt.Sprintf("%s@%s", s.cfg.PDC.HostedGrafanaID, gwURL.String())
+	user := fmt.Sprintf("%s@%s", cfg.sshUser(), cfg.GatewayHost())
 
 	// keep ssh_config parameters in a map so they can be oveeridden by the user
 	sshOptions := map[string]string{
-		"UserKnownHostsFile":  fmt.Sprintf("%s/%s", keyFileDir, KnownHostsFile),
-		"CertificateFile":     fmt.Sprintf("%s-cert.pub", s.cfg.KeyFile),
+		"UserKnownHostsFile":  cfg.knownHostsFile(),
+		"CertificateFile":     cfg.CertFile(),
 		"ServerAliveInterval": "15",
 		"ConnectTimeout":      "1",
 	}
+	if cfg.HostKeyFingerprint != "" {
+		sshOptions["UserKnownHostsFile"] = cfg.pinnedKnownHostsFile()
+		sshOptions["StrictHostKeyChecking"] = "yes"
+	}
+	if cfg.Compression {
+		sshOptions["Compression"] = "yes"
+	}
+	if cfg.ControlMaster {
+		sshOptions["ControlMaster"] = "auto"
+		sshOptions["ControlPath"] = cfg.controlPath()
+	}
+	if cfg.AddressFamily == AddressFamilyInet || cfg.AddressFamily == AddressFamilyInet6 {
+		sshOptions["AddressFamily"] = cfg.AddressFamily
+	}
+	algorithms, err := cfg.algorithmOptions()
+	if err != nil {
+		return nil, err
+	}
+	for o, v := range algorithms {
+		sshOptions[o] = v
+	}
 
 	nonOptionFlags := []string{} // for backwards compatibility, on -v particularly
-	for _, f := range s.cfg.SSHFlags {
+	for _, f := range cfg.SSHFlags {
 		name, value, err := extractOptionFromFlag(f)
 		if err != nil {
 			return nil, err
 		}
 		if name == "" {
+			// Flags such as -A or -L cannot be checked as options, so with
+			// an allowlist they must be allowed as they are.
+			if !cfg.sshFlagAllowed(f) {
+				return nil, fmt.Errorf("ssh flag %q is not allowed, allowed options are: %s", f, strings.Join(cfg.AllowedSSHOptions, ", "))
+			}
 			nonOptionFlags = append(nonOptionFlags, f)
 			continue
 		}
+		if !cfg.sshOptionAllowed(name) {
+			return nil, fmt.Errorf("ssh option %q is not allowed, allowed options are: %s", name, strings.Join(cfg.AllowedSSHOptions, ", "))
+		}
+		if cfg.HostKeyFingerprint != "" && hostKeyOption(name) {
+			return nil, fmt.Errorf("ssh option %q cannot be set with -ssh.host-key-fingerprint, which pins the gateway host key", name)
+		}
+		// ssh option names are case-insensitive, and ssh uses the first value
+		// of an option, so the user's value replaces the agent's.
+		for o := range sshOptions {
+			if strings.EqualFold(o, name) {
+				delete(sshOptions, o)
+			}
+		}
 		sshOptions[name] = value
 	}
 
@@ -243,14 +812,19 @@ func (s *Client) SSHFlagsFromConfig() ([]string, error) {
 	}
 	sort.Strings(optionsList)
 
-	result := []string{
-		"-i",
-		s.cfg.KeyFile,
+	// With a PKCS#11 token, ssh gets the private key from the library
+	// instead of the key file.
+	identity := []string{"-i", cfg.KeyFile}
+	if cfg.PKCS11Module != "" {
+		identity = []string{"-I", cfg.PKCS11Module}
+	}
+
+	result := append(identity,
 		user,
 		"-p",
-		fmt.Sprintf("%d", s.cfg.Port),
+		fmt.Sprintf("%d", cfg.Port),
 		"-R", "0",
-	}
+	)
 
 	for _, o := range optionsList {
 		result = append(result, "-o", fmt.Sprintf("%s=%s", o, sshOptions[o]))
@@ -265,50 +839,112 @@ func (s *Client) SSHFlagsFromConfig() ([]string, error) {
 	return result, nil
 }
 
+// extractOptionFromFlag returns the name and value of an ssh option flag, in
+// any of the forms accepted by ssh: "-o Name=value", "-oName=value",
+// "-o=Name=value" and "-o Name value". Without an = sign, the value must be a
+// single word. It returns an empty name if flag is not an option flag.
 func extractOptionFromFlag(flag string) (string, string, error) {
-	parts := strings.SplitN(flag, " ", 2)
-	if parts[0] != "-o" {
+	rest, ok := strings.CutPrefix(flag, "-o")
+	if !ok {
 		return "", "", nil
 	}
 
-	oParts := strings.Split(parts[1], "=")
-	if len(oParts) != 2 {
+	rest = strings.TrimLeft(rest, " \t=")
+	i := strings.IndexAny(rest, " \t=")
+	if i <= 0 {
+		return "", "", errors.New("invalid ssh option format, expecting '-o Name=string'")
+	}
+	name := rest[:i]
+	// ssh separates the value from the name with spaces, or an = sign with
+	// optional spaces around it.
+	value := strings.TrimSpace(rest[i:])
+	if v, ok := strings.CutPrefix(value, "="); ok {
+		value = strings.TrimSpace(v)
+	} else if strings.ContainsAny(value, " \t") {
+		return "", "", errors.New("invalid ssh option format, expecting '-o Name=string'")
+	}
+	if value == "" {
 		return "", "", errors.New("invalid ssh option format, expecting '-o Name=string'")
 	}
-	return oParts[0], oParts[1], nil
+	return name, value, nil
 }
 
-// Wraps a logger, implements io.Writer and writes to the logger.
+// maxLogLineLength is the length after which a partial line of ssh output is
+// logged without waiting for the end of the line.
+const maxLogLineLength = 64 * 1024
+
+// Wraps a logger, implements io.Writer and writes each line to the logger at
+// debug level, or the level of logLevel if set, with component=ssh.
 type loggerWriterAdapter struct {
-	logger log.Logger
+	logger   log.Logger
+	logLevel func(log.Logger) log.Logger
+
+	mu  sync.Mutex
+	buf []byte
 }
 
-func newLoggerWriterAdapter(logger log.Logger) loggerWriterAdapter {
-	return loggerWriterAdapter{
-		logger: logger,
+func newLoggerWriterAdapter(logger log.Logger) *loggerWriterAdapter {
+	return &loggerWriterAdapter{
+		logger:   log.With(logger, "component", "ssh"),
+		logLevel: level.Debug,
 	}
 }
 
 // Implements io.Writer.
-func (adapter loggerWriterAdapter) Write(p []byte) (n int, err error) {
+func (adapter *loggerWriterAdapter) Write(p []byte) (n int, err error) {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
 	// The ssh command output is separated by \r\n and the logger escapes strings.
 	// By default, the logger output would look like this: msg="debug: some message\r\ndebug2: some message\r\n".
-	// We split the messages on \r\n and log each of them at a time to make the output look like this:
+	// We split the messages on \n and log each of them at a time to make the output look like this:
 	// msg="debug: some message"
 	// msg="debug2: some message"
-	for _, msg := range bytes.Split(p, []byte{'\r', '\n'}) {
-		if len(msg) == 0 {
-			continue
+	// A line may be split across writes, so the last partial line is kept until
+	// the rest of it is written.
+	adapter.buf = append(adapter.buf, p...)
+	for {
+		i := bytes.IndexByte(adapter.buf, '\n')
+		if i < 0 {
+			break
 		}
+		if err := adapter.log(adapter.buf[:i]); err != nil {
+			return 0, err
+		}
+		adapter.buf = adapter.buf[i+1:]
+	}
 
-		if err := level.Info(adapter.logger).Log("msg", msg); err != nil {
-			return 0, fmt.Errorf("writing log statement")
+	if len(adapter.buf) > maxLogLineLength {
+		if err := adapter.log(adapter.buf); err != nil {
+			return 0, err
 		}
+		adapter.buf = nil
 	}
 
 	return len(p), nil
 }
 
+// Flush logs any partial line that has not been logged yet.
+func (adapter *loggerWriterAdapter) Flush() {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	_ = adapter.log(adapter.buf)
+	adapter.buf = nil
+}
+
+func (adapter *loggerWriterAdapter) log(line []byte) error {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return nil
+	}
+
+	if err := adapter.logLevel(adapter.logger).Log("msg", string(line)); err != nil {
+		return fmt.Errorf("writing log statement")
+	}
+	return nil
+}
+
 // openssh must be running 9.2 or above
 // checks version in format OpenSSH_{MAJOR}.{MINOR}
 func validateSSHVersion(ctx context.Context, logger log.Logger, sshCmd string) error {
@@ -3,7 +3,9 @@ package ssh_test
 import (
 	"context"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
@@ -149,6 +151,86 @@ func TestClient_SSHArgs(t *testing.T) {
 		assert.Equal(t, strings.Split(fmt.Sprintf("-i %s 123@host.grafana.net -p 22 -R 0 -o CertificateFile=%s -o ConnectTimeout=1 -o ServerAliveInterval=15 -o UserKnownHostsFile=%s -vv", cfg.KeyFile, cfg.KeyFile+certSuffix, path.Join(cfg.KeyFileDir(), ssh.KnownHostsFile)), " "), result)
 	})
 
+	t.Run("compression", func(t *testing.T) {
+		for _, enabled := range []bool{false, true} {
+			cfg := ssh.DefaultConfig()
+			cfg.URL = mustParseURL("host.grafana.net")
+			cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+			cfg.Compression = enabled
+
+			result, err := newTestClient(t, cfg, false).SSHFlagsFromConfig()
+
+			require.NoError(t, err)
+			if enabled {
+				assert.Contains(t, result, "Compression=yes")
+			} else {
+				assert.NotContains(t, strings.Join(result, " "), "Compression")
+			}
+		}
+	})
+
+	t.Run("algorithms", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.URL = mustParseURL("host.grafana.net")
+		cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+
+		result, err := newTestClient(t, cfg, false).SSHFlagsFromConfig()
+		require.NoError(t, err)
+		joined := strings.Join(result, " ")
+		for _, option := range []string{"Ciphers", "MACs", "KexAlgorithms"} {
+			assert.NotContains(t, joined, option, "unset algorithms must not be rendered")
+		}
+
+		cfg.Ciphers = "aes256-gcm@openssh.com,aes128-gcm@openssh.com"
+		cfg.MACs = "hmac-sha2-256-etm@openssh.com"
+		cfg.KexAlgorithms = "-diffie-hellman-group14-sha1"
+
+		result, err = newTestClient(t, cfg, false).SSHFlagsFromConfig()
+		require.NoError(t, err)
+		assert.Contains(t, result, "Ciphers=aes256-gcm@openssh.com,aes128-gcm@openssh.com")
+		assert.Contains(t, result, "MACs=hmac-sha2-256-etm@openssh.com")
+		assert.Contains(t, result, "KexAlgorithms=-diffie-hellman-group14-sha1")
+	})
+
+	t.Run("invalid algorithm lists", func(t *testing.T) {
+		for _, ciphers := range []string{",", "aes256-ctr,", "aes256-ctr,,aes128-ctr", "aes256-ctr, aes128-ctr"} {
+			cfg := ssh.DefaultConfig()
+			cfg.URL = mustParseURL("host.grafana.net")
+			cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+			cfg.Ciphers = ciphers
+
+			_, err := newTestClient(t, cfg, false).SSHFlagsFromConfig()
+			assert.ErrorContains(t, err, "invalid -ssh.ciphers", ciphers)
+		}
+	})
+
+	t.Run("user compression option is not duplicated", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.URL = mustParseURL("host.grafana.net")
+		cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+		cfg.Compression = true
+		cfg.SSHFlags = []string{"-o compression=no"}
+
+		result, err := newTestClient(t, cfg, false).SSHFlagsFromConfig()
+
+		require.NoError(t, err)
+		assert.Contains(t, result, "compression=no")
+		assert.NotContains(t, result, "Compression=yes")
+	})
+
+	t.Run("IPv6 literal gateway is not bracketed in the destination", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.URL = &url.URL{Host: "[2001:db8::1]"}
+		cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+
+		sshClient := newTestClient(t, cfg, false)
+		result, err := sshClient.SSHFlagsFromConfig()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "123@2001:db8::1", result[2])
+		assert.Equal(t, []string{"-p", "22"}, result[3:5])
+	})
+
 	t.Run("legacy args (deprecated)", func(t *testing.T) {
 		expectedArgs := []string{"test", "ok"}
 		cfg := ssh.DefaultConfig()
@@ -251,6 +333,123 @@ func TestClient_SSHArgs(t *testing.T) {
 
 	})
 
+	t.Run("allowed ssh options get appended to command", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.LogLevel = 0
+		cfg.URL = mustParseURL("host.grafana.net")
+		cfg.PDC = pdc.Config{
+			HostedGrafanaID: "123",
+		}
+
+		cfg.AllowedSSHOptions = []string{"ConnectTimeout"}
+		cfg.SSHFlags = []string{
+			"-o ConnectTimeout=3",
+		}
+
+		sshClient := newTestClient(t, cfg, false)
+		result, err := sshClient.SSHFlagsFromConfig()
+
+		assert.Nil(t, err)
+		assert.Contains(t, result, "ConnectTimeout=3")
+	})
+
+	t.Run("errors on disallowed ssh option", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.URL = mustParseURL("host.grafana.net")
+		cfg.PDC = pdc.Config{
+			HostedGrafanaID: "123",
+		}
+
+		cfg.AllowedSSHOptions = []string{"ConnectTimeout"}
+		cfg.SSHFlags = []string{
+			"-o StrictHostKeyChecking=no",
+		}
+
+		sshClient := newTestClient(t, cfg, false)
+		_, err := sshClient.SSHFlagsFromConfig()
+		assert.EqualError(t, err, `ssh option "StrictHostKeyChecking" is not allowed, allowed options are: ConnectTimeout`)
+	})
+
+	t.Run("allowlist applies to every option and flag form", func(t *testing.T) {
+		testcases := []struct {
+			flag    string
+			wantErr string
+		}{
+			{flag: "-o ConnectTimeout=3"},
+			{flag: "-oConnectTimeout=3"},
+			{flag: "-o ConnectTimeout 3"},
+			{flag: "-o connecttimeout = 3"},
+			{flag: "-4"},
+			{flag: "-o StrictHostKeyChecking=no", wantErr: `ssh option "StrictHostKeyChecking" is not allowed`},
+			{flag: "-oStrictHostKeyChecking=no", wantErr: `ssh option "StrictHostKeyChecking" is not allowed`},
+			{flag: "-o=StrictHostKeyChecking=no", wantErr: `ssh option "StrictHostKeyChecking" is not allowed`},
+			{flag: "-o StrictHostKeyChecking no", wantErr: `ssh option "StrictHostKeyChecking" is not allowed`},
+			{flag: "-A", wantErr: `ssh flag "-A" is not allowed`},
+			{flag: "-R 8080:localhost:80", wantErr: `ssh flag "-R 8080:localhost:80" is not allowed`},
+			{flag: "-L 8080:localhost:80", wantErr: `ssh flag "-L 8080:localhost:80" is not allowed`},
+			{flag: "-F /tmp/ssh_config", wantErr: `ssh flag "-F /tmp/ssh_config" is not allowed`},
+			{flag: "-4oStrictHostKeyChecking=no", wantErr: `ssh flag "-4oStrictHostKeyChecking=no" is not allowed`},
+		}
+
+		for _, tc := range testcases {
+			t.Run(tc.flag, func(t *testing.T) {
+				cfg := ssh.DefaultConfig()
+				cfg.URL = mustParseURL("host.grafana.net")
+				cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+				cfg.AllowedSSHOptions = []string{"ConnectTimeout", "-4"}
+				cfg.SSHFlags = []string{tc.flag}
+
+				sshClient := newTestClient(t, cfg, false)
+				result, err := sshClient.SSHFlagsFromConfig()
+				if tc.wantErr != "" {
+					assert.ErrorContains(t, err, tc.wantErr)
+					return
+				}
+				require.NoError(t, err)
+				if tc.flag == "-4" {
+					assert.Contains(t, result, "-4")
+				} else {
+					assert.Contains(t, strings.ToLower(strings.Join(result, " ")), "-o connecttimeout=3")
+				}
+			})
+		}
+	})
+
+	t.Run("ssh port can be overridden", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.Port = 2222
+
+		sshClient := newTestClient(t, cfg, false)
+		result, err := sshClient.SSHFlagsFromConfig()
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"-p", "2222"}, result[3:5])
+	})
+
+	t.Run("PKCS#11 module replaces the key file", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+		cfg.PKCS11Module = "/usr/lib/softhsm/libsofthsm2.so"
+
+		sshClient := newTestClient(t, cfg, false)
+		result, err := sshClient.SSHFlagsFromConfig()
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"-I", cfg.PKCS11Module}, result[0:2])
+		assert.NotContains(t, result, "-i")
+		assert.Contains(t, result, "CertificateFile="+cfg.KeyFile+certSuffix)
+	})
+
+	t.Run("errors on out of range ssh port", func(t *testing.T) {
+		for _, port := range []int{0, -1, 65536} {
+			cfg := ssh.DefaultConfig()
+			cfg.Port = port
+
+			sshClient := newTestClient(t, cfg, false)
+			_, err := sshClient.SSHFlagsFromConfig()
+			assert.EqualError(t, err, fmt.Sprintf("invalid ssh port %d, must be between 1 and 65535", port))
+		}
+	})
+
 	t.Run("errors on invalid option flag", func(t *testing.T) {
 		cfg := ssh.DefaultConfig()
 
@@ -268,6 +467,24 @@ func TestClient_SSHArgs(t *testing.T) {
 		assert.NotNil(t, err)
 		assert.Equal(t, err.Error(), "invalid ssh option format, expecting '-o Name=string'")
 	})
+
+	t.Run("errors on option flag without a value", func(t *testing.T) {
+		cfg := ssh.DefaultConfig()
+
+		cfg.URL = mustParseURL("host.grafana.net")
+		cfg.PDC = pdc.Config{
+			HostedGrafanaID: "123",
+		}
+
+		cfg.SSHFlags = []string{
+			"-o TestOption",
+		}
+
+		sshClient := newTestClient(t, cfg, false)
+		_, err := sshClient.SSHFlagsFromConfig()
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Error(), "invalid ssh option format, expecting '-o Name=string'")
+	})
 }
 
 func TestSSHVersionValidation(t *testing.T) {
@@ -325,6 +542,18 @@ func TestSSHVersionValidation(t *testing.T) {
 
 }
 
+func TestCheckSSHBinary(t *testing.T) {
+	t.Run("binary does not exist: friendly error", func(t *testing.T) {
+		err := ssh.CheckSSHBinary(path.Join(t.TempDir(), "ssh"))
+		assert.ErrorIs(t, err, ssh.ErrSSHNotFound)
+		assert.EqualError(t, err, "OpenSSH client not found on PATH; install openssh-client")
+	})
+
+	t.Run("binary exists", func(t *testing.T) {
+		assert.NoError(t, ssh.CheckSSHBinary(os.Args[0]))
+	})
+}
+
 type mockPDCClient struct {
 }
 
@@ -343,3 +572,23 @@ func (m mockPDCClient) SignSSHKey(_ context.Context, _ []byte) (*pdc.SigningResp
 		Certificate: *cert,
 	}, nil
 }
+
+func TestConfig_MetricsAuthBasic(t *testing.T) {
+	parse := func(value string) (*ssh.Config, error) {
+		cfg := ssh.DefaultConfig()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.RegisterFlags(fs)
+		return cfg, fs.Parse([]string{"-metrics.auth.basic", value})
+	}
+
+	cfg, err := parse("prometheus:pass:word")
+	require.NoError(t, err)
+	assert.Equal(t, "prometheus", cfg.MetricsAuth.BasicUser)
+	assert.Equal(t, "pass:word", cfg.MetricsAuth.BasicPassword)
+
+	for _, invalid := range []string{"prometheus", ":secret", "prometheus:"} {
+		_, err := parse(invalid)
+		assert.ErrorContains(t, err, "invalid -metrics.auth.basic, must be user:password", invalid)
+	}
+}
@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/hooks"
+)
+
+// States of the tunnel to the PDC gateway.
+const (
+	// StateIdle is the state before the ssh client is started.
+	StateIdle = "Idle"
+	// StateConnecting is the state while the first ssh connection is established.
+	StateConnecting = "Connecting"
+	// StateConnected is the state while the ssh command has been running for
+	// at least connectedAfter.
+	StateConnected = "Connected"
+	// StateBackoff is the state between the ssh command exiting and the next
+	// connection attempt.
+	StateBackoff = "Backoff"
+	// StateReconnecting is the state while an ssh connection is re-established.
+	StateReconnecting = "Reconnecting"
+	// StateTerminating is the state once the ssh client is stopping.
+	StateTerminating = "Terminating"
+)
+
+// connectedAfter is how long the ssh command must be running for the tunnel to
+// be considered connected. The ssh command exits within this time if it cannot
+// connect or authenticate.
+var connectedAfter = 5 * time.Second
+
+// tunnelState is the state machine of the tunnel. Transitions are logged, and
+// the time spent in each state is recorded.
+type tunnelState struct {
+	logger log.Logger
+	events *events.Writer
+	hooks  *hooks.Runner
+	now    func() time.Time
+
+	mu      sync.Mutex
+	current string
+	since   time.Time
+}
+
+func newTunnelState(logger log.Logger, ev *events.Writer, hr *hooks.Runner) *tunnelState {
+	return &tunnelState{
+		logger:  logger,
+		events:  ev,
+		hooks:   hr,
+		now:     time.Now,
+		current: StateIdle,
+		since:   time.Now(),
+	}
+}
+
+// Current returns the current state.
+func (ts *tunnelState) Current() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.current
+}
+
+// Transition moves to the given state. It is a no-op if already in that state.
+func (ts *tunnelState) Transition(to string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.transition(to)
+}
+
+// TransitionFrom moves to the given state only if the current state is one of
+// from. It returns whether the transition happened.
+func (ts *tunnelState) TransitionFrom(to string, from ...string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, f := range from {
+		if ts.current == f {
+			ts.transition(to)
+			return true
+		}
+	}
+	return false
+}
+
+// transition must be called with mu held.
+func (ts *tunnelState) transition(to string) {
+	if ts.current == to {
+		return
+	}
+
+	now := ts.now()
+	d := now.Sub(ts.since)
+	tunnelStateDurationSeconds.WithLabelValues(ts.current).Observe(d.Seconds())
+	if ts.current == StateConnected {
+		tunnelConnectedConnections.Dec()
+	}
+	if to == StateConnected {
+		tunnelConnectedConnections.Inc()
+		reconnectConsecutiveFailures.Set(0)
+	}
+	if ts.current == StateBackoff {
+		backoffSecondsTotal.Add(d.Seconds())
+	}
+	// An ssh command that exits before it is connected is a failed attempt.
+	if to == StateBackoff && (ts.current == StateConnecting || ts.current == StateReconnecting) {
+		reconnectConsecutiveFailures.Inc()
+	}
+	level.Info(ts.logger).Log("msg", "tunnel state changed", "from", ts.current, "to", to, "duration", d)
+
+	if ev := transitionEvent(ts.current, to); ev != "" {
+		if err := ts.events.Emit(ev); err != nil {
+			level.Warn(ts.logger).Log("msg", "could not write event", "event", ev, "err", err)
+		}
+		ts.hooks.Run(ev, to)
+	}
+
+	ts.current = to
+	ts.since = now
+}
+
+// transitionEvent returns the event to emit for a transition, if any.
+func transitionEvent(from, to string) string {
+	switch {
+	case to == StateConnected:
+		return events.Connected
+	case from == StateConnected:
+		return events.Disconnected
+	case to == StateReconnecting:
+		return events.Reconnecting
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/pdc-agent/pkg/events"
+	"github.com/grafana/pdc-agent/pkg/hooks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelState(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ts := newTunnelState(log.NewLogfmtLogger(buf), nil, nil)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts.now = func() time.Time { return now }
+	ts.since = now
+	advance := func(d time.Duration) { now = now.Add(d) }
+
+	backoffBefore := stateSampleCount(t, StateBackoff)
+	assert.Equal(t, StateIdle, ts.Current())
+
+	// first connection
+	require.True(t, ts.TransitionFrom(StateConnecting, StateIdle))
+	advance(connectedAfter)
+	require.True(t, ts.TransitionFrom(StateConnected, StateConnecting, StateReconnecting))
+	assert.Equal(t, StateConnected, ts.Current())
+
+	// simulated disconnect
+	advance(time.Minute)
+	ts.Transition(StateBackoff)
+	assert.Equal(t, StateBackoff, ts.Current())
+	assert.Contains(t, buf.String(), "from=Connected to=Backoff duration=1m0s")
+
+	// recovery
+	advance(time.Second)
+	assert.False(t, ts.TransitionFrom(StateConnecting, StateIdle))
+	ts.Transition(StateReconnecting)
+	advance(connectedAfter)
+	require.True(t, ts.TransitionFrom(StateConnected, StateConnecting, StateReconnecting))
+	assert.Equal(t, StateConnected, ts.Current())
+
+	// a late connected timer does not override a later state
+	ts.Transition(StateTerminating)
+	assert.False(t, ts.TransitionFrom(StateConnected, StateConnecting, StateReconnecting))
+	assert.Equal(t, StateTerminating, ts.Current())
+
+	// every state that was left has been observed
+	assert.Equal(t, backoffBefore+1, stateSampleCount(t, StateBackoff))
+	for _, s := range []string{StateIdle, StateConnecting, StateConnected, StateBackoff, StateReconnecting} {
+		assert.Contains(t, buf.String(), "from="+s)
+	}
+}
+
+func stateSampleCount(t *testing.T, state string) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	h, err := tunnelStateDurationSeconds.GetMetricWithLabelValues(state)
+	require.NoError(t, err)
+	require.NoError(t, h.(interface{ Write(*dto.Metric) error }).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestTunnelState_BackoffMetrics(t *testing.T) {
+	ts := newTunnelState(log.NewNopLogger(), nil, nil)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts.now = func() time.Time { return now }
+	ts.since = now
+	advance := func(d time.Duration) { now = now.Add(d) }
+
+	backoffBefore := testutil.ToFloat64(backoffSecondsTotal)
+
+	// three attempts fail before the ssh command connects
+	ts.Transition(StateConnecting)
+	for i, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		advance(time.Second)
+		ts.Transition(StateBackoff)
+		assert.Equal(t, float64(i+1), testutil.ToFloat64(reconnectConsecutiveFailures))
+		advance(wait)
+		ts.Transition(StateReconnecting)
+	}
+	assert.Equal(t, backoffBefore+7, testutil.ToFloat64(backoffSecondsTotal))
+
+	advance(connectedAfter)
+	ts.Transition(StateConnected)
+	assert.Equal(t, float64(0), testutil.ToFloat64(reconnectConsecutiveFailures))
+
+	// a connected ssh command that exits is not a failed attempt
+	advance(time.Hour)
+	ts.Transition(StateBackoff)
+	assert.Equal(t, float64(0), testutil.ToFloat64(reconnectConsecutiveFailures))
+	advance(time.Second)
+	ts.Transition(StateReconnecting)
+	assert.Equal(t, backoffBefore+8, testutil.ToFloat64(backoffSecondsTotal))
+}
+
+func TestTunnelState_Events(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ts := newTunnelState(log.NewNopLogger(), events.NewWriter(buf, "prod-us-east-0"), nil)
+
+	// connect, disconnect, reconnect, then stop
+	ts.Transition(StateConnecting)
+	ts.Transition(StateConnected)
+	ts.Transition(StateBackoff)
+	ts.Transition(StateReconnecting)
+	ts.Transition(StateConnected)
+	ts.Transition(StateTerminating)
+
+	var got []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var ev struct {
+			Event   string `json:"event"`
+			Cluster string `json:"cluster"`
+		}
+		require.NoError(t, dec.Decode(&ev))
+		assert.Equal(t, "prod-us-east-0", ev.Cluster)
+		got = append(got, ev.Event)
+	}
+
+	assert.Equal(t, []string{
+		events.Connected,
+		events.Disconnected,
+		events.Reconnecting,
+		events.Connected,
+		events.Disconnected,
+	}, got)
+}
+
+func TestTunnelState_Hooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts in tests")
+	}
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+	script := filepath.Join(dir, "hook")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$PDC_HOOK_EVENT $PDC_TUNNEL_STATE\" >> "+marker+"\n"), 0o755))
+
+	hr := hooks.NewRunner(log.NewNopLogger(), "prod-us-east-0", script, script, time.Second)
+	ts := newTunnelState(log.NewNopLogger(), nil, hr)
+
+	ts.Transition(StateConnecting)
+	ts.Transition(StateConnected)
+	hr.Wait()
+	ts.Transition(StateBackoff)
+	hr.Wait()
+
+	b, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "connected Connected\ndisconnected Backoff\n", string(b))
+}
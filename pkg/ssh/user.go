@@ -0,0 +1,41 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UserHostedGrafanaID is replaced with the hosted Grafana ID in User.
+const UserHostedGrafanaID = "{hosted_grafana_id}"
+
+// maxUserLen is the longest ssh username accepted.
+const maxUserLen = 64
+
+// userRe matches the ssh usernames that are accepted. They cannot start with
+// a dash, so that they are not read as an ssh flag, and cannot contain an @,
+// which separates the user from the gateway host.
+var userRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._+-]*$`)
+
+// sshUser returns the username of the ssh connections to the gateway: User
+// with UserHostedGrafanaID replaced, or the hosted Grafana ID if User is not
+// set.
+func (cfg Config) sshUser() string {
+	if cfg.User == "" {
+		return cfg.PDC.HostedGrafanaID
+	}
+	return strings.ReplaceAll(cfg.User, UserHostedGrafanaID, cfg.PDC.HostedGrafanaID)
+}
+
+// checkUser returns an error if User is set and is not a valid ssh username
+// once rendered.
+func (cfg Config) checkUser() error {
+	if cfg.User == "" {
+		return nil
+	}
+	user := cfg.sshUser()
+	if len(user) > maxUserLen || !userRe.MatchString(user) {
+		return fmt.Errorf("invalid -ssh.user %q, must be at most %d letters, digits, '.', '_', '+' or '-', and not start with '.', '+' or '-'", user, maxUserLen)
+	}
+	return nil
+}
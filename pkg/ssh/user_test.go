@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+func TestConfig_User(t *testing.T) {
+	testcases := []struct {
+		name     string
+		user     string
+		wantUser string
+		wantErr  string
+	}{
+		{
+			name:     "defaults to the hosted Grafana ID",
+			wantUser: "123",
+		},
+		{
+			name:     "specific user",
+			user:     "pdc-agent",
+			wantUser: "pdc-agent",
+		},
+		{
+			name:     "templated user",
+			user:     "stack-" + UserHostedGrafanaID,
+			wantUser: "stack-123",
+		},
+		{
+			name:    "user with a host",
+			user:    "agent@other.example.com",
+			wantErr: `invalid -ssh.user "agent@other.example.com"`,
+		},
+		{
+			name:    "user read as a flag",
+			user:    "-oProxyCommand=sh",
+			wantErr: `invalid -ssh.user "-oProxyCommand=sh"`,
+		},
+		{
+			name:    "user with spaces",
+			user:    "pdc agent",
+			wantErr: `invalid -ssh.user "pdc agent"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.KeyFile = filepath.Join(t.TempDir(), "grafana_pdc")
+			cfg.URL = &url.URL{Host: "host.grafana.net"}
+			cfg.PDC = pdc.Config{HostedGrafanaID: "123"}
+			cfg.User = tc.user
+
+			err := cfg.Validate()
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			flags, err := NewClient(cfg, log.NewNopLogger(), nil).SSHFlagsFromConfig()
+			require.NoError(t, err)
+			assert.Contains(t, flags, tc.wantUser+"@host.grafana.net")
+
+			cmd, err := NewClient(cfg, log.NewNopLogger(), nil).CommandLine()
+			require.NoError(t, err)
+			assert.Contains(t, cmd, " "+tc.wantUser+"@host.grafana.net ")
+		})
+	}
+}
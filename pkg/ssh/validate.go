@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/pdc-agent/pkg/metrics"
+)
+
+// Validate checks the config, including the settings that depend on each
+// other, and returns all the problems found, joined in one error, rather than
+// only the first one. It is meant to be called once the URLs are set.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.GatewayHost() == "" {
+		errs = append(errs, errors.New("the gateway host is not set"))
+	}
+	errs = append(errs, cfg.checkPort(), cfg.checkUser(), cfg.checkCertRenewJitter())
+	if cfg.AddressFamily != "" {
+		errs = append(errs, checkAddressFamily(cfg.AddressFamily))
+	}
+	if _, err := cfg.algorithmOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CertExpiryWindow < 0 {
+		errs = append(errs, fmt.Errorf("-cert-expiry-window must not be negative, got %s", cfg.CertExpiryWindow))
+	}
+	if ttl := cfg.PDC.RequestedCertTTL; ttl > 0 && cfg.CertExpiryWindow >= ttl {
+		errs = append(errs, fmt.Errorf("-cert-expiry-window %s must be less than -cert-ttl %s, or certificates are renewed as soon as they are signed", cfg.CertExpiryWindow, ttl))
+	}
+	if cfg.CertCheckCertExpiryPeriod < 0 {
+		errs = append(errs, fmt.Errorf("-cert-check-expiry-period must not be negative, got %s", cfg.CertCheckCertExpiryPeriod))
+	}
+	if cfg.MinSignInterval < 0 {
+		errs = append(errs, fmt.Errorf("-cert-min-sign-interval must not be negative, got %s", cfg.MinSignInterval))
+	}
+	if cfg.SignShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("-cert-sign-shutdown-grace must not be negative, got %s", cfg.SignShutdownGrace))
+	}
+	if cfg.TunnelHealthCheckPeriod < 0 {
+		errs = append(errs, fmt.Errorf("-ssh.health-check-period must not be negative, got %s", cfg.TunnelHealthCheckPeriod))
+	}
+	if cfg.FallbackGatewayURL != nil {
+		errs = append(errs, cfg.checkFallback())
+	}
+	if cfg.MetricsBindFailureMode != "" {
+		errs = append(errs, metrics.CheckBindFailureMode(cfg.MetricsBindFailureMode))
+	}
+	if cfg.MetricsPushInterval < 0 {
+		errs = append(errs, fmt.Errorf("-metrics.push.interval must not be negative, got %s", cfg.MetricsPushInterval))
+	}
+	if cfg.HostKeyFingerprint != "" && !strings.HasPrefix(cfg.HostKeyFingerprint, "SHA256:") {
+		errs = append(errs, fmt.Errorf("invalid -ssh.host-key-fingerprint %q, must be a SHA256 fingerprint as printed by ssh-keygen -l", cfg.HostKeyFingerprint))
+	}
+	if cfg.PKCS11PIN != "" && cfg.PKCS11Module == "" {
+		errs = append(errs, errors.New("-ssh.pkcs11-pin is set, but -ssh.pkcs11-module is not"))
+	}
+	if cfg.PKCS11Module != "" && cfg.ForceKeyFileOverwrite {
+		errs = append(errs, errors.New("-force-key-file-overwrite cannot be used with -ssh.pkcs11-module, keys cannot be created in the token"))
+	}
+	return errors.Join(errs...)
+}
+
+// checkPort returns an error if Port is not a valid TCP port.
+func (cfg Config) checkPort() error {
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid ssh port %d, must be between 1 and 65535", cfg.Port)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package ssh_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	validConfig := func() *ssh.Config {
+		cfg := ssh.DefaultConfig()
+		cfg.URL = mustParseURL("private-datasource-connect-prod-us-east-0.grafana.net")
+		return cfg
+	}
+
+	testcases := []struct {
+		name    string
+		modify  func(cfg *ssh.Config)
+		wantErr []string
+	}{
+		{
+			name:   "valid",
+			modify: func(cfg *ssh.Config) {},
+		},
+		{
+			name:    "gateway not set",
+			modify:  func(cfg *ssh.Config) { cfg.URL = nil },
+			wantErr: []string{"the gateway host is not set"},
+		},
+		{
+			name: "expiry window longer than the requested certificate lifetime",
+			modify: func(cfg *ssh.Config) {
+				cfg.CertExpiryWindow = time.Hour
+				cfg.PDC.RequestedCertTTL = 30 * time.Minute
+			},
+			wantErr: []string{"-cert-expiry-window 1h0m0s must be less than -cert-ttl 30m0s"},
+		},
+		{
+			name:    "unknown address family",
+			modify:  func(cfg *ssh.Config) { cfg.AddressFamily = "ipv4" },
+			wantErr: []string{`invalid address family "ipv4"`},
+		},
+		{
+			name:    "empty algorithm in a list",
+			modify:  func(cfg *ssh.Config) { cfg.MACs = "hmac-sha2-256,,hmac-sha2-512" },
+			wantErr: []string{`invalid -ssh.macs "hmac-sha2-256,,hmac-sha2-512"`},
+		},
+		{
+			name: "PKCS#11 key cannot be overwritten",
+			modify: func(cfg *ssh.Config) {
+				cfg.PKCS11Module = "/usr/lib/opensc-pkcs11.so"
+				cfg.ForceKeyFileOverwrite = true
+			},
+			wantErr: []string{"-force-key-file-overwrite cannot be used with -ssh.pkcs11-module"},
+		},
+		{
+			name:    "unknown metrics bind failure mode",
+			modify:  func(cfg *ssh.Config) { cfg.MetricsBindFailureMode = "ignore" },
+			wantErr: []string{`invalid -metrics.bind-failure-mode "ignore"`},
+		},
+		{
+			name: "negative metrics push interval",
+			modify: func(cfg *ssh.Config) {
+				cfg.MetricsPushURL = "http://pushgateway:9091"
+				cfg.MetricsPushInterval = -time.Second
+			},
+			wantErr: []string{"-metrics.push.interval must not be negative"},
+		},
+		{
+			name: "valid fallback gateway",
+			modify: func(cfg *ssh.Config) {
+				cfg.FallbackGatewayURL = mustParseURL("private-datasource-connect-prod-us-east-1.grafana.net")
+				cfg.FallbackAfter = 3
+			},
+		},
+		{
+			name: "invalid fallback gateway settings",
+			modify: func(cfg *ssh.Config) {
+				cfg.FallbackGatewayURL = mustParseURL("private-datasource-connect-prod-us-east-1.grafana.net")
+				cfg.FallbackPort = 70000
+				cfg.PrimaryRetryInterval = -time.Second
+				cfg.HostKeyFingerprint = "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+			},
+			wantErr: []string{
+				"fallback gateway: invalid ssh port 70000",
+				"-ssh.fallback-after must be at least 1, got 0",
+				"-ssh.primary-retry-interval must not be negative",
+				"-ssh.fallback-gateway-url cannot be used with -ssh.host-key-fingerprint",
+			},
+		},
+		{
+			name: "all problems are reported",
+			modify: func(cfg *ssh.Config) {
+				cfg.Port = 70000
+				cfg.CertRenewJitter = 0.7
+				cfg.HostKeyFingerprint = "nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+				cfg.TunnelHealthCheckPeriod = -time.Second
+			},
+			wantErr: []string{
+				"invalid ssh port 70000",
+				"invalid certificate renewal jitter 0.7",
+				"invalid -ssh.host-key-fingerprint",
+				"-ssh.health-check-period must not be negative",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.modify(cfg)
+
+			err := cfg.Validate()
+			if len(tc.wantErr) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, want := range tc.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// startupSignBackoff is the first wait between the startup certificate checks
+// when WaitForAPI is set. It doubles after each failure, up to
+// maxStartupSignBackoff. It is a variable so that tests can lower it.
+var startupSignBackoff = time.Second
+
+// maxStartupSignBackoff is the longest wait between the startup certificate
+// checks when WaitForAPI is set.
+const maxStartupSignBackoff = time.Minute
+
+// createKeysAtStartup ensures that the keys and certificate exist before the
+// tunnel is started. If WaitForAPI is set, failures are retried with backoff
+// until they succeed or ctx is done, so that the agent waits for the PDC API
+// to recover rather than exiting. Rejected tokens are not retried, as waiting
+// does not fix them.
+func (km *KeyManager) createKeysAtStartup(ctx context.Context) error {
+	force := km.cfg.ForceKeyFileOverwrite
+	backoff := startupSignBackoff
+	for attempt := 1; ; attempt++ {
+		err := km.CreateKeys(ctx, force)
+		if err == nil || !km.cfg.WaitForAPI || errors.Is(err, pdc.ErrInvalidCredentials) || errors.Is(err, pdc.ErrForbidden) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		level.Warn(km.logger).Log("msg", "could not check or generate certificate, waiting for the PDC API", "attempt", attempt, "retry_in", backoff, "err", err)
+
+		// The key pair is only replaced once, not on every attempt.
+		force = false
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, maxStartupSignBackoff)
+	}
+}
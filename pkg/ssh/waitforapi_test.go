@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/pdc"
+)
+
+// flakyClient fails the first failures sign requests with err, then signs
+// them with its CA.
+type flakyClient struct {
+	*signingClient
+	failures int32
+	err      error
+	calls    atomic.Int32
+}
+
+func (c *flakyClient) SignSSHKey(ctx context.Context, key []byte) (*pdc.SigningResponse, error) {
+	if c.calls.Add(1) <= c.failures {
+		return nil, c.err
+	}
+	return c.signingClient.SignSSHKey(ctx, key)
+}
+
+func TestKeyManager_WaitForAPI(t *testing.T) {
+	old := startupSignBackoff
+	startupSignBackoff = time.Millisecond
+	t.Cleanup(func() { startupSignBackoff = old })
+
+	errUnavailable := errors.New("PDC API returned 503 Service Unavailable")
+
+	testcases := []struct {
+		name       string
+		waitForAPI bool
+		failures   int32
+		err        error
+		wantErr    error
+		wantCalls  int32
+	}{
+		{
+			name:      "exits on failure by default",
+			failures:  3,
+			err:       errUnavailable,
+			wantErr:   errUnavailable,
+			wantCalls: 1,
+		},
+		{
+			name:       "waits for the PDC API to recover",
+			waitForAPI: true,
+			failures:   3,
+			err:        errUnavailable,
+			wantCalls:  4,
+		},
+		{
+			name:       "rejected tokens are not retried",
+			waitForAPI: true,
+			failures:   3,
+			err:        fmt.Errorf("signing: %w", pdc.ErrInvalidCredentials),
+			wantErr:    pdc.ErrInvalidCredentials,
+			wantCalls:  1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+			cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+			cfg.WaitForAPI = tc.waitForAPI
+			client := &flakyClient{signingClient: newSigningClient(t), failures: tc.failures, err: tc.err}
+			km := NewKeyManager(cfg, log.NewNopLogger(), client)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := km.Start(ctx)
+
+			assert.Equal(t, tc.wantCalls, client.calls.Load())
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				assert.NoFileExists(t, km.certFile())
+				return
+			}
+			require.NoError(t, err)
+			assert.FileExists(t, km.certFile())
+		})
+	}
+
+	t.Run("stops waiting when the context is done", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.KeyFile = filepath.Join(t.TempDir(), "key")
+		cfg.PDC = pdc.Config{HostedGrafanaID: "1"}
+		cfg.WaitForAPI = true
+		client := &flakyClient{signingClient: newSigningClient(t), failures: 1 << 30, err: errUnavailable}
+		km := NewKeyManager(cfg, log.NewNopLogger(), client)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- km.Start(ctx) }()
+
+		assert.Eventually(t, func() bool { return client.calls.Load() >= 2 }, 5*time.Second, time.Millisecond)
+		cancel()
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatal("key manager did not stop waiting")
+		}
+	})
+}
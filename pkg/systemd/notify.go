@@ -0,0 +1,120 @@
+// Package systemd notifies systemd of the state of the agent, when it is run
+// as a service with Type=notify.
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// defaultPollInterval is how often the tunnel state is checked.
+const defaultPollInterval = time.Second
+
+// Notifier sends notifications to systemd with the sd_notify protocol. It is
+// a no-op when NOTIFY_SOCKET is unset.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+	poll     time.Duration
+}
+
+// NewNotifierFromEnv returns a notifier for the NOTIFY_SOCKET, WATCHDOG_USEC
+// and WATCHDOG_PID environment variables set by systemd.
+func NewNotifierFromEnv() *Notifier {
+	n := &Notifier{socket: os.Getenv("NOTIFY_SOCKET"), poll: defaultPollInterval}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return n
+	}
+	// The watchdog is meant for another process if its pid is set and not ours.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return n
+	}
+	n.watchdog = time.Duration(usec) * time.Microsecond
+	return n
+}
+
+// Enabled returns whether the agent is run by systemd with Type=notify.
+func (n *Notifier) Enabled() bool {
+	return n.socket != ""
+}
+
+// Notify sends state, e.g. "READY=1", to systemd.
+func (n *Notifier) Notify(state string) error {
+	if !n.Enabled() {
+		return nil
+	}
+
+	addr := &net.UnixAddr{Name: n.socket, Net: "unixgram"}
+	// A leading @ is an abstract socket on Linux.
+	if addr.Name[0] == '@' {
+		addr.Name = "\x00" + addr.Name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Run sends READY=1 once the tunnel is first connected, keeps the STATUS of
+// the service up to date with the tunnel state, and sends WATCHDOG=1 at half
+// the watchdog timeout if the watchdog is enabled. It sends STOPPING=1 once
+// ctx is done, and returns.
+func (n *Notifier) Run(ctx context.Context, logger log.Logger, tunnelState func() string) {
+	if !n.Enabled() {
+		return
+	}
+
+	notify := func(state string) {
+		if err := n.Notify(state); err != nil {
+			level.Warn(logger).Log("msg", "could not notify systemd", "state", state, "err", err)
+		}
+	}
+
+	poll := time.NewTicker(n.poll)
+	defer poll.Stop()
+
+	var watchdog <-chan time.Time
+	if n.watchdog > 0 {
+		t := time.NewTicker(n.watchdog / 2)
+		defer t.Stop()
+		watchdog = t.C
+	}
+
+	ready := false
+	status := ""
+	for {
+		if st := tunnelState(); st != status {
+			status = st
+			msg := "STATUS=Tunnel " + st
+			if st == ssh.StateConnected && !ready {
+				ready = true
+				msg = "READY=1\n" + msg
+				level.Debug(logger).Log("msg", "notified systemd that the agent is ready")
+			}
+			notify(msg)
+		}
+
+		select {
+		case <-poll.C:
+		case <-watchdog:
+			notify("WATCHDOG=1")
+		case <-ctx.Done():
+			notify("STOPPING=1")
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pdc-agent/pkg/ssh"
+)
+
+// listenNotifySocket listens on a stub notify socket, sets NOTIFY_SOCKET to
+// it, and returns the received messages.
+func listenNotifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	// Unix socket paths are limited to about 100 bytes, which t.TempDir can
+	// exceed.
+	dir, err := os.MkdirTemp("", "sd")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	msgs := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+// waitFor returns the messages received until one equal to want.
+func waitFor(t *testing.T, msgs <-chan string, want string) []string {
+	t.Helper()
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-msgs:
+			got = append(got, msg)
+			if msg == want {
+				return got
+			}
+		case <-timeout:
+			t.Fatalf("did not receive %q, got %q", want, got)
+		}
+	}
+}
+
+func TestNotifier_Run(t *testing.T) {
+	msgs := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+
+	n := NewNotifierFromEnv()
+	require.True(t, n.Enabled())
+	assert.Equal(t, 100*time.Millisecond, n.watchdog)
+	n.poll = 10 * time.Millisecond
+
+	var connected atomic.Bool
+	state := func() string {
+		if connected.Load() {
+			return ssh.StateConnected
+		}
+		return ssh.StateConnecting
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx, log.NewNopLogger(), state)
+		close(done)
+	}()
+
+	got := waitFor(t, msgs, "WATCHDOG=1")
+	assert.Equal(t, "STATUS=Tunnel Connecting", got[0])
+	assert.NotContains(t, got, "READY=1\nSTATUS=Tunnel Connected", "ready before the tunnel is connected")
+
+	connected.Store(true)
+	waitFor(t, msgs, "READY=1\nSTATUS=Tunnel Connected")
+	waitFor(t, msgs, "WATCHDOG=1")
+
+	cancel()
+	waitFor(t, msgs, "STOPPING=1")
+	<-done
+}
+
+func TestNewNotifierFromEnv(t *testing.T) {
+	t.Run("not run by systemd", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		n := NewNotifierFromEnv()
+		assert.False(t, n.Enabled())
+		assert.NoError(t, n.Notify("READY=1"))
+	})
+
+	t.Run("watchdog disabled", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+		t.Setenv("WATCHDOG_USEC", "")
+		assert.Zero(t, NewNotifierFromEnv().watchdog)
+	})
+
+	t.Run("watchdog for another process", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+		t.Setenv("WATCHDOG_USEC", "30000000")
+		t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+		assert.Zero(t, NewNotifierFromEnv().watchdog)
+	})
+
+	t.Run("watchdog for this process", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+		t.Setenv("WATCHDOG_USEC", "30000000")
+		t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+		assert.Equal(t, 30*time.Second, NewNotifierFromEnv().watchdog)
+	})
+}
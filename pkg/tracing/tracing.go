@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"flag"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Config describes all properties that can be configured for the tracing package.
+type Config struct {
+	// Enabled exports traces to the endpoint set in OTEL_EXPORTER_OTLP_ENDPOINT.
+	// When disabled, the global no-op tracer is used.
+	Enabled bool
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cfg.Enabled, "tracing.enabled", false, "Export traces of the agent startup. The endpoint is set with the OTEL_EXPORTER_OTLP_ENDPOINT environment variable")
+}
+
+// Setup registers a global tracer provider that exports spans over OTLP/HTTP,
+// if tracing is enabled. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, cfg Config, version string) (func(context.Context) error, error) {
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := newTracerProvider(exporter, version)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// newTracerProvider returns a tracer provider that exports the spans of the
+// agent to exporter.
+func newTracerProvider(exporter sdktrace.SpanExporter, version string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("pdc-agent"),
+			semconv.ServiceVersion(version),
+		)),
+	)
+}
@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+func TestSetup_Disabled(t *testing.T) {
+	before := otel.GetTracerProvider()
+
+	shutdown, err := Setup(context.Background(), Config{}, "v1.0.0")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, before, otel.GetTracerProvider())
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := newTracerProvider(exporter, "v1.0.0")
+
+	_, span := tp.Tracer("test").Start(context.Background(), "sign certificate")
+	span.SetAttributes(attribute.String("cert.valid_before", "2026-10-15T00:00:00Z"))
+	err := errors.New("key signing request failed")
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+
+	// Spans are batched, and exported when they are flushed.
+	require.NoError(t, tp.ForceFlush(context.Background()))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	got := spans[0]
+	assert.Equal(t, "sign certificate", got.Name)
+	assert.Contains(t, got.Attributes, attribute.String("cert.valid_before", "2026-10-15T00:00:00Z"))
+	assert.Equal(t, codes.Error, got.Status.Code)
+	assert.Equal(t, "key signing request failed", got.Status.Description)
+	assert.Contains(t, got.Resource.Attributes(), semconv.ServiceName("pdc-agent"))
+	assert.Contains(t, got.Resource.Attributes(), semconv.ServiceVersion("v1.0.0"))
+}